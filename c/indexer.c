@@ -51,6 +51,10 @@
 void free_index(struct gzip_index *index)
 {
     if (index != NULL) {
+        if (index->list != NULL) {
+            for (int i = 0; i < index->have; i++)
+                free(index->list[i].window);
+        }
         free(index->list);
         free(index);
     }
@@ -68,6 +72,7 @@ static struct gzip_index *addpoint(struct gzip_index *index, int bits,
         index = malloc(sizeof(struct gzip_index));
         if (index == NULL) return NULL;
         index->list = malloc(sizeof(struct gzip_index_point) << 3);
+        index->have = 0;
         if (index->list == NULL) {
             free(index);
             return NULL;
@@ -89,6 +94,11 @@ static struct gzip_index *addpoint(struct gzip_index *index, int bits,
 
     /* fill in entry and increment how many we have */
     next = index->list + index->have;
+    next->window = malloc(WINSIZE);
+    if (next->window == NULL) {
+        free_index(index);
+        return NULL;
+    }
     next->bits = bits;
     next->in = in;
     next->out = out;
@@ -206,6 +216,223 @@ int generate_index_fp(FILE* in, off_t span, struct gzip_index** idx)
 
 }
 
+struct gzip_index_builder
+{
+    z_stream strm;
+    off_t totin, totout;        /* our own total counters to avoid 4GB limit */
+    off_t last;                 /* totout value of last access point */
+    off_t span;
+    unsigned wpos;              /* position of the next output in window */
+    struct gzip_index *index;   /* access points being generated */
+    unsigned char window[WINSIZE];
+    unsigned char last_in;      /* last byte consumed by strm, which holds the bits of an access point */
+
+    /* The probe uncompresses the data following the last access point without
+       its window, to find out whether the window is needed. Back-references
+       can't reach more than WINSIZE bytes back, so if the first WINSIZE bytes
+       after the access point are uncompressed without errors, the data after
+       the access point doesn't depend on the data before it. */
+    z_stream probe;
+    int probing;                /* the probe of the last access point is running */
+    unsigned probe_out;         /* bytes uncompressed by the probe */
+    unsigned char discard[WINSIZE];
+};
+
+/* Feed the probe with the compressed data consumed by strm. When the probe finds
+   out that the window of the last access point isn't needed, the window is dropped */
+static void probe_feed(struct gzip_index_builder* builder, unsigned char* in, unsigned len)
+{
+    int ret;
+    z_stream* probe = &builder->probe;
+    struct gzip_index_point* pt;
+
+    probe->next_in = in;
+    probe->avail_in = len;
+    while (builder->probing) {
+        probe->next_out = builder->discard;
+        probe->avail_out = WINSIZE - builder->probe_out;
+        ret = inflate(probe, Z_NO_FLUSH);
+        builder->probe_out = WINSIZE - probe->avail_out;
+        if (ret == Z_STREAM_END || builder->probe_out == WINSIZE) {
+            /* the window isn't needed */
+            pt = &builder->index->list[builder->index->have - 1];
+            free(pt->window);
+            pt->window = NULL;
+            builder->probing = 0;
+        } else if (ret != Z_OK && ret != Z_BUF_ERROR) {
+            /* most likely a distance too far back: the window is needed */
+            builder->probing = 0;
+        } else if (probe->avail_in == 0) {
+            break;
+        }
+    }
+    probe->next_in = Z_NULL;
+    probe->avail_in = 0;
+}
+
+/* Start probing the access point which has just been added. If the probe of the
+   previous access point is still running, that access point keeps its window */
+static int probe_start(struct gzip_index_builder* builder, int bits)
+{
+    int ret = inflateReset(&builder->probe);
+    if (ret != Z_OK)
+        return ret;
+    if (bits) {
+        ret = inflatePrime(&builder->probe, bits, builder->last_in >> (8 - bits));
+        if (ret != Z_OK)
+            return ret;
+    }
+    builder->probe_out = 0;
+    builder->probing = 1;
+    return Z_OK;
+}
+
+struct gzip_index_builder* index_builder_new(off_t span)
+{
+    struct gzip_index_builder* builder = malloc(sizeof(struct gzip_index_builder));
+    if (builder == NULL)
+        return NULL;
+    memset(builder, 0, sizeof(struct gzip_index_builder));
+    builder->span = span;
+
+    builder->strm.zalloc = Z_NULL;
+    builder->strm.zfree = Z_NULL;
+    builder->strm.opaque = Z_NULL;
+    builder->strm.avail_in = 0;
+    builder->strm.next_in = Z_NULL;
+    if (inflateInit2(&builder->strm, 47) != Z_OK) {     /* automatic zlib or gzip decoding */
+        free(builder);
+        return NULL;
+    }
+    builder->probe.zalloc = Z_NULL;
+    builder->probe.zfree = Z_NULL;
+    builder->probe.opaque = Z_NULL;
+    builder->probe.avail_in = 0;
+    builder->probe.next_in = Z_NULL;
+    if (inflateInit2(&builder->probe, -15) != Z_OK) {   /* raw inflate */
+        (void)inflateEnd(&builder->strm);
+        free(builder);
+        return NULL;
+    }
+    return builder;
+}
+
+/* The same as the loop of generate_index_fp, except that the input is passed by the caller
+   and the uncompressed data is copied out of the sliding window into `out` */
+int index_builder_inflate(struct gzip_index_builder* builder, void* in, unsigned in_len,
+    void* out, unsigned out_len, unsigned* in_used, unsigned* out_used)
+{
+    int ret = Z_OK;
+    z_stream* strm = &builder->strm;
+    unsigned avail, produced;
+    unsigned char* next_in;
+
+    *in_used = 0;
+    *out_used = 0;
+    strm->next_in = in;
+    strm->avail_in = in_len;
+    while (*out_used < out_len) {
+        /* reset sliding window if necessary */
+        if (builder->wpos == WINSIZE)
+            builder->wpos = 0;
+        avail = WINSIZE - builder->wpos;
+        if (avail > out_len - *out_used)
+            avail = out_len - *out_used;
+        strm->next_out = builder->window + builder->wpos;
+        strm->avail_out = avail;
+
+        /* inflate until out of input, output, or at end of block --
+           update the total input and output counters */
+        builder->totin += strm->avail_in;
+        builder->totout += strm->avail_out;
+        next_in = strm->next_in;
+        ret = inflate(strm, Z_BLOCK);      /* return at end of block */
+        builder->totin -= strm->avail_in;
+        builder->totout -= strm->avail_out;
+
+        produced = avail - strm->avail_out;
+        memcpy((unsigned char*)out + *out_used, builder->window + builder->wpos, produced);
+        *out_used += produced;
+        builder->wpos += produced;
+        if (strm->next_in != next_in) {
+            builder->last_in = strm->next_in[-1];
+            if (builder->probing)
+                probe_feed(builder, next_in, strm->next_in - next_in);
+        }
+
+        if (ret == Z_NEED_DICT)
+            ret = Z_DATA_ERROR;
+        if (ret == Z_MEM_ERROR || ret == Z_DATA_ERROR || ret == Z_STREAM_ERROR)
+            break;
+        if (ret == Z_STREAM_END)
+            break;
+        /* no progress is possible without more input */
+        if (ret == Z_BUF_ERROR) {
+            ret = Z_OK;
+            break;
+        }
+
+        /* if at end of block, consider adding an index entry,
+           see generate_index_fp for the details */
+        if ((strm->data_type & 128) && !(strm->data_type & 64) &&
+            (builder->totout == 0 || builder->totout - builder->last > builder->span)) {
+            builder->index = addpoint(builder->index, strm->data_type & 7, builder->totin,
+                                      builder->totout, WINSIZE - builder->wpos, builder->window);
+            if (builder->index == NULL) {
+                ret = Z_MEM_ERROR;
+                break;
+            }
+            builder->last = builder->totout;
+            ret = probe_start(builder, strm->data_type & 7);
+            if (ret != Z_OK)
+                break;
+        }
+        if (strm->avail_in == 0 && produced == 0)
+            break;
+    }
+    *in_used = in_len - strm->avail_in;
+    /* don't keep the pointer to the caller's buffer */
+    strm->next_in = Z_NULL;
+    strm->avail_in = 0;
+
+    if (ret == Z_STREAM_END)
+        return 1;
+    if (ret < 0)
+        return ret;
+    return 0;
+}
+
+struct gzip_index* index_builder_index(struct gzip_index_builder* builder)
+{
+    return builder->index;
+}
+
+struct gzip_index* index_builder_finish(struct gzip_index_builder* builder)
+{
+    struct gzip_index* index = builder->index;
+    off_t span = builder->span;
+    builder->index = NULL;
+    index_builder_free(builder);
+    if (index == NULL)
+        return NULL;
+
+    /* release unused entries in list */
+    index->list = realloc(index->list, sizeof(struct gzip_index_point) * index->have);
+    index->size = index->have;
+    index->span_size = span;
+    return index;
+}
+
+void index_builder_free(struct gzip_index_builder* builder)
+{
+    if (builder != NULL) {
+        (void)inflateEnd(&builder->strm);
+        (void)inflateEnd(&builder->probe);
+        free_index(builder->index);
+        free(builder);
+    }
+}
+
 int has_bits(struct gzip_index* index, int point_index)
 {
     if (point_index >= index->have)
@@ -215,7 +442,7 @@ int has_bits(struct gzip_index* index, int point_index)
     return index->list[point_index].bits != 0;
 }
 
-static uint8_t get_bits(struct gzip_index* index, int point_index)
+int get_bits(struct gzip_index* index, int point_index)
 {
     return index->list[point_index].bits;
 }
@@ -264,7 +491,8 @@ int extract_data_from_buffer(void* d, off_t datalen, struct gzip_index* index, o
         inflatePrime(&strm, bits, ret >> (8 - bits));
         data++;
     }
-    (void)inflateSetDictionary(&strm, index->list[first_point_index].window, WINSIZE);
+    if (index->list[first_point_index].window != NULL)
+        (void)inflateSetDictionary(&strm, index->list[first_point_index].window, WINSIZE);
     offset -= index->list[first_point_index].out;
     strm.avail_in = 0;
     skip = 1;                               /* while skipping to offset */
@@ -361,7 +589,8 @@ int extract_data_fp(FILE *in, struct gzip_index *index, off_t offset, void *buff
         }
         (void)inflatePrime(&strm, here->bits, ret >> (8 - here->bits));
     }
-    (void)inflateSetDictionary(&strm, here->window, WINSIZE);
+    if (here->window != NULL)
+        (void)inflateSetDictionary(&strm, here->window, WINSIZE);
     /* skip uncompressed bytes until offset reached, then satisfy request */
     offset -= here->out;
     strm.avail_in = 0;
@@ -540,7 +769,10 @@ int index_to_blob(struct gzip_index* index, void* buf)
         cur += 8;
         memcpy(cur, &pt->bits, 1);
         cur += 1;
-        memcpy(cur, &pt->window, WINSIZE);
+        if (pt->window != NULL)
+            memcpy(cur, pt->window, WINSIZE);
+        else
+            memset(cur, 0, WINSIZE);
         cur += WINSIZE;
     }
 
@@ -559,6 +791,7 @@ struct gzip_index* blob_to_index(void* buf)
     {
         return NULL;
     }
+    index->have = 0;
 
     unsigned size;
     off_t span_size;
@@ -569,6 +802,12 @@ struct gzip_index* blob_to_index(void* buf)
     memcpy(&span_size, cur, 8);
     cur += 8;
 
+    if (size == 0)
+    {
+        free(index);
+        return NULL;
+    }
+
     index->list = malloc(sizeof(struct gzip_index_point) * size);
     if (index->list == NULL)
     {
@@ -581,18 +820,29 @@ struct gzip_index* blob_to_index(void* buf)
     // gzip header takes the first 10 bytes, so span 0 always starts at offset 10 in compressed file
     pt0->in = 10; 
     pt0->out = 0;
-    memset(pt0->window, 0, WINSIZE);
+    // nothing precedes span 0, so it doesn't need a window
+    pt0->window = NULL;
+    index->have = 1;
 
     for(int i = 1; i < size; i++)
     {
         struct gzip_index_point* pt = &index->list[i];
+        pt->window = malloc(WINSIZE);
+        if (pt->window == NULL)
+        {
+            free_index(index);
+            return NULL;
+        }
+        index->have++;
         memcpy(&pt->in, cur, 8);
         cur += 8;
         memcpy(&pt->out, cur, 8);
         cur += 8;
+        // only the lowest byte of bits is serialized, so the rest needs to be cleared
+        pt->bits = 0;
         memcpy(&pt->bits, cur, 1);
         cur += 1;
-        memcpy(&pt->window, cur, WINSIZE);
+        memcpy(pt->window, cur, WINSIZE);
         cur += WINSIZE;
     }
 
@@ -602,3 +852,50 @@ struct gzip_index* blob_to_index(void* buf)
 
     return index;
 }
+
+struct gzip_index* new_index(int have, off_t span_size)
+{
+    struct gzip_index* index = malloc(sizeof(struct gzip_index));
+    if (index == NULL)
+    {
+        return NULL;
+    }
+    index->list = calloc(have, sizeof(struct gzip_index_point));
+    if (index->list == NULL)
+    {
+        free(index);
+        return NULL;
+    }
+    index->have = have;
+    index->size = have;
+    index->span_size = span_size;
+    return index;
+}
+
+void set_point(struct gzip_index* index, int point_index, off_t in, off_t out, int bits)
+{
+    struct gzip_index_point* pt = &index->list[point_index];
+    pt->in = in;
+    pt->out = out;
+    pt->bits = bits;
+}
+
+unsigned char* get_window(struct gzip_index* index, int point_index)
+{
+    return index->list[point_index].window;
+}
+
+int set_window(struct gzip_index* index, int point_index, void* window)
+{
+    struct gzip_index_point* pt = &index->list[point_index];
+    if (pt->window == NULL)
+    {
+        pt->window = malloc(WINSIZE);
+        if (pt->window == NULL)
+        {
+            return GZIP_INDEXER_CANNOT_ALLOC;
+        }
+    }
+    memcpy(pt->window, window, WINSIZE);
+    return GZIP_INDEXER_OK;
+}
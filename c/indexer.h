@@ -67,7 +67,7 @@ struct gzip_index_point
     off_t out;          /* corresponding offset in uncompressed data */
     off_t in;           /* offset in input file of first full byte */
     int bits;           /* number of bits (1-7) from byte at in - 1, or 0 */
-    unsigned char window[WINSIZE];  /* preceding 32K of uncompressed data */    
+    unsigned char *window;  /* preceding 32K of uncompressed data, or NULL if it's not needed */
 };
 
 struct gzip_index 
@@ -87,6 +87,30 @@ int pt_index_from_ucmp_offset(struct gzip_index* index, off_t off);
 int generate_index_fp(FILE* fp, off_t span, struct gzip_index** index);
 int generate_index(const char* filepath, off_t span, struct gzip_index** index);
 
+/* Builds the index of a gzip stream which is uncompressed in chunks,
+   so the stream doesn't need to be stored in a file.
+*/
+struct gzip_index_builder;
+
+struct gzip_index_builder* index_builder_new(off_t span);
+
+/* Uncompresses up to in_len bytes from `in` into `out`, adding access points
+   to the index on the way. The number of bytes consumed from `in` and
+   written to `out` are returned in in_used and out_used.
+   Returns 1 at the end of the gzip stream, 0 if more input or output space
+   is needed, or a negative zlib error code.
+*/
+int index_builder_inflate(struct gzip_index_builder* builder, void* in, unsigned in_len,
+    void* out, unsigned out_len, unsigned* in_used, unsigned* out_used);
+
+/* Get the index built so far. It's owned by the builder and can be NULL */
+struct gzip_index* index_builder_index(struct gzip_index_builder* builder);
+
+/* Get the index and free the builder. This must be called after the end of the stream */
+struct gzip_index* index_builder_finish(struct gzip_index_builder* builder);
+
+void index_builder_free(struct gzip_index_builder* builder);
+
 // TODO: Improve this
 int extract_data_from_buffer(void* d, off_t datalen, struct gzip_index* index, off_t offset, void* buffer, off_t len, int first_point_index);
 int extract_data_fp(FILE *in, struct gzip_index *index, off_t offset, void *buf, int len);
@@ -94,6 +118,7 @@ int extract_data(const char* file, struct gzip_index* index, off_t offset, void*
 
 
 int has_bits(struct gzip_index* index, int point_index);
+int get_bits(struct gzip_index* index, int point_index);
 off_t get_ucomp_off(struct gzip_index* index, int point_index);
 off_t get_comp_off(struct gzip_index* index, int point_index);
 
@@ -117,4 +142,15 @@ struct gzip_index* blob_to_index(void* buf);
 
 void free_index(struct gzip_index *index);
 
+/* Subroutines to build an index point by point, e.g. from a serialization done outside of the indexer */
+
+/* Allocates an index of `have` points without windows */
+struct gzip_index* new_index(int have, off_t span_size);
+void set_point(struct gzip_index* index, int point_index, off_t in, off_t out, int bits);
+
+/* Get the window of a point, which is NULL if the point doesn't need one */
+unsigned char* get_window(struct gzip_index* index, int point_index);
+/* Copies WINSIZE bytes from `window` into the window of a point */
+int set_window(struct gzip_index* index, int point_index, void* window);
+
 #endif // INDEXER_H
@@ -34,11 +34,15 @@ package cache
 
 import (
 	"bytes"
+	"container/list"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/awslabs/soci-snapshotter/util/lrucache"
 	"github.com/awslabs/soci-snapshotter/util/namedmutex"
@@ -78,9 +82,23 @@ type DirectoryCacheConfig struct {
 	// Direct forcefully enables direct mode for all operation in cache.
 	// Thus operation won't use on-memory caches.
 	Direct bool
-}
 
-// TODO: contents validation.
+	// Quota bounds the size of the entries on disk. It may be shared with other caches.
+	// The size of the entries on disk isn't bounded if it's nil.
+	// The entries already in the directory when the cache is created are accounted for too.
+	Quota *DiskQuota
+
+	// Verify stores a checksum with each entry on disk, which is verified when the entry is read from disk.
+	// Entries which don't match their checksum are removed and reported as missing.
+	Verify bool
+
+	// OnCorrupted is called with the key of each entry found corrupted on disk. Optional.
+	OnCorrupted func(key string)
+
+	// Persistent keeps the entries on disk when the cache is closed, so that they're reused by the
+	// next cache created on the same directory. Otherwise the directory is removed on Close.
+	Persistent bool
+}
 
 // BlobCache represents a cache for bytes data
 type BlobCache interface {
@@ -91,6 +109,10 @@ type BlobCache interface {
 	// from cache
 	Get(key string, opts ...Option) (Reader, error)
 
+	// Exists returns true if the contents of `key` are in the cache. It's cheaper than Get
+	// since the contents aren't opened nor verified, so Get may still miss them.
+	Exists(key string) bool
+
 	// Close closes the cache
 	Close() error
 }
@@ -166,6 +188,12 @@ func NewDirectoryCache(directory string, config DirectoryCacheConfig) (BlobCache
 		return nil, err
 	}
 	wipdir := filepath.Join(directory, "wip")
+	if config.Persistent {
+		// entries left half-written by a previous cache
+		if err := os.RemoveAll(wipdir); err != nil {
+			return nil, err
+		}
+	}
 	if err := os.MkdirAll(wipdir, 0700); err != nil {
 		return nil, err
 	}
@@ -177,8 +205,18 @@ func NewDirectoryCache(directory string, config DirectoryCacheConfig) (BlobCache
 		wipDirectory: wipdir,
 		bufPool:      bufPool,
 		direct:       config.Direct,
+		quota:        config.Quota,
+		verify:       config.Verify,
+		onCorrupted:  config.OnCorrupted,
+		persistent:   config.Persistent,
+		verified:     make(map[string]os.FileInfo),
 	}
 	dc.syncAdd = config.SyncAdd
+	if dc.quota != nil {
+		if err := dc.loadEntries(); err != nil {
+			return nil, err
+		}
+	}
 	return dc, nil
 }
 
@@ -194,6 +232,18 @@ type directoryCache struct {
 
 	syncAdd bool
 	direct  bool
+	quota   *DiskQuota
+
+	verify      bool
+	onCorrupted func(key string)
+
+	persistent bool
+
+	// entriesMu serializes the replacement of entry files on commit with their removal when
+	// they're found corrupted, so that a file committed concurrently isn't removed.
+	entriesMu sync.Mutex
+	// verified are the entry files which matched their checksum, by key.
+	verified map[string]os.FileInfo
 
 	closed   bool
 	closedMu sync.Mutex
@@ -223,9 +273,11 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 
 		// Get data from disk. If the file is already opened, use it.
 		if f, done, ok := dc.fileCache.Get(key); ok {
+			unpin := dc.quota.pin(dc.cachePath(key))
 			return &reader{
-				ReaderAt: f.(*os.File),
+				ReaderAt: dc.contents(f.(*os.File)), // already verified when opened
 				closeFunc: func() error {
+					unpin()
 					done() // file will be closed when it's evicted from the cache
 					return nil
 				},
@@ -233,21 +285,33 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 		}
 	}
 
-	// Open the cache file and read the target region
+	// Open the cache file and read the target region. The file isn't evicted from disk while it's read.
 	// TODO: If the target cache is write-in-progress, should we wait for the completion
 	//       or simply report the cache miss?
+	unpin := dc.quota.pin(dc.cachePath(key))
 	file, err := os.Open(dc.cachePath(key))
 	if err != nil {
+		unpin()
 		return nil, errors.Wrapf(err, "failed to open blob file for %q", key)
 	}
+	if dc.verify {
+		if err := dc.verifyFile(key, file); err != nil {
+			file.Close()
+			unpin()
+			return nil, errors.Wrapf(err, "corrupted blob file for %q", key)
+		}
+	}
 
 	// If "direct" option is specified, do not cache the file on memory.
 	// This option is useful for preventing memory cache from being polluted by data
 	// that won't be accessed immediately.
 	if dc.direct || opt.direct {
 		return &reader{
-			ReaderAt:  file,
-			closeFunc: func() error { return file.Close() },
+			ReaderAt: dc.contents(file),
+			closeFunc: func() error {
+				unpin()
+				return file.Close()
+			},
 		}, nil
 	}
 
@@ -255,8 +319,9 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 	//       but making I/O (possibly huge) on every fetching
 	//       might be costly.
 	return &reader{
-		ReaderAt: file,
+		ReaderAt: dc.contents(file),
 		closeFunc: func() error {
+			unpin()
 			_, done, added := dc.fileCache.Add(key, file)
 			defer done() // Release it immediately. Cleaned up on eviction.
 			if !added {
@@ -267,6 +332,20 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 	}, nil
 }
 
+func (dc *directoryCache) Exists(key string) bool {
+	if dc.isClosed() {
+		return false
+	}
+	if !dc.direct {
+		if _, done, ok := dc.cache.Get(key); ok {
+			done()
+			return true
+		}
+	}
+	_, err := os.Stat(dc.cachePath(key))
+	return err == nil
+}
+
 func (dc *directoryCache) Add(key string, opts ...Option) (Writer, error) {
 	if dc.isClosed() {
 		return nil, fmt.Errorf("cache is already closed")
@@ -281,12 +360,30 @@ func (dc *directoryCache) Add(key string, opts ...Option) (Writer, error) {
 	if err != nil {
 		return nil, err
 	}
+	var wipW io.WriteCloser = wip
+	var cw *checksumWriter
+	if dc.verify {
+		// the header is written once the contents are complete
+		if _, err := wip.Write(make([]byte, entryHeaderSize)); err != nil {
+			wip.Close()
+			os.Remove(wip.Name())
+			return nil, err
+		}
+		cw = newChecksumWriter(wip)
+		wipW = cw
+	}
 	w := &writer{
-		WriteCloser: wip,
+		WriteCloser: wipW,
 		commitFunc: func() error {
 			if dc.isClosed() {
 				return fmt.Errorf("cache is already closed")
 			}
+			if cw != nil {
+				if _, err := wip.WriteAt(cw.header(), 0); err != nil {
+					os.Remove(wip.Name())
+					return errors.Wrapf(err, "failed to write checksum of %q", key)
+				}
+			}
 			// Commit the cache contents
 			c := dc.cachePath(key)
 			if err := os.MkdirAll(filepath.Dir(c), os.ModePerm); err != nil {
@@ -297,7 +394,21 @@ func (dc *directoryCache) Add(key string, opts ...Option) (Writer, error) {
 				return multierror.Append(allErr,
 					errors.Wrapf(err, "failed to create cache directory %q", c))
 			}
-			return os.Rename(wip.Name(), c)
+			dc.entriesMu.Lock()
+			err := os.Rename(wip.Name(), c)
+			delete(dc.verified, key)
+			dc.entriesMu.Unlock()
+			if err != nil {
+				return err
+			}
+			if dc.quota != nil {
+				fi, err := os.Stat(c)
+				if err != nil {
+					return err
+				}
+				dc.quota.add(dc, key, c, fi.Size())
+			}
+			return nil
 		},
 		abortFunc: func() error {
 			return os.Remove(wip.Name())
@@ -366,6 +477,10 @@ func (dc *directoryCache) Close() error {
 		return nil
 	}
 	dc.closed = true
+	dc.quota.release(dc)
+	if dc.persistent {
+		return nil
+	}
 	return os.RemoveAll(dc.directory)
 }
 
@@ -376,6 +491,50 @@ func (dc *directoryCache) isClosed() bool {
 	return closed
 }
 
+// loadEntries accounts the entries already on disk, e.g. left by a persistent cache, in the quota, so
+// that they're evicted like the entries added by this cache.
+func (dc *directoryCache) loadEntries() error {
+	type file struct {
+		entry diskEntry
+		mtime time.Time
+	}
+	var files []file
+	err := filepath.WalkDir(dc.directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path == dc.wipDirectory {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		key, err := filepath.Rel(dc.directory, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, file{diskEntry{path: path, key: key, size: fi.Size()}, fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to load the entries of %q", dc.directory)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].mtime.Before(files[j].mtime) })
+	entries := make([]diskEntry, len(files))
+	for i, f := range files {
+		entries[i] = f.entry
+	}
+	dc.quota.load(dc, entries)
+	return nil
+}
+
 func (dc *directoryCache) cachePath(key string) string {
 	return filepath.Join(dc.directory, key)
 }
@@ -384,16 +543,97 @@ func (dc *directoryCache) wipFile(key string) (*os.File, error) {
 	return os.CreateTemp(dc.wipDirectory, key+"-*")
 }
 
+// contents returns the reader of the contents of the entry file `f`.
+func (dc *directoryCache) contents(f *os.File) io.ReaderAt {
+	if dc.verify {
+		return &offsetReaderAt{f, entryHeaderSize}
+	}
+	return f
+}
+
+// verifyFile verifies the checksum of the file `f` of the entry `key`, unless it has already been verified.
+// If it's corrupted, it's removed from disk, so that it's added again.
+func (dc *directoryCache) verifyFile(key string, f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	dc.entriesMu.Lock()
+	v, ok := dc.verified[key]
+	dc.entriesMu.Unlock()
+	if ok && sameFile(v, fi) {
+		return nil
+	}
+	if err := verifyEntry(f); err != nil {
+		dc.removeCorrupted(key, fi)
+		return err
+	}
+	dc.entriesMu.Lock()
+	dc.verified[key] = fi
+	dc.entriesMu.Unlock()
+	return nil
+}
+
+// removeCorrupted removes the corrupted file `fi` of the entry `key` from disk, unless it has been
+// replaced since it was opened.
+func (dc *directoryCache) removeCorrupted(key string, fi os.FileInfo) {
+	c := dc.cachePath(key)
+	dc.entriesMu.Lock()
+	cur, err := os.Stat(c)
+	removed := err == nil && sameFile(cur, fi)
+	if removed {
+		os.Remove(c)
+		delete(dc.verified, key)
+	}
+	dc.entriesMu.Unlock()
+	if removed {
+		dc.quota.drop(c)
+	}
+	if dc.onCorrupted != nil {
+		dc.onCorrupted(key)
+	}
+}
+
+// forget forgets the entry `key` evicted from disk.
+func (dc *directoryCache) forget(key string) {
+	dc.fileCache.Remove(key)
+	dc.entriesMu.Lock()
+	delete(dc.verified, key)
+	dc.entriesMu.Unlock()
+}
+
+// sameFile returns true if `fi1` and `fi2` describe the same unmodified file.
+func sameFile(fi1, fi2 os.FileInfo) bool {
+	return os.SameFile(fi1, fi2) && fi1.Size() == fi2.Size() && fi1.ModTime().Equal(fi2.ModTime())
+}
+
 func NewMemoryCache() BlobCache {
 	return &MemoryCache{
 		Membuf: map[string]*bytes.Buffer{},
 	}
 }
 
+// NewBoundedMemoryCache returns a memory cache which evicts the least recently used entries
+// once the size of its entries exceeds maxSize bytes.
+func NewBoundedMemoryCache(maxSize int64) BlobCache {
+	return &MemoryCache{
+		Membuf:  map[string]*bytes.Buffer{},
+		maxSize: maxSize,
+		order:   list.New(),
+		elems:   map[string]*list.Element{},
+	}
+}
+
 // MemoryCache is a cache implementation which backend is a memory.
 type MemoryCache struct {
 	Membuf map[string]*bytes.Buffer
 	mu     sync.Mutex
+
+	// maxSize bounds the size of the entries if it's positive.
+	maxSize int64
+	size    int64
+	order   *list.List               // of keys, from the least to the most recently used
+	elems   map[string]*list.Element // by key
 }
 
 func (mc *MemoryCache) Get(key string, opts ...Option) (Reader, error) {
@@ -403,9 +643,19 @@ func (mc *MemoryCache) Get(key string, opts ...Option) (Reader, error) {
 	if !ok {
 		return nil, fmt.Errorf("Missed cache: %q", key)
 	}
+	if mc.maxSize > 0 {
+		mc.order.MoveToBack(mc.elems[key])
+	}
 	return &reader{bytes.NewReader(b.Bytes()), func() error { return nil }}, nil
 }
 
+func (mc *MemoryCache) Exists(key string) bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	_, ok := mc.Membuf[key]
+	return ok
+}
+
 func (mc *MemoryCache) Add(key string, opts ...Option) (Writer, error) {
 	b := new(bytes.Buffer)
 	return &writer{
@@ -413,6 +663,9 @@ func (mc *MemoryCache) Add(key string, opts ...Option) (Writer, error) {
 		commitFunc: func() error {
 			mc.mu.Lock()
 			defer mc.mu.Unlock()
+			if mc.maxSize > 0 {
+				mc.account(key, b)
+			}
 			mc.Membuf[key] = b
 			return nil
 		},
@@ -420,7 +673,33 @@ func (mc *MemoryCache) Add(key string, opts ...Option) (Writer, error) {
 	}, nil
 }
 
+// account accounts for the entry `b` added as `key`, and evicts the least recently used entries
+// other than `key` while the cache is too large. Readers of evicted entries keep their contents.
+func (mc *MemoryCache) account(key string, b *bytes.Buffer) {
+	if old, ok := mc.Membuf[key]; ok {
+		mc.size -= int64(old.Len())
+		mc.order.MoveToBack(mc.elems[key])
+	} else {
+		mc.elems[key] = mc.order.PushBack(key)
+	}
+	mc.size += int64(b.Len())
+	for mc.size > mc.maxSize && mc.order.Front().Value.(string) != key {
+		victim := mc.order.Remove(mc.order.Front()).(string)
+		mc.size -= int64(mc.Membuf[victim].Len())
+		delete(mc.Membuf, victim)
+		delete(mc.elems, victim)
+	}
+}
+
 func (mc *MemoryCache) Close() error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.Membuf = map[string]*bytes.Buffer{}
+	if mc.maxSize > 0 {
+		mc.size = 0
+		mc.order.Init()
+		mc.elems = map[string]*list.Element{}
+	}
 	return nil
 }
 
@@ -43,6 +43,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -85,12 +87,83 @@ func TestDirectoryCache(t *testing.T) {
 		return c, func() { os.RemoveAll(tmp) }
 	}
 	testCache(t, "dir-with-small-mem", newCache)
+
+	// with verification of the entries
+	newCache = func() (BlobCache, cleanFunc) {
+		tmp, err := os.MkdirTemp("", "testcache")
+		if err != nil {
+			t.Fatalf("failed to make tempdir: %v", err)
+		}
+		c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{
+			MaxLRUCacheEntry: 1,
+			SyncAdd:          true,
+			Verify:           true,
+		})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return c, func() { os.RemoveAll(tmp) }
+	}
+	testCache(t, "dir-with-verification", newCache)
 }
 
 func TestMemoryCache(t *testing.T) {
 	testCache(t, "memory", func() (BlobCache, cleanFunc) { return NewMemoryCache(), func() {} })
 }
 
+func TestBoundedMemoryCache(t *testing.T) {
+	testCache(t, "bounded-memory", func() (BlobCache, cleanFunc) { return NewBoundedMemoryCache(1 << 20), func() {} })
+
+	c := NewBoundedMemoryCache(30)
+	defer c.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		addEntry(t, c, key, strings.Repeat(key, 10))
+	}
+	r, err := c.Get("a")
+	if err != nil {
+		t.Fatalf("failed to get a: %v", err)
+	}
+	r.Close()
+	addEntry(t, c, "d", strings.Repeat("d", 10))
+	for key, expected := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		r, err := c.Get(key)
+		if cached := err == nil; cached != expected {
+			t.Errorf("unexpected entry %q; expected cached: %v, got cached: %v", key, expected, cached)
+		}
+		if err == nil {
+			r.Close()
+		}
+	}
+}
+
+func TestPersistentDirectoryCache(t *testing.T) {
+	dir := t.TempDir()
+	newCache := func() BlobCache {
+		c, err := NewDirectoryCache(dir, DirectoryCacheConfig{SyncAdd: true, Direct: true, Persistent: true})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return c
+	}
+	c := newCache()
+	addEntry(t, c, "a", "contents")
+	w, err := c.Add("b")
+	if err != nil {
+		t.Fatalf("failed to add b: %v", err)
+	}
+	w.Write([]byte("half-written"))
+	if err := c.Close(); err != nil {
+		t.Fatalf("failed to close cache: %v", err)
+	}
+
+	c = newCache()
+	defer c.Close()
+	testChunk(t, c, "a", 0, "contents")
+	if wip, err := os.ReadDir(filepath.Join(dir, "wip")); err != nil || len(wip) != 0 {
+		t.Fatalf("unexpected half-written entries; err: %v, entries: %d", err, len(wip))
+	}
+}
+
 type cleanFunc func()
 
 func testCache(t *testing.T, name string, newCache func() (BlobCache, cleanFunc)) {
@@ -0,0 +1,109 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Entries of caches with verification enabled start with a header: a magic number (4 bytes),
+// the CRC-32C checksum of the contents (4 bytes) and the size of the contents (8 bytes), little-endian.
+const entryHeaderSize = 16
+
+var (
+	entryMagic = []byte("SCE1")
+
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+	// ErrCorrupted is returned when the contents of an entry don't match its checksum.
+	ErrCorrupted = errors.New("cache entry is corrupted")
+)
+
+// checksumWriter computes the checksum of the contents written to an entry.
+type checksumWriter struct {
+	f    *os.File
+	crc  hash.Hash32
+	size int64
+}
+
+func newChecksumWriter(f *os.File) *checksumWriter {
+	return &checksumWriter{f: f, crc: crc32.New(castagnoli)}
+}
+
+func (w *checksumWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	w.crc.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *checksumWriter) Close() error {
+	return w.f.Close()
+}
+
+// header returns the header of the entry, with the checksum of the contents written so far.
+func (w *checksumWriter) header() []byte {
+	h := make([]byte, entryHeaderSize)
+	copy(h, entryMagic)
+	binary.LittleEndian.PutUint32(h[4:8], w.crc.Sum32())
+	binary.LittleEndian.PutUint64(h[8:16], uint64(w.size))
+	return h
+}
+
+// verifyEntry checks that the contents of the entry file `f` match the checksum of its header.
+func verifyEntry(f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	h := make([]byte, entryHeaderSize)
+	if _, err := f.ReadAt(h, 0); err != nil {
+		return fmt.Errorf("%w: cannot read header: %v", ErrCorrupted, err)
+	}
+	if !bytes.Equal(h[0:4], entryMagic) {
+		return fmt.Errorf("%w: invalid header", ErrCorrupted)
+	}
+	size := int64(binary.LittleEndian.Uint64(h[8:16]))
+	if size != fi.Size()-entryHeaderSize {
+		return fmt.Errorf("%w: %d bytes of contents, expected %d", ErrCorrupted, fi.Size()-entryHeaderSize, size)
+	}
+	crc := crc32.New(castagnoli)
+	if _, err := io.Copy(crc, io.NewSectionReader(f, entryHeaderSize, size)); err != nil {
+		return err
+	}
+	if crc.Sum32() != binary.LittleEndian.Uint32(h[4:8]) {
+		return fmt.Errorf("%w: checksum mismatch", ErrCorrupted)
+	}
+	return nil
+}
+
+// offsetReaderAt reads the contents of an entry file, after its header.
+type offsetReaderAt struct {
+	f      *os.File
+	offset int64
+}
+
+func (r *offsetReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return r.f.ReadAt(p, off+r.offset)
+}
@@ -0,0 +1,157 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCorruptedEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(path string) error
+	}{
+		{
+			name: "modified contents",
+			corrupt: func(path string) error {
+				f, err := os.OpenFile(path, os.O_WRONLY, 0)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				_, err = f.WriteAt([]byte("x"), entryHeaderSize+3)
+				return err
+			},
+		},
+		{
+			name: "truncated contents",
+			corrupt: func(path string) error {
+				return os.Truncate(path, entryHeaderSize+5)
+			},
+		},
+		{
+			name: "truncated header",
+			corrupt: func(path string) error {
+				return os.Truncate(path, entryHeaderSize-1)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var corrupted []string
+			quota, err := NewDiskQuota(DiskQuotaConfig{})
+			if err != nil {
+				t.Fatalf("failed to create quota: %v", err)
+			}
+			c, err := NewDirectoryCache(t.TempDir(), DirectoryCacheConfig{
+				SyncAdd:     true,
+				Direct:      true,
+				Quota:       quota,
+				Verify:      true,
+				OnCorrupted: func(key string) { corrupted = append(corrupted, key) },
+			})
+			if err != nil {
+				t.Fatalf("failed to make cache: %v", err)
+			}
+			defer c.Close()
+
+			addEntry(t, c, "key", sampleData)
+			if err := tt.corrupt(c.(*directoryCache).cachePath("key")); err != nil {
+				t.Fatalf("failed to corrupt entry: %v", err)
+			}
+			if r, err := c.Get("key"); err == nil {
+				r.Close()
+				t.Fatalf("corrupted entry was read")
+			}
+			if len(corrupted) != 1 || corrupted[0] != "key" {
+				t.Fatalf("unexpected corrupted entries: %v", corrupted)
+			}
+			if quota.Size() != 0 {
+				t.Fatalf("corrupted entry is still accounted for: %d bytes", quota.Size())
+			}
+
+			// the entry is added again
+			addEntry(t, c, "key", sampleData)
+			r, err := c.Get("key")
+			if err != nil {
+				t.Fatalf("failed to get entry added again: %v", err)
+			}
+			defer r.Close()
+			data, err := io.ReadAll(io.NewSectionReader(r, 0, int64(len(sampleData))))
+			if err != nil || string(data) != sampleData {
+				t.Fatalf("unexpected contents %q: %v", data, err)
+			}
+			if quota.Size() != int64(entryHeaderSize+len(sampleData)) {
+				t.Fatalf("unexpected size of the entry on disk: %d", quota.Size())
+			}
+		})
+	}
+}
+
+func TestVerifiedEntries(t *testing.T) {
+	var corrupted []string
+	c, err := NewDirectoryCache(t.TempDir(), DirectoryCacheConfig{
+		SyncAdd:     true,
+		Direct:      true,
+		Verify:      true,
+		OnCorrupted: func(key string) { corrupted = append(corrupted, key) },
+	})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	defer c.Close()
+	dc := c.(*directoryCache)
+	path := dc.cachePath("key")
+
+	addEntry(t, c, "key", sampleData)
+	if !c.Exists("key") || c.Exists("missing") {
+		t.Fatalf("unexpected existence of entries")
+	}
+	testChunk(t, c, "key", 0, sampleData)
+
+	// the entry is verified once, so a change which keeps its size and modification time isn't noticed
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat entry: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("failed to open entry: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("x"), entryHeaderSize); err != nil {
+		t.Fatalf("failed to modify entry: %v", err)
+	}
+	f.Close()
+	if err := os.Chtimes(path, time.Now(), fi.ModTime()); err != nil {
+		t.Fatalf("failed to restore the modification time: %v", err)
+	}
+	testChunk(t, c, "key", 1, sampleData[1:])
+	if len(corrupted) != 0 {
+		t.Fatalf("verified entry is verified again: %v", corrupted)
+	}
+
+	// a corrupted file isn't removed once the entry has been committed again
+	addEntry(t, c, "key", sampleData)
+	dc.removeCorrupted("key", fi)
+	if !c.Exists("key") {
+		t.Fatalf("entry committed again is removed")
+	}
+	testChunk(t, c, "key", 0, sampleData)
+}
@@ -0,0 +1,242 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	// EvictionPolicyLRU evicts the least recently used entries first.
+	EvictionPolicyLRU = "lru"
+	// EvictionPolicyLFU evicts the least frequently used entries first, and the least
+	// recently used ones among the entries used as often.
+	EvictionPolicyLFU = "lfu"
+)
+
+type DiskQuotaConfig struct {
+	// MaxSize is the maximum size in bytes of the entries on disk. 0 means unlimited,
+	// in which case the size of the entries is only tracked.
+	MaxSize int64
+
+	// EvictionPolicy chooses the entries evicted once MaxSize is exceeded (default: EvictionPolicyLRU).
+	EvictionPolicy string
+
+	// OnSizeChange is called with the size of the entries on disk whenever it changes. Optional.
+	OnSizeChange func(size int64)
+
+	// OnEvicted is called with the size of each entry evicted from disk. Optional.
+	OnEvicted func(size int64)
+}
+
+// DiskQuota bounds the size of the entries that directory caches store on disk. It can be
+// shared by several directory caches, e.g. all the caches under the same root directory.
+// Once the quota is exceeded, entries are evicted from disk, except the ones being read.
+type DiskQuota struct {
+	config DiskQuotaConfig
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*diskEntry // by path
+	order   *list.List            // of *diskEntry, from the least to the most recently used
+}
+
+type diskEntry struct {
+	path  string
+	key   string
+	size  int64
+	hits  int64
+	pins  int
+	owner *directoryCache
+	elem  *list.Element
+}
+
+func NewDiskQuota(config DiskQuotaConfig) (*DiskQuota, error) {
+	switch config.EvictionPolicy {
+	case "":
+		config.EvictionPolicy = EvictionPolicyLRU
+	case EvictionPolicyLRU, EvictionPolicyLFU:
+	default:
+		return nil, fmt.Errorf("unknown eviction policy %q", config.EvictionPolicy)
+	}
+	if config.MaxSize < 0 {
+		return nil, fmt.Errorf("invalid maximum cache size %d", config.MaxSize)
+	}
+	return &DiskQuota{
+		config:  config,
+		entries: make(map[string]*diskEntry),
+		order:   list.New(),
+	}, nil
+}
+
+// Size returns the size in bytes of the entries on disk.
+func (q *DiskQuota) Size() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// add accounts for the entry of `owner` committed to `path`, and evicts other entries if the quota is exceeded.
+func (q *DiskQuota) add(owner *directoryCache, key, path string, size int64) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, ok := q.entries[path]
+	if ok {
+		// the entry has been overwritten
+		q.size -= e.size
+		e.size = size
+		q.order.MoveToBack(e.elem)
+	} else {
+		e = &diskEntry{path: path, key: key, size: size, owner: owner}
+		e.elem = q.order.PushBack(e)
+		q.entries[path] = e
+	}
+	e.hits++
+	q.size += size
+	q.evict(e)
+	q.sizeChanged()
+}
+
+// load accounts for the entries of `owner` found on disk when it's created, ordered from the least to
+// the most recently modified, and evicts entries if the quota is exceeded.
+func (q *DiskQuota) load(owner *directoryCache, entries []diskEntry) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, loaded := range entries {
+		if _, ok := q.entries[loaded.path]; ok {
+			continue
+		}
+		e := &diskEntry{path: loaded.path, key: loaded.key, size: loaded.size, hits: 1, owner: owner}
+		e.elem = q.order.PushBack(e)
+		q.entries[e.path] = e
+		q.size += e.size
+	}
+	q.evict(nil)
+	q.sizeChanged()
+}
+
+// pin marks the entry at `path` as used, and keeps it from being evicted until `unpin` is called.
+func (q *DiskQuota) pin(path string) (unpin func()) {
+	if q == nil {
+		return func() {}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, ok := q.entries[path]
+	if !ok {
+		return func() {}
+	}
+	e.hits++
+	e.pins++
+	q.order.MoveToBack(e.elem)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			e.pins--
+			q.mu.Unlock()
+		})
+	}
+}
+
+// release forgets the entries of `owner`, whose files are removed with its directory.
+func (q *DiskQuota) release(owner *directoryCache) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for path, e := range q.entries {
+		if e.owner == owner {
+			q.remove(e)
+			delete(q.entries, path)
+		}
+	}
+	q.sizeChanged()
+}
+
+// drop forgets the entry at `path`, which is removed from disk without being evicted.
+func (q *DiskQuota) drop(path string) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if e, ok := q.entries[path]; ok {
+		q.remove(e)
+		delete(q.entries, path)
+		q.sizeChanged()
+	}
+}
+
+// evict evicts entries until the quota isn't exceeded anymore. Pinned entries and `keep`, the entry
+// being added, aren't evicted, so the quota may stay exceeded if all the other entries are being read.
+func (q *DiskQuota) evict(keep *diskEntry) {
+	for q.config.MaxSize > 0 && q.size > q.config.MaxSize {
+		victim := q.victim(keep)
+		if victim == nil {
+			return
+		}
+		if err := os.Remove(victim.path); err != nil && !os.IsNotExist(err) {
+			// the entry isn't accounted for anymore anyway, so that it isn't picked again
+			fmt.Println("failed to evict cache entry:", err)
+		}
+		victim.owner.forget(victim.key)
+		q.remove(victim)
+		delete(q.entries, victim.path)
+		if q.config.OnEvicted != nil {
+			q.config.OnEvicted(victim.size)
+		}
+	}
+}
+
+func (q *DiskQuota) victim(keep *diskEntry) *diskEntry {
+	var victim *diskEntry
+	for elem := q.order.Front(); elem != nil; elem = elem.Next() {
+		e := elem.Value.(*diskEntry)
+		if e == keep || e.pins > 0 {
+			continue
+		}
+		if q.config.EvictionPolicy == EvictionPolicyLRU {
+			return e
+		}
+		if victim == nil || e.hits < victim.hits {
+			victim = e
+		}
+	}
+	return victim
+}
+
+func (q *DiskQuota) remove(e *diskEntry) {
+	q.order.Remove(e.elem)
+	q.size -= e.size
+}
+
+func (q *DiskQuota) sizeChanged() {
+	if q.config.OnSizeChange != nil {
+		q.config.OnSizeChange(q.size)
+	}
+}
@@ -0,0 +1,221 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskQuota(t *testing.T) {
+	const entrySize = 10
+	tests := []struct {
+		name     string
+		policy   string
+		reads    []string // entries read after adding a, b and c, before adding d
+		pinned   string   // entry being read while d is added
+		expected []string // entries left on disk after adding d
+	}{
+		{
+			name:     "lru",
+			policy:   EvictionPolicyLRU,
+			expected: []string{"b", "c", "d"},
+		},
+		{
+			name:     "lru reads",
+			policy:   EvictionPolicyLRU,
+			reads:    []string{"a", "b"},
+			expected: []string{"a", "b", "d"},
+		},
+		{
+			name:     "lru pinned",
+			policy:   EvictionPolicyLRU,
+			pinned:   "a",
+			expected: []string{"a", "c", "d"},
+		},
+		{
+			name:     "lfu",
+			policy:   EvictionPolicyLFU,
+			reads:    []string{"a", "a", "b", "c", "c"},
+			expected: []string{"a", "c", "d"},
+		},
+		{
+			name:     "lfu ties",
+			policy:   EvictionPolicyLFU,
+			reads:    []string{"c", "a", "b"},
+			expected: []string{"a", "b", "d"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var size, evicted int64
+			quota, err := NewDiskQuota(DiskQuotaConfig{
+				MaxSize:        3 * entrySize,
+				EvictionPolicy: tt.policy,
+				OnSizeChange:   func(s int64) { size = s },
+				OnEvicted:      func(s int64) { evicted += s },
+			})
+			if err != nil {
+				t.Fatalf("failed to create quota: %v", err)
+			}
+			// the quota is shared by two caches
+			c1 := newQuotaTestCache(t, quota)
+			defer c1.Close()
+			c2 := newQuotaTestCache(t, quota)
+			defer c2.Close()
+			caches := map[string]BlobCache{"a": c1, "b": c2, "c": c1, "d": c2}
+
+			for _, key := range []string{"a", "b", "c"} {
+				addEntry(t, caches[key], key, strings.Repeat(key, entrySize))
+			}
+			for _, key := range tt.reads {
+				r, err := caches[key].Get(key)
+				if err != nil {
+					t.Fatalf("failed to get %q: %v", key, err)
+				}
+				r.Close()
+			}
+			if tt.pinned != "" {
+				r, err := caches[tt.pinned].Get(tt.pinned)
+				if err != nil {
+					t.Fatalf("failed to get %q: %v", tt.pinned, err)
+				}
+				defer r.Close()
+			}
+			addEntry(t, caches["d"], "d", strings.Repeat("d", entrySize))
+
+			for _, key := range []string{"a", "b", "c", "d"} {
+				r, err := caches[key].Get(key)
+				left := err == nil
+				if left {
+					r.Close()
+				}
+				if expected := contains(tt.expected, key); left != expected {
+					t.Errorf("unexpected entry %q; expected on disk: %v, got on disk: %v", key, expected, left)
+				}
+			}
+			if size != 3*entrySize || quota.Size() != size || evicted != entrySize {
+				t.Fatalf("unexpected sizes; size: %d, quota size: %d, evicted: %d", size, quota.Size(), evicted)
+			}
+
+			c1.Close()
+			if expected := int64(len(tt.expected)-count(tt.expected, caches, c1)) * entrySize; size != expected {
+				t.Fatalf("unexpected size after closing a cache; expected %d, got %d", expected, size)
+			}
+		})
+	}
+}
+
+func TestDiskQuotaPolicy(t *testing.T) {
+	if _, err := NewDiskQuota(DiskQuotaConfig{EvictionPolicy: "fifo"}); err == nil {
+		t.Fatalf("expected an error creating a quota with an unknown policy")
+	}
+	if _, err := NewDiskQuota(DiskQuotaConfig{MaxSize: -1}); err == nil {
+		t.Fatalf("expected an error creating a quota with a negative size")
+	}
+}
+
+func TestDiskQuotaExistingEntries(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewDirectoryCache(dir, DirectoryCacheConfig{SyncAdd: true, Direct: true, Persistent: true})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	keys := []string{"a", "b", "c"}
+	for i, key := range keys {
+		addEntry(t, c, key, "0123456789")
+		mtime := time.Now().Add(time.Duration(i-len(keys)) * time.Hour)
+		if err := os.Chtimes(filepath.Join(dir, key), mtime, mtime); err != nil {
+			t.Fatalf("failed to set the modification time of %q: %v", key, err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("failed to close cache: %v", err)
+	}
+
+	quota, err := NewDiskQuota(DiskQuotaConfig{MaxSize: 30})
+	if err != nil {
+		t.Fatalf("failed to make quota: %v", err)
+	}
+	c, err = NewDirectoryCache(dir, DirectoryCacheConfig{SyncAdd: true, Direct: true, Persistent: true, Quota: quota})
+	if err != nil {
+		t.Fatalf("failed to reopen cache: %v", err)
+	}
+	defer c.Close()
+	if size := quota.Size(); size != 30 {
+		t.Fatalf("unexpected size of existing entries %d; want 30", size)
+	}
+	addEntry(t, c, "d", "0123456789")
+	if size := quota.Size(); size != 30 {
+		t.Fatalf("unexpected size after eviction %d; want 30", size)
+	}
+	for key, expected := range map[string]bool{"a": false, "b": true, "c": true, "d": true} {
+		_, err := os.Stat(filepath.Join(dir, key))
+		if onDisk := err == nil; onDisk != expected {
+			t.Errorf("unexpected entry %q; expected on disk: %v, got on disk: %v", key, expected, onDisk)
+		}
+	}
+}
+
+func newQuotaTestCache(t *testing.T, quota *DiskQuota) BlobCache {
+	c, err := NewDirectoryCache(t.TempDir(), DirectoryCacheConfig{
+		SyncAdd: true,
+		Direct:  true,
+		Quota:   quota,
+	})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	return c
+}
+
+func addEntry(t *testing.T, c BlobCache, key, data string) {
+	w, err := c.Add(key)
+	if err != nil {
+		t.Fatalf("failed to add %q: %v", key, err)
+	}
+	defer w.Close()
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatalf("failed to write %q: %v", key, err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("failed to commit %q: %v", key, err)
+	}
+}
+
+func contains(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// count returns the number of `keys` in the cache `c`.
+func count(keys []string, caches map[string]BlobCache, c BlobCache) int {
+	n := 0
+	for _, key := range keys {
+		if caches[key] == c {
+			n++
+		}
+	}
+	return n
+}
@@ -17,12 +17,21 @@
 package commands
 
 import (
+	"context"
+	"fmt"
 	"os"
 
 	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/service/keychain/dockerconfig"
+	"github.com/awslabs/soci-snapshotter/service/resolver"
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	"oras.land/oras-go/v2/content/oci"
@@ -52,60 +61,236 @@ var CreateCommand = cli.Command{
 			Usage: "The minimum layer size in bytes to build zTOC for. Default is 0.",
 			Value: 0,
 		},
+		cli.StringSliceFlag{
+			Name:  "platform, p",
+			Usage: "Build SOCI index for a specific platform. Can be specified multiple times. Default is the platform of the host",
+		},
+		cli.BoolFlag{
+			Name:  "all-platforms",
+			Usage: "Build SOCI index for all platforms of the image",
+		},
+		cli.StringFlag{
+			Name:  "ztoc-version",
+			Usage: fmt.Sprintf("The version of the zTOC format. Use %s for snapshotters which only support gob-encoded zTOCs, which can only index gzip layers, and %s for snapshotters which don't support compact gzip checkpoints. Default is %s.", soci.ZtocVersionGob, soci.ZtocVersionProto, soci.DefaultZtocVersion),
+			Value: soci.DefaultZtocVersion,
+		},
+		cli.BoolFlag{
+			Name:  "force-rebuild",
+			Usage: "Build the zTOCs of all layers, instead of reusing the zTOCs built previously for the same layers with the same options",
+		},
+		cli.BoolFlag{
+			Name:  "remote",
+			Usage: "Build SOCI index for an image in a registry, streaming its layers instead of reading them from containerd",
+		},
+		cli.StringFlag{
+			Name:  "oci-layout",
+			Usage: "Build SOCI index for an image of the OCI image layout in this directory instead of containerd. The image ref can be omitted if the layout has a single image",
+		},
+		cli.StringFlag{
+			Name:  "archive",
+			Usage: "Build SOCI index for an image of this tarball, such as created by \"docker save\", instead of containerd. The image ref can be omitted if the tarball has a single image. The layers of tarballs created by \"docker save\" before Docker 25 are indexed uncompressed, as they are in the tarball",
+		},
+		cli.BoolFlag{
+			Name:  "write-to-layout",
+			Usage: "Also write the SOCI index and zTOCs into the OCI image layout given by --oci-layout, so that they can be copied to a registry with the image",
+		},
 	},
 	Action: func(cliContext *cli.Context) error {
 		srcRef := cliContext.Args().Get(0)
-		if srcRef == "" {
+		if srcRef == "" && cliContext.String("oci-layout") == "" && cliContext.String("archive") == "" {
 			return errors.New("source image needs to be specified")
 		}
+		if cliContext.Bool("write-to-layout") && cliContext.String("oci-layout") == "" {
+			return errors.New("--write-to-layout requires --oci-layout")
+		}
 
 		err := os.MkdirAll(config.SociIndexDirectory, 0755)
 		if err != nil {
 			return err
 		}
 
-		client, ctx, cancel, err := commands.NewClient(cliContext)
+		ctx, cs, srcImg, cancel, err := getImage(cliContext, srcRef)
 		if err != nil {
 			return err
 		}
 		defer cancel()
 
-		cs := client.ContentStore()
-		is := client.ImageService()
-		srcImg, err := is.Get(ctx, srcRef)
-		if err != nil {
-			return err
-		}
 		spanSize := cliContext.Int64("span-size")
 		minLayerSize := cliContext.Int64("min-layer-size")
+		ztocVersion := cliContext.String("ztoc-version")
 		blobStore, err := oci.New(config.SociContentStorePath)
 		if err != nil {
 			return err
 		}
 
-		sociIndex, err := soci.BuildSociIndex(ctx, cs, srcImg, spanSize, blobStore,
-			soci.WithMinLayerSize(minLayerSize),
-			soci.WithBuildToolIdentifier(buildToolIdentifier),
-			soci.WithBuildToolVersion(buildToolVersion))
-
+		ps, err := getImagePlatforms(ctx, cliContext, cs, srcImg)
 		if err != nil {
 			return err
 		}
 
-		sociIndexWithMetadata := soci.IndexWithMetadata{
-			Index:       sociIndex,
-			ImageDigest: srcImg.Target.Digest,
-			// TODO: This is not strictly correct because the default platform matcher used in BuildSociIndex
-			// might match a compatible version (i.e. linux/amd64 will match linux/i386). Building indices for
-			// multiple/non-default platforms will be needed at some point and this should be fixed with that change as well.
-			Platform: platforms.DefaultSpec(),
-		}
+		for _, plat := range ps {
+			sociIndex, err := soci.BuildSociIndex(ctx, cs, srcImg, spanSize, blobStore,
+				soci.WithMinLayerSize(minLayerSize),
+				soci.WithBuildToolIdentifier(buildToolIdentifier),
+				soci.WithBuildToolVersion(buildToolVersion),
+				soci.WithZtocVersion(ztocVersion),
+				soci.WithForceRebuild(cliContext.Bool("force-rebuild")),
+				soci.WithPlatform(plat))
 
-		err = soci.WriteSociIndex(ctx, sociIndexWithMetadata, blobStore)
-		if err != nil {
-			return err
+			if err != nil {
+				return fmt.Errorf("cannot build SOCI index for platform %s: %w", platforms.Format(plat), err)
+			}
+
+			sociIndexWithMetadata := soci.IndexWithMetadata{
+				Index:    sociIndex,
+				Platform: plat,
+			}
+			// "soci index prune" would remove the indices of images which aren't in containerd
+			if imageFromContainerd(cliContext) {
+				sociIndexWithMetadata.ImageDigest = srcImg.Target.Digest
+			}
+
+			err = soci.WriteSociIndex(ctx, sociIndexWithMetadata, blobStore)
+			if err != nil {
+				return err
+			}
+
+			if cliContext.Bool("write-to-layout") {
+				err = soci.WriteSociIndexToLayout(ctx, sociIndex, blobStore, cliContext.String("oci-layout"))
+				if err != nil {
+					return fmt.Errorf("cannot write SOCI index to the OCI image layout: %w", err)
+				}
+			}
 		}
 
 		return nil
 	},
 }
+
+// getImagePlatforms returns the platforms selected by the `--platform` and `--all-platforms` flags.
+// If neither flag is set, the default platform of the host is returned.
+func getImagePlatforms(ctx context.Context, cliContext *cli.Context, cs content.Provider, img images.Image) ([]ocispec.Platform, error) {
+	if cliContext.Bool("all-platforms") {
+		if len(cliContext.StringSlice("platform")) > 0 {
+			return nil, errors.New("--all-platforms and --platform cannot be used together")
+		}
+		all, err := images.Platforms(ctx, cs, img.Target)
+		if err != nil {
+			return nil, err
+		}
+		var ps []ocispec.Platform
+		seen := make(map[string]struct{})
+		for _, p := range all {
+			p = platforms.Normalize(p)
+			// attestation manifests, such as the ones created by buildx, don't refer to a runnable platform
+			if p.OS == "unknown" || p.Architecture == "unknown" {
+				continue
+			}
+			key := platforms.Format(p)
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			ps = append(ps, p)
+		}
+		return ps, nil
+	}
+
+	ps := []ocispec.Platform{}
+	for _, s := range cliContext.StringSlice("platform") {
+		p, err := platforms.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid platform %q: %w", s, err)
+		}
+		ps = append(ps, p)
+	}
+	if len(ps) == 0 {
+		ps = append(ps, platforms.DefaultSpec())
+	}
+	return ps, nil
+}
+
+// getImage returns the image `ref` and a content.Provider to read its contents from.
+// The image is read from containerd, or from where the `--remote`, `--oci-layout` or `--archive` flags tell.
+func getImage(cliContext *cli.Context, ref string) (context.Context, content.Provider, images.Image, context.CancelFunc, error) {
+	if !imageFromContainerd(cliContext) {
+		sources := 0
+		for _, set := range []bool{cliContext.Bool("remote"), cliContext.String("oci-layout") != "", cliContext.String("archive") != ""} {
+			if set {
+				sources++
+			}
+		}
+		if sources > 1 {
+			return nil, nil, images.Image{}, nil, errors.New("--remote, --oci-layout and --archive cannot be used together")
+		}
+
+		ctx, cancel := commands.AppContext(cliContext)
+		var (
+			cs  content.Provider
+			img images.Image
+			err error
+		)
+		switch {
+		case cliContext.Bool("remote"):
+			cs, img, err = resolveRemoteImage(ctx, ref)
+		case cliContext.String("oci-layout") != "":
+			cs, img, err = soci.OpenOCILayout(cliContext.String("oci-layout"), ref)
+		default:
+			var closeArchive func() error
+			cs, img, closeArchive, err = soci.OpenDockerArchive(cliContext.String("archive"), ref)
+			if err == nil {
+				cancelCtx := cancel
+				cancel = func() {
+					closeArchive()
+					cancelCtx()
+				}
+			}
+		}
+		if err != nil {
+			cancel()
+			return nil, nil, images.Image{}, nil, err
+		}
+		return ctx, cs, img, cancel, nil
+	}
+
+	client, ctx, cancel, err := commands.NewClient(cliContext)
+	if err != nil {
+		return nil, nil, images.Image{}, nil, err
+	}
+	img, err := client.ImageService().Get(ctx, ref)
+	if err != nil {
+		cancel()
+		return nil, nil, images.Image{}, nil, err
+	}
+	return ctx, client.ContentStore(), img, cancel, nil
+}
+
+// imageFromContainerd returns whether the image is read from containerd, rather than from where
+// the `--remote`, `--oci-layout` or `--archive` flags tell.
+func imageFromContainerd(cliContext *cli.Context) bool {
+	return !cliContext.Bool("remote") && cliContext.String("oci-layout") == "" && cliContext.String("archive") == ""
+}
+
+// resolveRemoteImage resolves the image `ref` in its registry, with the credentials of the docker config.
+// It returns the image and a content.Provider which streams its contents from the registry.
+func resolveRemoteImage(ctx context.Context, ref string) (content.Provider, images.Image, error) {
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return nil, images.Image{}, fmt.Errorf("cannot parse image ref (%s): %w", ref, err)
+	}
+	hosts := resolver.RegistryHostsFromConfig(resolver.Config{}, dockerconfig.NewDockerConfigKeychain(ctx))
+	r := docker.NewResolver(docker.ResolverOptions{
+		Hosts: func(string) ([]docker.RegistryHost, error) {
+			return hosts(refspec)
+		},
+	})
+	name, desc, err := r.Resolve(ctx, refspec.String())
+	if err != nil {
+		return nil, images.Image{}, fmt.Errorf("cannot resolve %s: %w", ref, err)
+	}
+	fetcher, err := r.Fetcher(ctx, name)
+	if err != nil {
+		return nil, images.Image{}, err
+	}
+	return soci.NewFetcherProvider(fetcher), images.Image{Name: name, Target: desc}, nil
+}
@@ -0,0 +1,56 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli"
+)
+
+const (
+	// FormatText is the human-readable output format of the inspection commands.
+	FormatText = "text"
+	// FormatJSON is the JSON output format of the inspection commands.
+	FormatJSON = "json"
+)
+
+// FormatFlag selects the output format of the inspection commands.
+var FormatFlag = cli.StringFlag{
+	Name:  "format",
+	Usage: fmt.Sprintf("output format, either %q or %q", FormatText, FormatJSON),
+	Value: FormatText,
+}
+
+// OutputFormat returns the output format selected with FormatFlag.
+func OutputFormat(cliContext *cli.Context) (string, error) {
+	switch format := cliContext.String(FormatFlag.Name); format {
+	case FormatText, FormatJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unsupported output format %q", format)
+	}
+}
+
+// PrintJSON prints `v` as indented JSON to stdout.
+func PrintJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -66,10 +66,9 @@ command.
 			Name:  skipContentVerifyOpt,
 			Usage: "Skip content verification for layers contained in this image.",
 		},
-		// This is a standin for the snapshotter receiving the index digest from container runtimes.
 		cli.StringFlag{
 			Name:  "soci-index-digest",
-			Usage: "The SOCI index digest.",
+			Usage: "The SOCI index digest. If not given, the snapshotter discovers the index among the referrers of the image.",
 		},
 	), commands.SnapshotterFlags...),
 	Action: func(context *cli.Context) error {
@@ -84,7 +83,7 @@ command.
 		sociIndexDigest := context.String("soci-index-digest")
 
 		if sociIndexDigest == "" {
-			fmt.Printf("unable to find SOCI index digest for %v: the container image will be pulled in non-SOCI mode\n", ref)
+			fmt.Printf("no SOCI index digest given for %v: the snapshotter will look for a SOCI index among the referrers of the image\n", ref)
 		} else {
 			fmt.Printf("using SOCI index digest: %v\n", sociIndexDigest)
 		}
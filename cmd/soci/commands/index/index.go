@@ -23,5 +23,10 @@ var Command = cli.Command{
 	Usage: "manage indices",
 	Subcommands: []cli.Command{
 		listCommand,
+		infoCommand,
+		rmCommand,
+		pruneCommand,
+		signCommand,
+		verifyCommand,
 	},
 }
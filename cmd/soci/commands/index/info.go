@@ -0,0 +1,204 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands"
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	ctrcommands "github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+// indexInfo is the output of "soci index info".
+type indexInfo struct {
+	Digest digest.Digest   `json:"digest"`
+	Index  *soci.SociIndex `json:"index"`
+	Blobs  []blobInfo      `json:"blobs"`
+	// SkippedLayers are the layers of the image without ztoc.
+	// They are only known if the image manifest is in the content store of containerd.
+	SkippedLayers []ocispec.Descriptor `json:"skippedLayers,omitempty"`
+	// PrefetchList is the prefetch list of the index, recorded by "soci profile".
+	PrefetchList *soci.PrefetchList `json:"prefetchList,omitempty"`
+}
+
+// blobInfo is a blob of an index, with its entry in the artifacts db if it's in the local content store.
+type blobInfo struct {
+	Descriptor ocispec.Descriptor  `json:"descriptor"`
+	Artifact   *soci.ArtifactEntry `json:"artifact,omitempty"`
+}
+
+var infoCommand = cli.Command{
+	Name:      "info",
+	Usage:     "get detailed info about an index",
+	ArgsUsage: "[flags] <digest>",
+	Flags: []cli.Flag{
+		commands.FormatFlag,
+	},
+	Action: func(cliContext *cli.Context) error {
+		indexDigest, err := digest.Parse(cliContext.Args().First())
+		if err != nil {
+			return err
+		}
+		format, err := commands.OutputFormat(cliContext)
+		if err != nil {
+			return err
+		}
+		client, ctx, cancel, err := ctrcommands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		store, err := oci.New(config.SociContentStorePath)
+		if err != nil {
+			return fmt.Errorf("cannot create local content store: %w", err)
+		}
+		index, err := soci.ReadSociIndex(ctx, indexDigest, store)
+		if err != nil {
+			return fmt.Errorf("cannot read index %s: %w", indexDigest, err)
+		}
+		db, err := soci.NewDB()
+		if err != nil {
+			return err
+		}
+
+		info := indexInfo{Digest: indexDigest, Index: index}
+		for _, blob := range index.Blobs {
+			if blob == nil || blob.MediaType == soci.SociPrefetchListMediaType {
+				continue
+			}
+			bi := blobInfo{Descriptor: *blob}
+			if ae, err := db.GetArtifactEntry(blob.Digest.String()); err == nil {
+				bi.Artifact = ae
+			}
+			info.Blobs = append(info.Blobs, bi)
+		}
+		info.SkippedLayers, err = skippedLayers(ctx, client.ContentStore(), index)
+		if err != nil {
+			return err
+		}
+		info.PrefetchList, err = soci.ReadPrefetchList(ctx, index, store)
+		if err != nil {
+			return err
+		}
+
+		if format == commands.FormatJSON {
+			return commands.PrintJSON(info)
+		}
+		printIndexInfo(info)
+		return nil
+	},
+}
+
+// skippedLayers returns the layers of the image of `index` which have no ztoc in the index.
+// It returns no layers if the image manifest isn't in the content store.
+func skippedLayers(ctx context.Context, cs content.Store, index *soci.SociIndex) ([]ocispec.Descriptor, error) {
+	if index.Subject.Digest == "" {
+		return nil, nil
+	}
+	b, err := content.ReadBlob(ctx, cs, index.Subject)
+	if err != nil {
+		return nil, nil
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, fmt.Errorf("cannot decode image manifest %s: %w", index.Subject.Digest, err)
+	}
+	indexed := make(map[string]struct{})
+	for _, blob := range index.Blobs {
+		if blob != nil && blob.MediaType != soci.SociPrefetchListMediaType {
+			indexed[blob.Annotations[soci.IndexAnnotationImageLayerDigest]] = struct{}{}
+		}
+	}
+	var skipped []ocispec.Descriptor
+	for _, layer := range manifest.Layers {
+		if _, ok := indexed[layer.Digest.String()]; !ok {
+			skipped = append(skipped, layer)
+		}
+	}
+	return skipped, nil
+}
+
+func printIndexInfo(info indexInfo) {
+	index := info.Index
+	fmt.Printf("digest: %s\n", info.Digest)
+	fmt.Printf("media type: %s\n", index.MediaType)
+	fmt.Printf("artifact type: %s\n", index.ArtifactType)
+	fmt.Printf("subject: %s (%s, %d bytes)\n", index.Subject.Digest, index.Subject.MediaType, index.Subject.Size)
+	if len(index.Annotations) > 0 {
+		fmt.Printf("annotations:\n")
+		keys := make([]string, 0, len(index.Annotations))
+		for k := range index.Annotations {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Printf("  %s: %s\n", k, index.Annotations[k])
+		}
+	}
+
+	fmt.Printf("\nblobs:\n")
+	writer := tabwriter.NewWriter(os.Stdout, 8, 8, 4, ' ', 0)
+	writer.Write([]byte("ZTOC DIGEST\tSIZE\tLAYER DIGEST\tLAYER MEDIA TYPE\tLOCAL\t\n"))
+	for _, bi := range info.Blobs {
+		local := "no"
+		if bi.Artifact != nil {
+			local = "yes"
+		}
+		writer.Write([]byte(fmt.Sprintf(
+			"%s\t%d\t%s\t%s\t%s\t\n",
+			bi.Descriptor.Digest,
+			bi.Descriptor.Size,
+			bi.Descriptor.Annotations[soci.IndexAnnotationImageLayerDigest],
+			bi.Descriptor.Annotations[soci.IndexAnnotationImageLayerMediaType],
+			local,
+		)))
+	}
+	writer.Flush()
+
+	if len(info.SkippedLayers) > 0 {
+		fmt.Printf("\nskipped layers:\n")
+		writer = tabwriter.NewWriter(os.Stdout, 8, 8, 4, ' ', 0)
+		writer.Write([]byte("LAYER DIGEST\tSIZE\tMEDIA TYPE\t\n"))
+		for _, l := range info.SkippedLayers {
+			writer.Write([]byte(fmt.Sprintf("%s\t%d\t%s\t\n", l.Digest, l.Size, l.MediaType)))
+		}
+		writer.Flush()
+	}
+
+	if info.PrefetchList != nil {
+		fmt.Printf("\nprefetch list: %s\n", info.Index.PrefetchListDescriptor().Digest)
+		writer = tabwriter.NewWriter(os.Stdout, 8, 8, 4, ' ', 0)
+		writer.Write([]byte("LAYER DIGEST\tFILES\tSPANS\t\n"))
+		for _, l := range info.PrefetchList.Layers {
+			writer.Write([]byte(fmt.Sprintf("%s\t%d\t%d\t\n", l.Digest, len(l.Files), len(l.Spans))))
+		}
+		writer.Flush()
+	}
+}
@@ -0,0 +1,94 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package index
+
+import (
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/urfave/cli"
+)
+
+var pruneCommand = cli.Command{
+	Name:  "prune",
+	Usage: "remove unused SOCI artifacts from the local content store",
+	Description: `Remove the SOCI artifacts which aren't needed anymore from the local content store:
+indices of images which were removed from containerd, their signatures, and ztocs
+which aren't used by any remaining index. Images are looked up in all containerd namespaces.
+
+Only the artifacts recorded in the local artifacts database are pruned, i.e. the ones created by
+"soci create", "soci index sign" or "soci profile". Artifacts which the snapshotter fetched from
+a registry into the local content store aren't recorded, so they are kept.
+`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "list the artifacts which would be removed, without removing them",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		// the artifacts database is shared by all namespaces, so an index is only
+		// orphaned if its image doesn't exist in any of them
+		nss, err := client.NamespaceService().List(ctx)
+		if err != nil {
+			return err
+		}
+		is := client.ImageService()
+		imageExists := func(imageDigest string) (bool, error) {
+			for _, ns := range nss {
+				imgs, err := is.List(namespaces.WithNamespace(ctx, ns), fmt.Sprintf("target.digest==%s", imageDigest))
+				if err != nil {
+					return false, err
+				}
+				if len(imgs) > 0 {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+
+		db, err := soci.NewDB()
+		if err != nil {
+			return err
+		}
+		dryRun := cliContext.Bool("dry-run")
+		removed, err := soci.PruneArtifacts(db, config.SociContentStorePath, imageExists, dryRun)
+		if err != nil {
+			return err
+		}
+		verb := "removed"
+		if dryRun {
+			verb = "would remove"
+		}
+		var size int64
+		for _, ae := range removed {
+			fmt.Printf("%s %s %s\n", verb, ae.Type, ae.Digest)
+			size += ae.Size
+		}
+		fmt.Printf("%s %d artifacts, %d bytes\n", verb, len(removed), size)
+		return nil
+	},
+}
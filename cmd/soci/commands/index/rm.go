@@ -0,0 +1,62 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package index
+
+import (
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli"
+)
+
+var rmCommand = cli.Command{
+	Name:      "remove",
+	Aliases:   []string{"rm"},
+	Usage:     "remove indices from the local content store",
+	ArgsUsage: "<digest> [<digest>...]",
+	Description: `Remove SOCI indices and their signatures from the local content store.
+
+The ztocs of the indices are kept, since other indices may use them.
+Run "soci index prune" to remove the ztocs which aren't used anymore.
+`,
+	Action: func(cliContext *cli.Context) error {
+		args := cliContext.Args()
+		if len(args) == 0 {
+			return fmt.Errorf("please provide the digest of an index")
+		}
+		db, err := soci.NewDB()
+		if err != nil {
+			return err
+		}
+		for _, arg := range args {
+			indexDigest, err := digest.Parse(arg)
+			if err != nil {
+				return err
+			}
+			removed, err := soci.RemoveIndex(db, config.SociContentStorePath, indexDigest.String())
+			if err != nil {
+				return fmt.Errorf("cannot remove index %s: %w", indexDigest, err)
+			}
+			for _, ae := range removed {
+				fmt.Printf("removed %s %s\n", ae.Type, ae.Digest)
+			}
+		}
+		return nil
+	},
+}
@@ -0,0 +1,73 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package index
+
+import (
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+var signCommand = cli.Command{
+	Name:      "sign",
+	Usage:     "sign an index with a local private key",
+	ArgsUsage: "[flags] <digest>",
+	Description: `Sign a SOCI index in the local content store with an ECDSA or ed25519 private key.
+The key must be PEM-encoded, either in PKCS #8 or in SEC 1 form.
+
+The signature is stored in the local content store as a referrer of the index,
+and is pushed along with the index by "soci push".
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "key",
+			Usage: "path to the private key to sign the index with",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		indexDigest, err := digest.Parse(cliContext.Args().First())
+		if err != nil {
+			return err
+		}
+		keyPath := cliContext.String("key")
+		if keyPath == "" {
+			return fmt.Errorf("please provide a private key with --key")
+		}
+		signer, err := soci.LoadPrivateKey(keyPath)
+		if err != nil {
+			return err
+		}
+		store, err := oci.New(config.SociContentStorePath)
+		if err != nil {
+			return fmt.Errorf("cannot create local content store: %w", err)
+		}
+		ctx, cancel := commands.AppContext(cliContext)
+		defer cancel()
+
+		desc, err := soci.SignIndex(ctx, indexDigest, signer, store)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("index %s -> signature %s\n", indexDigest, desc.Digest)
+		return nil
+	},
+}
@@ -0,0 +1,78 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package index
+
+import (
+	"crypto"
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+var verifyCommand = cli.Command{
+	Name:      "verify",
+	Usage:     "verify the signatures of an index with local public keys",
+	ArgsUsage: "[flags] <digest>",
+	Description: `Verify that a SOCI index in the local content store is signed by one of the given public keys.
+The keys must be PEM-encoded ECDSA or ed25519 public keys in PKIX form.
+`,
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "key",
+			Usage: "path to a public key trusted to sign the index. Can be specified multiple times",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		indexDigest, err := digest.Parse(cliContext.Args().First())
+		if err != nil {
+			return err
+		}
+		var keys []crypto.PublicKey
+		for _, path := range cliContext.StringSlice("key") {
+			key, err := soci.LoadPublicKey(path)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		if len(keys) == 0 {
+			return fmt.Errorf("please provide at least one public key with --key")
+		}
+		verifier, err := soci.NewIndexVerifier(keys...)
+		if err != nil {
+			return err
+		}
+		store, err := oci.New(config.SociContentStorePath)
+		if err != nil {
+			return fmt.Errorf("cannot create local content store: %w", err)
+		}
+		ctx, cancel := commands.AppContext(cliContext)
+		defer cancel()
+
+		keyID, err := verifier.VerifyLocalIndex(ctx, indexDigest, store)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("index %s is signed by key %s\n", indexDigest, keyID)
+		return nil
+	},
+}
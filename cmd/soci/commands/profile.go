@@ -0,0 +1,299 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/oci"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+	orasoci "oras.land/oras-go/v2/content/oci"
+)
+
+// ProfileCommand runs a container of an image once, records the files it reads while starting,
+// and attaches them to the SOCI index of the image as a prefetch list.
+var ProfileCommand = cli.Command{
+	Name:      "profile",
+	Usage:     "record the files read when a container starts, and attach them to the SOCI index as a prefetch list",
+	ArgsUsage: "[flags] <image_ref> [<command> [<args>...]]",
+	Description: `Run a container of the image with the soci snapshotter, record the files and spans its startup reads,
+and write a new SOCI index with a prefetch list of these spans. The snapshotter fetches the spans of the
+prefetch list before the others when it mounts the image with the new index.
+
+The image is pulled into a temporary namespace, so that its layers are mounted afresh, and removed afterwards.
+The container is killed once --duration has elapsed, unless it exits before.
+Signatures of the original index don't apply to the new one.
+`,
+	Flags: append(commands.RegistryFlags,
+		cli.DurationFlag{
+			Name:  "duration",
+			Usage: "how long to run the container for",
+			Value: 30 * time.Second,
+		},
+		cli.StringFlag{
+			Name:  "soci-index-digest",
+			Usage: "The SOCI index to attach the prefetch list to. Default is the SOCI index of the image in the local store",
+		},
+		cli.StringFlag{
+			Name:  "snapshotter",
+			Usage: "The name of the soci snapshotter in containerd",
+			Value: "soci",
+		},
+	),
+	Action: func(cliContext *cli.Context) error {
+		ref := cliContext.Args().First()
+		if ref == "" {
+			return errors.New("image needs to be specified")
+		}
+		args := cliContext.Args().Tail()
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		indexDigest, err := profiledIndexDigest(ctx, cliContext, client, ref)
+		if err != nil {
+			return err
+		}
+		store, err := orasoci.New(config.SociContentStorePath)
+		if err != nil {
+			return fmt.Errorf("cannot create local content store: %w", err)
+		}
+		index, err := soci.ReadSociIndex(ctx, indexDigest, store)
+		if err != nil {
+			return fmt.Errorf("cannot read SOCI index %s: %w", indexDigest, err)
+		}
+
+		profileID := strconv.FormatInt(time.Now().UnixNano(), 10)
+		profileDir := filepath.Join(config.SociProfilesPath, profileID)
+		defer os.RemoveAll(profileDir)
+
+		// the layers are mounted afresh in a temporary namespace, even if the image is already mounted
+		ns := "soci-profile-" + profileID
+		nsCtx := namespaces.WithNamespace(ctx, ns)
+		defer func() {
+			if err := client.NamespaceService().Delete(ctx, ns); err != nil {
+				log.G(ctx).WithError(err).Warnf("cannot remove temporary namespace %s", ns)
+			}
+		}()
+
+		fmt.Printf("pulling %s with SOCI index %s\n", ref, indexDigest)
+		resolver, err := commands.GetResolver(nsCtx, cliContext)
+		if err != nil {
+			return err
+		}
+		img, err := client.Pull(nsCtx, ref,
+			containerd.WithResolver(resolver),
+			containerd.WithPullUnpack,
+			containerd.WithPullSnapshotter(cliContext.String("snapshotter")),
+			containerd.WithImageHandlerWrapper(profileLabelsHandlerWrapper(ref, indexDigest.String(), profileID)),
+		)
+		if err != nil {
+			return fmt.Errorf("cannot pull %s: %w", ref, err)
+		}
+		defer func() {
+			if err := client.ImageService().Delete(nsCtx, img.Name(), images.SynchronousDelete()); err != nil {
+				log.G(ctx).WithError(err).Warnf("cannot remove image %s from temporary namespace", img.Name())
+			}
+		}()
+
+		if err := runProfiledContainer(nsCtx, client, img, profileID, cliContext.String("snapshotter"), args, cliContext.Duration("duration")); err != nil {
+			return err
+		}
+
+		list, err := buildPrefetchList(nsCtx, client, index, store, profileDir)
+		if err != nil {
+			return err
+		}
+		if len(list.Layers) == 0 {
+			return errors.New("no file access was recorded; check that the image was lazily loaded by the soci snapshotter")
+		}
+		for _, l := range list.Layers {
+			fmt.Printf("layer %s: %d files, %d spans\n", l.Digest, len(l.Files), len(l.Spans))
+		}
+		newDigest, err := soci.AddPrefetchList(ctx, indexDigest, list, store)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("SOCI index with prefetch list: %s\n", newDigest)
+		return nil
+	},
+}
+
+// profiledIndexDigest returns the digest of the SOCI index given with --soci-index-digest, or the digest of
+// the SOCI index built for the image in containerd, e.g. by "soci create".
+func profiledIndexDigest(ctx context.Context, cliContext *cli.Context, client *containerd.Client, ref string) (digest.Digest, error) {
+	if d := cliContext.String("soci-index-digest"); d != "" {
+		return digest.Parse(d)
+	}
+	img, err := client.ImageService().Get(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("cannot find the SOCI index of %s; use --soci-index-digest: %w", ref, err)
+	}
+	descs, err := soci.GetIndexDescriptorCollection(ctx, client.ContentStore(), img, nil)
+	if err != nil {
+		return "", err
+	}
+	switch len(descs) {
+	case 0:
+		return "", fmt.Errorf("no SOCI index found for %s; create one with \"soci create\" or use --soci-index-digest", ref)
+	case 1:
+		return descs[0].Digest, nil
+	default:
+		return "", fmt.Errorf("%d SOCI indices found for %s; choose one with --soci-index-digest", len(descs), ref)
+	}
+}
+
+// profileLabelsHandlerWrapper appends the labels of source.AppendDefaultLabelsHandlerWrapper to the layers
+// of the image, and the label which makes the snapshotter record the accesses to their files into the profile `profileID`.
+func profileLabelsHandlerWrapper(ref, indexDigest, profileID string) func(images.Handler) images.Handler {
+	appendDefaultLabels := source.AppendDefaultLabelsHandlerWrapper(ref, indexDigest)
+	return func(f images.Handler) images.Handler {
+		h := appendDefaultLabels(f)
+		return images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+			children, err := h.Handle(ctx, desc)
+			if err != nil {
+				return nil, err
+			}
+			for i := range children {
+				c := &children[i]
+				if images.IsLayerType(c.MediaType) {
+					if c.Annotations == nil {
+						c.Annotations = make(map[string]string)
+					}
+					c.Annotations[source.TargetSociProfileLabel] = profileID
+				}
+			}
+			return children, nil
+		})
+	}
+}
+
+// runProfiledContainer runs a container of `img` until it exits or `duration` has elapsed, then removes it.
+func runProfiledContainer(ctx context.Context, client *containerd.Client, img containerd.Image, id, snapshotter string, args []string, duration time.Duration) error {
+	container, err := client.NewContainer(ctx, id,
+		containerd.WithSnapshotter(snapshotter),
+		containerd.WithNewSnapshot(id, img),
+		containerd.WithNewSpec(oci.WithImageConfigArgs(img, args)),
+	)
+	if err != nil {
+		return fmt.Errorf("cannot create container: %w", err)
+	}
+	defer container.Delete(ctx, containerd.WithSnapshotCleanup)
+
+	task, err := container.NewTask(ctx, cio.NullIO)
+	if err != nil {
+		return fmt.Errorf("cannot create task: %w", err)
+	}
+	defer task.Delete(ctx, containerd.WithProcessKill)
+
+	statusC, err := task.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("running container for up to %s\n", duration)
+	if err := task.Start(ctx); err != nil {
+		return fmt.Errorf("cannot start task: %w", err)
+	}
+	select {
+	case status := <-statusC:
+		fmt.Printf("container exited with status %d\n", status.ExitCode())
+	case <-time.After(duration):
+		if err := task.Kill(ctx, syscall.SIGKILL); err != nil {
+			return fmt.Errorf("cannot kill task: %w", err)
+		}
+		<-statusC
+	}
+	return nil
+}
+
+// buildPrefetchList maps the accesses recorded in `profileDir` for the layers of the image of `index` to the spans of their ztocs.
+func buildPrefetchList(ctx context.Context, client *containerd.Client, index *soci.SociIndex, store *orasoci.Store, profileDir string) (*soci.PrefetchList, error) {
+	manifest, err := images.Manifest(ctx, client.ContentStore(), index.Subject, platforms.All)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read image manifest %s: %w", index.Subject.Digest, err)
+	}
+	ztocs := make(map[string]ocispec.Descriptor)
+	for _, blob := range index.Blobs {
+		if blob != nil && blob.MediaType == soci.SociLayerMediaType {
+			ztocs[blob.Annotations[soci.IndexAnnotationImageLayerDigest]] = *blob
+		}
+	}
+
+	list := &soci.PrefetchList{}
+	for _, l := range manifest.Layers {
+		ztocDesc, ok := ztocs[l.Digest.String()]
+		if !ok {
+			continue
+		}
+		f, err := os.Open(filepath.Join(profileDir, l.Digest.Encoded()))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		accesses, err := soci.ReadFileAccesses(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the profile of layer %s: %w", l.Digest, err)
+		}
+		if len(accesses) == 0 {
+			continue
+		}
+		ztoc, err := readZtoc(ctx, store, ztocDesc)
+		if err != nil {
+			return nil, err
+		}
+		layer, err := soci.NewPrefetchLayer(l.Digest, ztoc, accesses)
+		if err != nil {
+			return nil, fmt.Errorf("cannot build the prefetch list of layer %s: %w", l.Digest, err)
+		}
+		list.Layers = append(list.Layers, layer)
+	}
+	return list, nil
+}
+
+func readZtoc(ctx context.Context, store *orasoci.Store, desc ocispec.Descriptor) (*soci.Ztoc, error) {
+	rc, err := store.Fetch(ctx, desc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch ztoc %s: %w", desc.Digest, err)
+	}
+	defer rc.Close()
+	return soci.GetZtoc(rc)
+}
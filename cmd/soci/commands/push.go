@@ -24,6 +24,7 @@ import (
 	"github.com/awslabs/soci-snapshotter/fs/config"
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/containerd/reference"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli"
@@ -39,16 +40,31 @@ var PushCommand = cli.Command{
 	Usage:     "push SOCI artifacts to a registry",
 	ArgsUsage: "[flags] <ref>",
 	Description: `Push SOCI artifacts to a registry by image reference.
-If multiple soci indices exist for the given image, the most recent one will be pushed.
+If multiple soci indices exist for the given image and platform, the most recent one will be pushed.
+By default, only the index for the platform of the host is pushed.
 
 After pushing the soci artifacts, they should be available in the registry. Soci artifacts will be pushed only
-if they are available in the snapshotter's local content store.
+if they are available in the snapshotter's local content store. The indices are referrers of the image, which is
+how the snapshotter discovers them. The signatures of the pushed indices created by
+"soci index sign" are pushed as well.
 `,
 	Flags: append(append(append(commands.RegistryFlags, commands.LabelFlag), commands.SnapshotterFlags...),
 		cli.Uint64Flag{
 			Name:  "max-concurrent-uploads",
 			Usage: "Max concurrent uploads. Default is 10",
 			Value: 10,
+		},
+		cli.StringSliceFlag{
+			Name:  "platform, p",
+			Usage: "Push SOCI index for a specific platform. Can be specified multiple times. Default is the platform of the host",
+		},
+		cli.BoolFlag{
+			Name:  "all-platforms",
+			Usage: "Push SOCI indices for all platforms of the image",
+		},
+		cli.BoolFlag{
+			Name:  "remote",
+			Usage: "Read the image from the registry instead of containerd, e.g. after \"soci create --remote\"",
 		}),
 	Action: func(cliContext *cli.Context) error {
 		ref := cliContext.Args().First()
@@ -56,25 +72,31 @@ if they are available in the snapshotter's local content store.
 			return fmt.Errorf("please provide an image reference to push")
 		}
 
-		client, ctx, cancel, err := commands.NewClient(cliContext)
+		ctx, cs, img, cancel, err := getImage(cliContext, ref)
 		if err != nil {
 			return err
 		}
 		defer cancel()
 
-		cs := client.ContentStore()
-		is := client.ImageService()
-		img, err := is.Get(ctx, ref)
+		ps, err := getImagePlatforms(ctx, cliContext, cs, img)
 		if err != nil {
 			return err
 		}
 
-		indexDescriptors, err := soci.GetIndexDescriptorCollection(ctx, cs, img)
-		if err != nil {
-			return err
+		var indexDescs []ocispec.Descriptor
+		for _, plat := range ps {
+			indexDescriptors, err := soci.GetIndexDescriptorCollection(ctx, cs, img, []ocispec.Platform{plat})
+			if err != nil {
+				return err
+			}
+			if len(indexDescriptors) == 0 {
+				fmt.Printf("could not find any soci indices for platform %s\n", platforms.Format(plat))
+				continue
+			}
+			indexDescs = append(indexDescs, indexDescriptors[len(indexDescriptors)-1])
 		}
 
-		if len(indexDescriptors) == 0 {
+		if len(indexDescs) == 0 {
 			return fmt.Errorf("could not find any soci indices to push")
 		}
 
@@ -90,7 +112,6 @@ if they are available in the snapshotter's local content store.
 			return fmt.Errorf("cannot create OCI local store: %w", err)
 		}
 
-		indexDesc := indexDescriptors[len(indexDescriptors)-1]
 		refspec, err := reference.Parse(ref)
 		if err != nil {
 			return err
@@ -123,9 +144,35 @@ if they are available in the snapshotter's local content store.
 			return nil
 		}
 
-		err = oraslib.CopyGraph(context.Background(), src, dst, indexDesc, options)
-		if err != nil {
-			return fmt.Errorf("error pushing graph to remote: %w", err)
+		for _, indexDesc := range indexDescs {
+			err = oraslib.CopyGraph(context.Background(), src, dst, indexDesc, options)
+			if err != nil {
+				return fmt.Errorf("error pushing graph to remote: %w", err)
+			}
+			index, err := soci.ReadSociIndex(ctx, indexDesc.Digest, src)
+			if err != nil {
+				return err
+			}
+			// registries without the referrers API only list the index as a referrer of the image through the referrers tag
+			err = soci.AddReferrerToTagSchema(ctx, dst, index.Subject.Digest, soci.Referrer{Descriptor: indexDesc, ArtifactType: soci.SociIndexArtifactType})
+			if err != nil {
+				return fmt.Errorf("error adding index to the referrers of the image: %w", err)
+			}
+
+			signatureDescs, err := soci.GetSignatureDescriptors(indexDesc.Digest)
+			if err != nil {
+				return err
+			}
+			for _, signatureDesc := range signatureDescs {
+				err = oraslib.CopyGraph(context.Background(), src, dst, signatureDesc, options)
+				if err != nil {
+					return fmt.Errorf("error pushing signature to remote: %w", err)
+				}
+				err = soci.AddReferrerToTagSchema(ctx, dst, indexDesc.Digest, soci.Referrer{Descriptor: signatureDesc, ArtifactType: soci.SociSignatureArtifactType})
+				if err != nil {
+					return fmt.Errorf("error adding signature to the referrers of the index: %w", err)
+				}
+			}
 		}
 
 		return nil
@@ -0,0 +1,173 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/fs/remote"
+	"github.com/awslabs/soci-snapshotter/service/keychain/dockerconfig"
+	"github.com/awslabs/soci-snapshotter/service/resolver"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+var getFileCommand = cli.Command{
+	Name:      "get-file",
+	Usage:     "extract a file from a layer using its ztoc",
+	ArgsUsage: "[flags] <ztoc-digest> <path>",
+	Description: `Extract a single file from an image layer, only reading the parts of the layer
+holding the file according to the ztoc.
+
+The layer is read from the content store of containerd, or with --remote, fetched
+from the registry of an image with ranged requests, using the credentials of the
+docker config.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "path to write the file to, instead of stdout",
+		},
+		cli.StringFlag{
+			Name:  "remote",
+			Usage: "reference of an image in a registry to fetch the layer from",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		ztocDigest, err := digest.Parse(cliContext.Args().Get(0))
+		if err != nil {
+			return err
+		}
+		path := cliContext.Args().Get(1)
+		if path == "" {
+			return fmt.Errorf("please provide the path of a file in the layer")
+		}
+
+		layerDigest, err := ztocLayerDigest(ztocDigest)
+		if err != nil {
+			return err
+		}
+		ztoc, err := readLocalZtoc(cliContext, ztocDigest)
+		if err != nil {
+			return err
+		}
+		layerDesc := ocispec.Descriptor{Digest: layerDigest, Size: int64(ztoc.CompressedFileSize)}
+
+		var (
+			layer   *io.SectionReader
+			closeFn func() error
+		)
+		if ref := cliContext.String("remote"); ref != "" {
+			ctx, cancel := commands.AppContext(cliContext)
+			defer cancel()
+			layer, closeFn, err = openRemoteLayer(ctx, ref, layerDesc)
+		} else {
+			client, ctx, cancel, cerr := commands.NewClient(cliContext)
+			if cerr != nil {
+				return cerr
+			}
+			defer cancel()
+			ra, rerr := client.ContentStore().ReaderAt(ctx, layerDesc)
+			if rerr != nil {
+				return fmt.Errorf("cannot read layer %s from the content store: %w", layerDigest, rerr)
+			}
+			layer, closeFn = io.NewSectionReader(ra, 0, ra.Size()), ra.Close
+		}
+		if err != nil {
+			return err
+		}
+		defer closeFn()
+
+		contents, err := soci.ExtractFileByName(layer, ztoc, path)
+		if err != nil {
+			return err
+		}
+		if output := cliContext.String("output"); output != "" {
+			return os.WriteFile(output, contents, 0644)
+		}
+		_, err = os.Stdout.Write(contents)
+		return err
+	},
+}
+
+// readLocalZtoc reads a ztoc from the local content store.
+func readLocalZtoc(cliContext *cli.Context, ztocDigest digest.Digest) (*soci.Ztoc, error) {
+	storage, err := oci.New(config.SociContentStorePath)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cliContext.GlobalDuration("timeout"))
+	defer cancel()
+	reader, err := storage.Fetch(ctx, ocispec.Descriptor{Digest: ztocDigest})
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return soci.GetZtoc(reader)
+}
+
+// ztocLayerDigest returns the digest of the layer of a ztoc, as recorded in the artifacts db.
+func ztocLayerDigest(ztocDigest digest.Digest) (digest.Digest, error) {
+	db, err := soci.NewDB()
+	if err != nil {
+		return "", err
+	}
+	entry, err := db.GetArtifactEntry(ztocDigest.String())
+	if err != nil {
+		return "", err
+	}
+	if entry.Type != soci.ArtifactEntryTypeLayer {
+		return "", fmt.Errorf("%s is not a ztoc, but a %s", ztocDigest, entry.Type)
+	}
+	layerDigest, err := digest.Parse(entry.OriginalDigest)
+	if err != nil {
+		return "", fmt.Errorf("invalid layer digest of ztoc %s: %w", ztocDigest, err)
+	}
+	return layerDigest, nil
+}
+
+// openRemoteLayer returns a reader of the layer `desc` of the image `ref`, which fetches the
+// requested ranges of the layer from the registry.
+func openRemoteLayer(ctx context.Context, ref string, desc ocispec.Descriptor) (*io.SectionReader, func() error, error) {
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot parse image ref (%s): %w", ref, err)
+	}
+	hosts := resolver.RegistryHostsFromConfig(resolver.Config{}, dockerconfig.NewDockerConfigKeychain(ctx))
+	blob, err := remote.NewResolver(config.BlobConfig{}, nil).Resolve(ctx, hosts, refspec, desc, cache.NewMemoryCache())
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot resolve layer %s of %s: %w", desc.Digest, ref, err)
+	}
+	sr := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (int, error) {
+		return blob.ReadAt(p, offset)
+	}), 0, blob.Size())
+	return sr, blob.Close, nil
+}
+
+type readerAtFunc func([]byte, int64) (int, error)
+
+func (f readerAtFunc) ReadAt(p []byte, offset int64) (int, error) { return f(p, offset) }
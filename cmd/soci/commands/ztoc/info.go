@@ -52,8 +52,22 @@ var infoCommand = cli.Command{
 		if err != nil {
 			return err
 		}
+		compressionAlgo := ztoc.CompressionAlgorithm
+		if compressionAlgo == "" {
+			compressionAlgo = soci.CompressionGzip
+		}
+		checkpointsSize, uncompressedCheckpointsSize, err := ztoc.CheckpointsSize()
+		if err != nil {
+			return err
+		}
 		fmt.Printf("version: %s\n", ztoc.Version)
-		fmt.Printf("build tool: %s\n\n\n", ztoc.BuildToolIdentifier)
+		fmt.Printf("build tool: %s\n", ztoc.BuildToolIdentifier)
+		fmt.Printf("compression: %s\n", compressionAlgo)
+		fmt.Printf("checkpoints size: %d bytes\n", checkpointsSize)
+		if saved := uncompressedCheckpointsSize - checkpointsSize; saved > 0 {
+			fmt.Printf("checkpoints size saved: %d bytes (%.1f%%)\n", saved, 100*float64(saved)/float64(uncompressedCheckpointsSize))
+		}
+		fmt.Printf("\n\n")
 
 		for _, v := range ztoc.Metadata {
 			fmt.Printf("filename: %s, offset: %d, size: %d, span_start: %d, span_end: %d\n", v.Name, v.UncompressedOffset, v.UncompressedSize, v.SpanStart, v.SpanEnd)
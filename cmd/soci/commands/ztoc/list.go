@@ -0,0 +1,119 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands"
+	"github.com/awslabs/soci-snapshotter/soci"
+	ctrcommands "github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli"
+)
+
+var listCommand = cli.Command{
+	Name:  "list",
+	Usage: "list ztocs",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "image-ref",
+			Usage: "filter ztocs to those of the layers of a specific image ref",
+		},
+		cli.StringFlag{
+			Name:  "layer",
+			Usage: "filter ztocs to those of a specific layer digest",
+		},
+		commands.FormatFlag,
+	},
+	Action: func(cliContext *cli.Context) error {
+		format, err := commands.OutputFormat(cliContext)
+		if err != nil {
+			return err
+		}
+
+		// layers is the set of layer digests to list the ztocs of, or nil to list all ztocs
+		var layers map[string]struct{}
+		if l := cliContext.String("layer"); l != "" {
+			layerDigest, err := digest.Parse(l)
+			if err != nil {
+				return err
+			}
+			layers = map[string]struct{}{layerDigest.String(): {}}
+		}
+		if ref := cliContext.String("image-ref"); ref != "" {
+			client, ctx, cancel, err := ctrcommands.NewClient(cliContext)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+			img, err := client.ImageService().Get(ctx, ref)
+			if err != nil {
+				return err
+			}
+			cs := client.ContentStore()
+			manifestDesc, err := soci.GetImageManifestDescriptor(ctx, cs, img, platforms.Default())
+			if err != nil {
+				return err
+			}
+			manifest, err := images.Manifest(ctx, cs, *manifestDesc, platforms.Default())
+			if err != nil {
+				return err
+			}
+			imageLayers := make(map[string]struct{})
+			for _, desc := range manifest.Layers {
+				if _, ok := layers[desc.Digest.String()]; layers == nil || ok {
+					imageLayers[desc.Digest.String()] = struct{}{}
+				}
+			}
+			layers = imageLayers
+		}
+
+		db, err := soci.NewDB()
+		if err != nil {
+			return err
+		}
+		ztocs := []*soci.ArtifactEntry{}
+		err = db.Walk(func(ae *soci.ArtifactEntry) error {
+			if ae.Type != soci.ArtifactEntryTypeLayer {
+				return nil
+			}
+			if _, ok := layers[ae.OriginalDigest]; layers == nil || ok {
+				ztocs = append(ztocs, ae)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if format == commands.FormatJSON {
+			return commands.PrintJSON(ztocs)
+		}
+		writer := tabwriter.NewWriter(os.Stdout, 8, 8, 4, ' ', 0)
+		writer.Write([]byte("DIGEST\tSIZE\tLAYER DIGEST\t\n"))
+		for _, ae := range ztocs {
+			writer.Write([]byte(fmt.Sprintf("%s\t%d\t%s\t\n", ae.Digest, ae.Size, ae.OriginalDigest)))
+		}
+		writer.Flush()
+		return nil
+	},
+}
@@ -0,0 +1,89 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+)
+
+var verifyCommand = cli.Command{
+	Name:      "verify",
+	Usage:     "verify that a ztoc matches its layer",
+	ArgsUsage: "[flags] <ztoc-digest>",
+	Description: `Verify a ztoc of the local content store against its layer in the content store of containerd.
+The digests of the spans are recomputed, and every file of the ztoc is compared with the
+layer read as a stream, including the contents of regular files extracted through the ztoc.
+
+The command fails if any difference is found.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "layer",
+			Usage: "digest of the layer to verify the ztoc against, instead of the layer the ztoc was built for",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		ztocDigest, err := digest.Parse(cliContext.Args().First())
+		if err != nil {
+			return err
+		}
+		var layerDigest digest.Digest
+		if l := cliContext.String("layer"); l != "" {
+			layerDigest, err = digest.Parse(l)
+		} else {
+			layerDigest, err = ztocLayerDigest(ztocDigest)
+		}
+		if err != nil {
+			return err
+		}
+		ztoc, err := readLocalZtoc(cliContext, ztocDigest)
+		if err != nil {
+			return err
+		}
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		ra, err := client.ContentStore().ReaderAt(ctx, ocispec.Descriptor{Digest: layerDigest})
+		if err != nil {
+			return fmt.Errorf("cannot read layer %s from the content store: %w", layerDigest, err)
+		}
+		defer ra.Close()
+
+		mismatches, err := soci.VerifyZtoc(ztoc, io.NewSectionReader(ra, 0, ra.Size()))
+		if err != nil {
+			return err
+		}
+		for _, m := range mismatches {
+			fmt.Println(m)
+		}
+		if len(mismatches) > 0 {
+			return fmt.Errorf("ztoc %s doesn't match layer %s: %d differences found", ztocDigest, layerDigest, len(mismatches))
+		}
+		fmt.Printf("ztoc %s matches layer %s\n", ztocDigest, layerDigest)
+		return nil
+	},
+}
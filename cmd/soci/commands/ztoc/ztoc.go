@@ -23,5 +23,8 @@ var Command = cli.Command{
 	Usage: "manage ztocs",
 	Subcommands: []cli.Command{
 		infoCommand,
+		listCommand,
+		getFileCommand,
+		verifyCommand,
 	},
 }
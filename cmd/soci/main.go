@@ -79,6 +79,7 @@ func main() {
 		ztoc.Command,
 		commands.CreateCommand,
 		commands.PushCommand,
+		commands.ProfileCommand,
 		run.Command,
 	}
 
@@ -67,7 +67,7 @@ func newArtifactFetcher(refspec reference.Spec, localStore, remoteStore content.
 	}, nil
 }
 
-func newRemoteStore(refspec reference.Spec) (content.Storage, error) {
+func newRemoteStore(refspec reference.Spec) (*remote.Repository, error) {
 	repo, err := remote.NewRepository(refspec.Locator)
 	if err != nil {
 		return nil, fmt.Errorf("cannot create repository %s: %w", refspec.Locator, err)
@@ -165,7 +165,32 @@ func (f *artifactFetcher) Store(ctx context.Context, desc ocispec.Descriptor, re
 	return nil
 }
 
-func FetchSociArtifacts(ctx context.Context, imageRef, indexDigest string, store content.Storage) (*soci.SociIndex, error) {
+// DiscoverSociIndices lists the SOCI indices of the image manifest `manifestDigest` in the repository of `imageRef`,
+// which are the referrers of the manifest with the SOCI index artifact type.
+func DiscoverSociIndices(ctx context.Context, imageRef string, manifestDigest digest.Digest) ([]ocispec.Descriptor, error) {
+	refspec, err := reference.Parse(imageRef)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse image ref (%s): %w", imageRef, err)
+	}
+	remoteStore, err := newRemoteStore(refspec)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create remote store: %w", err)
+	}
+	referrers, err := soci.GetReferrers(ctx, remoteStore, manifestDigest, soci.SociIndexArtifactType)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list the referrers of image manifest %s: %w", manifestDigest, err)
+	}
+	var indices []ocispec.Descriptor
+	for _, r := range referrers {
+		indices = append(indices, r.Descriptor)
+	}
+	return indices, nil
+}
+
+// FetchSociArtifacts fetches the SOCI index and its ztocs, from the local store if they are there and otherwise
+// from the remote repository of the image. If `verifier` isn't nil, the index is rejected unless it's signed by
+// one of the keys of the verifier.
+func FetchSociArtifacts(ctx context.Context, imageRef, indexDigest string, store content.Storage, verifier *soci.IndexVerifier) (*soci.SociIndex, error) {
 	refspec, err := reference.Parse(imageRef)
 	if err != nil {
 		return nil, fmt.Errorf("cannot parse image ref (%s): %w", imageRef, err)
@@ -199,6 +224,11 @@ func FetchSociArtifacts(ctx context.Context, imageRef, indexDigest string, store
 		return nil, err
 	}
 	indexBytes := buffer.Bytes()
+	if verifier != nil {
+		if err := verifyIndex(ctx, verifier, dgst, indexBytes, store, remoteStore); err != nil {
+			return nil, err
+		}
+	}
 	if err := json.Unmarshal(indexBytes, &index); err != nil {
 		return nil, err
 	}
@@ -240,3 +270,35 @@ func FetchSociArtifacts(ctx context.Context, imageRef, indexDigest string, store
 
 	return &index, nil
 }
+
+// verifyIndex verifies the signatures of the SOCI index. The signatures in the local store are checked first,
+// then the signatures among the referrers of the index in the remote repository.
+func verifyIndex(ctx context.Context, verifier *soci.IndexVerifier, indexDigest digest.Digest, indexBytes []byte, localStore content.Storage, remoteStore *remote.Repository) error {
+	localSignatures, err := soci.GetSignatureDescriptors(indexDigest)
+	if err != nil {
+		log.G(ctx).WithError(err).Debug("cannot get local signatures of SOCI index")
+	}
+	if len(localSignatures) > 0 {
+		keyID, err := verifier.Verify(ctx, indexBytes, localSignatures, localStore)
+		if err == nil {
+			log.G(ctx).WithField("digest", indexDigest).WithField("key", keyID).Info("verified SOCI index signature")
+			return nil
+		}
+		log.G(ctx).WithError(err).Debug("no valid local signature of SOCI index")
+	}
+
+	referrers, err := soci.GetReferrers(ctx, remoteStore, indexDigest, soci.SociSignatureArtifactType)
+	if err != nil {
+		return fmt.Errorf("cannot list the signatures of SOCI index %s: %w", indexDigest, err)
+	}
+	var remoteSignatures []ocispec.Descriptor
+	for _, r := range referrers {
+		remoteSignatures = append(remoteSignatures, r.Descriptor)
+	}
+	keyID, err := verifier.Verify(ctx, indexBytes, remoteSignatures, remoteStore)
+	if err != nil {
+		return err
+	}
+	log.G(ctx).WithField("digest", indexDigest).WithField("key", keyID).Info("verified SOCI index signature")
+	return nil
+}
@@ -53,12 +53,16 @@ const (
 
 	// Default path to snapshotter root dir
 	SociSnapshotterRootPath = "/var/lib/soci-snapshotter-grpc/"
+
+	// Default path to the profiles of the file accesses recorded for `soci profile`
+	SociProfilesPath = "/var/lib/soci-snapshotter-grpc/profiles/"
 )
 
 type Config struct {
 	HTTPCacheType       string `toml:"http_cache_type"`
 	FSCacheType         string `toml:"filesystem_cache_type"`
 	ResolveResultEntry  int    `toml:"resolve_result_entry"`
+	IndexCacheEntry     int    `toml:"index_cache_entry"`
 	NoBackgroundFetch   bool   `toml:"no_background_fetch"`
 	Debug               bool   `toml:"debug"`
 	AllowNoVerification bool   `toml:"allow_no_verification"`
@@ -73,6 +77,15 @@ type Config struct {
 	DirectoryCacheConfig `toml:"directory_cache"`
 
 	FuseConfig `toml:"fuse"`
+
+	// SignatureConfig is config for verifying the signatures of SOCI indices.
+	SignatureConfig `toml:"signature"`
+
+	// PrefetchConfig is config for the order of background fetch.
+	PrefetchConfig `toml:"prefetch"`
+
+	// ReadaheadConfig is config for fetching spans ahead of sequential reads of files.
+	ReadaheadConfig `toml:"readahead"`
 }
 
 type BlobConfig struct {
@@ -93,6 +106,26 @@ type DirectoryCacheConfig struct {
 	MaxCacheFds      int  `toml:"max_cache_fds"`
 	SyncAdd          bool `toml:"sync_add"`
 	Direct           bool `toml:"direct" default:"true"`
+
+	// MaxDiskSize is the maximum size in bytes of the entries on disk of all the HTTP caches.
+	// Once it's exceeded, entries which aren't being read are evicted. 0 means unlimited.
+	MaxDiskSize int64 `toml:"max_disk_size"`
+
+	// MaxSpanCacheSize is the maximum size in bytes of the span cache shared by all the layers, which is
+	// kept on disk across restarts, or in memory if filesystem_cache_type is "memory".
+	// 0 means 10 GiB on disk and 1 GiB in memory.
+	MaxSpanCacheSize int64 `toml:"max_span_cache_size"`
+
+	// EvictionPolicy chooses the entries evicted once MaxDiskSize or MaxSpanCacheSize is exceeded:
+	// "lru" (default) or "lfu". The span cache in memory always evicts the least recently used entries.
+	EvictionPolicy string `toml:"eviction_policy"`
+
+	// VerifyHTTPCache stores a checksum with each entry of the HTTP caches. Entries which don't
+	// match their checksum when they're read from disk are treated as missing and fetched again.
+	VerifyHTTPCache bool `toml:"verify_http_cache"`
+
+	// VerifySpanCache stores a checksum with each entry of the span cache, like VerifyHTTPCache.
+	VerifySpanCache bool `toml:"verify_span_cache"`
 }
 
 type FuseConfig struct {
@@ -102,3 +135,35 @@ type FuseConfig struct {
 	// EntryTimeout defines TTL for directory, name lookup in seconds.
 	EntryTimeout int64 `toml:"entry_timeout"`
 }
+
+type SignatureConfig struct {
+	// RequireSignedIndex rejects SOCI indices which aren't signed by one of the keys in PublicKeys.
+	RequireSignedIndex bool `toml:"require_signed_index"`
+
+	// PublicKeys are the paths to the PEM-encoded ECDSA or ed25519 public keys trusted to sign SOCI indices.
+	PublicKeys []string `toml:"public_keys"`
+}
+
+type PrefetchConfig struct {
+	// Priority lists the spans and files fetched first in background for every layer. Each entry is
+	// either a span ID or the absolute path of a file of the layer. Entries which don't match a layer are ignored.
+	Priority []string `toml:"priority"`
+
+	// LayerPriority lists the spans and files fetched first in background for the layer of the digest
+	// key, before the ones of Priority.
+	LayerPriority map[string][]string `toml:"layer_priority"`
+}
+
+type ReadaheadConfig struct {
+	// MaxSpans is the maximum number of spans fetched ahead of the sequential reads of an open file.
+	// 0 disables readahead.
+	MaxSpans int `toml:"max_spans"`
+
+	// InitialSpans is the number of spans fetched ahead once the reads of an open file look sequential.
+	// It doubles every time the reads catch up with the spans fetched ahead, up to MaxSpans (default: 1).
+	InitialSpans int `toml:"initial_spans"`
+
+	// SequentialReads is the number of consecutive sequential reads of an open file which make it
+	// read ahead (default: 2).
+	SequentialReads int `toml:"sequential_reads"`
+}
@@ -44,8 +44,10 @@ package fs
 
 import (
 	"context"
+	"crypto"
 	"fmt"
 	"os/exec"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -66,6 +68,7 @@ import (
 	metrics "github.com/docker/go-metrics"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	orascontent "oras.land/oras-go/v2/content"
@@ -142,6 +145,19 @@ func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snapshot.F
 		return nil, fmt.Errorf("cannot create local store: %w", err)
 	}
 
+	var indexVerifier *soci.IndexVerifier
+	if cfg.RequireSignedIndex {
+		indexVerifier, err = newIndexVerifier(cfg.SignatureConfig)
+		if err != nil {
+			return nil, fmt.Errorf("cannot set up SOCI index verification: %w", err)
+		}
+	}
+
+	prefetchPriority, layerPrefetchPriority, err := parsePrefetchConfig(cfg.PrefetchConfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefetch config: %w", err)
+	}
+
 	tm := task.NewBackgroundTaskManager(maxConcurrency, 5*time.Second)
 	r, err := layer.NewResolver(root, tm, cfg, fsOpts.resolveHandlers, metadataStore, store)
 	if err != nil {
@@ -157,7 +173,7 @@ func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snapshot.F
 	if ns != nil {
 		metrics.Register(ns) // Register layer metrics.
 	}
-	return &filesystem{
+	fs := &filesystem{
 		resolver:              r,
 		getSources:            getSources,
 		noBackgroundFetch:     cfg.NoBackgroundFetch,
@@ -169,9 +185,46 @@ func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snapshot.F
 		metricsController:     c,
 		attrTimeout:           attrTimeout,
 		entryTimeout:          entryTimeout,
-		imageLayerToSociDesc:  make(map[string]ocispec.Descriptor),
+		indexRefs:             make(map[string]func()),
 		orasStore:             store,
-	}, nil
+		indexVerifier:         indexVerifier,
+		profilesDir:           config.SociProfilesPath,
+		profiles:              make(map[string]*profileRecorder),
+		prefetchPriority:      prefetchPriority,
+		layerPrefetchPriority: layerPrefetchPriority,
+	}
+	fs.indices = newIndexCache(cfg.IndexCacheEntry, fs.loadSociIndex)
+	return fs, nil
+}
+
+func newIndexVerifier(cfg config.SignatureConfig) (*soci.IndexVerifier, error) {
+	var keys []crypto.PublicKey
+	for _, path := range cfg.PublicKeys {
+		key, err := soci.LoadPublicKey(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return soci.NewIndexVerifier(keys...)
+}
+
+func parsePrefetchConfig(cfg config.PrefetchConfig) ([]layer.PrefetchPriority, map[digest.Digest][]layer.PrefetchPriority, error) {
+	priority, err := layer.ParsePrefetchPriorities(cfg.Priority)
+	if err != nil {
+		return nil, nil, err
+	}
+	layerPriority := make(map[digest.Digest][]layer.PrefetchPriority)
+	for d, entries := range cfg.LayerPriority {
+		layerDigest, err := digest.Parse(d)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid layer digest %q: %w", d, err)
+		}
+		if layerPriority[layerDigest], err = layer.ParsePrefetchPriorities(entries); err != nil {
+			return nil, nil, fmt.Errorf("layer %s: %w", d, err)
+		}
+	}
+	return priority, layerPriority, nil
 }
 
 type filesystem struct {
@@ -187,33 +240,69 @@ type filesystem struct {
 	metricsController     *layermetrics.Controller
 	attrTimeout           time.Duration
 	entryTimeout          time.Duration
-	sociIndex             *soci.SociIndex
-	imageLayerToSociDesc  map[string]ocispec.Descriptor
-	loadIndexOnce         sync.Once
-	orasStore             orascontent.Storage
+	// indices are the SOCI indices of the mounted images.
+	indices *indexCache
+	// indexRefs releases the index used by each mountpoint. It's guarded by layerMu.
+	indexRefs map[string]func()
+	orasStore orascontent.Storage
+	// indexVerifier verifies the signatures of SOCI indices. It's nil if signatures aren't required.
+	indexVerifier *soci.IndexVerifier
+	// profilesDir is the directory of the profiles recorded for mounts labeled with a profile ID.
+	profilesDir string
+	// profiles are the recorders of the mountpoints being profiled. It's guarded by layerMu.
+	profiles map[string]*profileRecorder
+	// prefetchPriority are the spans and files fetched first in background for every layer.
+	prefetchPriority []layer.PrefetchPriority
+	// layerPrefetchPriority are the spans and files fetched first in background for specific layers.
+	layerPrefetchPriority map[digest.Digest][]layer.PrefetchPriority
+}
+
+// Close releases the resources shared by the mounted layers, e.g. the span cache.
+func (fs *filesystem) Close() error {
+	return fs.resolver.Close()
 }
 
-func (fs *filesystem) fetchSociArtifacts(ctx context.Context, imageRef, indexDigest string) error {
+// loadSociIndex loads the SOCI index of an image, fetching it and its ztocs if they aren't in the local store.
+// If `indexDigest` is empty, the index is discovered among the referrers of the image manifest `imgManifestDigest`.
+// It returns a nil index if the image has none.
+func (fs *filesystem) loadSociIndex(ctx context.Context, imageRef, indexDigest, imgManifestDigest string) (*imageIndex, error) {
+	indexDigests := []string{indexDigest}
+	if indexDigest == "" {
+		indexDigests = nil
+		manifestDigest, err := digest.Parse(imgManifestDigest)
+		if err != nil {
+			log.G(ctx).WithError(err).Debug("no image manifest digest to discover SOCI indices with")
+			return nil, nil
+		}
+		descs, err := DiscoverSociIndices(ctx, imageRef, manifestDigest)
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("cannot discover SOCI indices")
+			return nil, nil
+		}
+		for _, desc := range descs {
+			indexDigests = append(indexDigests, desc.Digest.String())
+		}
+		log.G(ctx).WithField("image", imageRef).Debugf("discovered %d SOCI indices", len(indexDigests))
+	}
+
 	var retErr error
-	fs.loadIndexOnce.Do(func() {
-		index, err := FetchSociArtifacts(ctx, imageRef, indexDigest, fs.orasStore)
+	for _, indexDigest := range indexDigests {
+		index, err := FetchSociArtifacts(ctx, imageRef, indexDigest, fs.orasStore, fs.indexVerifier)
 		if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
 			retErr = fmt.Errorf("error trying to fetch SOCI artifacts: %w", err)
-			return
+			continue
 		}
-		fs.sociIndex = index
-		fs.populateImageLayerToSociMapping(index)
-	})
-	return retErr
-}
-
-func (fs *filesystem) populateImageLayerToSociMapping(sociIndex *soci.SociIndex) {
-	for _, desc := range sociIndex.Blobs {
-		if desc != nil {
-			ociDigest := desc.Annotations[soci.IndexAnnotationImageLayerDigest]
-			fs.imageLayerToSociDesc[ociDigest] = *desc
+		if index == nil {
+			return nil, nil
 		}
+		// the prefetch list is only a hint, the image can be mounted without it
+		prefetchList, err := soci.ReadPrefetchList(ctx, index, fs.orasStore)
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("digest", indexDigest).Warn("cannot read the prefetch list of SOCI index")
+		}
+		return newImageIndex(index, prefetchList), nil
 	}
+	return nil, retErr
 }
 
 func (fs *filesystem) MountLocal(ctx context.Context, mountpoint string, labels map[string]string) error {
@@ -264,19 +353,24 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	defer fs.backgroundTaskManager.DonePrioritizedTask()
 	ctx = log.WithLogger(ctx, log.G(ctx).WithField("mountpoint", mountpoint))
 
-	sociIndexDigest, ok := labels[source.TargetSociIndexDigestLabel]
-	if !ok {
-		return fmt.Errorf("unable to get soci index digest from labels")
-	}
 	imageRef, ok := labels[source.TargetRefLabel]
 	if !ok {
 		return fmt.Errorf("unable to get image ref from labels")
 	}
 
-	err := fs.fetchSociArtifacts(ctx, imageRef, sociIndexDigest)
+	// Without a SOCI index, only eStargz layers can be lazily loaded using their verified TOCs,
+	// and only if signed SOCI indices aren't required.
+	// If the labels don't have the digest of the index, it's discovered through the referrers of the image manifest.
+	// Each image has its own index, which is kept as long as a mountpoint uses it.
+	index, releaseIndex, err := fs.indices.get(ctx, imageRef, labels[source.TargetSociIndexDigestLabel], labels[source.TargetImgManifestDigestLabel])
 	if err != nil {
 		return fmt.Errorf("unable to fetch SOCI artifacts: %w", err)
 	}
+	defer func() {
+		if retErr != nil {
+			releaseIndex()
+		}
+	}()
 
 	// Get source information of this layer.
 	src, err := fs.getSources(labels)
@@ -286,6 +380,15 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		return fmt.Errorf("source must be passed")
 	}
 
+	// Spans and files of the target layer to fetch first, if the mount asks for some.
+	var labelPriorities []layer.PrefetchPriority
+	if p, ok := labels[source.TargetSociPrefetchPriorityLabel]; ok {
+		labelPriorities, err = layer.ParsePrefetchPriorities(strings.Split(p, ","))
+		if err != nil {
+			return fmt.Errorf("invalid label %s: %w", source.TargetSociPrefetchPriorityLabel, err)
+		}
+	}
+
 	// Resolve the target layer
 	var (
 		resultChan = make(chan layer.Layer)
@@ -294,15 +397,10 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	go func() {
 		rErr := fmt.Errorf("failed to resolve target")
 		for _, s := range src {
-			sociDesc := ocispec.Descriptor{}
-			if desc, ok := fs.imageLayerToSociDesc[s.Target.Digest.String()]; ok {
-				sociDesc = desc
-			}
-
-			l, err := fs.resolver.Resolve(ctx, s.Hosts, s.Name, s.Target, sociDesc)
+			l, err := fs.resolver.Resolve(ctx, s.Hosts, s.Name, s.Target, index.ztocDescriptor(s.Target.Digest))
 			if err == nil {
 				resultChan <- l
-				fs.backgroundFetch(ctx, l, start)
+				fs.backgroundFetch(ctx, l, start, fs.prefetchPriorities(ctx, index, s.Target.Digest, labelPriorities))
 				return
 			}
 			rErr = errors.Wrapf(rErr, "failed to resolve layer %q from %q: %v", s.Target.Digest, s.Name, err)
@@ -317,16 +415,12 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		go func() {
 			// Avoids to get canceled by client.
 			ctx := log.WithLogger(context.Background(), log.G(ctx).WithField("mountpoint", mountpoint))
-			sociDesc := ocispec.Descriptor{}
-			if descriptor, ok := fs.imageLayerToSociDesc[desc.Digest.String()]; ok {
-				sociDesc = descriptor
-			}
-			l, err := fs.resolver.Resolve(ctx, preResolve.Hosts, preResolve.Name, desc, sociDesc)
+			l, err := fs.resolver.Resolve(ctx, preResolve.Hosts, preResolve.Name, desc, index.ztocDescriptor(desc.Digest))
 			if err != nil {
 				log.G(ctx).WithError(err).Debug("failed to pre-resolve")
 				return
 			}
-			fs.backgroundFetch(ctx, l, start)
+			fs.backgroundFetch(ctx, l, start, fs.prefetchPriorities(ctx, index, desc.Digest, nil))
 
 			// Release this layer because this isn't target and we don't use it anymore here.
 			// However, this will remain on the resolver cache until eviction.
@@ -358,7 +452,24 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		log.G(ctx).Infof("Verification forcefully skipped")
 	}
 
-	node, err := l.RootNode(0)
+	// Record the accesses to the files of the layer if the mount is profiled. The recorder
+	// is passed as an interface only if it's set, since RootNode checks for nil.
+	var recorder layer.AccessRecorder
+	var profile *profileRecorder
+	if profileID, ok := labels[source.TargetSociProfileLabel]; ok {
+		profile, err = newProfileRecorder(fs.profilesDir, profileID, l.Info().Digest)
+		if err != nil {
+			return errors.Wrapf(err, "failed to record profile")
+		}
+		defer func() {
+			if retErr != nil {
+				profile.Close()
+			}
+		}()
+		recorder = profile
+	}
+
+	node, err := l.RootNode(0, recorder)
 	if err != nil {
 		log.G(ctx).WithError(err).Warnf("Failed to get root node")
 		return errors.Wrapf(err, "failed to get root node")
@@ -371,6 +482,10 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	// Register the mountpoint layer
 	fs.layerMu.Lock()
 	fs.layer[mountpoint] = l
+	fs.indexRefs[mountpoint] = releaseIndex
+	if profile != nil {
+		fs.profiles[mountpoint] = profile
+	}
 	fs.layerMu.Unlock()
 	fs.metricsController.Add(mountpoint, l)
 
@@ -471,6 +586,16 @@ func (fs *filesystem) Unmount(ctx context.Context, mountpoint string) error {
 	}
 	delete(fs.layer, mountpoint) // unregisters the corresponding layer
 	l.Done()
+	if releaseIndex, ok := fs.indexRefs[mountpoint]; ok {
+		delete(fs.indexRefs, mountpoint)
+		releaseIndex()
+	}
+	if profile, ok := fs.profiles[mountpoint]; ok {
+		delete(fs.profiles, mountpoint)
+		if err := profile.Close(); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to close profile")
+		}
+	}
 	fs.layerMu.Unlock()
 	fs.metricsController.Remove(mountpoint)
 	// The goroutine which serving the mountpoint possibly becomes not responding.
@@ -481,11 +606,21 @@ func (fs *filesystem) Unmount(ctx context.Context, mountpoint string) error {
 	return syscall.Unmount(mountpoint, syscall.MNT_FORCE)
 }
 
-func (fs *filesystem) backgroundFetch(ctx context.Context, l layer.Layer, start time.Time) {
-	// Fetch whole layer aggressively in background.
+// prefetchPriorities returns the spans and files of the layer `layerDigest` to fetch first in background:
+// the ones of the mount labels, then the ones configured for the layer and for every layer, then the ones of the SOCI index.
+func (fs *filesystem) prefetchPriorities(ctx context.Context, index *imageIndex, layerDigest digest.Digest, labelPriorities []layer.PrefetchPriority) []layer.PrefetchPriority {
+	var priorities []layer.PrefetchPriority
+	priorities = append(priorities, labelPriorities...)
+	priorities = append(priorities, fs.layerPrefetchPriority[layerDigest]...)
+	priorities = append(priorities, fs.prefetchPriority...)
+	return append(priorities, index.prefetchPriorities(ctx, layerDigest)...)
+}
+
+func (fs *filesystem) backgroundFetch(ctx context.Context, l layer.Layer, start time.Time, priorities []layer.PrefetchPriority) {
+	// Fetch whole layer aggressively in background, starting with the prioritized spans and files.
 	if !fs.noBackgroundFetch {
 		go func() {
-			if err := l.BackgroundFetch(); err == nil {
+			if err := l.BackgroundFetch(priorities); err == nil {
 				// write log record for the latency between mount start and last on demand fetch
 				commonmetrics.LogLatencyForLastOnDemandFetch(ctx, l.Info().Digest, start, l.Info().ReadTime)
 			}
@@ -41,12 +41,15 @@ package fs
 import (
 	"context"
 	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
+	"github.com/awslabs/soci-snapshotter/fs/config"
 	"github.com/awslabs/soci-snapshotter/fs/layer"
 	"github.com/awslabs/soci-snapshotter/fs/remote"
 	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/awslabs/soci-snapshotter/task"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
@@ -81,12 +84,14 @@ type breakableLayer struct {
 	success bool
 }
 
-func (l *breakableLayer) Info() layer.Info                                    { return layer.Info{} }
-func (l *breakableLayer) RootNode(uint32) (fusefs.InodeEmbedder, error)       { return nil, nil }
+func (l *breakableLayer) Info() layer.Info { return layer.Info{} }
+func (l *breakableLayer) RootNode(uint32, layer.AccessRecorder) (fusefs.InodeEmbedder, error) {
+	return nil, nil
+}
 func (l *breakableLayer) Verify(tocDigest digest.Digest) error                { return nil }
 func (l *breakableLayer) SkipVerify()                                         {}
 func (l *breakableLayer) ReadAt([]byte, int64, ...remote.Option) (int, error) { return 0, nil }
-func (l *breakableLayer) BackgroundFetch() error                              { return fmt.Errorf("fail") }
+func (l *breakableLayer) BackgroundFetch([]layer.PrefetchPriority) error      { return fmt.Errorf("fail") }
 func (l *breakableLayer) Check() error {
 	if !l.success {
 		return fmt.Errorf("failed")
@@ -100,3 +105,46 @@ func (l *breakableLayer) Refresh(ctx context.Context, hosts source.RegistryHosts
 	return nil
 }
 func (l *breakableLayer) Done() {}
+
+func TestPrefetchPriorities(t *testing.T) {
+	layerDigest := digest.FromString("layer")
+	otherLayer := digest.FromString("other layer")
+	prefetchPriority, layerPrefetchPriority, err := parsePrefetchConfig(config.PrefetchConfig{
+		Priority:      []string{"/etc/passwd"},
+		LayerPriority: map[string][]string{layerDigest.String(): {"5", "/bin/sh"}},
+	})
+	if err != nil {
+		t.Fatalf("failed to parse prefetch config: %v", err)
+	}
+	fs := &filesystem{prefetchPriority: prefetchPriority, layerPrefetchPriority: layerPrefetchPriority}
+	index := newImageIndex(&soci.SociIndex{Blobs: []*ocispec.Descriptor{{
+		MediaType: soci.SociLayerMediaType,
+		Digest:    digest.FromString("ztoc"),
+		Annotations: map[string]string{
+			soci.IndexAnnotationImageLayerDigest: layerDigest.String(),
+			soci.IndexAnnotationPrefetchPriority: "/lib/libc.so,2",
+		},
+	}}}, &soci.PrefetchList{Layers: []soci.PrefetchLayer{{Digest: layerDigest, Spans: []soci.SpanId{7}}}})
+
+	// the label, then the config of the layer and of every layer, then the index
+	priorities := fs.prefetchPriorities(context.TODO(), index, layerDigest, []layer.PrefetchPriority{{Span: 1}})
+	expected := []layer.PrefetchPriority{{Span: 1}, {Span: 5}, {Path: "/bin/sh"}, {Path: "/etc/passwd"}, {Path: "/lib/libc.so"}, {Span: 2}, {Span: 7}}
+	if !reflect.DeepEqual(priorities, expected) {
+		t.Fatalf("unexpected priorities; expected %v, got %v", expected, priorities)
+	}
+	priorities = fs.prefetchPriorities(context.TODO(), nil, otherLayer, nil)
+	expected = []layer.PrefetchPriority{{Path: "/etc/passwd"}}
+	if !reflect.DeepEqual(priorities, expected) {
+		t.Fatalf("unexpected priorities of a layer without index; expected %v, got %v", expected, priorities)
+	}
+
+	for _, cfg := range []config.PrefetchConfig{
+		{Priority: []string{"etc/passwd"}},
+		{LayerPriority: map[string][]string{"layer": {"1"}}},
+		{LayerPriority: map[string][]string{layerDigest.String(): {"-1"}}},
+	} {
+		if _, _, err := parsePrefetchConfig(cfg); err == nil {
+			t.Fatalf("expected an error parsing %+v", cfg)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/util/lrucache"
+	"github.com/awslabs/soci-snapshotter/util/namedmutex"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const defaultIndexCacheEntry = 30
+
+// imageIndex is the SOCI index of an image, with the ztocs of its layers and its prefetch list.
+type imageIndex struct {
+	index                *soci.SociIndex
+	imageLayerToSociDesc map[string]ocispec.Descriptor
+	// prefetchList is the prefetch list of the index. It's nil if the index has none.
+	prefetchList *soci.PrefetchList
+}
+
+func newImageIndex(index *soci.SociIndex, prefetchList *soci.PrefetchList) *imageIndex {
+	imageLayerToSociDesc := make(map[string]ocispec.Descriptor)
+	for _, desc := range index.Blobs {
+		if desc != nil && desc.MediaType != soci.SociPrefetchListMediaType {
+			ociDigest := desc.Annotations[soci.IndexAnnotationImageLayerDigest]
+			imageLayerToSociDesc[ociDigest] = *desc
+		}
+	}
+	return &imageIndex{
+		index:                index,
+		imageLayerToSociDesc: imageLayerToSociDesc,
+		prefetchList:         prefetchList,
+	}
+}
+
+// ztocDescriptor returns the descriptor of the ztoc of the layer `layerDigest`,
+// or an empty descriptor if the image has no index or the index has no ztoc for the layer.
+func (i *imageIndex) ztocDescriptor(layerDigest digest.Digest) ocispec.Descriptor {
+	if i == nil {
+		return ocispec.Descriptor{}
+	}
+	return i.imageLayerToSociDesc[layerDigest.String()]
+}
+
+// prefetchPriorities returns the spans and files of the layer `layerDigest` to prefetch first: the ones of
+// the prefetch-priority annotation of its ztoc, then the spans of the prefetch list. It returns nil if the
+// image has no index. Since priorities are only hints, an invalid annotation is ignored.
+func (i *imageIndex) prefetchPriorities(ctx context.Context, layerDigest digest.Digest) []layer.PrefetchPriority {
+	if i == nil {
+		return nil
+	}
+	var priorities []layer.PrefetchPriority
+	desc := i.ztocDescriptor(layerDigest)
+	if a, ok := desc.Annotations[soci.IndexAnnotationPrefetchPriority]; ok {
+		p, err := layer.ParsePrefetchPriorities(strings.Split(a, ","))
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("layer", layerDigest).Warn("invalid prefetch priority annotation")
+		} else {
+			priorities = append(priorities, p...)
+		}
+	}
+	return append(priorities, layer.SpanPriorities(i.prefetchList.Spans(layerDigest))...)
+}
+
+// loadIndexFunc loads the SOCI index of an image. It returns a nil index if the image has none.
+type loadIndexFunc func(ctx context.Context, imageRef, indexDigest, imgManifestDigest string) (*imageIndex, error)
+
+// indexCache keeps track of the SOCI indices of the mounted images.
+// Indices are reference-counted by the mounts using them, and are evicted in LRU order
+// once the cache is full and nobody refers to them anymore.
+type indexCache struct {
+	cache   *lrucache.Cache
+	cacheMu sync.Mutex
+	loadMu  *namedmutex.NamedMutex
+	load    loadIndexFunc
+}
+
+func newIndexCache(maxEntries int, load loadIndexFunc) *indexCache {
+	if maxEntries == 0 {
+		maxEntries = defaultIndexCacheEntry
+	}
+	cache := lrucache.New(maxEntries)
+	cache.OnEvicted = func(key string, value interface{}) {
+		log.L.WithField("key", key).Debugf("evicted SOCI index")
+	}
+	return &indexCache{
+		cache:  cache,
+		loadMu: new(namedmutex.NamedMutex),
+		load:   load,
+	}
+}
+
+// indexCacheKey identifies the index of an image. Different images, or the same image
+// mounted with different indices, get different keys.
+func indexCacheKey(imageRef, indexDigest, imgManifestDigest string) string {
+	if imgManifestDigest == "" && indexDigest == "" {
+		return imageRef
+	}
+	return imgManifestDigest + "/" + indexDigest
+}
+
+// get returns the SOCI index of an image, loading it if it isn't cached. The caller must call
+// `done` when it doesn't use the index anymore. A nil index is returned if the image has none,
+// in which case nothing is cached so that the index is looked up again on the next call.
+func (c *indexCache) get(ctx context.Context, imageRef, indexDigest, imgManifestDigest string) (_ *imageIndex, done func(), _ error) {
+	key := indexCacheKey(imageRef, indexDigest, imgManifestDigest)
+
+	// Wait if loading this index is already running, so it's only loaded once.
+	c.loadMu.Lock(key)
+	defer c.loadMu.Unlock(key)
+
+	c.cacheMu.Lock()
+	cached, done, ok := c.cache.Get(key)
+	c.cacheMu.Unlock()
+	if ok {
+		return cached.(*imageIndex), done, nil
+	}
+
+	index, err := c.load(ctx, imageRef, indexDigest, imgManifestDigest)
+	if err != nil {
+		return nil, nil, err
+	}
+	if index == nil {
+		return nil, func() {}, nil
+	}
+
+	c.cacheMu.Lock()
+	cached, done, _ = c.cache.Add(key, index)
+	c.cacheMu.Unlock()
+	return cached.(*imageIndex), done, nil
+}
@@ -0,0 +1,200 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testIndices builds an index for each image manifest digest, with one ztoc for each layer.
+type testIndices struct {
+	mu      sync.Mutex
+	layers  map[string][]digest.Digest
+	loads   map[string]int
+	evicted []string
+}
+
+func (ti *testIndices) load(ctx context.Context, imageRef, indexDigest, imgManifestDigest string) (*imageIndex, error) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.loads[imgManifestDigest]++
+	layers, ok := ti.layers[imgManifestDigest]
+	if !ok {
+		return nil, nil
+	}
+	var blobs []*ocispec.Descriptor
+	for _, l := range layers {
+		blobs = append(blobs, &ocispec.Descriptor{
+			MediaType: soci.SociLayerMediaType,
+			Digest:    ztocDigest(imgManifestDigest, l),
+			Annotations: map[string]string{
+				soci.IndexAnnotationImageLayerDigest: l.String(),
+			},
+		})
+	}
+	return newImageIndex(&soci.SociIndex{Blobs: blobs}, nil), nil
+}
+
+func (ti *testIndices) loadCount(imgManifestDigest string) int {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	return ti.loads[imgManifestDigest]
+}
+
+func ztocDigest(imgManifestDigest string, layerDigest digest.Digest) digest.Digest {
+	return digest.FromString(imgManifestDigest + layerDigest.String())
+}
+
+func TestIndexCacheImages(t *testing.T) {
+	sharedLayer := digest.FromString("shared layer")
+	images := map[string][]digest.Digest{
+		digest.FromString("image1").String(): {sharedLayer, digest.FromString("layer1")},
+		digest.FromString("image2").String(): {sharedLayer, digest.FromString("layer2")},
+		digest.FromString("image3").String(): {digest.FromString("layer3")},
+	}
+	ti := &testIndices{layers: images, loads: make(map[string]int)}
+	c := newIndexCache(0, ti.load)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		for manifestDigest, layers := range images {
+			manifestDigest, layers := manifestDigest, layers
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				index, done, err := c.get(ctx, "example.com/image", "", manifestDigest)
+				if err != nil {
+					t.Errorf("cannot get the index of %s: %v", manifestDigest, err)
+					return
+				}
+				defer done()
+				for _, l := range layers {
+					if got := index.ztocDescriptor(l).Digest; got != ztocDigest(manifestDigest, l) {
+						t.Errorf("unexpected ztoc of layer %s of image %s: %s", l, manifestDigest, got)
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	for manifestDigest := range images {
+		if n := ti.loadCount(manifestDigest); n != 1 {
+			t.Errorf("index of %s loaded %d times; expected once", manifestDigest, n)
+		}
+	}
+}
+
+func TestIndexCacheNoIndex(t *testing.T) {
+	ti := &testIndices{layers: map[string][]digest.Digest{}, loads: make(map[string]int)}
+	c := newIndexCache(0, ti.load)
+	manifestDigest := digest.FromString("image").String()
+	for i := 0; i < 2; i++ {
+		index, done, err := c.get(context.Background(), "example.com/image", "", manifestDigest)
+		if err != nil {
+			t.Fatalf("cannot get the index: %v", err)
+		}
+		if got := index.ztocDescriptor(digest.FromString("layer")); got.Digest != "" {
+			t.Fatalf("unexpected ztoc of an image without index: %v", got)
+		}
+		done()
+	}
+	// images without index are looked up again, in case the index is pushed later
+	if n := ti.loadCount(manifestDigest); n != 2 {
+		t.Fatalf("index loaded %d times; expected twice", n)
+	}
+}
+
+func TestIndexCacheLoadError(t *testing.T) {
+	loadErr := errors.New("cannot load")
+	var loads int
+	c := newIndexCache(0, func(ctx context.Context, imageRef, indexDigest, imgManifestDigest string) (*imageIndex, error) {
+		loads++
+		if loads == 1 {
+			return nil, loadErr
+		}
+		return newImageIndex(&soci.SociIndex{}, nil), nil
+	})
+	if _, _, err := c.get(context.Background(), "example.com/image", "", ""); !errors.Is(err, loadErr) {
+		t.Fatalf("unexpected error; expected %v, got %v", loadErr, err)
+	}
+	index, done, err := c.get(context.Background(), "example.com/image", "", "")
+	if err != nil {
+		t.Fatalf("cannot get the index after a failure: %v", err)
+	}
+	defer done()
+	if index == nil {
+		t.Fatalf("expected an index after a failure")
+	}
+}
+
+func TestIndexCacheEviction(t *testing.T) {
+	images := map[string][]digest.Digest{
+		digest.FromString("image1").String(): {digest.FromString("layer1")},
+		digest.FromString("image2").String(): {digest.FromString("layer2")},
+	}
+	ti := &testIndices{layers: images, loads: make(map[string]int)}
+	c := newIndexCache(1, ti.load)
+	c.cache.OnEvicted = func(key string, value interface{}) {
+		ti.mu.Lock()
+		defer ti.mu.Unlock()
+		ti.evicted = append(ti.evicted, key)
+	}
+	ctx := context.Background()
+	image1 := digest.FromString("image1").String()
+	image2 := digest.FromString("image2").String()
+
+	index1, done1, err := c.get(ctx, "example.com/image1", "", image1)
+	if err != nil {
+		t.Fatalf("cannot get the index of image1: %v", err)
+	}
+	_, done2, err := c.get(ctx, "example.com/image2", "", image2)
+	if err != nil {
+		t.Fatalf("cannot get the index of image2: %v", err)
+	}
+	// image1 is out of the cache, but still in use
+	if len(ti.evicted) != 0 {
+		t.Fatalf("index evicted while in use: %v", ti.evicted)
+	}
+	layer1 := images[image1][0]
+	if got := index1.ztocDescriptor(layer1).Digest; got != ztocDigest(image1, layer1) {
+		t.Fatalf("unexpected ztoc of image1 after it's out of the cache: %s", got)
+	}
+	done1()
+	if len(ti.evicted) != 1 || ti.evicted[0] != indexCacheKey("example.com/image1", "", image1) {
+		t.Fatalf("unexpected evicted indices: %v", ti.evicted)
+	}
+
+	// image2 stays in the cache once released
+	done2()
+	_, done2, err = c.get(ctx, "example.com/image2", "", image2)
+	if err != nil {
+		t.Fatalf("cannot get the index of image2: %v", err)
+	}
+	done2()
+	if n := ti.loadCount(image2); n != 1 {
+		t.Fatalf("index of image2 loaded %d times; expected once", n)
+	}
+}
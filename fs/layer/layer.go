@@ -75,15 +75,26 @@ const (
 	defaultMaxLRUCacheEntry   = 10
 	defaultMaxCacheFds        = 10
 	memoryCacheType           = "memory"
+
+	// the default sizes of the span cache, which is shared by all the layers
+	defaultMaxSpanCacheDiskSize   = 10 << 30
+	defaultMaxSpanCacheMemorySize = 1 << 30
 )
 
+// AccessRecorder records the accesses to the files of a layer, e.g. to profile the startup of a container.
+type AccessRecorder interface {
+	// RecordAccess records an access to the uncompressed contents of the layer.
+	RecordAccess(soci.FileAccess)
+}
+
 // Layer represents a layer.
 type Layer interface {
 	// Info returns the information of this layer.
 	Info() Info
 
-	// RootNode returns the root node of this layer.
-	RootNode(baseInode uint32) (fusefs.InodeEmbedder, error)
+	// RootNode returns the root node of this layer. The accesses to the files
+	// of the layer are recorded by `recorder`, unless it's nil.
+	RootNode(baseInode uint32, recorder AccessRecorder) (fusefs.InodeEmbedder, error)
 
 	// Check checks if the layer is still connectable.
 	Check() error
@@ -102,9 +113,9 @@ type Layer interface {
 	// ReadAt reads this layer.
 	ReadAt([]byte, int64, ...remote.Option) (int, error)
 
-	// BackgroundFetch fetches the entire layer contents to the cache.
-	// Fetching contents is done as a background task.
-	BackgroundFetch() error
+	// BackgroundFetch fetches the entire layer contents to the cache, starting with the spans
+	// of `priorities`. Fetching contents is done as a background task.
+	BackgroundFetch(priorities []PrefetchPriority) error
 
 	// Done releases the reference to this layer. The resources related to this layer will be
 	// discarded sooner or later. Queries after calling this function won't be serviced.
@@ -117,6 +128,7 @@ type Info struct {
 	Size        int64     // layer size in bytes
 	FetchedSize int64     // layer fetched size in bytes
 	ReadTime    time.Time // last time the layer was read
+	Prefetch    PrefetchProgress
 }
 
 // Resolver resolves the layer location and provieds the handler of that layer.
@@ -132,6 +144,10 @@ type Resolver struct {
 	config                config.Config
 	metadataStore         metadata.Store
 	artifactStore         content.Storage
+	// spanCache caches the spans of all the layers by content, so that layers share the spans they have in common.
+	spanCache cache.BlobCache
+	// httpCacheQuota bounds the size on disk of the HTTP caches of all the blobs.
+	httpCacheQuota *cache.DiskQuota
 }
 
 // NewResolver returns a new layer resolver.
@@ -167,6 +183,15 @@ func NewResolver(root string, backgroundTaskManager *task.BackgroundTaskManager,
 		return nil, err
 	}
 
+	httpCacheQuota, err := newDiskQuota("httpcache", cfg.DirectoryCacheConfig.MaxDiskSize, cfg)
+	if err != nil {
+		return nil, err
+	}
+	spanCache, err := newSpanCache(filepath.Join(root, "spancache"), cfg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create span cache")
+	}
+
 	return &Resolver{
 		rootDir:               root,
 		resolver:              remote.NewResolver(cfg.BlobConfig, resolveHandlers),
@@ -177,14 +202,98 @@ func NewResolver(root string, backgroundTaskManager *task.BackgroundTaskManager,
 		resolveLock:           new(namedmutex.NamedMutex),
 		metadataStore:         metadataStore,
 		artifactStore:         artifactStore,
+		spanCache:             spanCache,
+		httpCacheQuota:        httpCacheQuota,
 	}, nil
 }
 
-func newCache(root string, cacheType string, cfg config.Config) (cache.BlobCache, error) {
+// newDiskQuota returns the quota of `maxSize` bytes of the caches under the cache root `name`, which exports
+// their size and evictions as metrics.
+func newDiskQuota(name string, maxSize int64, cfg config.Config) (*cache.DiskQuota, error) {
+	quota, err := cache.NewDiskQuota(cache.DiskQuotaConfig{
+		MaxSize:        maxSize,
+		EvictionPolicy: cfg.DirectoryCacheConfig.EvictionPolicy,
+		OnSizeChange: func(size int64) {
+			commonmetrics.SetCacheDiskSize(name, size)
+		},
+		OnEvicted: func(size int64) {
+			commonmetrics.AddCacheEviction(name, size)
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid quota of %s", name)
+	}
+	return quota, nil
+}
+
+// newSpanCache returns the span cache shared by all the layers, at `dir` unless it's in memory.
+// The cache is kept on disk across restarts, since its entries are identified by their digest,
+// except the ones which can't be shared, which are removed.
+func newSpanCache(dir string, cfg config.Config) (cache.BlobCache, error) {
+	maxSize := cfg.DirectoryCacheConfig.MaxSpanCacheSize
+	if cfg.FSCacheType == memoryCacheType {
+		if maxSize == 0 {
+			maxSize = defaultMaxSpanCacheMemorySize
+		}
+		return cache.NewBoundedMemoryCache(maxSize), nil
+	}
+	if maxSize == 0 {
+		maxSize = defaultMaxSpanCacheDiskSize
+	}
+	quota, err := newDiskQuota("spancache", maxSize, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := removeStaleSpans(dir); err != nil {
+		return nil, err
+	}
+	return newDirectoryCache(filepath.Base(dir), dir, cfg.DirectoryCacheConfig.VerifySpanCache, true, cfg, quota)
+}
+
+// removeStaleSpans removes the entries of the span cache at `dir` which can't be read by any span manager
+// anymore, and the per-start directories of previous versions.
+func removeStaleSpans(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Name() == "wip" {
+			continue
+		}
+		if e.IsDir() || spanmanager.IsPrivateCacheKey(e.Name()) {
+			if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// newCache returns a cache on a new directory under `root`, which is removed when the cache is closed.
+// If `verify` is true, the checksums of its entries are verified when they're read from disk, which
+// only applies to directory caches.
+func newCache(root string, cacheType string, verify bool, cfg config.Config, quota *cache.DiskQuota) (cache.BlobCache, error) {
 	if cacheType == memoryCacheType {
 		return cache.NewMemoryCache(), nil
 	}
+	// create a cache on an unique directory
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	cachePath, err := os.MkdirTemp(root, "")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to initialize directory cache")
+	}
+	return newDirectoryCache(filepath.Base(root), cachePath, verify, false, cfg, quota)
+}
 
+// newDirectoryCache returns a directory cache at `dir`, which reports its corrupted entries as the ones of the
+// cache root `name`. If `persistent` is true, its entries are kept on disk when it's closed.
+func newDirectoryCache(name, dir string, verify, persistent bool, cfg config.Config, quota *cache.DiskQuota) (cache.BlobCache, error) {
 	dcc := cfg.DirectoryCacheConfig
 	maxDataEntry := dcc.MaxLRUCacheEntry
 	if maxDataEntry == 0 {
@@ -208,26 +317,30 @@ func newCache(root string, cacheType string, cfg config.Config) (cache.BlobCache
 	fCache.OnEvicted = func(key string, value interface{}) {
 		value.(*os.File).Close()
 	}
-	// create a cache on an unique directory
-	if err := os.MkdirAll(root, 0700); err != nil {
-		return nil, err
-	}
-	cachePath, err := os.MkdirTemp(root, "")
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to initialize directory cache")
-	}
 	return cache.NewDirectoryCache(
-		cachePath,
+		dir,
 		cache.DirectoryCacheConfig{
 			SyncAdd:   dcc.SyncAdd,
 			DataCache: dCache,
 			FdCache:   fCache,
 			BufPool:   bufPool,
 			Direct:    dcc.Direct,
+			Quota:     quota,
+			Verify:    verify,
+			OnCorrupted: func(key string) {
+				commonmetrics.IncCacheCorruptionCount(name)
+				log.L.WithField("key", key).Warnf("removed corrupted entry from %s", name)
+			},
+			Persistent: persistent,
 		},
 	)
 }
 
+// Close releases the resources shared by the layers. The resolver can't be used afterwards.
+func (r *Resolver) Close() error {
+	return r.spanCache.Close()
+}
+
 // Resolve resolves a layer based on the passed layer blob information.
 func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc, sociDesc ocispec.Descriptor, metadataOpts ...metadata.Option) (_ Layer, retErr error) {
 	name := refspec.String() + "/" + desc.Digest.String()
@@ -268,38 +381,19 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 		}
 	}()
 
-	spanCache, err := newCache(filepath.Join(r.rootDir, "spancache"), r.config.FSCacheType, r.config)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to create span manager cache")
-	}
-	defer func() {
-		if retErr != nil {
-			spanCache.Close()
-		}
-	}()
-
-	ztocReader, err := r.artifactStore.Fetch(ctx, sociDesc)
+	// Get a reader for the layer files
+	// Each file's read operation is a prioritized task and all background tasks
+	// will be stopped during the execution so this can avoid being disturbed for
+	// NW traffic by background tasks.
+	sr := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (n int, err error) {
+		r.backgroundTaskManager.DoPrioritizedTask()
+		defer r.backgroundTaskManager.DonePrioritizedTask()
+		return blobR.ReadAt(p, offset)
+	}), 0, blobR.Size())
+	ztoc, err := r.getZtoc(ctx, desc, sociDesc, sr)
 	if err != nil {
 		return nil, err
 	}
-	defer ztocReader.Close()
-	// Check if the ztoc exists (will be passed from fs)
-	// If it exists, we decide if we want to lazily load layer, or
-	// download/decompress the entire layer
-	// If we decide to download/decompress the entire layer, getZtoc will not return the ztoc
-	ztoc, err := soci.GetZtoc(ztocReader)
-
-	if err != nil {
-		// for now error out and let container runtime handle the layer download
-		return nil, errors.Wrapf(err, "cannot get ztoc; download and unpack this layer in container runtime for now")
-	}
-
-	if ztoc == nil {
-		// 1. download and unpack the layer
-		// 2. return the reference to the layer
-		// for now just error out, so container runtime takes care of this
-		return nil, errors.Errorf("download and unpack this layer in container runtime for now")
-	}
 
 	// log ztoc info
 	log.G(context.Background()).WithFields(logrus.Fields{
@@ -309,15 +403,6 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 	// continue with resolving the layer presuming we handle ZTOC
 	// ztoc will belong to a layer
 
-	// Get a reader for the layer files
-	// Each file's read operation is a prioritized task and all background tasks
-	// will be stopped during the execution so this can avoid being disturbed for
-	// NW traffic by background tasks.
-	sr := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (n int, err error) {
-		r.backgroundTaskManager.DoPrioritizedTask()
-		defer r.backgroundTaskManager.DonePrioritizedTask()
-		return blobR.ReadAt(p, offset)
-	}), 0, blobR.Size())
 	// define telemetry hooks to measure latency metrics for the metadata store
 	telemetry := metadata.Telemetry{
 		InitMetadataStoreLatency: func(start time.Time) {
@@ -330,14 +415,21 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 	}
 	log.G(ctx).Debugf("[Resolver.Resolve]Initialized metadata store for layer sha=%v", desc.Digest)
 
-	spanManager := spanmanager.New(ztoc, sr, spanCache, cache.Direct())
-	vr, err := reader.NewReader(meta, desc.Digest, spanManager)
+	spanManager, err := spanmanager.New(ztoc, sr, r.spanCache, cache.Direct())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create span manager")
+	}
+	// Spans are read ahead without pausing background tasks, nor polluting the memory cache.
+	rr := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (int, error) {
+		return blobR.ReadAt(p, offset, remote.WithCacheOpts(cache.Direct()))
+	}), 0, blobR.Size())
+	vr, err := reader.NewReader(meta, desc.Digest, spanManager, reader.WithReadahead(r.config.ReadaheadConfig, rr))
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to read layer")
 	}
 
 	pr := newPrefetcherReader(r, blobR, desc.Digest)
-	prefetcher := newPrefetcher(pr, spanManager)
+	prefetcher := newPrefetcher(pr, spanManager, ztoc)
 
 	// Combine layer information together and cache it.
 	l := newLayer(r, desc, blobR, vr, prefetcher)
@@ -352,6 +444,49 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 	return &layerRef{cachedL.(*layer), done2}, nil
 }
 
+// getZtoc returns the ztoc of the layer. The ztoc is fetched from the artifact store if the layer
+// is in the SOCI index. Otherwise, the layer can still be lazily loaded if it's an eStargz layer
+// with a TOC digest, in which case the ztoc is converted from the eStargz TOC, unless signed SOCI
+// indices are required.
+func (r *Resolver) getZtoc(ctx context.Context, desc, sociDesc ocispec.Descriptor, sr *io.SectionReader) (*soci.Ztoc, error) {
+	if sociDesc.Digest == "" {
+		if r.config.RequireSignedIndex {
+			return nil, errors.New("layer is not in a signed SOCI index; download and unpack this layer in container runtime")
+		}
+		ztoc, err := soci.NewZtocFromEstargz(sr, digest.Digest(desc.Annotations[soci.EstargzTOCDigestAnnotation]))
+		if err != nil {
+			// for now error out and let container runtime handle the layer download
+			return nil, errors.Wrapf(err, "layer is not in the SOCI index and cannot get ztoc from eStargz TOC; download and unpack this layer in container runtime for now")
+		}
+		log.G(ctx).WithField("layer_sha", desc.Digest).Debugf("[Resolver.Resolve] converted eStargz TOC to ZTOC")
+		return ztoc, nil
+	}
+
+	ztocReader, err := r.artifactStore.Fetch(ctx, sociDesc)
+	if err != nil {
+		return nil, err
+	}
+	defer ztocReader.Close()
+	// Check if the ztoc exists (will be passed from fs)
+	// If it exists, we decide if we want to lazily load layer, or
+	// download/decompress the entire layer
+	// If we decide to download/decompress the entire layer, getZtoc will not return the ztoc
+	ztoc, err := soci.GetZtoc(ztocReader)
+
+	if err != nil {
+		// for now error out and let container runtime handle the layer download
+		return nil, errors.Wrapf(err, "cannot get ztoc; download and unpack this layer in container runtime for now")
+	}
+
+	if ztoc == nil {
+		// 1. download and unpack the layer
+		// 2. return the reference to the layer
+		// for now just error out, so container runtime takes care of this
+		return nil, errors.Errorf("download and unpack this layer in container runtime for now")
+	}
+	return ztoc, nil
+}
+
 // resolveBlob resolves a blob based on the passed layer blob information.
 func (r *Resolver) resolveBlob(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (_ *blobRef, retErr error) {
 	name := refspec.String() + "/" + desc.Digest.String()
@@ -371,7 +506,7 @@ func (r *Resolver) resolveBlob(ctx context.Context, hosts source.RegistryHosts,
 		r.blobCacheMu.Unlock()
 	}
 
-	httpCache, err := newCache(filepath.Join(r.rootDir, "httpcache"), r.config.HTTPCacheType, r.config)
+	httpCache, err := newCache(filepath.Join(r.rootDir, "httpcache"), r.config.HTTPCacheType, r.config.DirectoryCacheConfig.VerifyHTTPCache, r.config, r.httpCacheQuota)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to create http cache")
 	}
@@ -436,6 +571,7 @@ func (l *layer) Info() Info {
 		Size:        l.blob.Size(),
 		FetchedSize: l.blob.FetchedSize(),
 		ReadTime:    readTime,
+		Prefetch:    l.prefetcher.progress(),
 	}
 }
 
@@ -471,10 +607,10 @@ func (l *layer) SkipVerify() {
 	l.r = l.verifiableReader.SkipVerify()
 }
 
-func (l *layer) BackgroundFetch() (err error) {
+func (l *layer) BackgroundFetch(priorities []PrefetchPriority) (err error) {
 	l.backgroundFetchOnce.Do(func() {
-		ctx := context.Background()
-		err = l.backgroundFetch(ctx)
+		ctx := log.WithLogger(context.Background(), log.L.WithField("layer", l.desc.Digest))
+		err = l.backgroundFetch(ctx, priorities)
 		if err != nil {
 			log.G(ctx).WithError(err).Warnf("failed to fetch whole layer=%v", l.desc.Digest)
 			return
@@ -484,12 +620,12 @@ func (l *layer) BackgroundFetch() (err error) {
 	return
 }
 
-func (l *layer) backgroundFetch(ctx context.Context) error {
+func (l *layer) backgroundFetch(ctx context.Context, priorities []PrefetchPriority) error {
 	defer commonmetrics.WriteLatencyLogValue(ctx, l.desc.Digest, commonmetrics.BackgroundFetchTotal, time.Now())
 	if l.isClosed() {
 		return fmt.Errorf("layer is already closed")
 	}
-	err := l.prefetcher.prefetch()
+	err := l.prefetcher.prefetch(ctx, priorities)
 	return err
 }
 
@@ -514,14 +650,14 @@ func newPrefetcherReader(resolver *Resolver, blob *blobRef, digest digest.Digest
 	return r
 }
 
-func (l *layer) RootNode(baseInode uint32) (fusefs.InodeEmbedder, error) {
+func (l *layer) RootNode(baseInode uint32, recorder AccessRecorder) (fusefs.InodeEmbedder, error) {
 	if l.isClosed() {
 		return nil, fmt.Errorf("layer is already closed")
 	}
 	if l.r == nil {
 		return nil, fmt.Errorf("layer hasn't been verified yet")
 	}
-	return newNode(l.desc.Digest, l.r, l.blob, baseInode)
+	return newNode(l.desc.Digest, l.r, l.blob, baseInode, recorder)
 }
 
 func (l *layer) ReadAt(p []byte, offset int64, opts ...remote.Option) (int, error) {
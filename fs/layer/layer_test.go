@@ -39,16 +39,116 @@
 package layer
 
 import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/awslabs/soci-snapshotter/fs/config"
 	"github.com/awslabs/soci-snapshotter/metadata/db"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 func TestLayer(t *testing.T) {
 	TestSuiteLayer(t, db.NewDbMetadataStore)
 }
 
+func TestSpanCache(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "spancache")
+	shared := strings.Repeat("a", 64)
+	cfg := config.Config{}
+	cfg.DirectoryCacheConfig.SyncAdd = true
+	c, err := newSpanCache(dir, cfg)
+	if err != nil {
+		t.Fatalf("failed to make span cache: %v", err)
+	}
+	for _, key := range []string{shared, strings.Repeat("b", 32) + "-1"} {
+		w, err := c.Add(key)
+		if err != nil {
+			t.Fatalf("failed to add %q: %v", key, err)
+		}
+		if _, err := w.Write([]byte("span")); err != nil {
+			t.Fatalf("failed to write %q: %v", key, err)
+		}
+		if err := w.Commit(); err != nil {
+			t.Fatalf("failed to commit %q: %v", key, err)
+		}
+		w.Close()
+	}
+	if err := os.Mkdir(filepath.Join(dir, "old"), 0700); err != nil {
+		t.Fatalf("failed to make stale directory: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("failed to close span cache: %v", err)
+	}
+
+	c, err = newSpanCache(dir, cfg)
+	if err != nil {
+		t.Fatalf("failed to reopen span cache: %v", err)
+	}
+	defer c.Close()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read span cache: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if strings.Join(names, ",") != shared+",wip" {
+		t.Fatalf("unexpected span cache entries %v; want shared entry and wip", names)
+	}
+	r, err := c.Get(shared)
+	if err != nil {
+		t.Fatalf("shared span isn't reused: %v", err)
+	}
+	r.Close()
+}
+
+func TestEstargzZtoc(t *testing.T) {
+	sr, tocDigest, err := soci.BuildEstargz([]testutil.TarEntry{testutil.File("file", "contents")}, 1<<16)
+	if err != nil {
+		t.Fatalf("failed to build eStargz layer: %v", err)
+	}
+	withTOCDigest := ocispec.Descriptor{
+		Annotations: map[string]string{soci.EstargzTOCDigestAnnotation: tocDigest.String()},
+	}
+	tests := []struct {
+		name               string
+		desc               ocispec.Descriptor
+		requireSignedIndex bool
+		expectZtoc         bool
+	}{
+		{
+			name:       "TOC digest",
+			desc:       withTOCDigest,
+			expectZtoc: true,
+		},
+		{
+			name: "no TOC digest",
+		},
+		{
+			name:               "signed index required",
+			desc:               withTOCDigest,
+			requireSignedIndex: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Resolver{}
+			r.config.RequireSignedIndex = tt.requireSignedIndex
+			ztoc, err := r.getZtoc(context.Background(), tt.desc, ocispec.Descriptor{}, sr)
+			if gotZtoc := err == nil && ztoc != nil; gotZtoc != tt.expectZtoc {
+				t.Fatalf("unexpected ztoc; expected ztoc: %v, got error: %v", tt.expectZtoc, err)
+			}
+		})
+	}
+}
+
 func TestWaiter(t *testing.T) {
 	var (
 		w         = newWaiter()
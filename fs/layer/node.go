@@ -56,6 +56,7 @@ import (
 	"github.com/awslabs/soci-snapshotter/fs/reader"
 	"github.com/awslabs/soci-snapshotter/fs/remote"
 	"github.com/awslabs/soci-snapshotter/metadata"
+	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/containerd/containerd/log"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -76,7 +77,7 @@ const (
 
 var opaqueXattrs = []string{"trusted.overlay.opaque", "user.overlay.opaque"}
 
-func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, baseInode uint32) (fusefs.InodeEmbedder, error) {
+func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, baseInode uint32, recorder AccessRecorder) (fusefs.InodeEmbedder, error) {
 	rootID := r.Metadata().RootID()
 	rootAttr, err := r.Metadata().GetAttr(rootID)
 	if err != nil {
@@ -87,6 +88,7 @@ func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, baseIno
 		layerDigest: layerDgst,
 		baseInode:   baseInode,
 		rootID:      rootID,
+		recorder:    recorder,
 	}
 	ffs.s = ffs.newState(layerDgst, blob)
 	return &node{
@@ -103,6 +105,8 @@ type fs struct {
 	layerDigest digest.Digest
 	baseInode   uint32
 	rootID      uint32
+	// recorder records the accesses to the files. It's nil if they aren't recorded.
+	recorder AccessRecorder
 }
 
 func (fs *fs) inodeOfState() uint64 {
@@ -315,10 +319,20 @@ func (n *node) Open(ctx context.Context, flags uint32) (fh fusefs.FileHandle, fu
 		n.fs.s.report(fmt.Errorf("node.Open: %v", err))
 		return nil, 0, syscall.EIO
 	}
-	return &file{
+	f := &file{
 		n:  n,
 		ra: ra,
-	}, fuse.FOPEN_KEEP_CACHE, 0
+	}
+	if n.fs.recorder != nil {
+		mf, err := n.fs.r.Metadata().OpenFile(n.id)
+		if err != nil {
+			n.fs.s.report(fmt.Errorf("node.Open: %v", err))
+			return nil, 0, syscall.EIO
+		}
+		f.offset = mf.GetUncompressedOffset()
+		n.fs.recorder.RecordAccess(soci.FileAccess{Start: f.offset, End: f.offset})
+	}
+	return f, fuse.FOPEN_KEEP_CACHE, 0
 }
 
 var _ = (fusefs.NodeGetattrer)((*node)(nil))
@@ -395,6 +409,9 @@ func (n *node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
 type file struct {
 	n  *node
 	ra io.ReaderAt
+	// offset is the offset of the contents of the file in the uncompressed layer.
+	// It's only set if the accesses to the file are recorded.
+	offset soci.FileSize
 }
 
 var _ = (fusefs.FileReader)((*file)(nil))
@@ -407,6 +424,10 @@ func (f *file) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResul
 		f.n.fs.s.report(fmt.Errorf("file.Read: %v", err))
 		return nil, syscall.EIO
 	}
+	if f.n.fs.recorder != nil && n > 0 {
+		start := f.offset + soci.FileSize(off)
+		f.n.fs.recorder.RecordAccess(soci.FileAccess{Start: start, End: start + soci.FileSize(n)})
+	}
 	return fuse.ReadResultData(dest[:n]), 0
 }
 
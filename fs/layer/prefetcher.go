@@ -17,29 +17,123 @@
 package layer
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
 	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/log"
 )
 
+// PrefetchPriority is an entry of the prioritized spans of a layer, which are fetched in background
+// before the other spans: either a span, or the spans of a file.
+type PrefetchPriority struct {
+	// Path is the absolute path of a file of the layer. It's empty if the entry is a span.
+	Path string
+	// Span is the ID of a span of the layer, if Path is empty.
+	Span soci.SpanId
+}
+
+// SpanPriorities returns the prefetch priorities of `spans`, in order.
+func SpanPriorities(spans []soci.SpanId) []PrefetchPriority {
+	priorities := make([]PrefetchPriority, 0, len(spans))
+	for _, id := range spans {
+		priorities = append(priorities, PrefetchPriority{Span: id})
+	}
+	return priorities
+}
+
+// ParsePrefetchPriorities parses prefetch priorities. Each entry is either a span ID, e.g. "3",
+// or the absolute path of a file of the layer, e.g. "/usr/bin/env".
+func ParsePrefetchPriorities(entries []string) ([]PrefetchPriority, error) {
+	var priorities []PrefetchPriority
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		switch {
+		case e == "":
+			continue
+		case strings.HasPrefix(e, "/"):
+			priorities = append(priorities, PrefetchPriority{Path: path.Clean(e)})
+		default:
+			id, err := strconv.ParseInt(e, 10, 32)
+			if err != nil || id < 0 {
+				return nil, fmt.Errorf("invalid prefetch priority %q: neither a span ID nor an absolute path", e)
+			}
+			priorities = append(priorities, PrefetchPriority{Span: soci.SpanId(id)})
+		}
+	}
+	return priorities, nil
+}
+
+// PrefetchProgress is the progress of the background fetch of a layer.
+// The prioritized spans are warm once PriorityDone is true.
+type PrefetchProgress struct {
+	// Spans is the number of spans of the layer.
+	Spans int64
+	// FetchedSpans is the number of spans fetched in background, including the prioritized ones.
+	FetchedSpans int64
+	// PrioritySpans is the number of prioritized spans. It's only known once the background fetch started.
+	PrioritySpans int64
+	// FetchedPrioritySpans is the number of prioritized spans fetched in background.
+	FetchedPrioritySpans int64
+	// PriorityDone is true once all the prioritized spans are fetched.
+	PriorityDone bool
+}
+
 type prefetcher struct {
 	r           *io.SectionReader // reader for prefetching the layer
 	spanManager *spanmanager.SpanManager
+	ztoc        *soci.Ztoc
+
+	// progress, updated atomically
+	fetchedSpans         int64
+	prioritySpans        int64
+	fetchedPrioritySpans int64
+	priorityDone         int32
 }
 
-func newPrefetcher(r *io.SectionReader, spanManager *spanmanager.SpanManager) *prefetcher {
+func newPrefetcher(r *io.SectionReader, spanManager *spanmanager.SpanManager, ztoc *soci.Ztoc) *prefetcher {
 	p := prefetcher{
 		r:           r,
 		spanManager: spanManager,
+		ztoc:        ztoc,
 	}
 	return &p
 }
 
-func (p *prefetcher) prefetch() error {
+// prefetch fetches all the spans of the layer, starting with the spans of `priorities` in order.
+// The other spans are fetched afterwards, in order.
+func (p *prefetcher) prefetch(ctx context.Context, priorities []PrefetchPriority) error {
+	start := time.Now()
+	hot := p.resolvePriorities(ctx, priorities)
+	atomic.StoreInt64(&p.prioritySpans, int64(len(hot)))
+	fetched := make(map[soci.SpanId]struct{}, len(hot))
+	for _, spanID := range hot {
+		if err := p.spanManager.ResolveSpan(spanID, p.r); err != nil {
+			return err
+		}
+		fetched[spanID] = struct{}{}
+		atomic.AddInt64(&p.fetchedPrioritySpans, 1)
+		atomic.AddInt64(&p.fetchedSpans, 1)
+	}
+	atomic.StoreInt32(&p.priorityDone, 1)
+	if len(hot) > 0 {
+		log.G(ctx).Infof("prefetched %d prioritized spans in %s", len(hot), time.Since(start))
+	}
+
 	var spanID soci.SpanId
 	for {
+		if _, ok := fetched[spanID]; ok {
+			spanID++
+			continue
+		}
 		err := p.spanManager.ResolveSpan(spanID, p.r)
 		if errors.Is(err, spanmanager.ErrExceedMaxSpan) {
 			break
@@ -47,7 +141,59 @@ func (p *prefetcher) prefetch() error {
 		if err != nil {
 			return err
 		}
+		atomic.AddInt64(&p.fetchedSpans, 1)
 		spanID++
 	}
 	return nil
 }
+
+// resolvePriorities returns the spans of `priorities`, in order and without duplicates.
+// Since priorities are hints which may not match the layer, unknown spans and files are skipped.
+func (p *prefetcher) resolvePriorities(ctx context.Context, priorities []PrefetchPriority) []soci.SpanId {
+	var files map[string]*soci.FileMetadata
+	var spans []soci.SpanId
+	seen := make(map[soci.SpanId]struct{})
+	add := func(first, last soci.SpanId) {
+		for id := first; id <= last && id <= p.ztoc.MaxSpanId; id++ {
+			if _, ok := seen[id]; !ok && id >= 0 {
+				seen[id] = struct{}{}
+				spans = append(spans, id)
+			}
+		}
+	}
+	for _, pp := range priorities {
+		if pp.Path == "" {
+			add(pp.Span, pp.Span)
+			continue
+		}
+		if files == nil {
+			// names of the ztoc are relative, and may start with "./"
+			files = make(map[string]*soci.FileMetadata)
+			for i := range p.ztoc.Metadata {
+				md := &p.ztoc.Metadata[i]
+				if md.Type == "reg" {
+					files[path.Clean("/"+md.Name)] = md
+				}
+			}
+		}
+		md, ok := files[pp.Path]
+		if !ok {
+			log.G(ctx).Debugf("prioritized file %s isn't a regular file of the layer", pp.Path)
+			continue
+		}
+		if md.UncompressedSize > 0 {
+			add(md.SpanStart, md.SpanEnd)
+		}
+	}
+	return spans
+}
+
+func (p *prefetcher) progress() PrefetchProgress {
+	return PrefetchProgress{
+		Spans:                int64(p.ztoc.MaxSpanId) + 1,
+		FetchedSpans:         atomic.LoadInt64(&p.fetchedSpans),
+		PrioritySpans:        atomic.LoadInt64(&p.prioritySpans),
+		FetchedPrioritySpans: atomic.LoadInt64(&p.fetchedPrioritySpans),
+		PriorityDone:         atomic.LoadInt32(&p.priorityDone) == 1,
+	}
+}
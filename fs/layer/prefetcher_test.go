@@ -18,7 +18,10 @@ package layer
 
 import (
 	"compress/gzip"
+	"context"
+	"io"
 	"math/rand"
+	"reflect"
 	"testing"
 
 	"github.com/awslabs/soci-snapshotter/cache"
@@ -45,13 +48,122 @@ func TestPrefetcher(t *testing.T) {
 
 	spanCache := cache.NewMemoryCache()
 	defer spanCache.Close()
-	spanManager := spanmanager.New(ztoc, r, spanCache)
-	prefetcher := newPrefetcher(r, spanManager)
+	spanManager, err := spanmanager.New(ztoc, r, spanCache)
+	if err != nil {
+		t.Fatalf("failed to create span manager: %v", err)
+	}
+	prefetcher := newPrefetcher(r, spanManager, ztoc)
 
-	err = prefetcher.prefetch()
+	err = prefetcher.prefetch(context.Background(), nil)
 	if err != nil {
 		t.Fatal("prefetch failed: %w", err)
 	}
+	progress := prefetcher.progress()
+	if progress.FetchedSpans != progress.Spans || progress.PrioritySpans != 0 || !progress.PriorityDone {
+		t.Fatalf("unexpected progress: %+v", progress)
+	}
+}
+
+func TestPrefetcherPriorities(t *testing.T) {
+	spanSize := 1 << 14
+	tarEntries := []testutil.TarEntry{
+		testutil.File("file1.txt", string(genRandomByteData(100000))),
+		testutil.Dir("dir/"),
+		testutil.File("dir/file2.txt", string(genRandomByteData(10))),
+	}
+	// spans of uncompressed layers start at multiples of the span size
+	ztoc, r, err := soci.BuildTarZtocReader(tarEntries, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	var file2 *soci.FileMetadata
+	for i := range ztoc.Metadata {
+		if ztoc.Metadata[i].Name == "dir/file2.txt" {
+			file2 = &ztoc.Metadata[i]
+		}
+	}
+	if file2 == nil || file2.SpanStart != file2.SpanEnd {
+		t.Fatalf("unexpected metadata of dir/file2.txt: %+v", file2)
+	}
+
+	testCases := []struct {
+		name       string
+		priorities []PrefetchPriority
+		expected   []soci.SpanId
+	}{
+		{
+			name: "spans",
+			// spans beyond the layer are ignored
+			priorities: SpanPriorities([]soci.SpanId{3, ztoc.MaxSpanId + 1, 1}),
+			expected:   []soci.SpanId{3, 1},
+		},
+		{
+			name: "files",
+			// unknown files and duplicate spans are ignored
+			priorities: []PrefetchPriority{{Path: "/dir/file2.txt"}, {Path: "/missing"}, {Span: file2.SpanStart}, {Span: 0}},
+			expected:   []soci.SpanId{file2.SpanStart, 0},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			spanCache := cache.NewMemoryCache()
+			defer spanCache.Close()
+			spanManager, err := spanmanager.New(ztoc, r, spanCache)
+			if err != nil {
+				t.Fatalf("failed to create span manager: %v", err)
+			}
+			var offsets []int64
+			pr := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (int, error) {
+				offsets = append(offsets, offset)
+				return r.ReadAt(p, offset)
+			}), 0, r.Size())
+
+			prefetcher := newPrefetcher(pr, spanManager, ztoc)
+			if err := prefetcher.prefetch(context.Background(), tc.priorities); err != nil {
+				t.Fatalf("prefetch failed: %v", err)
+			}
+			if len(offsets) != int(ztoc.MaxSpanId)+1 {
+				t.Fatalf("unexpected number of reads; expected %d, got %d", ztoc.MaxSpanId+1, len(offsets))
+			}
+			// prioritized spans are fetched first, then the others in order
+			expected := tc.expected
+			for id := soci.SpanId(0); id <= ztoc.MaxSpanId; id++ {
+				prioritized := false
+				for _, p := range tc.expected {
+					prioritized = prioritized || p == id
+				}
+				if !prioritized {
+					expected = append(expected, id)
+				}
+			}
+			for i, id := range expected {
+				if offsets[i] != int64(id)*int64(spanSize) {
+					t.Fatalf("unexpected read %d; expected offset %d, got %d", i, int64(id)*int64(spanSize), offsets[i])
+				}
+			}
+			progress := prefetcher.progress()
+			if progress.PrioritySpans != int64(len(tc.expected)) || progress.FetchedPrioritySpans != progress.PrioritySpans ||
+				progress.FetchedSpans != progress.Spans || !progress.PriorityDone {
+				t.Fatalf("unexpected progress: %+v", progress)
+			}
+		})
+	}
+}
+
+func TestParsePrefetchPriorities(t *testing.T) {
+	priorities, err := ParsePrefetchPriorities([]string{"3", " /usr/bin/../bin/env ", "", "0"})
+	if err != nil {
+		t.Fatalf("failed to parse priorities: %v", err)
+	}
+	expected := []PrefetchPriority{{Span: 3}, {Path: "/usr/bin/env"}, {Span: 0}}
+	if !reflect.DeepEqual(priorities, expected) {
+		t.Fatalf("unexpected priorities; expected %v, got %v", expected, priorities)
+	}
+	for _, entry := range []string{"-1", "usr/bin/env", "1.5"} {
+		if _, err := ParsePrefetchPriorities([]string{entry}); err == nil {
+			t.Fatalf("expected an error parsing %q", entry)
+		}
+	}
 }
 
 func genRandomByteData(size int) []byte {
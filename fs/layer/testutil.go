@@ -176,7 +176,11 @@ func makeNodeReader(t *testing.T, contents []byte, spanSize int64, factory metad
 	if err != nil {
 		t.Fatalf("failed to create reader: %v", err)
 	}
-	spanManager := spanmanager.New(ztoc, sr, cache.NewMemoryCache())
+	spanManager, err := spanmanager.New(ztoc, sr, cache.NewMemoryCache())
+	if err != nil {
+		mr.Close()
+		t.Fatalf("failed to create span manager: %v", err)
+	}
 	vr, err := reader.NewReader(mr, digest.FromString(""), spanManager)
 	if err != nil {
 		mr.Close()
@@ -319,7 +323,10 @@ func testExistence(t *testing.T, factory metadata.Store) {
 					t.Fatalf("failed to create reader: %v", err)
 				}
 				defer mr.Close()
-				spanManager := spanmanager.New(ztoc, sr, cache.NewMemoryCache())
+				spanManager, err := spanmanager.New(ztoc, sr, cache.NewMemoryCache())
+				if err != nil {
+					t.Fatalf("failed to create span manager: %v", err)
+				}
 				vr, err := reader.NewReader(mr, digest.FromString(""), spanManager)
 				if err != nil {
 					t.Fatalf("failed to make new reader: %v", err)
@@ -336,7 +343,7 @@ func testExistence(t *testing.T, factory metadata.Store) {
 }
 
 func getRootNode(t *testing.T, r reader.Reader) *node {
-	rootNode, err := newNode(testStateLayerDigest, &testReader{r}, &testBlobState{10, 5}, 100)
+	rootNode, err := newNode(testStateLayerDigest, &testReader{r}, &testBlobState{10, 5}, 100, nil)
 	if err != nil {
 		t.Fatalf("failed to get root node: %v", err)
 	}
@@ -55,6 +55,18 @@ const (
 	// BytesServedKey is the key for any metric related to counting bytes served as the part of specific operation.
 	BytesServedKey = "bytes_served"
 
+	// CacheDiskSizeKey is the key for the size of the entries of the caches on disk.
+	CacheDiskSizeKey = "cache_disk_size_bytes"
+
+	// CacheEvictionCountKey is the key for the count of the entries evicted from the caches on disk.
+	CacheEvictionCountKey = "cache_eviction_count"
+
+	// CacheEvictedBytesKey is the key for the bytes of the entries evicted from the caches on disk.
+	CacheEvictedBytesKey = "cache_evicted_bytes"
+
+	// CacheCorruptionCountKey is the key for the count of the entries of the caches found corrupted on disk.
+	CacheCorruptionCountKey = "cache_corruption_count"
+
 	// Keep namespace as soci and subsystem as fs.
 	namespace = "soci"
 	subsystem = "fs"
@@ -75,6 +87,13 @@ const (
 	OnDemandBytesServed              = "on_demand_bytes_served"
 	OnDemandBytesFetched             = "on_demand_bytes_fetched"
 
+	FileVerificationFailureCount = "file_verification_failure_count"
+
+	// spans fetched ahead of sequential reads, and the ones which were read afterwards or never
+	ReadaheadSpanCount       = "readahead_span_count"
+	ReadaheadHitSpanCount    = "readahead_hit_span_count"
+	ReadaheadWastedSpanCount = "readahead_wasted_span_count"
+
 	// logs metrics
 	BackgroundFetchTotal      = "background_fetch_total"
 	BackgroundFetchDownload   = "background_fetch_download"
@@ -134,6 +153,50 @@ var (
 		},
 		[]string{"operation_type", "layer"},
 	)
+
+	// cacheDiskSize reflects the size of the entries of the caches on disk, per cache root.
+	cacheDiskSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      CacheDiskSizeKey,
+			Help:      "The size in bytes of the entries of soci snapshotter caches on disk. Broken down by cache.",
+		},
+		[]string{"cache"},
+	)
+
+	// cacheEvictionCount collects the count of the entries evicted from the caches on disk, per cache root.
+	cacheEvictionCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      CacheEvictionCountKey,
+			Help:      "The count of entries evicted from soci snapshotter caches on disk. Broken down by cache.",
+		},
+		[]string{"cache"},
+	)
+
+	// cacheEvictedBytes collects the bytes of the entries evicted from the caches on disk, per cache root.
+	cacheEvictedBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      CacheEvictedBytesKey,
+			Help:      "The bytes of the entries evicted from soci snapshotter caches on disk. Broken down by cache.",
+		},
+		[]string{"cache"},
+	)
+
+	// cacheCorruptionCount collects the count of the entries found corrupted on disk, per cache root.
+	cacheCorruptionCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      CacheCorruptionCountKey,
+			Help:      "The count of entries of soci snapshotter caches found corrupted on disk. Broken down by cache.",
+		},
+		[]string{"cache"},
+	)
 )
 
 var register sync.Once
@@ -159,6 +222,10 @@ func Register() {
 		prometheus.MustRegister(operationLatencyMicroseconds)
 		prometheus.MustRegister(operationCount)
 		prometheus.MustRegister(bytesCount)
+		prometheus.MustRegister(cacheDiskSize)
+		prometheus.MustRegister(cacheEvictionCount)
+		prometheus.MustRegister(cacheEvictedBytes)
+		prometheus.MustRegister(cacheCorruptionCount)
 	})
 }
 
@@ -185,11 +252,32 @@ func IncOperationCount(operation string, layer digest.Digest) {
 	operationCount.WithLabelValues(operation, layer.String()).Inc()
 }
 
+// AddOperationCount wraps the labels attachment as well as calling Add into a single method.
+func AddOperationCount(operation string, layer digest.Digest, count int64) {
+	operationCount.WithLabelValues(operation, layer.String()).Add(float64(count))
+}
+
 // AddBytesCount wraps the labels attachment as well as calling Add into a single method.
 func AddBytesCount(operation string, layer digest.Digest, bytes int64) {
 	bytesCount.WithLabelValues(operation, layer.String()).Add(float64(bytes))
 }
 
+// SetCacheDiskSize sets the size in bytes of the entries on disk of the cache `cache`.
+func SetCacheDiskSize(cache string, size int64) {
+	cacheDiskSize.WithLabelValues(cache).Set(float64(size))
+}
+
+// AddCacheEviction counts an entry of `size` bytes evicted from the disk of the cache `cache`.
+func AddCacheEviction(cache string, size int64) {
+	cacheEvictionCount.WithLabelValues(cache).Inc()
+	cacheEvictedBytes.WithLabelValues(cache).Add(float64(size))
+}
+
+// IncCacheCorruptionCount counts an entry of the cache `cache` found corrupted on disk.
+func IncCacheCorruptionCount(cache string) {
+	cacheCorruptionCount.WithLabelValues(cache).Inc()
+}
+
 // WriteLatencyLogValue wraps writing the log info record for latency in milliseconds. The log record breaks down by operation and layer digest.
 func WriteLatencyLogValue(ctx context.Context, layer digest.Digest, operation string, start time.Time) {
 	ctx = log.WithLogger(ctx, log.G(ctx).WithField("metrics", "latency").WithField("operation", operation).WithField("layer_sha", layer.String()))
@@ -38,6 +38,9 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// spans is the unit of the metrics counting the spans of a layer.
+const spans metrics.Unit = "spans"
+
 var layerMetrics = []*metric{
 	{
 		name: "layer_fetched_size",
@@ -65,4 +68,73 @@ var layerMetrics = []*metric{
 			}
 		},
 	},
+	{
+		name: "layer_prefetch_spans",
+		help: "Total number of spans of the layer fetched in background",
+		unit: spans,
+		vt:   prometheus.GaugeValue,
+		getValues: func(l layer.Layer) []value {
+			return []value{
+				{
+					v: float64(l.Info().Prefetch.Spans),
+				},
+			}
+		},
+	},
+	{
+		name: "layer_prefetch_fetched_spans",
+		help: "Number of spans of the layer fetched in background so far",
+		unit: spans,
+		vt:   prometheus.GaugeValue,
+		getValues: func(l layer.Layer) []value {
+			return []value{
+				{
+					v: float64(l.Info().Prefetch.FetchedSpans),
+				},
+			}
+		},
+	},
+	{
+		name: "layer_prefetch_priority_spans",
+		help: "Number of prioritized spans of the layer, fetched first in background",
+		unit: spans,
+		vt:   prometheus.GaugeValue,
+		getValues: func(l layer.Layer) []value {
+			return []value{
+				{
+					v: float64(l.Info().Prefetch.PrioritySpans),
+				},
+			}
+		},
+	},
+	{
+		name: "layer_prefetch_fetched_priority_spans",
+		help: "Number of prioritized spans of the layer fetched in background so far",
+		unit: spans,
+		vt:   prometheus.GaugeValue,
+		getValues: func(l layer.Layer) []value {
+			return []value{
+				{
+					v: float64(l.Info().Prefetch.FetchedPrioritySpans),
+				},
+			}
+		},
+	},
+	{
+		name: "layer_prefetch_priority_done",
+		help: "Whether the prioritized spans of the layer are all fetched (1) or not (0)",
+		unit: metrics.Unit(""),
+		vt:   prometheus.GaugeValue,
+		getValues: func(l layer.Layer) []value {
+			var done float64
+			if l.Info().Prefetch.PriorityDone {
+				done = 1
+			}
+			return []value{
+				{
+					v: done,
+				},
+			}
+		},
+	},
 }
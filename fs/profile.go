@@ -0,0 +1,80 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+)
+
+// profileIDPattern matches the IDs of profiles, which are used as directory names.
+var profileIDPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// profileRecorder records the accesses to the files of a layer into a profile. A profile is a directory
+// with a file per layer, named after the encoded layer digest, with an access per line in JSON.
+type profileRecorder struct {
+	mu     sync.Mutex
+	f      *os.File
+	enc    *json.Encoder
+	seen   map[soci.FileAccess]struct{}
+	failed bool
+}
+
+func newProfileRecorder(profilesDir, profileID string, layerDigest digest.Digest) (*profileRecorder, error) {
+	if !profileIDPattern.MatchString(profileID) {
+		return nil, fmt.Errorf("invalid profile ID %q", profileID)
+	}
+	dir := filepath.Join(profilesDir, profileID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, layerDigest.Encoded()), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &profileRecorder{
+		f:    f,
+		enc:  json.NewEncoder(f),
+		seen: make(map[soci.FileAccess]struct{}),
+	}, nil
+}
+
+func (r *profileRecorder) RecordAccess(a soci.FileAccess) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.seen[a]; ok || r.failed {
+		return
+	}
+	r.seen[a] = struct{}{}
+	if err := r.enc.Encode(a); err != nil {
+		// the profile is incomplete, but the layer is still usable
+		log.L.WithError(err).WithField("profile", r.f.Name()).Warn("cannot record file access")
+		r.failed = true
+	}
+}
+
+func (r *profileRecorder) Close() error {
+	return r.f.Close()
+}
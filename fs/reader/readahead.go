@@ -0,0 +1,204 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/log"
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	defaultReadaheadInitialSpans    = 1
+	defaultReadaheadSequentialReads = 2
+)
+
+// readahead fetches spans ahead of the sequential reads of the files of a layer, so that a process
+// streaming a file doesn't wait for the spans one after another.
+//
+// Spans are fetched asynchronously, one readahead at a time per layer, from a reader which doesn't
+// pause background fetch like on-demand reads do. The spans aren't locked while they're fetched, so
+// on-demand reads never wait for readahead; at worst they fetch a span being fetched ahead.
+type readahead struct {
+	cfg         config.ReadaheadConfig
+	spanManager *spanmanager.SpanManager
+	layerSha    digest.Digest
+	// r is the reader of the layer used to fetch spans ahead.
+	r *io.SectionReader
+
+	// busy is 1 while spans are fetched ahead.
+	busy int32
+
+	mu sync.Mutex
+	// spans are the spans fetched ahead which haven't been read yet.
+	spans  map[soci.SpanId]struct{}
+	closed bool
+}
+
+// accessPattern tracks the reads of an open file, to detect sequential reads.
+type accessPattern struct {
+	mu sync.Mutex
+	// next is the offset in the file following the last read.
+	next soci.FileSize
+	// sequentialReads is the number of consecutive reads which started where the previous one ended.
+	sequentialReads int
+	// window is the number of spans fetched ahead the last time. It's 0 until the reads are sequential.
+	window int
+	// aheadEnd is the span following the last span fetched ahead.
+	aheadEnd soci.SpanId
+}
+
+// newReadahead returns the readahead of a layer as configured by `cfg`, which fetches spans from `r`.
+// It returns nil if readahead is disabled.
+func newReadahead(cfg config.ReadaheadConfig, spanManager *spanmanager.SpanManager, layerSha digest.Digest, r *io.SectionReader) *readahead {
+	if cfg.MaxSpans <= 0 {
+		return nil
+	}
+	if cfg.InitialSpans <= 0 {
+		cfg.InitialSpans = defaultReadaheadInitialSpans
+	}
+	if cfg.InitialSpans > cfg.MaxSpans {
+		cfg.InitialSpans = cfg.MaxSpans
+	}
+	if cfg.SequentialReads <= 0 {
+		cfg.SequentialReads = defaultReadaheadSequentialReads
+	}
+	return &readahead{
+		cfg:         cfg,
+		spanManager: spanManager,
+		layerSha:    layerSha,
+		r:           r,
+		spans:       make(map[soci.SpanId]struct{}),
+	}
+}
+
+// read records that `n` bytes have been read at `offset` of the file `sf`. If the reads of the file
+// are sequential, the spans following the read are fetched ahead, with a window growing up to MaxSpans
+// as long as the reads stay sequential.
+func (ra *readahead) read(sf *file, offset, n soci.FileSize) {
+	fileStart := sf.fr.GetUncompressedOffset()
+	ra.hit(ra.spanManager.SpanOf(fileStart+offset), ra.spanManager.SpanOf(fileStart+offset+n-1))
+
+	p := &sf.pattern
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if offset == p.next {
+		p.sequentialReads++
+	} else {
+		p.sequentialReads = 1
+		p.window = 0
+		p.aheadEnd = 0
+	}
+	p.next = offset + n
+	fileSize := sf.fr.GetUncompressedFileSize()
+	if p.sequentialReads < ra.cfg.SequentialReads || p.next >= fileSize {
+		return
+	}
+
+	cur := ra.spanManager.SpanOf(fileStart + p.next)
+	if p.aheadEnd-cur > soci.SpanId(p.window/2) {
+		// most of the spans fetched ahead are still to be read
+		return
+	}
+	window := ra.cfg.InitialSpans
+	if p.window > 0 {
+		window = p.window * 2
+		if window > ra.cfg.MaxSpans {
+			window = ra.cfg.MaxSpans
+		}
+	}
+	first := cur
+	if p.aheadEnd > first {
+		first = p.aheadEnd
+	}
+	end := cur + soci.SpanId(window)
+	if last := ra.spanManager.SpanOf(fileStart + fileSize - 1); end > last+1 {
+		end = last + 1
+	}
+	if first >= end {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&ra.busy, 0, 1) {
+		// another file is read ahead; try again at the next read
+		return
+	}
+	p.window = window
+	p.aheadEnd = end
+	go ra.fetch(first, end-1)
+}
+
+// fetch fetches the spans from `first` to `last` ahead of the reads.
+func (ra *readahead) fetch(first, last soci.SpanId) {
+	defer atomic.StoreInt32(&ra.busy, 0)
+	ids, err := ra.spanManager.FetchSpans(first, last, ra.r)
+	if err != nil {
+		// the spans will be fetched again when they're read
+		log.L.WithError(err).WithField("layer", ra.layerSha).Debugf("failed to read spans %d-%d ahead", first, last)
+		return
+	}
+	if len(ids) == 0 {
+		return
+	}
+	commonmetrics.AddOperationCount(commonmetrics.ReadaheadSpanCount, ra.layerSha, int64(len(ids)))
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	if ra.closed {
+		commonmetrics.AddOperationCount(commonmetrics.ReadaheadWastedSpanCount, ra.layerSha, int64(len(ids)))
+		return
+	}
+	for _, id := range ids {
+		ra.spans[id] = struct{}{}
+	}
+}
+
+// hit records the read of the spans from `first` to `last`, and counts the ones fetched ahead.
+func (ra *readahead) hit(first, last soci.SpanId) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	if len(ra.spans) == 0 {
+		return
+	}
+	var hits int64
+	for id := first; id <= last; id++ {
+		if _, ok := ra.spans[id]; ok {
+			delete(ra.spans, id)
+			hits++
+		}
+	}
+	if hits > 0 {
+		commonmetrics.AddOperationCount(commonmetrics.ReadaheadHitSpanCount, ra.layerSha, hits)
+	}
+}
+
+// close counts the spans fetched ahead which have never been read.
+func (ra *readahead) close() {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.closed = true
+	if len(ra.spans) > 0 {
+		commonmetrics.AddOperationCount(commonmetrics.ReadaheadWastedSpanCount, ra.layerSha, int64(len(ra.spans)))
+	}
+	ra.spans = nil
+}
@@ -41,11 +41,13 @@ package reader
 import (
 	"fmt"
 	"io"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/fs/config"
 	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
 	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
 	"github.com/awslabs/soci-snapshotter/metadata"
@@ -122,15 +124,31 @@ func (vr *VerifiableReader) isClosed() bool {
 	return closed
 }
 
+// Option is an option of NewReader.
+type Option func(*reader)
+
+// WithReadahead makes the reader fetch spans ahead of the sequential reads of files from `r`, as configured
+// by `cfg`. `r` should have a lower priority than the reader of the span manager.
+func WithReadahead(cfg config.ReadaheadConfig, r *io.SectionReader) Option {
+	return func(gr *reader) {
+		gr.readahead = newReadahead(cfg, gr.spanManager, gr.layerSha, r)
+	}
+}
+
 // NewReader creates a Reader based on the given soci blob and Span Manager.
 // It returns VerifiableReader so the caller must provide a metadata.ChunkVerifier
 // to use for verifying file or chunk contained in this stargz blob.
-func NewReader(r metadata.Reader, layerSha digest.Digest, spanManager *spanmanager.SpanManager) (*VerifiableReader, error) {
+func NewReader(r metadata.Reader, layerSha digest.Digest, spanManager *spanmanager.SpanManager, opts ...Option) (*VerifiableReader, error) {
 	vr := &reader{
 		spanManager: spanManager,
 		r:           r,
 		layerSha:    layerSha,
 		verifier:    digestVerifier,
+
+		fileVerifiers: make(map[uint32]*fileVerifier),
+	}
+	for _, o := range opts {
+		o(vr)
 	}
 	return &VerifiableReader{r: vr, verifier: digestVerifier}, nil
 }
@@ -148,6 +166,14 @@ type reader struct {
 
 	verify   bool
 	verifier func(uint32, string) (digest.Verifier, error)
+
+	// fileVerifiers verify the contents of files against their digests, keyed by file id.
+	// They are shared between all opens of a file.
+	fileVerifiers   map[uint32]*fileVerifier
+	fileVerifiersMu sync.Mutex
+
+	// readahead fetches spans ahead of sequential reads. It's nil if readahead is disabled.
+	readahead *readahead
 }
 
 func (gr *reader) Metadata() metadata.Reader {
@@ -180,9 +206,30 @@ func (gr *reader) OpenFile(id uint32) (io.ReaderAt, error) {
 		id: id,
 		fr: fr,
 		gr: gr,
+		v:  gr.fileVerifier(id, fr),
 	}, nil
 }
 
+// fileVerifier returns the verifier of the file. It returns nil if the digest of the file isn't recorded.
+func (gr *reader) fileVerifier(id uint32, fr metadata.File) *fileVerifier {
+	dgst := fr.GetDigest()
+	if dgst == "" || dgst.Validate() != nil {
+		return nil
+	}
+	gr.fileVerifiersMu.Lock()
+	defer gr.fileVerifiersMu.Unlock()
+	v, ok := gr.fileVerifiers[id]
+	if !ok {
+		v = &fileVerifier{
+			digest:   dgst,
+			size:     fr.GetUncompressedFileSize(),
+			digester: dgst.Algorithm().Digester(),
+		}
+		gr.fileVerifiers[id] = v
+	}
+	return v
+}
+
 func (gr *reader) Close() (retErr error) {
 	gr.closedMu.Lock()
 	defer gr.closedMu.Unlock()
@@ -190,6 +237,9 @@ func (gr *reader) Close() (retErr error) {
 		return nil
 	}
 	gr.closed = true
+	if gr.readahead != nil {
+		gr.readahead.close()
+	}
 	if err := gr.r.Close(); err != nil {
 		retErr = multierror.Append(retErr, err)
 	}
@@ -207,10 +257,19 @@ type file struct {
 	id uint32
 	fr metadata.File
 	gr *reader
+	v  *fileVerifier
+
+	// pattern tracks the reads of this open file for readahead.
+	pattern accessPattern
 }
 
 // ReadAt reads the file when the file is requested by the container
 func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
+	if sf.v != nil {
+		if err := sf.v.failure(); err != nil {
+			return 0, err
+		}
+	}
 	uncompFileSize := sf.fr.GetUncompressedFileSize()
 	if soci.FileSize(offset) >= uncompFileSize {
 		return 0, io.EOF
@@ -237,11 +296,122 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 	if soci.FileSize(n) != expectedSize {
 		return 0, fmt.Errorf("unexpected copied data size for on-demand fetch. read = %d, expected = %d", n, expectedSize)
 	}
+	if sf.v != nil {
+		if err := sf.v.verify(sf, soci.FileSize(offset), p[:n]); err != nil {
+			if errors.Is(err, ErrFileDigestMismatch) {
+				commonmetrics.IncOperationCount(commonmetrics.FileVerificationFailureCount, sf.gr.layerSha)
+			}
+			return 0, err
+		}
+	}
+	if sf.gr.readahead != nil && n > 0 {
+		sf.gr.readahead.read(sf, soci.FileSize(offset), soci.FileSize(n))
+	}
 	commonmetrics.AddBytesCount(commonmetrics.OnDemandBytesServed, sf.gr.layerSha, int64(n)) // measure the number of on demand bytes served
 
 	return n, nil
 }
 
+// ErrFileDigestMismatch is returned when the contents of a file don't match the digest recorded in the ztoc.
+var ErrFileDigestMismatch = errors.New("file digest mismatch")
+
+// fileRange is the range [start, end) of a file.
+type fileRange struct {
+	start, end soci.FileSize
+}
+
+// fileVerifier verifies the contents of a file against its digest once the whole file has been read.
+// The file is hashed while it's read sequentially from the beginning. If the file is read in any
+// other order, the whole file is read again from the span manager to be hashed once all of its
+// contents have been read, which only hits the cache by then.
+type fileVerifier struct {
+	digest digest.Digest
+	size   soci.FileSize
+
+	mu sync.Mutex
+	// digester hashes the file contents up to `next`. It's nil once the file isn't read sequentially.
+	digester digest.Digester
+	next     soci.FileSize
+	// ranges are the sorted non-overlapping ranges of the file which have been read.
+	ranges   []fileRange
+	verified bool
+	err      error
+}
+
+// failure returns the error of the verification if the file failed it.
+func (v *fileVerifier) failure() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.err
+}
+
+// verify records that `contents` of the file have been read at `offset` and verifies the file
+// if it has been fully read.
+func (v *fileVerifier) verify(sf *file, offset soci.FileSize, contents []byte) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.verified || v.err != nil {
+		return v.err
+	}
+	if v.digester != nil {
+		if offset == v.next {
+			v.digester.Hash().Write(contents)
+			v.next += soci.FileSize(len(contents))
+		} else if offset > v.next || offset+soci.FileSize(len(contents)) > v.next {
+			// the file isn't read sequentially anymore, unless the contents have been hashed already
+			v.digester = nil
+		}
+	}
+	v.addRange(fileRange{offset, offset + soci.FileSize(len(contents))})
+	if len(v.ranges) != 1 || v.ranges[0] != (fileRange{0, v.size}) {
+		return nil
+	}
+
+	var actual digest.Digest
+	if v.digester != nil {
+		actual = v.digester.Digest()
+	} else {
+		start := sf.fr.GetUncompressedOffset()
+		r, err := sf.gr.spanManager.GetContents(start, start+v.size)
+		if err != nil {
+			return errors.Wrap(err, "failed to read the file for verification")
+		}
+		digester := v.digest.Algorithm().Digester()
+		if _, err := io.Copy(digester.Hash(), r); err != nil {
+			return errors.Wrap(err, "failed to read the file for verification")
+		}
+		actual = digester.Digest()
+	}
+	v.digester = nil
+	v.ranges = nil
+	if actual != v.digest {
+		v.err = errors.Wrapf(ErrFileDigestMismatch, "file %d: expected %s, got %s", sf.id, v.digest, actual)
+		return v.err
+	}
+	v.verified = true
+	return nil
+}
+
+// addRange adds `r` to the ranges read, merging it with the ranges it overlaps or touches.
+func (v *fileVerifier) addRange(r fileRange) {
+	// the first range which ends at or after the start of r
+	i := sort.Search(len(v.ranges), func(i int) bool {
+		return v.ranges[i].end >= r.start
+	})
+	j := i
+	for ; j < len(v.ranges) && v.ranges[j].start <= r.end; j++ {
+		if v.ranges[j].start < r.start {
+			r.start = v.ranges[j].start
+		}
+		if v.ranges[j].end > r.end {
+			r.end = v.ranges[j].end
+		}
+	}
+	ranges := append([]fileRange{}, v.ranges[:i]...)
+	ranges = append(ranges, r)
+	v.ranges = append(ranges, v.ranges[j:]...)
+}
+
 type CacheOption func(*cacheOptions)
 
 type cacheOptions struct {
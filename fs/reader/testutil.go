@@ -41,12 +41,17 @@ package reader
 import (
 	"bytes"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/fs/config"
 	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
 	"github.com/awslabs/soci-snapshotter/metadata"
 	"github.com/awslabs/soci-snapshotter/soci"
@@ -66,6 +71,8 @@ var spanSizeCond = [3]int64{64, 128, 256}
 func TestSuiteReader(t *testing.T, store metadata.Store) {
 	testFileReadAt(t, store)
 	testFailReader(t, store)
+	testFileVerification(t, store)
+	testReadahead(t, store)
 }
 
 func testFileReadAt(t *testing.T, factory metadata.Store) {
@@ -119,7 +126,7 @@ func testFileReadAt(t *testing.T, factory metadata.Store) {
 							}
 
 							// data we get through a file.
-							f, closeFn := makeFile(t, []byte(sampleData1)[:filesize], factory, spanSize)
+							f, _, closeFn := makeFile(t, []byte(sampleData1)[:filesize], factory, spanSize)
 							defer closeFn()
 
 							// read the file
@@ -141,7 +148,8 @@ func testFileReadAt(t *testing.T, factory metadata.Store) {
 	}
 }
 
-func makeFile(t *testing.T, contents []byte, factory metadata.Store, spanSize int64) (*file, func() error) {
+// makeFile returns the file of a layer with `contents`, and the reader of the layer.
+func makeFile(t *testing.T, contents []byte, factory metadata.Store, spanSize int64) (*file, *io.SectionReader, func() error) {
 	testName := "test"
 	tarEntry := []testutil.TarEntry{
 		testutil.File(testName, string(contents)),
@@ -155,7 +163,11 @@ func makeFile(t *testing.T, contents []byte, factory metadata.Store, spanSize in
 	if err != nil {
 		t.Fatalf("failed to create reader: %v", err)
 	}
-	spanManager := spanmanager.New(ztoc, sr, cache.NewMemoryCache())
+	spanManager, err := spanmanager.New(ztoc, sr, cache.NewMemoryCache())
+	if err != nil {
+		mr.Close()
+		t.Fatalf("failed to create span manager: %v", err)
+	}
 	vr, err := NewReader(mr, digest.FromString(""), spanManager)
 	if err != nil {
 		mr.Close()
@@ -177,7 +189,7 @@ func makeFile(t *testing.T, contents []byte, factory metadata.Store, spanSize in
 		vr.Close()
 		t.Fatalf("invalid type of file %q", tid)
 	}
-	return f, vr.Close
+	return f, sr, vr.Close
 }
 
 func testFailReader(t *testing.T, factory metadata.Store) {
@@ -211,7 +223,11 @@ func testFailReader(t *testing.T, factory metadata.Store) {
 			if !found {
 				t.Fatalf("free ID not found")
 			}
-			spanManager := spanmanager.New(ztoc, sr, cache.NewMemoryCache())
+			spanManager, err := spanmanager.New(ztoc, sr, cache.NewMemoryCache())
+			if err != nil {
+				mr.Close()
+				t.Fatalf("failed to create span manager: %v", err)
+			}
 			vr, err := NewReader(mr, digest.FromString(""), spanManager)
 			if err != nil {
 				mr.Close()
@@ -243,3 +259,102 @@ func testFailReader(t *testing.T, factory metadata.Store) {
 		})
 	}
 }
+
+func testFileVerification(t *testing.T, factory metadata.Store) {
+	contents := []byte(strings.Repeat(sampleData1, 100))
+	readOrders := map[string][]int64{
+		"sequential":   {0, 100, 200, 300, 400, 500, 600, 700, 800, 900},
+		"out_of_order": {500, 0, 900, 300, 100, 700, 200, 800, 400, 600},
+		"overlapping":  {0, 50, 450, 400, 150, 100, 600, 550, 900, 850, 700, 800, 250, 300},
+		"reversed":     {900, 800, 700, 600, 500, 400, 300, 200, 100, 0},
+	}
+	for name, offsets := range readOrders {
+		for _, corrupted := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s_corrupted_%v", name, corrupted), func(t *testing.T) {
+				f, _, closeFn := makeFile(t, contents, factory, spanSizeCond[0])
+				defer closeFn()
+				if f.v == nil {
+					t.Fatalf("file digest isn't recorded")
+				}
+				if corrupted {
+					wrong := digest.FromString("wrong")
+					f.v.digest = wrong
+					f.v.digester = wrong.Algorithm().Digester()
+				}
+
+				var err error
+				for i, off := range offsets {
+					_, err = f.ReadAt(make([]byte, 100), off)
+					if err != nil && i != len(offsets)-1 {
+						t.Fatalf("failed to read off=%d before the file is fully read: %v", off, err)
+					}
+				}
+				if !corrupted {
+					if err != nil {
+						t.Fatalf("failed to verify the file: %v", err)
+					}
+					return
+				}
+				if !errors.Is(err, ErrFileDigestMismatch) {
+					t.Fatalf("unexpected error of the last read; expected %v, got %v", ErrFileDigestMismatch, err)
+				}
+				if _, err := f.ReadAt(make([]byte, 100), 0); !errors.Is(err, ErrFileDigestMismatch) {
+					t.Fatalf("unexpected error after a verification failure; expected %v, got %v", ErrFileDigestMismatch, err)
+				}
+			})
+		}
+	}
+}
+
+func testReadahead(t *testing.T, factory metadata.Store) {
+	// deflate blocks, hence spans, of random letters are smaller than the ones of random bytes
+	contents := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(contents)
+	for i := range contents {
+		contents[i] = 'a' + contents[i]%16
+	}
+	const readSize = 4096
+	cfg := config.ReadaheadConfig{MaxSpans: 8}
+	readOrders := map[string]func(off int64) int64{
+		"sequential": func(off int64) int64 { return off },
+		"reversed":   func(off int64) int64 { return int64(len(contents)) - readSize - off },
+	}
+	for name, order := range readOrders {
+		t.Run(fmt.Sprintf("readahead_%s", name), func(t *testing.T) {
+			f, sr, closeFn := makeFile(t, contents, factory, 1024)
+			defer closeFn()
+			ra := newReadahead(cfg, f.gr.spanManager, f.gr.layerSha, sr)
+			f.gr.readahead = ra
+
+			var fetchedAhead bool
+			for off := int64(0); off < int64(len(contents)); off += readSize {
+				readOff := order(off)
+				p := make([]byte, readSize)
+				n, err := f.ReadAt(p, readOff)
+				if err != nil {
+					t.Fatalf("failed to read off=%d: %v", readOff, err)
+				}
+				if !bytes.Equal(p[:n], contents[readOff:readOff+int64(n)]) {
+					t.Fatalf("unexpected contents at off=%d", readOff)
+				}
+				for atomic.LoadInt32(&ra.busy) != 0 {
+					time.Sleep(time.Millisecond)
+				}
+				ra.mu.Lock()
+				fetchedAhead = fetchedAhead || len(ra.spans) > 0
+				ra.mu.Unlock()
+			}
+
+			sequential := name == "sequential"
+			if fetchedAhead != sequential {
+				t.Fatalf("unexpected readahead; expected %v, got %v", sequential, fetchedAhead)
+			}
+			if sequential && f.pattern.window != cfg.MaxSpans {
+				t.Fatalf("readahead window didn't grow to %d: %d", cfg.MaxSpans, f.pattern.window)
+			}
+			if len(ra.spans) != 0 {
+				t.Fatalf("%d spans fetched ahead haven't been read", len(ra.spans))
+			}
+		})
+	}
+}
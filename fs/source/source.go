@@ -102,6 +102,14 @@ const (
 	TargetImgManifestDigestLabel = "containerd.io/snapshot/remote/image.manifest.digest"
 
 	TargetSociIndexDigestLabel = "containerd.io/snapshot/remote/soci.index.digest"
+
+	// TargetSociProfileLabel is a label which contains the ID of a profile recording the accesses to
+	// the files of the layer. Accesses aren't recorded without this label.
+	TargetSociProfileLabel = "containerd.io/snapshot/remote/soci.profile"
+
+	// TargetSociPrefetchPriorityLabel is a label which contains a comma-separated list of the spans
+	// and files of the layer to fetch first in background. Files are absolute paths in the layer.
+	TargetSociPrefetchPriorityLabel = "containerd.io/snapshot/remote/soci.prefetch-priority"
 )
 
 // FromDefaultLabels returns a function for converting snapshot labels to
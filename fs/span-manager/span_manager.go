@@ -16,24 +16,18 @@
 
 package spanmanager
 
-// #cgo CFLAGS: -I${SRCDIR}/../../c/
-// #cgo LDFLAGS: -L${SRCDIR}/../../out -lindexer -lz
-// #include "indexer.h"
-// #include <stdlib.h>
-// #include <stdio.h>
-import "C"
-
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"runtime"
-	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
-	"unsafe"
 
 	"github.com/awslabs/soci-snapshotter/cache"
 	"github.com/awslabs/soci-snapshotter/soci"
@@ -41,6 +35,10 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
+// maxCoalescedReadSize is the maximum size of the compressed contents fetched by a single read
+// when the reads of contiguous spans are coalesced. Longer runs of spans are split.
+const maxCoalescedReadSize soci.FileSize = 4 << 20 // 4 MiB
+
 type spanState int
 
 const (
@@ -55,11 +53,12 @@ const (
 )
 
 // map of valid span transtions. Key is the current state and value is valid new states.
+// Fetched and Uncompressed spans are requested again once their contents are evicted from the cache.
 var stateTransitionMap = map[spanState][]spanState{
 	unrequested:  {unrequested, requested},
 	requested:    {requested, fetched},
-	fetched:      {fetched, uncompressed},
-	uncompressed: {uncompressed},
+	fetched:      {fetched, uncompressed, requested},
+	uncompressed: {uncompressed, requested},
 }
 
 var (
@@ -77,6 +76,12 @@ type span struct {
 	endUncompOffset   soci.FileSize
 	state             atomic.Value
 	mu                sync.Mutex
+
+	// keys of the compressed and uncompressed contents of the span in the cache, computed once
+	keysOnce        sync.Once
+	compressedKey   string
+	uncompressedKey string
+	keysErr         error
 }
 
 func (s *span) setState(state spanState) error {
@@ -98,13 +103,21 @@ func (s *span) validateStateTransition(newState spanState) error {
 	return errInvalidSpanStateTransition
 }
 
+// SpanManager fetches, uncompresses and caches the spans of a layer. Spans are cached by content,
+// so the cache can be shared by the span managers of all layers: a span already cached for a layer
+// isn't fetched again for another layer with the same span, e.g. the same layer of another image.
 type SpanManager struct {
 	cache    cache.BlobCache
 	cacheOpt []cache.Option
-	index    *C.struct_gzip_index
+	zinfo    soci.Zinfo
 	r        *io.SectionReader // reader for contents of the spans managed by SpanManager
 	spans    []*span
 	ztoc     *soci.Ztoc
+	// privateKeyPrefix is the prefix of the cache keys of the contents which can't be shared with
+	// other layers, because they can't be identified by their digest.
+	privateKeyPrefix string
+	// maxReadSize bounds the size of the coalesced reads of spans.
+	maxReadSize soci.FileSize
 }
 
 type spanInfo struct {
@@ -120,46 +133,46 @@ type spanInfo struct {
 	spanIndexInBuf []soci.FileSize
 }
 
-func New(ztoc *soci.Ztoc, r *io.SectionReader, cache cache.BlobCache, cacheOpt ...cache.Option) *SpanManager {
-	index := C.blob_to_index(unsafe.Pointer(&ztoc.IndexByteData[0]))
+// New returns a span manager for the layer of `ztoc`, whose contents are read from `r`. The spans are
+// cached in `cache`, which may be shared with other span managers. It isn't closed with the span manager.
+func New(ztoc *soci.Ztoc, r *io.SectionReader, cache cache.BlobCache, cacheOpt ...cache.Option) (*SpanManager, error) {
+	zinfo, err := ztoc.Zinfo()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get checkpoints of the ztoc: %w", err)
+	}
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		zinfo.Close()
+		return nil, err
+	}
 	spans := make([]*span, ztoc.MaxSpanId+1)
 	m := &SpanManager{
-		cache:    cache,
-		cacheOpt: cacheOpt,
-		index:    index,
-		r:        r,
-		spans:    spans,
-		ztoc:     ztoc,
+		cache:            cache,
+		cacheOpt:         cacheOpt,
+		zinfo:            zinfo,
+		r:                r,
+		spans:            spans,
+		ztoc:             ztoc,
+		privateKeyPrefix: hex.EncodeToString(nonce[:]),
+		maxReadSize:      maxCoalescedReadSize,
 	}
 	m.buildAllSpans()
 	runtime.SetFinalizer(m, func(m *SpanManager) {
 		m.Close()
 	})
 
-	return m
+	return m, nil
 }
 
 func (m *SpanManager) buildAllSpans() {
-	m.spans[0] = &span{
-		id:                0,
-		startCompOffset:   soci.FileSize(C.get_comp_off(m.index, C.int(0))),
-		endCompOffset:     m.getEndCompressedOffset(0),
-		startUncompOffset: soci.FileSize(C.get_ucomp_off(m.index, C.int(0))),
-		endUncompOffset:   m.getEndUncompressedOffset(0),
-	}
-	m.spans[0].state.Store(unrequested)
 	var i soci.SpanId
-	for i = 1; i <= m.ztoc.MaxSpanId; i++ {
-		startCompOffset := m.spans[i-1].endCompOffset
-		if C.has_bits(m.index, C.int(i)) != 0 {
-			startCompOffset -= 1
-		}
+	for i = 0; i <= m.ztoc.MaxSpanId; i++ {
 		s := span{
 			id:                i,
-			startCompOffset:   startCompOffset,
-			endCompOffset:     m.getEndCompressedOffset(i),
-			startUncompOffset: m.spans[i-1].endUncompOffset,
-			endUncompOffset:   m.getEndUncompressedOffset(i),
+			startCompOffset:   m.zinfo.StartCompressedOffset(i),
+			endCompOffset:     m.zinfo.EndCompressedOffset(i, m.ztoc.CompressedFileSize),
+			startUncompOffset: m.zinfo.StartUncompressedOffset(i),
+			endUncompOffset:   m.zinfo.EndUncompressedOffset(i, m.ztoc.UncompressedFileSize),
 		}
 		m.spans[i] = &s
 		m.spans[i].state.Store(unrequested)
@@ -171,22 +184,20 @@ func (m *SpanManager) ResolveSpan(spanId soci.SpanId, r *io.SectionReader) error
 		return ErrExceedMaxSpan
 	}
 
-	// Check if the span exists in the cache
+	// Check if the span exists in the cache. It may have been cached for another layer with the same span.
 	s := m.spans[spanId]
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	state := s.state.Load().(spanState)
-	if state == uncompressed {
-		id := strconv.Itoa(int(spanId))
-		_, err := m.cache.Get(id)
-		if err == nil {
-			// The span is already in cache.
-			return nil
-		}
+	cached, err := m.isSpanCached(s)
+	if err != nil {
+		return err
+	}
+	if cached {
+		return nil
 	}
 
 	// The span is not available in cache. Fetch the span and add it to cache
-	_, err := m.fetchAndCacheSpan(spanId, r, true)
+	_, err = m.fetchAndCacheSpan(spanId, r, true)
 	if err != nil {
 		return err
 	}
@@ -196,11 +207,17 @@ func (m *SpanManager) ResolveSpan(spanId soci.SpanId, r *io.SectionReader) error
 
 // GetContents returns a reader for the requested contents.
 // offsetStart and offsetEnd are start and end uncompressed offsets of the file.
+// Contiguous spans missing from the cache are fetched together, with a single read of the layer.
 func (m *SpanManager) GetContents(offsetStart, offsetEnd soci.FileSize) (io.Reader, error) {
 	si := m.getSpanInfo(offsetStart, offsetEnd)
 	numSpans := si.spanEnd - si.spanStart + 1
 	spanReaders := make([]io.Reader, numSpans)
 
+	fetchedSpans, err := m.fetchMissingSpans(si.spanStart, si.spanEnd)
+	if err != nil {
+		return nil, err
+	}
+
 	eg, _ := errgroup.WithContext(context.Background())
 	var i soci.SpanId
 	for i = 0; i < numSpans; i++ {
@@ -208,6 +225,10 @@ func (m *SpanManager) GetContents(offsetStart, offsetEnd soci.FileSize) (io.Read
 		eg.Go(func() error {
 			spanContentSize := si.endOffInSpan[j] - si.startOffInSpan[j]
 			spanId := j + si.spanStart
+			if buf, ok := fetchedSpans[spanId]; ok {
+				spanReaders[j] = bytes.NewReader(buf[si.startOffInSpan[j]:si.endOffInSpan[j]])
+				return nil
+			}
 			r, err := m.GetSpanContent(spanId, si.startOffInSpan[j], si.endOffInSpan[j], spanContentSize)
 			if err != nil {
 				return err
@@ -223,10 +244,169 @@ func (m *SpanManager) GetContents(offsetStart, offsetEnd soci.FileSize) (io.Read
 	return io.MultiReader(spanReaders...), nil
 }
 
+// fetchMissingSpans fetches the spans from `first` to `last` which aren't in the cache, coalescing the reads
+// of contiguous spans up to maxReadSize bytes, and caches them. It returns the uncompressed contents of the
+// spans it fetched. Spans are locked in ascending order, so concurrent calls with overlapping spans don't deadlock.
+func (m *SpanManager) fetchMissingSpans(first, last soci.SpanId) (map[soci.SpanId][]byte, error) {
+	fetchedSpans := make(map[soci.SpanId][]byte)
+	var run []*span
+	unlockRun := func() {
+		for _, s := range run {
+			s.mu.Unlock()
+		}
+		run = nil
+	}
+	defer unlockRun()
+	flush := func() error {
+		if len(run) == 0 {
+			return nil
+		}
+		bufs, err := m.fetchAndCacheSpans(run)
+		if err != nil {
+			return err
+		}
+		for i, s := range run {
+			fetchedSpans[s.id] = bufs[i]
+		}
+		unlockRun()
+		return nil
+	}
+
+	for id := first; id <= last; id++ {
+		s := m.spans[id]
+		cached, err := m.isSpanCached(s)
+		if err != nil {
+			return nil, err
+		}
+		if !cached {
+			s.mu.Lock()
+			// check again in case we raced with another thread
+			if cached, err = m.isSpanCached(s); err != nil {
+				s.mu.Unlock()
+				return nil, err
+			}
+			if !cached {
+				if len(run) > 0 && s.endCompOffset-run[0].startCompOffset > m.maxReadSize {
+					if err := flush(); err != nil {
+						s.mu.Unlock()
+						return nil, err
+					}
+				}
+				run = append(run, s)
+				continue
+			}
+			s.mu.Unlock()
+		}
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return fetchedSpans, nil
+}
+
+// FetchSpans fetches the spans from `first` to `last` which aren't cached yet from `r`, coalescing the reads of
+// contiguous spans up to maxReadSize bytes, and caches them uncompressed. It returns the IDs of the spans it
+// fetched, in order.
+//
+// Unlike on-demand reads, the spans aren't locked while they're fetched, so reads of the spans don't wait
+// for them; spans cached by other reads in the meantime are skipped once fetched.
+func (m *SpanManager) FetchSpans(first, last soci.SpanId, r *io.SectionReader) ([]soci.SpanId, error) {
+	if first < 0 || last > m.ztoc.MaxSpanId {
+		return nil, ErrExceedMaxSpan
+	}
+	var ids []soci.SpanId
+	var run []*span
+	flush := func() error {
+		if len(run) == 0 {
+			return nil
+		}
+		fetched, err := m.fetchUnlockedSpans(run, r)
+		ids = append(ids, fetched...)
+		run = nil
+		return err
+	}
+	for id := first; id <= last; id++ {
+		s := m.spans[id]
+		cached, err := m.isSpanCached(s)
+		if err != nil {
+			return ids, err
+		}
+		if cached || (len(run) > 0 && s.endCompOffset-run[0].startCompOffset > m.maxReadSize) {
+			if err := flush(); err != nil {
+				return ids, err
+			}
+		}
+		if !cached {
+			run = append(run, s)
+		}
+	}
+	return ids, flush()
+}
+
+// fetchUnlockedSpans reads the compressed contents of the contiguous spans of `run` from `r` at once without
+// locking them, then caches each span which still isn't cached. It returns the IDs of the spans it cached.
+func (m *SpanManager) fetchUnlockedSpans(run []*span, r *io.SectionReader) ([]soci.SpanId, error) {
+	start := run[0].startCompOffset
+	buf := make([]byte, run[len(run)-1].endCompOffset-start)
+	n, err := r.ReadAt(buf, int64(start))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	var ids []soci.SpanId
+	for _, s := range run {
+		if end := s.endCompOffset - start; int(end) > n {
+			return ids, fmt.Errorf("unexpected data size for reading compressed spans %d-%d. read = %d, expected = %d", run[0].id, run[len(run)-1].id, n, len(buf))
+		}
+		cached, err := m.cacheUnlockedSpan(s, buf[s.startCompOffset-start:s.endCompOffset-start])
+		if err != nil {
+			return ids, err
+		}
+		if cached {
+			ids = append(ids, s.id)
+		}
+	}
+	return ids, nil
+}
+
+// cacheUnlockedSpan caches the compressed contents of the span fetched without locking it, unless the
+// span has been cached in the meantime. It returns true if it cached the span.
+func (m *SpanManager) cacheUnlockedSpan(s *span, compressedBuf []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cached, err := m.isSpanCached(s)
+	if err != nil || cached {
+		return false, err
+	}
+	if err := s.setState(requested); err != nil {
+		return false, err
+	}
+	if _, err := m.cacheSpan(s, compressedBuf, false); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SpanOf returns the ID of the span which contains the uncompressed offset `offset` of the layer.
+func (m *SpanManager) SpanOf(offset soci.FileSize) soci.SpanId {
+	return m.zinfo.UncompressedOffsetToSpanId(offset)
+}
+
+// isSpanCached returns true if the contents of the span are in the cache, compressed or uncompressed.
+func (m *SpanManager) isSpanCached(s *span) (bool, error) {
+	compressedKey, uncompressedKey, err := m.cacheKeys(s)
+	if err != nil {
+		return false, err
+	}
+	return m.isCached(uncompressedKey) || (!m.isUncompressedLayer() && m.isCached(compressedKey)), nil
+}
+
 // getSpanInfo returns spanInfo from the offsets of the requested file
 func (m *SpanManager) getSpanInfo(offsetStart, offsetEnd soci.FileSize) *spanInfo {
-	spanStart := soci.SpanId(C.pt_index_from_ucmp_offset(m.index, C.long(offsetStart)))
-	spanEnd := soci.SpanId(C.pt_index_from_ucmp_offset(m.index, C.long(offsetEnd)))
+	spanStart := m.zinfo.UncompressedOffsetToSpanId(offsetStart)
+	spanEnd := m.zinfo.UncompressedOffsetToSpanId(offsetEnd)
 	numSpans := spanEnd - spanStart + 1
 	start := make([]soci.FileSize, numSpans)
 	end := make([]soci.FileSize, numSpans)
@@ -288,10 +468,10 @@ func (m *SpanManager) GetSpanContent(spanId soci.SpanId, offsetStart, offsetEnd,
 	return io.Reader(buf), nil
 }
 
-// getSpanFromCache returns the reader for the contents of the span stored in the cache.
+// getSpanFromCache returns the reader for the contents of the span stored in the cache with the key `key`.
 // offset is the offset of the requested contents within the span. size is the size of the requested contents.
-func (m *SpanManager) getSpanFromCache(spanId string, offset, size soci.FileSize) (io.Reader, error) {
-	r, err := m.cache.Get(spanId)
+func (m *SpanManager) getSpanFromCache(key string, offset, size soci.FileSize) (io.Reader, error) {
+	r, err := m.cache.Get(key)
 	if err != nil {
 		return nil, ErrSpanNotAvailable
 	}
@@ -311,9 +491,50 @@ func (m *SpanManager) verifySpanContents(compressedData []byte, id soci.SpanId)
 	return nil
 }
 
-// addSpanToCache adds contents of the span to the cache.
-func (m *SpanManager) addSpanToCache(spanId string, contents []byte, opts ...cache.Option) {
-	if w, err := m.cache.Add(spanId, opts...); err == nil {
+// isCached returns true if contents with the key `key` are in the cache.
+// The contents aren't verified, so reading them may still miss.
+func (m *SpanManager) isCached(key string) bool {
+	return m.cache.Exists(key)
+}
+
+// cacheKeys returns the keys of the compressed and uncompressed contents of the span in the cache.
+func (m *SpanManager) cacheKeys(s *span) (compressedKey, uncompressedKey string, err error) {
+	s.keysOnce.Do(func() {
+		s.compressedKey, s.uncompressedKey, s.keysErr = m.buildCacheKeys(s)
+	})
+	return s.compressedKey, s.uncompressedKey, s.keysErr
+}
+
+// buildCacheKeys builds the cache keys of the span from its digest, so that identical spans of different
+// layers share their cache entries. Contents whose digest isn't known get keys private to the span manager.
+func (m *SpanManager) buildCacheKeys(s *span) (compressedKey, uncompressedKey string, err error) {
+	// private keys contain "-", unlike encoded digests; see IsPrivateCacheKey
+	privateKey := fmt.Sprintf("%s-%d", m.privateKeyPrefix, s.id)
+	if len(m.ztoc.ZtocInfo.SpanDigests) != int(m.ztoc.MaxSpanId)+1 {
+		return privateKey + "-compressed", privateKey, nil
+	}
+	spanDigest := m.ztoc.ZtocInfo.SpanDigests[s.id]
+	key, err := soci.UncompressedSpanKey(m.zinfo, s.id, spanDigest, s.endUncompOffset-s.startUncompOffset)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot get cache key of span %d: %w", s.id, err)
+	}
+	if m.hasUncompressedSpanDigests() {
+		// only the uncompressed contents are verified
+		return privateKey + "-compressed", key.Encoded(), nil
+	}
+	return spanDigest.Encoded(), key.Encoded(), nil
+}
+
+// IsPrivateCacheKey returns true if `key` is the cache key of contents which only the span manager which
+// cached them can read, because they aren't identified by their digest. Such contents are useless once
+// their span manager is gone, e.g. after a restart.
+func IsPrivateCacheKey(key string) bool {
+	return strings.Contains(key, "-")
+}
+
+// addSpanToCache adds contents of the span to the cache with the key `key`.
+func (m *SpanManager) addSpanToCache(key string, contents []byte, opts ...cache.Option) {
+	if w, err := m.cache.Add(key, opts...); err == nil {
 		if n, err := w.Write(contents); err != nil || n != len(contents) {
 			w.Abort()
 		} else {
@@ -323,25 +544,24 @@ func (m *SpanManager) addSpanToCache(spanId string, contents []byte, opts ...cac
 	}
 }
 
-// resolveSpanFromCache resolves the span (in Fetched/Uncompressed state) from the cache.
+// resolveSpanFromCache resolves the span from the cache. The span may have been cached by this span manager
+// (in Fetched/Uncompressed state), or by the span manager of another layer with the same span.
 // This method returns the reader for the uncompressed span.
-// For Uncompressed span, directly return the reader from the cache.
-// For Fetched span, get the compressed span from the cache, uncompress it, cache the uncompressed span and
+// If the uncompressed span is cached, directly return the reader from the cache.
+// If only the compressed span is cached, uncompress it, cache the uncompressed span and
 // returns the reader for the uncompressed span.
 func (m *SpanManager) resolveSpanFromCache(s *span, offsetStart, size soci.FileSize) (io.Reader, error) {
-	id := fmt.Sprintf("%d", s.id)
-	state := s.state.Load().(spanState)
-	if state == uncompressed {
-		r, err := m.getSpanFromCache(id, offsetStart, size)
-		if err != nil {
-			return nil, err
-		}
+	compressedKey, uncompressedKey, err := m.cacheKeys(s)
+	if err != nil {
+		return nil, err
+	}
+	if r, err := m.getSpanFromCache(uncompressedKey, offsetStart, size); err == nil {
 		return r, nil
 	}
-	if state == fetched {
+	if !m.isUncompressedLayer() {
 		// get the compressed span from the cache
 		compressedSize := s.endCompOffset - s.startCompOffset
-		r, err := m.getSpanFromCache(id, 0, compressedSize)
+		r, err := m.getSpanFromCache(compressedKey, 0, compressedSize)
 		if err != nil {
 			return nil, err
 		}
@@ -359,12 +579,14 @@ func (m *SpanManager) resolveSpanFromCache(s *span, offsetStart, size soci.FileS
 		}
 
 		// cache the uncompressed span
-		m.addSpanToCache(id, uncompSpanBuf, m.cacheOpt...)
-		err = s.setState(uncompressed)
-		if err != nil {
-			return nil, err
+		m.addSpanToCache(uncompressedKey, uncompSpanBuf, m.cacheOpt...)
+		if s.state.Load().(spanState) == fetched {
+			err = s.setState(uncompressed)
+			if err != nil {
+				return nil, err
+			}
 		}
-		return bytes.NewReader(uncompSpanBuf[offsetStart:]), nil
+		return bytes.NewReader(uncompSpanBuf[offsetStart : offsetStart+size]), nil
 	}
 	return nil, ErrSpanNotAvailable
 }
@@ -387,18 +609,22 @@ func (m *SpanManager) fetchSpan(buf []byte, spanId soci.SpanId, r *io.SectionRea
 
 func (m *SpanManager) uncompressSpan(s *span, compressedBuf []byte) ([]byte, error) {
 	uncompSize := s.endUncompOffset - s.startUncompOffset
-	bytes := make([]byte, uncompSize)
 
 	// Theoretically, a span can be empty. If that happens, just return an empty buffer.
 	if uncompSize == 0 {
-		return bytes, nil
+		return []byte{}, nil
 	}
 
-	ret := C.extract_data_from_buffer(unsafe.Pointer(&compressedBuf[0]), C.off_t(len(compressedBuf)), m.index, C.off_t(s.startUncompOffset), unsafe.Pointer(&bytes[0]), C.off_t(uncompSize), C.int(s.id))
-	if ret <= 0 {
-		return bytes, fmt.Errorf("error extracting data; return code: %v", ret)
+	uncompSpanBuf, err := m.zinfo.ExtractDataFromBuffer(compressedBuf, uncompSize, s.startUncompOffset, s.id)
+	if err != nil {
+		return nil, err
 	}
-	return bytes, nil
+	if m.hasUncompressedSpanDigests() {
+		if err := m.verifySpanContents(uncompSpanBuf, s.id); err != nil {
+			return nil, err
+		}
+	}
+	return uncompSpanBuf, nil
 }
 
 func (m *SpanManager) fetchAndCacheSpan(spanId soci.SpanId, r *io.SectionReader, isPrefetch bool) ([]byte, error) {
@@ -409,18 +635,60 @@ func (m *SpanManager) fetchAndCacheSpan(spanId soci.SpanId, r *io.SectionReader,
 	if err != nil && err != io.EOF {
 		return nil, err
 	}
+	return m.cacheSpan(s, compressedBuf, isPrefetch)
+}
 
-	if err := m.verifySpanContents(compressedBuf, spanId); err != nil {
+// fetchAndCacheSpans fetches the contiguous spans `run` with a single read, then verifies, uncompresses
+// and caches each of them. The caller must hold the locks of the spans. It returns the uncompressed spans.
+func (m *SpanManager) fetchAndCacheSpans(run []*span) ([][]byte, error) {
+	start := run[0].startCompOffset
+	buf := make([]byte, run[len(run)-1].endCompOffset-start)
+	for _, s := range run {
+		if err := s.setState(requested); err != nil {
+			return nil, err
+		}
+	}
+	n, err := m.r.ReadAt(buf, int64(start))
+	if err != nil && err != io.EOF {
 		return nil, err
 	}
-	err = s.setState(fetched)
+	uncompSpanBufs := make([][]byte, len(run))
+	for i, s := range run {
+		if end := s.endCompOffset - start; int(end) > n {
+			// the spans read entirely are still cached
+			return nil, fmt.Errorf("unexpected data size for reading compressed spans %d-%d. read = %d, expected = %d", run[0].id, run[len(run)-1].id, n, len(buf))
+		}
+		// the compressed data of consecutive gzip spans may share a byte
+		compressedBuf := buf[s.startCompOffset-start : s.endCompOffset-start]
+		if uncompSpanBufs[i], err = m.cacheSpan(s, compressedBuf, false); err != nil {
+			return nil, err
+		}
+	}
+	return uncompSpanBufs, nil
+}
+
+// cacheSpan verifies the compressed contents of the span, which have just been fetched, and caches them.
+// Prefetched spans are cached compressed, except for uncompressed layers. The other spans are uncompressed
+// and cached uncompressed, in which case the uncompressed contents are returned.
+func (m *SpanManager) cacheSpan(s *span, compressedBuf []byte, isPrefetch bool) ([]byte, error) {
+	if !m.hasUncompressedSpanDigests() {
+		if err := m.verifySpanContents(compressedBuf, s.id); err != nil {
+			return nil, err
+		}
+	}
+	err := s.setState(fetched)
 	if err != nil {
 		return nil, err
 	}
 
-	id := strconv.Itoa(int(spanId))
-	if isPrefetch {
-		m.addSpanToCache(id, compressedBuf, m.cacheOpt...)
+	compressedKey, uncompressedKey, err := m.cacheKeys(s)
+	if err != nil {
+		return nil, err
+	}
+	// The contents of spans of uncompressed layers can be cached as they are fetched,
+	// so they are always stored in Uncompressed state.
+	if isPrefetch && !m.isUncompressedLayer() {
+		m.addSpanToCache(compressedKey, compressedBuf, m.cacheOpt...)
 		if err != nil {
 			return nil, err
 		} else {
@@ -433,7 +701,7 @@ func (m *SpanManager) fetchAndCacheSpan(spanId soci.SpanId, r *io.SectionReader,
 		}
 
 		// Cache the content of the whole span
-		m.addSpanToCache(id, uncompSpanBuf, m.cacheOpt...)
+		m.addSpanToCache(uncompressedKey, uncompSpanBuf, m.cacheOpt...)
 		err = s.setState(uncompressed)
 		if err != nil {
 			return nil, err
@@ -442,27 +710,19 @@ func (m *SpanManager) fetchAndCacheSpan(spanId soci.SpanId, r *io.SectionReader,
 	}
 }
 
-func (m *SpanManager) getEndCompressedOffset(spanId soci.SpanId) soci.FileSize {
-	var end soci.FileSize
-	if spanId == m.ztoc.MaxSpanId {
-		end = m.ztoc.CompressedFileSize
-	} else {
-		end = soci.FileSize(C.get_comp_off(m.index, C.int(1+int(spanId))))
-	}
-	return end
+// isUncompressedLayer returns true if the spans are plain byte ranges of an uncompressed layer.
+func (m *SpanManager) isUncompressedLayer() bool {
+	return m.ztoc.CompressionAlgorithm == soci.CompressionUncompressed
 }
 
-func (m *SpanManager) getEndUncompressedOffset(spanId soci.SpanId) soci.FileSize {
-	var end soci.FileSize
-	if spanId == m.ztoc.MaxSpanId {
-		end = m.ztoc.UncompressedFileSize
-	} else {
-		end = soci.FileSize(C.get_ucomp_off(m.index, C.int(1+int(spanId))))
-	}
-	return end
+// hasUncompressedSpanDigests returns true if the span digests are the digests of the uncompressed
+// contents of the spans. This is the case for ztocs converted from eStargz TOCs, which only record
+// the digests of the uncompressed file chunks.
+func (m *SpanManager) hasUncompressedSpanDigests() bool {
+	return m.ztoc.CompressionAlgorithm == soci.CompressionEstargz
 }
 
+// Close releases the resources of the span manager. The cache is left open, since it may be shared.
 func (m *SpanManager) Close() {
-	C.free_index(m.index)
-	m.cache.Close()
+	m.zinfo.Close()
 }
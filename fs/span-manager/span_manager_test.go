@@ -24,10 +24,12 @@ import (
 	"io"
 	"math/rand"
 	"testing"
+	"time"
 
 	"github.com/awslabs/soci-snapshotter/cache"
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/opencontainers/go-digest"
 )
 
 func init() {
@@ -92,7 +94,11 @@ func TestSpanManager(t *testing.T) {
 
 			cache := cache.NewMemoryCache()
 			defer cache.Close()
-			m := New(ztoc, r, cache)
+			m, err := New(ztoc, r, cache)
+			if err != nil {
+				err = fmt.Errorf("failed to create span manager: %w", err)
+				return
+			}
 
 			// Test GetContent
 			fileContentFromSpans, err := getFileContentFromSpans(m, ztoc, fileName)
@@ -122,6 +128,131 @@ func TestSpanManager(t *testing.T) {
 	}
 }
 
+func TestSpanManagerZstd(t *testing.T) {
+	var spanSize soci.FileSize = 65536 // 64 KiB
+	fileContents := map[string][]byte{
+		"file1": genRandomByteData(10),
+		"file2": genRandomByteData(10 * spanSize),
+		"file3": genRandomByteData(spanSize + 1),
+	}
+	var tarEntries []testutil.TarEntry
+	for name, content := range fileContents {
+		tarEntries = append(tarEntries, testutil.File(name, string(content)))
+	}
+	ztoc, r, err := soci.BuildZstdZtocReader(tarEntries, int(spanSize)/4, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	cache := cache.NewMemoryCache()
+	defer cache.Close()
+	m, err := New(ztoc, r, cache)
+	if err != nil {
+		t.Fatalf("failed to create span manager: %v", err)
+	}
+
+	for name, content := range fileContents {
+		fileContentFromSpans, err := getFileContentFromSpans(m, ztoc, name)
+		if err != nil {
+			t.Fatalf("failed to get contents of %s: %v", name, err)
+		}
+		if !bytes.Equal(content, fileContentFromSpans) {
+			t.Fatalf("contents of %s are not the same as span contents", name)
+		}
+	}
+
+	var i soci.SpanId
+	for i = 0; i <= ztoc.MaxSpanId; i++ {
+		if err := m.ResolveSpan(i, r); err != nil {
+			t.Fatalf("error resolving span %d. error: %v", i, err)
+		}
+	}
+}
+
+func TestSpanManagerEstargz(t *testing.T) {
+	var chunkSize soci.FileSize = 65536 // 64 KiB
+	fileContents := map[string][]byte{
+		"file1": genRandomByteData(10),
+		"file2": genRandomByteData(10 * chunkSize),
+		"file3": genRandomByteData(chunkSize + 1),
+	}
+	var tarEntries []testutil.TarEntry
+	for name, content := range fileContents {
+		tarEntries = append(tarEntries, testutil.File(name, string(content)))
+	}
+	ztoc, r, err := soci.BuildEstargzZtocReader(tarEntries, int64(chunkSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	spanCache := cache.NewMemoryCache()
+	defer spanCache.Close()
+	m, err := New(ztoc, r, spanCache)
+	if err != nil {
+		t.Fatalf("failed to create span manager: %v", err)
+	}
+
+	// prefetch half of the spans, so both fetched and unrequested spans are read
+	var i soci.SpanId
+	for i = 0; i <= ztoc.MaxSpanId; i += 2 {
+		if err := m.ResolveSpan(i, r); err != nil {
+			t.Fatalf("error resolving span %d. error: %v", i, err)
+		}
+	}
+
+	for name, content := range fileContents {
+		fileContentFromSpans, err := getFileContentFromSpans(m, ztoc, name)
+		if err != nil {
+			t.Fatalf("failed to get contents of %s: %v", name, err)
+		}
+		if !bytes.Equal(content, fileContentFromSpans) {
+			t.Fatalf("contents of %s are not the same as span contents", name)
+		}
+	}
+
+	// the digests of eStargz spans are verified against the uncompressed chunks
+	ztoc.ZtocInfo.SpanDigests[0] = digest.FromBytes([]byte("corrupted"))
+	m, err = New(ztoc, r, cache.NewMemoryCache())
+	if err != nil {
+		t.Fatalf("failed to create span manager: %v", err)
+	}
+	if _, err := m.GetContents(0, 1); !errors.Is(err, ErrIncorrectSpanDigest) {
+		t.Fatalf("unexpected error reading corrupted span; expected %v, got %v", ErrIncorrectSpanDigest, err)
+	}
+}
+
+func TestSpanManagerUncompressed(t *testing.T) {
+	var spanSize soci.FileSize = 65536 // 64 KiB
+	content := genRandomByteData(3*spanSize + 100)
+	tarEntries := []testutil.TarEntry{
+		testutil.File("uncompressed-test", string(content)),
+	}
+	ztoc, r, err := soci.BuildTarZtocReader(tarEntries, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	cache := cache.NewMemoryCache()
+	defer cache.Close()
+	m, err := New(ztoc, r, cache)
+	if err != nil {
+		t.Fatalf("failed to create span manager: %v", err)
+	}
+
+	// spans of uncompressed layers go to Uncompressed state when they are prefetched
+	if err := m.ResolveSpan(0, r); err != nil {
+		t.Fatalf("failed resolving span 0: %v", err)
+	}
+	if state := m.spans[0].state.Load().(spanState); state != uncompressed {
+		t.Fatalf("unexpected state of prefetched span; expected %v, got %v", uncompressed, state)
+	}
+
+	fileContentFromSpans, err := getFileContentFromSpans(m, ztoc, "uncompressed-test")
+	if err != nil {
+		t.Fatalf("failed to get file contents: %v", err)
+	}
+	if !bytes.Equal(content, fileContentFromSpans) {
+		t.Fatalf("file contents are not the same as span contents")
+	}
+}
+
 func TestSpanManagerCache(t *testing.T) {
 	var spanSize soci.FileSize = 65536 // 64 KiB
 	content := genRandomByteData(spanSize)
@@ -134,7 +265,10 @@ func TestSpanManagerCache(t *testing.T) {
 	}
 	cache := cache.NewMemoryCache()
 	defer cache.Close()
-	m := New(ztoc, r, cache)
+	m, err := New(ztoc, r, cache)
+	if err != nil {
+		t.Fatalf("failed to create span manager: %v", err)
+	}
 	m.addSpanToCache("spanId", content)
 
 	testCases := []struct {
@@ -169,6 +303,295 @@ func TestSpanManagerCache(t *testing.T) {
 	}
 }
 
+func TestSpanManagerCoalescedFetch(t *testing.T) {
+	var spanSize soci.FileSize = 65536 // 64 KiB
+	fileName := "span-manager-coalesced-test"
+	fileContent := genRandomByteData(10 * spanSize)
+	testCases := []struct {
+		name          string
+		cachedSpans   []soci.SpanId // spans resolved before reading the file
+		maxReadSpans  int           // maximum number of spans per read if positive
+		expectedReads int
+	}{
+		{
+			name:          "no cached span",
+			expectedReads: 1,
+		},
+		{
+			name:          "a cached span in the middle",
+			cachedSpans:   []soci.SpanId{4},
+			expectedReads: 2,
+		},
+		{
+			name:          "cached spans at both ends",
+			cachedSpans:   []soci.SpanId{0, 1, 7},
+			expectedReads: 1,
+		},
+		{
+			name:          "reads split by size",
+			maxReadSpans:  3,
+			expectedReads: 3,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ztoc, r, err := soci.BuildZtocReader([]testutil.TarEntry{testutil.File(fileName, string(fileContent))}, gzip.BestCompression, int64(spanSize))
+			if err != nil {
+				t.Fatalf("failed to create ztoc: %v", err)
+			}
+			var reads int
+			countingReader := io.NewSectionReader(readerFn(func(b []byte, off int64) (int, error) {
+				reads++
+				return r.ReadAt(b, off)
+			}), 0, r.Size())
+
+			cache := cache.NewMemoryCache()
+			defer cache.Close()
+			m, err := New(ztoc, countingReader, cache)
+			if err != nil {
+				t.Fatalf("failed to create span manager: %v", err)
+			}
+			if tc.maxReadSpans > 0 {
+				m.maxReadSize = m.spans[tc.maxReadSpans-1].endCompOffset - m.spans[0].startCompOffset
+			}
+			for _, id := range tc.cachedSpans {
+				if err := m.ResolveSpan(id, r); err != nil {
+					t.Fatalf("failed to resolve span %d: %v", id, err)
+				}
+			}
+			content, err := getFileContentFromSpans(m, ztoc, fileName)
+			if err != nil {
+				t.Fatalf("failed to get file contents: %v", err)
+			}
+			if !bytes.Equal(content, fileContent) {
+				t.Fatalf("file contents are not the same as span contents")
+			}
+			if reads != tc.expectedReads {
+				t.Fatalf("unexpected number of reads; expected %d, got %d", tc.expectedReads, reads)
+			}
+
+			// all the spans are cached now
+			reads = 0
+			if _, err := getFileContentFromSpans(m, ztoc, fileName); err != nil {
+				t.Fatalf("failed to get file contents: %v", err)
+			}
+			if reads != 0 {
+				t.Fatalf("cached spans were read again %d times", reads)
+			}
+		})
+	}
+}
+
+func TestSpanManagerFetchSpans(t *testing.T) {
+	var spanSize soci.FileSize = 65536 // 64 KiB
+	fileName := "span-manager-fetch-spans-test"
+	fileContent := genRandomByteData(10 * spanSize)
+	ztoc, r, err := soci.BuildZtocReader([]testutil.TarEntry{testutil.File(fileName, string(fileContent))}, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+
+	t.Run("fetched spans are cached", func(t *testing.T) {
+		var reads int
+		countingReader := io.NewSectionReader(readerFn(func(b []byte, off int64) (int, error) {
+			reads++
+			return r.ReadAt(b, off)
+		}), 0, r.Size())
+		m, err := New(ztoc, countingReader, cache.NewMemoryCache())
+		if err != nil {
+			t.Fatalf("failed to create span manager: %v", err)
+		}
+		ids, err := m.FetchSpans(0, ztoc.MaxSpanId, r)
+		if err != nil {
+			t.Fatalf("failed to fetch spans: %v", err)
+		}
+		if len(ids) != int(ztoc.MaxSpanId)+1 {
+			t.Fatalf("unexpected fetched spans %v", ids)
+		}
+		content, err := getFileContentFromSpans(m, ztoc, fileName)
+		if err != nil {
+			t.Fatalf("failed to get file contents: %v", err)
+		}
+		if !bytes.Equal(content, fileContent) {
+			t.Fatalf("file contents are not the same as span contents")
+		}
+		if reads != 0 {
+			t.Fatalf("fetched spans were read again %d times", reads)
+		}
+		if _, err := m.FetchSpans(0, ztoc.MaxSpanId+1, r); !errors.Is(err, ErrExceedMaxSpan) {
+			t.Fatalf("unexpected error fetching spans out of range: %v", err)
+		}
+	})
+
+	t.Run("reads don't wait for fetched spans", func(t *testing.T) {
+		m, err := New(ztoc, r, cache.NewMemoryCache())
+		if err != nil {
+			t.Fatalf("failed to create span manager: %v", err)
+		}
+		started, release := make(chan struct{}), make(chan struct{})
+		blockingReader := io.NewSectionReader(readerFn(func(b []byte, off int64) (int, error) {
+			close(started)
+			<-release
+			return r.ReadAt(b, off)
+		}), 0, r.Size())
+		type result struct {
+			ids []soci.SpanId
+			err error
+		}
+		fetched := make(chan result)
+		go func() {
+			ids, err := m.FetchSpans(0, ztoc.MaxSpanId, blockingReader)
+			fetched <- result{ids, err}
+		}()
+		<-started
+
+		read := make(chan error)
+		go func() {
+			content, err := getFileContentFromSpans(m, ztoc, fileName)
+			if err == nil && !bytes.Equal(content, fileContent) {
+				err = fmt.Errorf("file contents are not the same as span contents")
+			}
+			read <- err
+		}()
+		select {
+		case err := <-read:
+			if err != nil {
+				t.Fatalf("failed to get file contents: %v", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("read waited for the spans being fetched")
+		}
+
+		close(release)
+		res := <-fetched
+		if res.err != nil {
+			t.Fatalf("failed to fetch spans: %v", res.err)
+		}
+		if len(res.ids) != 0 {
+			t.Fatalf("spans cached by the read were cached again: %v", res.ids)
+		}
+	})
+}
+
+func TestSpanManagerSharedCache(t *testing.T) {
+	var spanSize soci.FileSize = 65536 // 64 KiB
+	fileName := "span-manager-shared-cache-test"
+	fileContent := genRandomByteData(10 * spanSize)
+	otherContent := genRandomByteData(10 * spanSize)
+	builders := map[string]func(tarEntries []testutil.TarEntry) (*soci.Ztoc, *io.SectionReader, error){
+		"gzip": func(tarEntries []testutil.TarEntry) (*soci.Ztoc, *io.SectionReader, error) {
+			return soci.BuildZtocReader(tarEntries, gzip.BestCompression, int64(spanSize))
+		},
+		"uncompressed": func(tarEntries []testutil.TarEntry) (*soci.Ztoc, *io.SectionReader, error) {
+			return soci.BuildTarZtocReader(tarEntries, int64(spanSize))
+		},
+	}
+	failingReader := io.NewSectionReader(readerFn(func([]byte, int64) (int, error) {
+		return 0, errors.New("the span should be read from the cache")
+	}), 0, 1<<30)
+
+	for name, build := range builders {
+		for _, prefetch := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s prefetch=%v", name, prefetch), func(t *testing.T) {
+				ztoc, r, err := build([]testutil.TarEntry{testutil.File(fileName, string(fileContent))})
+				if err != nil {
+					t.Fatalf("failed to create ztoc: %v", err)
+				}
+				// the same layer resolved again, e.g. for another image
+				sameZtoc, _, err := build([]testutil.TarEntry{testutil.File(fileName, string(fileContent))})
+				if err != nil {
+					t.Fatalf("failed to create ztoc: %v", err)
+				}
+				otherZtoc, _, err := build([]testutil.TarEntry{testutil.File(fileName, string(otherContent))})
+				if err != nil {
+					t.Fatalf("failed to create ztoc: %v", err)
+				}
+
+				cache := cache.NewMemoryCache()
+				defer cache.Close()
+				m, err := New(ztoc, r, cache)
+				if err != nil {
+					t.Fatalf("failed to create span manager: %v", err)
+				}
+				if prefetch {
+					for id := soci.SpanId(0); id <= ztoc.MaxSpanId; id++ {
+						if err := m.ResolveSpan(id, r); err != nil {
+							t.Fatalf("failed to resolve span %d: %v", id, err)
+						}
+					}
+				} else if _, err := getFileContentFromSpans(m, ztoc, fileName); err != nil {
+					t.Fatalf("failed to get file contents: %v", err)
+				}
+
+				same, err := New(sameZtoc, failingReader, cache)
+				if err != nil {
+					t.Fatalf("failed to create span manager: %v", err)
+				}
+				content, err := getFileContentFromSpans(same, sameZtoc, fileName)
+				if err != nil {
+					t.Fatalf("failed to get file contents from the shared cache: %v", err)
+				}
+				if !bytes.Equal(content, fileContent) {
+					t.Fatalf("file contents from the shared cache are not expected")
+				}
+				for id := soci.SpanId(0); id <= sameZtoc.MaxSpanId; id++ {
+					if err := same.ResolveSpan(id, failingReader); err != nil {
+						t.Fatalf("failed to resolve span %d from the shared cache: %v", id, err)
+					}
+				}
+
+				other, err := New(otherZtoc, failingReader, cache)
+				if err != nil {
+					t.Fatalf("failed to create span manager: %v", err)
+				}
+				if _, err := getFileContentFromSpans(other, otherZtoc, fileName); err == nil {
+					t.Fatalf("spans of another layer were read from the cache")
+				}
+			})
+		}
+	}
+}
+
+func TestSpanManagerEvictedSpans(t *testing.T) {
+	var spanSize soci.FileSize = 65536 // 64 KiB
+	fileName := "span-manager-evicted-spans-test"
+	fileContent := genRandomByteData(4 * spanSize)
+	ztoc, r, err := soci.BuildZtocReader([]testutil.TarEntry{testutil.File(fileName, string(fileContent))}, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	memoryCache := cache.NewMemoryCache().(*cache.MemoryCache)
+	m, err := New(ztoc, r, memoryCache)
+	if err != nil {
+		t.Fatalf("failed to create span manager: %v", err)
+	}
+
+	// spans in Fetched and Uncompressed state are fetched again once evicted
+	if err := m.ResolveSpan(0, r); err != nil {
+		t.Fatalf("failed to resolve span: %v", err)
+	}
+	if _, err := getFileContentFromSpans(m, ztoc, fileName); err != nil {
+		t.Fatalf("failed to get file contents: %v", err)
+	}
+	if err := m.ResolveSpan(1, r); err != nil {
+		t.Fatalf("failed to resolve span: %v", err)
+	}
+	memoryCache.Membuf = map[string]*bytes.Buffer{}
+	content, err := getFileContentFromSpans(m, ztoc, fileName)
+	if err != nil {
+		t.Fatalf("failed to get file contents after eviction: %v", err)
+	}
+	if !bytes.Equal(content, fileContent) {
+		t.Fatalf("file contents are not the same as span contents")
+	}
+	for id := soci.SpanId(0); id <= ztoc.MaxSpanId; id++ {
+		memoryCache.Membuf = map[string]*bytes.Buffer{}
+		if err := m.ResolveSpan(id, r); err != nil {
+			t.Fatalf("failed to resolve span %d after eviction: %v", id, err)
+		}
+	}
+}
+
 func TestStateTransition(t *testing.T) {
 	var spanSize soci.FileSize = 65536 // 64 KiB
 	content := genRandomByteData(spanSize)
@@ -181,7 +604,10 @@ func TestStateTransition(t *testing.T) {
 	}
 	cache := cache.NewMemoryCache()
 	defer cache.Close()
-	m := New(ztoc, r, cache)
+	m, err := New(ztoc, r, cache)
+	if err != nil {
+		t.Fatalf("failed to create span manager: %v", err)
+	}
 
 	// check initial span states
 	for i := uint32(0); i <= uint32(ztoc.MaxSpanId); i++ {
@@ -278,7 +704,7 @@ func TestValidateState(t *testing.T) {
 		{
 			name:         "span in Fetched state with valid new state",
 			currentState: fetched,
-			newState:     []spanState{uncompressed, fetched},
+			newState:     []spanState{uncompressed, fetched, requested},
 			expectedErr:  nil,
 		},
 		{
@@ -290,7 +716,7 @@ func TestValidateState(t *testing.T) {
 		{
 			name:         "span in Uncompressed state with valid new state",
 			currentState: uncompressed,
-			newState:     []spanState{uncompressed},
+			newState:     []spanState{uncompressed, requested},
 			expectedErr:  nil,
 		},
 		{
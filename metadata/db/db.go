@@ -40,6 +40,7 @@ import (
 	"github.com/awslabs/soci-snapshotter/metadata"
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/awslabs/soci-snapshotter/util/dbutil"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	bolt "go.etcd.io/bbolt"
 )
@@ -73,6 +74,7 @@ import (
 //         - spanStart : <varint>           : the first span for the data.
 //         - spanEnd : <varint>             : the last span for the data.
 //         - firstSpanHasBits : <varint>    : flag for if there is partial uncompressed data that is stored in the previous byte.
+//         - digest : <string>              : digest of the contents of the regular node, if recorded in the ztoc.
 
 var (
 	bucketKeyFilesystems = []byte("filesystems")
@@ -100,6 +102,7 @@ var (
 	bucketKeySpanStart          = []byte("spanStart")
 	bucketKeySpanEnd            = []byte("spanEnd")
 	bucketKeyFirstSpanHasBits   = []byte("firstSpanHasBits")
+	bucketKeyDigest             = []byte("digest")
 )
 
 type childEntry struct {
@@ -113,6 +116,7 @@ type metadataEntry struct {
 	SpanStart          soci.SpanId
 	SpanEnd            soci.SpanId
 	FirstSpanHasBits   string
+	Digest             digest.Digest
 }
 
 func getNodes(tx *bolt.Tx, fsID string) (*bolt.Bucket, error) {
@@ -369,6 +373,11 @@ func writeMetadataEntry(md *bolt.Bucket, m *metadataEntry) error {
 	if err := md.Put(bucketKeyFirstSpanHasBits, []byte(m.FirstSpanHasBits)); err != nil {
 		return errors.Wrapf(err, "failed to set SpanEnd value %s", m.FirstSpanHasBits)
 	}
+	if m.Digest != "" {
+		if err := md.Put(bucketKeyDigest, []byte(m.Digest)); err != nil {
+			return errors.Wrapf(err, "failed to set Digest value %s", m.Digest)
+		}
+	}
 	return nil
 }
 
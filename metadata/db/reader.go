@@ -49,6 +49,7 @@ import (
 
 	"github.com/awslabs/soci-snapshotter/metadata"
 	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"github.com/rs/xid"
 	bolt "go.etcd.io/bbolt"
@@ -259,6 +260,7 @@ func (r *reader) initNodes(ztoc *soci.Ztoc) error {
 				md[id].SpanStart = ent.SpanStart
 				md[id].SpanEnd = ent.SpanEnd
 				md[id].FirstSpanHasBits = strconv.FormatBool(ent.FirstSpanHasBits)
+				md[id].Digest = ent.Digest
 			}
 		}
 		return nil
@@ -508,6 +510,7 @@ func (r *reader) ForeachChild(id uint32, f func(name string, id uint32, mode os.
 func (r *reader) OpenFile(id uint32) (metadata.File, error) {
 	var size int64
 	var uncompressedOffset soci.FileSize
+	var dgst digest.Digest
 
 	if err := r.view(func(tx *bolt.Tx) error {
 		nodes, err := getNodes(tx, r.fsID)
@@ -529,12 +532,13 @@ func (r *reader) OpenFile(id uint32) (metadata.File, error) {
 		}
 		if md, err := getMetadataBucketByID(metadataEntries, id); err == nil {
 			uncompressedOffset = getUncompressedOffset(md)
+			dgst = digest.Digest(md.Get(bucketKeyDigest))
 		}
 		return nil
 	}); err != nil {
 		return nil, err
 	}
-	return &file{uncompressedOffset, soci.FileSize(size)}, nil
+	return &file{uncompressedOffset, soci.FileSize(size), dgst}, nil
 }
 
 func getUncompressedOffset(md *bolt.Bucket) soci.FileSize {
@@ -545,6 +549,7 @@ func getUncompressedOffset(md *bolt.Bucket) soci.FileSize {
 type file struct {
 	uncompressedOffset soci.FileSize
 	uncompressedSize   soci.FileSize
+	digest             digest.Digest
 }
 
 func (fr *file) GetUncompressedFileSize() soci.FileSize {
@@ -555,6 +560,10 @@ func (fr *file) GetUncompressedOffset() soci.FileSize {
 	return fr.uncompressedOffset
 }
 
+func (fr *file) GetDigest() digest.Digest {
+	return fr.digest
+}
+
 func attrFromZtocEntry(src *soci.FileMetadata, dst *metadata.Attr) *metadata.Attr {
 	dst.Size = int64(src.UncompressedSize)
 	dst.ModTime = src.ModTime
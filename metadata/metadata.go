@@ -38,6 +38,7 @@ import (
 	"time"
 
 	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/opencontainers/go-digest"
 )
 
 // Attr reprensents the attributes of a node.
@@ -92,6 +93,8 @@ type Reader interface {
 type File interface {
 	GetUncompressedFileSize() soci.FileSize
 	GetUncompressedOffset() soci.FileSize
+	// GetDigest returns the digest of the file contents. It's empty if the ztoc doesn't record it.
+	GetDigest() digest.Digest
 }
 
 type Options struct {
@@ -50,12 +50,27 @@ import (
 
 var allowedPrefix = [4]string{"", "./", "/", "../"}
 
-var srcCompressions = map[string]int{
-	"gzip-nocompression":      gzip.NoCompression,
-	"gzip-bestspeed":          gzip.BestSpeed,
-	"gzip-bestcompression":    gzip.BestCompression,
-	"gzip-defaultcompression": gzip.DefaultCompression,
-	"gzip-huffmanonly":        gzip.HuffmanOnly,
+type ztocBuilder func(ents []testutil.TarEntry, spanSize int64, opts ...testutil.BuildTarOption) (*soci.Ztoc, *io.SectionReader, error)
+
+func gzipZtocBuilder(compressionLevel int) ztocBuilder {
+	return func(ents []testutil.TarEntry, spanSize int64, opts ...testutil.BuildTarOption) (*soci.Ztoc, *io.SectionReader, error) {
+		return soci.BuildZtocReader(ents, compressionLevel, spanSize, opts...)
+	}
+}
+
+var srcCompressions = map[string]ztocBuilder{
+	"gzip-nocompression":      gzipZtocBuilder(gzip.NoCompression),
+	"gzip-bestspeed":          gzipZtocBuilder(gzip.BestSpeed),
+	"gzip-bestcompression":    gzipZtocBuilder(gzip.BestCompression),
+	"gzip-defaultcompression": gzipZtocBuilder(gzip.DefaultCompression),
+	"gzip-huffmanonly":        gzipZtocBuilder(gzip.HuffmanOnly),
+	"zstd":                    zstdZtocBuilder,
+	"uncompressed":            soci.BuildTarZtocReader,
+	"estargz":                 soci.BuildEstargzZtocReader,
+}
+
+func zstdZtocBuilder(ents []testutil.TarEntry, spanSize int64, opts ...testutil.BuildTarOption) (*soci.Ztoc, *io.SectionReader, error) {
+	return soci.BuildZstdZtocReader(ents, int(spanSize), spanSize, opts...)
 }
 
 type ReaderFactory func(sr *io.SectionReader, ztoc *soci.Ztoc, opts ...Option) (r TestableReader, err error)
@@ -177,13 +192,13 @@ func TestReader(t *testing.T, factory ReaderFactory) {
 	for _, tt := range tests {
 		for _, prefix := range allowedPrefix {
 			prefix := prefix
-			for srcCompresionName, srcCompression := range srcCompressions {
+			for srcCompresionName, buildZtoc := range srcCompressions {
 				t.Run(tt.name+"-"+srcCompresionName, func(t *testing.T) {
 					opts := []testutil.BuildTarOption{
 						testutil.WithPrefix(prefix),
 					}
 
-					ztoc, sr, err := soci.BuildZtocReader(tt.in, srcCompression, 64, opts...)
+					ztoc, sr, err := buildZtoc(tt.in, 64, opts...)
 					if err != nil {
 						t.Fatalf("failed to build ztoc: %v", err)
 					}
@@ -35,6 +35,7 @@ package snapshot
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -680,6 +681,12 @@ func (o *snapshotter) Close() error {
 	if err := o.cleanup(ctx, cleanupCommitted); err != nil {
 		log.G(ctx).WithError(err).Warn("failed to cleanup")
 	}
+	// the filesystem may hold resources shared by the layers
+	if c, ok := o.fs.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to close filesystem")
+		}
+	}
 	return o.ms.Close()
 }
 
@@ -35,11 +35,16 @@ import (
 // - soci_artifacts
 //       - *soci_artifact_digest*       : bucket for each soci layer keyed by a unique string.
 //         - size : <varint>            : size of the artifact.
-//         - originalDigest : <string>  : the digest for the image manifest or layer
+//         - originalDigest : <string>  : the digest for the image manifest or layer, or of the index for signatures
 //         - imageDigest: <string>      : the digest of the image index
 //         - platform: <string>         : the platform for the index
 //         - location: <string>         : the location of the artifact
-//         - type: <string>             : the type of the artifact (can be either "soci_index" or "soci_layer")
+//         - type: <string>             : the type of the artifact (can be "soci_index", "soci_layer", "soci_signature" or "soci_prefetch_list")
+//         - spanSize: <varint>         : the span size of the ztoc, for ztocs only
+//         - ztocVersion: <string>      : the version of the ztoc format, for ztocs only
+//         - buildTool: <string>        : the identifier of the tool which built the ztoc, for ztocs only
+//         - buildToolVersion: <string> : the version of the tool which built the ztoc, for ztocs only
+//         - builderRevision: <string>  : the revision of the ztoc builder which built the ztoc, for ztocs only
 
 // ArtifactsDB is a store for SOCI artifact metadata
 type ArtifactsDb struct {
@@ -56,6 +61,11 @@ var (
 	bucketKeyImageDigest    = []byte("image_digest")
 	bucketKeyPlatform       = []byte("platform")
 	bucketKeyLocation       = []byte("location")
+	bucketKeySpanSize       = []byte("span_size")
+	bucketKeyZtocVersion    = []byte("ztoc_version")
+	bucketKeyBuildTool      = []byte("build_tool")
+	bucketKeyBuildToolVer   = []byte("build_tool_version")
+	bucketKeyZtocBuilderRev = []byte("ztoc_builder_revision")
 	bucketKeyType           = []byte("type")
 
 	artifactsDbName = "artifacts.db"
@@ -63,6 +73,10 @@ var (
 	ArtifactEntryTypeIndex ArtifactEntryType = "soci_index"
 	// ArtifactEntryTypeLayer indicates that an ArtifactEntry is a SOCI layer artifact
 	ArtifactEntryTypeLayer ArtifactEntryType = "soci_layer"
+	// ArtifactEntryTypeSignature indicates that an ArtifactEntry is the signature of a SOCI index
+	ArtifactEntryTypeSignature ArtifactEntryType = "soci_signature"
+	// ArtifactEntryTypePrefetchList indicates that an ArtifactEntry is the prefetch list of a SOCI index
+	ArtifactEntryTypePrefetchList ArtifactEntryType = "soci_prefetch_list"
 
 	db   *ArtifactsDb
 	once sync.Once
@@ -71,21 +85,32 @@ var (
 // ArtifactEntry is a metadata object for a SOCI artifact.
 type ArtifactEntry struct {
 	// Size is the SOCI artifact's size in bytes.
-	Size int64
+	Size int64 `json:"size"`
 	// Digest is the SOCI artifact's digest.
-	Digest string
+	Digest string `json:"digest"`
 	// OriginalDigest is the digest of the content for which the SOCI artifact was created.
-	OriginalDigest string
+	OriginalDigest string `json:"originalDigest"`
 	// ImageDigest is the digest of the container image that was used to generat the artifact
 	// ImageDigest refers to the image, OriginalDigest refers to the specific content within that
 	// image that was used to generate the Artifact.
-	ImageDigest string
+	ImageDigest string `json:"imageDigest,omitempty"`
 	// Platform is the platform for which the artifact was generated.
-	Platform string
+	Platform string `json:"platform,omitempty"`
 	// Location is the file path for the SOCI artifact.
-	Location string
+	Location string `json:"location,omitempty"`
 	// Type is the type of SOCI artifact.
-	Type ArtifactEntryType
+	Type ArtifactEntryType `json:"type"`
+	// SpanSize is the span size a ztoc was built with. Ztocs built before it was recorded have none.
+	SpanSize int64 `json:"spanSize,omitempty"`
+	// ZtocVersion is the version of the format of a ztoc.
+	ZtocVersion string `json:"ztocVersion,omitempty"`
+	// BuildToolIdentifier is the identifier of the tool which built a ztoc.
+	BuildToolIdentifier string `json:"buildToolIdentifier,omitempty"`
+	// BuildToolVersion is the version of the tool which built a ztoc.
+	BuildToolVersion string `json:"buildToolVersion,omitempty"`
+	// ZtocBuilderRevision is the ZtocBuilderRevision of the soci package which built a ztoc.
+	// Ztocs built before it was recorded have none.
+	ZtocBuilderRevision string `json:"ztocBuilderRevision,omitempty"`
 }
 
 func getIndexArtifactEntries(indexDigest string) ([]ArtifactEntry, error) {
@@ -214,6 +239,20 @@ func (db *ArtifactsDb) WriteArtifactEntry(entry *ArtifactEntry) error {
 	return err
 }
 
+// RemoveArtifactEntry removes the ArtifactEntry with the digest `digest` from the ArtifactsDB.
+func (db *ArtifactsDb) RemoveArtifactEntry(digest string) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := getArtifactsBucket(tx)
+		if err != nil {
+			return err
+		}
+		if bucket.Bucket([]byte(digest)) == nil {
+			return fmt.Errorf("couldn't remove artifact %s, %w", digest, errdefs.ErrNotFound)
+		}
+		return bucket.DeleteBucket([]byte(digest))
+	})
+}
+
 func getArtifactsBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
 	artifacts := tx.Bucket(bucketKeySociArtifacts)
 	if artifacts == nil {
@@ -246,6 +285,16 @@ func loadArtifact(artifactBkt *bolt.Bucket, digest string) (*ArtifactEntry, erro
 	ae.OriginalDigest = string(artifactBkt.Get(bucketKeyOriginalDigest))
 	ae.ImageDigest = string(artifactBkt.Get(bucketKeyImageDigest))
 	ae.Platform = string(artifactBkt.Get(bucketKeyPlatform))
+	if encodedSpanSize := artifactBkt.Get(bucketKeySpanSize); encodedSpanSize != nil {
+		ae.SpanSize, err = dbutil.DecodeInt(encodedSpanSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ae.ZtocVersion = string(artifactBkt.Get(bucketKeyZtocVersion))
+	ae.BuildToolIdentifier = string(artifactBkt.Get(bucketKeyBuildTool))
+	ae.BuildToolVersion = string(artifactBkt.Get(bucketKeyBuildToolVer))
+	ae.ZtocBuilderRevision = string(artifactBkt.Get(bucketKeyZtocBuilderRev))
 	return &ae, nil
 }
 
@@ -263,6 +312,10 @@ func putArtifactEntry(artifacts *bolt.Bucket, ae *ArtifactEntry) error {
 	if err != nil {
 		return err
 	}
+	spanSizeInBytes, err := dbutil.EncodeInt(ae.SpanSize)
+	if err != nil {
+		return err
+	}
 
 	updates := []struct {
 		key []byte
@@ -274,6 +327,11 @@ func putArtifactEntry(artifacts *bolt.Bucket, ae *ArtifactEntry) error {
 		{bucketKeyImageDigest, []byte(ae.ImageDigest)},
 		{bucketKeyPlatform, []byte(ae.Platform)},
 		{bucketKeyType, []byte(ae.Type)},
+		{bucketKeySpanSize, spanSizeInBytes},
+		{bucketKeyZtocVersion, []byte(ae.ZtocVersion)},
+		{bucketKeyBuildTool, []byte(ae.BuildToolIdentifier)},
+		{bucketKeyBuildToolVer, []byte(ae.BuildToolVersion)},
+		{bucketKeyZtocBuilderRev, []byte(ae.ZtocBuilderRevision)},
 	}
 
 	for _, update := range updates {
@@ -0,0 +1,337 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// EstargzTOCDigestAnnotation is the annotation of eStargz layer descriptors holding the digest of the TOC JSON.
+	EstargzTOCDigestAnnotation = "containerd.io/snapshot/stargz/toc.digest"
+
+	// estargzTOCName is the name of the tar entry holding the TOC JSON.
+	estargzTOCName = "stargz.index.json"
+	// estargzFooterSize is the size of the footer of eStargz layers.
+	estargzFooterSize = 51
+	// legacyStargzFooterSize is the size of the footer of stargz layers, which predate eStargz.
+	legacyStargzFooterSize = 47
+
+	estargzChunkType = "chunk"
+)
+
+// ErrNotEstargz is returned when the layer doesn't end with an eStargz footer.
+var ErrNotEstargz = errors.New("layer is not an eStargz layer")
+
+// ErrNoEstargzTOCDigest is returned when the digest of the TOC of an eStargz layer isn't known,
+// so the TOC, hence the contents of the layer, can't be verified.
+var ErrNoEstargzTOCDigest = errors.New("eStargz layer has no TOC digest")
+
+// estargzTOC is the TOC of eStargz layers (`stargz.index.json`).
+// See https://github.com/containerd/stargz-snapshotter/blob/main/docs/estargz.md for the format.
+type estargzTOC struct {
+	Version int               `json:"version"`
+	Entries []estargzTOCEntry `json:"entries"`
+}
+
+type estargzTOCEntry struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime3339 string            `json:"modtime,omitempty"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	Uname       string            `json:"userName,omitempty"`
+	Gname       string            `json:"groupName,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	DevMajor    int               `json:"devMajor,omitempty"`
+	DevMinor    int               `json:"devMinor,omitempty"`
+	Xattrs      map[string][]byte `json:"xattrs,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	ChunkOffset int64             `json:"chunkOffset,omitempty"`
+	ChunkSize   int64             `json:"chunkSize,omitempty"`
+	ChunkDigest string            `json:"chunkDigest,omitempty"`
+	InnerOffset int64             `json:"innerOffset,omitempty"`
+}
+
+// NewZtocFromEstargz converts the TOC of the eStargz layer read from `sr` to a ztoc,
+// so the layer can be lazily loaded without building a SOCI index for it.
+// The TOC is verified against `tocDigest`, which is required since the contents of the spans
+// are verified against the chunk digests recorded in the TOC.
+// ErrNotEstargz is returned if the layer isn't an eStargz layer.
+func NewZtocFromEstargz(sr *io.SectionReader, tocDigest digest.Digest) (*Ztoc, error) {
+	tocOffset, footerSize, err := readEstargzFooter(sr)
+	if err != nil {
+		return nil, err
+	}
+	if tocDigest == "" {
+		return nil, ErrNoEstargzTOCDigest
+	}
+	toc, err := readEstargzTOC(io.NewSectionReader(sr, tocOffset, sr.Size()-tocOffset-footerSize), tocDigest)
+	if err != nil {
+		return nil, err
+	}
+	return estargzTOCToZtoc(toc, FileSize(tocOffset), FileSize(sr.Size()))
+}
+
+// readEstargzFooter returns the offset of the TOC and the size of the footer of the layer.
+// The footer is an empty gzip member whose extra field holds the offset of the TOC as
+// "%016xSTARGZ", optionally prefixed by the "SG" subfield header in eStargz.
+func readEstargzFooter(sr *io.SectionReader) (int64, int64, error) {
+	for _, footerSize := range []int64{estargzFooterSize, legacyStargzFooterSize} {
+		if sr.Size() < footerSize {
+			continue
+		}
+		footer := make([]byte, footerSize)
+		if _, err := sr.ReadAt(footer, sr.Size()-footerSize); err != nil {
+			return 0, 0, fmt.Errorf("cannot read the footer: %w", err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(footer))
+		if err != nil {
+			continue
+		}
+		extra := zr.Header.Extra
+		if footerSize == estargzFooterSize {
+			if len(extra) != 26 || extra[0] != 'S' || extra[1] != 'G' {
+				continue
+			}
+			extra = extra[4:]
+		}
+		if len(extra) != 22 || string(extra[16:]) != "STARGZ" {
+			continue
+		}
+		tocOffset, err := strconv.ParseInt(string(extra[:16]), 16, 64)
+		if err != nil || tocOffset < 0 || tocOffset > sr.Size()-footerSize {
+			return 0, 0, fmt.Errorf("invalid TOC offset in the footer: %q", extra[:16])
+		}
+		return tocOffset, footerSize, nil
+	}
+	return 0, 0, ErrNotEstargz
+}
+
+// readEstargzTOC reads the TOC JSON from the gzip member `r`, which holds a tar with the TOC entry,
+// and verifies it against `tocDigest`.
+func readEstargzTOC(r io.Reader, tocDigest digest.Digest) (*estargzTOC, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot uncompress the TOC: %w", err)
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the TOC: %w", err)
+	}
+	if hdr.Name != estargzTOCName {
+		return nil, fmt.Errorf("unexpected TOC entry %q", hdr.Name)
+	}
+	tocJSON, err := io.ReadAll(tr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the TOC: %w", err)
+	}
+	if err := tocDigest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid TOC digest %q: %w", tocDigest, err)
+	}
+	if actual := tocDigest.Algorithm().FromBytes(tocJSON); actual != tocDigest {
+		return nil, fmt.Errorf("TOC digest mismatch: expected %s, got %s", tocDigest, actual)
+	}
+	var toc estargzTOC
+	if err := json.Unmarshal(tocJSON, &toc); err != nil {
+		return nil, fmt.Errorf("cannot parse the TOC: %w", err)
+	}
+	return &toc, nil
+}
+
+// estargzTOCToZtoc builds the ztoc of an eStargz layer from its TOC.
+// Each chunk of a regular file is a span, see estargzZinfo for the layout of the spans.
+func estargzTOCToZtoc(toc *estargzTOC, tocOffset, compressedFileSize FileSize) (*Ztoc, error) {
+	var (
+		md          []FileMetadata
+		checkpoints []estargzCheckpoint
+		spanDigests []digest.Digest
+		// the offset of the next chunk in the uncompressed file contents
+		out FileSize
+		// the regular file whose chunks are being read and the size of its chunks read so far
+		curFile    *FileMetadata
+		curFileOff FileSize
+		// eStargz omits the user and group names if they are the same as in the previous entry with the same id
+		unames = make(map[int]string)
+		gnames = make(map[int]string)
+	)
+
+	addChunk := func(ent *estargzTOCEntry) error {
+		if ent.InnerOffset != 0 {
+			return fmt.Errorf("chunk of %q is not at the beginning of a gzip member", ent.Name)
+		}
+		if curFile == nil || FileSize(ent.ChunkOffset) != curFileOff {
+			return fmt.Errorf("unexpected chunk of %q at offset %d", ent.Name, ent.ChunkOffset)
+		}
+		chunkSize := FileSize(ent.ChunkSize)
+		if chunkSize == 0 {
+			chunkSize = curFile.UncompressedSize - curFileOff
+		}
+		if chunkSize <= 0 || curFileOff+chunkSize > curFile.UncompressedSize {
+			return fmt.Errorf("invalid chunk size %d of %q", chunkSize, ent.Name)
+		}
+		in := FileSize(ent.Offset)
+		if in >= tocOffset || (len(checkpoints) > 0 && in <= checkpoints[len(checkpoints)-1].in) {
+			return fmt.Errorf("invalid offset %d of a chunk of %q", in, ent.Name)
+		}
+		chunkDigest := ent.ChunkDigest
+		if chunkDigest == "" && chunkSize == curFile.UncompressedSize {
+			// a file consisting of a single chunk may only record the digest of the file
+			chunkDigest = ent.Digest
+		}
+		dgst, err := digest.Parse(chunkDigest)
+		if err != nil {
+			return fmt.Errorf("invalid digest of a chunk of %q: %w", ent.Name, err)
+		}
+
+		checkpoints = append(checkpoints, estargzCheckpoint{in: in, out: out})
+		spanDigests = append(spanDigests, dgst)
+		if curFileOff == 0 {
+			curFile.SpanStart = SpanId(len(checkpoints) - 1)
+		}
+		curFile.SpanEnd = SpanId(len(checkpoints) - 1)
+		curFileOff += chunkSize
+		out += chunkSize
+		return nil
+	}
+
+	for i := range toc.Entries {
+		ent := &toc.Entries[i]
+		if ent.Type == estargzChunkType {
+			if curFile == nil || ent.Name != curFile.Name {
+				return nil, fmt.Errorf("chunk of %q doesn't follow its file", ent.Name)
+			}
+			if err := addChunk(ent); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if curFile != nil && curFileOff != curFile.UncompressedSize {
+			return nil, fmt.Errorf("missing chunks of %q", curFile.Name)
+		}
+		curFile = nil
+
+		switch ent.Type {
+		case "reg", "dir", "symlink", "hardlink", "char", "block", "fifo":
+		default:
+			return nil, fmt.Errorf("unsupported TOC entry type %q of %q", ent.Type, ent.Name)
+		}
+		var modTime time.Time
+		if ent.ModTime3339 != "" {
+			t, err := time.Parse(time.RFC3339, ent.ModTime3339)
+			if err != nil {
+				return nil, fmt.Errorf("invalid modification time of %q: %w", ent.Name, err)
+			}
+			modTime = t
+		}
+		if ent.Uname != "" {
+			unames[ent.UID] = ent.Uname
+		}
+		if ent.Gname != "" {
+			gnames[ent.GID] = ent.Gname
+		}
+		var xattrs map[string]string
+		if len(ent.Xattrs) > 0 {
+			// ztocs keep the extended attributes as PAX records
+			xattrs = make(map[string]string, len(ent.Xattrs))
+			for k, v := range ent.Xattrs {
+				xattrs["SCHILY.xattr."+k] = string(v)
+			}
+		}
+		spanId := SpanId(0)
+		if len(checkpoints) > 0 {
+			spanId = SpanId(len(checkpoints) - 1)
+		}
+		md = append(md, FileMetadata{
+			Name:               ent.Name,
+			Type:               ent.Type,
+			UncompressedOffset: out,
+			SpanStart:          spanId,
+			SpanEnd:            spanId,
+			Linkname:           ent.LinkName,
+			Mode:               ent.Mode,
+			UID:                ent.UID,
+			GID:                ent.GID,
+			Uname:              unames[ent.UID],
+			Gname:              gnames[ent.GID],
+			ModTime:            modTime,
+			Devmajor:           int64(ent.DevMajor),
+			Devminor:           int64(ent.DevMinor),
+			Xattrs:             xattrs,
+		})
+		if ent.Type == "reg" {
+			curFile = &md[len(md)-1]
+			curFile.UncompressedSize = FileSize(ent.Size)
+			if ent.Digest != "" {
+				dgst, err := digest.Parse(ent.Digest)
+				if err != nil {
+					return nil, fmt.Errorf("invalid digest of %q: %w", ent.Name, err)
+				}
+				curFile.Digest = dgst
+			}
+			curFileOff = 0
+			if ent.Size > 0 {
+				if err := addChunk(ent); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if curFile != nil && curFileOff != curFile.UncompressedSize {
+		return nil, fmt.Errorf("missing chunks of %q", curFile.Name)
+	}
+
+	if len(checkpoints) == 0 {
+		// a layer without file contents still has a single empty span
+		checkpoints = append(checkpoints, estargzCheckpoint{in: tocOffset, out: 0})
+		spanDigests = append(spanDigests, digest.FromBytes(nil))
+	}
+	zinfo := &estargzZinfo{tocOffset: tocOffset, checkpoints: checkpoints}
+	indexData, err := zinfo.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Ztoc{
+		Version:              DefaultZtocVersion,
+		IndexByteData:        indexData,
+		Metadata:             md,
+		CompressedFileSize:   compressedFileSize,
+		UncompressedFileSize: out,
+		MaxSpanId:            zinfo.MaxSpanId(),
+		BuildToolIdentifier:  "eStargz TOC",
+		ZtocInfo: ztocInfo{
+			SpanDigests: spanDigests,
+		},
+		CompressionAlgorithm: CompressionEstargz,
+	}, nil
+}
@@ -0,0 +1,137 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestEstargzZtoc(t *testing.T) {
+	testcases := []struct {
+		name      string
+		chunkSize int64
+		minSpans  SpanId
+	}{
+		{
+			name:      "chunk size 4MiB",
+			chunkSize: 4 << 20,
+			minSpans:  4,
+		},
+		{
+			name:      "chunk size 64KiB",
+			chunkSize: 1 << 16,
+			minSpans:  14,
+		},
+	}
+
+	fileContents := []fileContent{
+		{fileName: "file1", content: genRandomByteData(10)},
+		{fileName: "dir/file2", content: genRandomByteData(500000)},
+		{fileName: "file3", content: genRandomByteData(88888)},
+		{fileName: "empty", content: []byte{}},
+		{fileName: "file4", content: genRandomByteData(250000)},
+	}
+	tarEntries := []testutil.TarEntry{testutil.Dir("dir/")}
+	for _, fc := range fileContents {
+		tarEntries = append(tarEntries, testutil.File(fc.fileName, string(fc.content)))
+	}
+	tarEntries = append(tarEntries, testutil.Symlink("link", "file1"))
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ztoc, sr, err := BuildEstargzZtocReader(tarEntries, tc.chunkSize)
+			if err != nil {
+				t.Fatalf("can't build ztoc: %v", err)
+			}
+			if ztoc.CompressionAlgorithm != CompressionEstargz {
+				t.Fatalf("unexpected compression algorithm; expected %s, got %s", CompressionEstargz, ztoc.CompressionAlgorithm)
+			}
+			if ztoc.MaxSpanId+1 < tc.minSpans {
+				t.Fatalf("unexpected number of spans; expected at least %d, got %d", tc.minSpans, ztoc.MaxSpanId+1)
+			}
+			if len(ztoc.ZtocInfo.SpanDigests) != int(ztoc.MaxSpanId)+1 {
+				t.Fatalf("unexpected number of span digests; expected %d, got %d", ztoc.MaxSpanId+1, len(ztoc.ZtocInfo.SpanDigests))
+			}
+			if len(ztoc.Metadata) != len(tarEntries) {
+				t.Fatalf("unexpected number of files; expected %d, got %d", len(tarEntries), len(ztoc.Metadata))
+			}
+
+			for _, fc := range fileContents {
+				entry, err := GetMetadataEntry(ztoc, fc.fileName)
+				if err != nil {
+					t.Fatalf("could not find the metadata entry for the file %s: %v", fc.fileName, err)
+				}
+				extracted, err := ExtractFile(sr, &FileExtractConfig{
+					UncompressedSize:     entry.UncompressedSize,
+					UncompressedOffset:   entry.UncompressedOffset,
+					SpanStart:            entry.SpanStart,
+					SpanEnd:              entry.SpanEnd,
+					IndexByteData:        ztoc.IndexByteData,
+					CompressedFileSize:   ztoc.CompressedFileSize,
+					MaxSpanId:            ztoc.MaxSpanId,
+					CompressionAlgorithm: ztoc.CompressionAlgorithm,
+				})
+				if err != nil {
+					t.Fatalf("could not extract file %s: %v", fc.fileName, err)
+				}
+				if !bytes.Equal(extracted, fc.content) {
+					t.Fatalf("file %s: extracted bytes != original bytes", fc.fileName)
+				}
+			}
+		})
+	}
+}
+
+func TestEstargzZtocTOCDigest(t *testing.T) {
+	tarEntries := []testutil.TarEntry{
+		testutil.File("file1", string(genRandomByteData(100))),
+	}
+	sr, tocDigest, err := BuildEstargz(tarEntries, 1<<16)
+	if err != nil {
+		t.Fatalf("can't build eStargz layer: %v", err)
+	}
+	if _, err := NewZtocFromEstargz(sr, tocDigest); err != nil {
+		t.Fatalf("can't convert TOC with the correct digest: %v", err)
+	}
+	if _, err := NewZtocFromEstargz(sr, digest.FromBytes([]byte("wrong"))); err == nil {
+		t.Fatalf("converted TOC with a wrong digest")
+	}
+	if _, err := NewZtocFromEstargz(sr, ""); !errors.Is(err, ErrNoEstargzTOCDigest) {
+		t.Fatalf("unexpected error converting TOC without digest; expected %v, got %v", ErrNoEstargzTOCDigest, err)
+	}
+}
+
+func TestEstargzZtocNotEstargz(t *testing.T) {
+	tarEntries := []testutil.TarEntry{
+		testutil.File("file1", string(genRandomByteData(100))),
+	}
+	data, err := io.ReadAll(testutil.BuildTarGz(tarEntries, gzip.DefaultCompression))
+	if err != nil {
+		t.Fatalf("can't build layer: %v", err)
+	}
+	_, err = NewZtocFromEstargz(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), "")
+	if !errors.Is(err, ErrNotEstargz) {
+		t.Fatalf("unexpected error; expected %v, got %v", ErrNotEstargz, err)
+	}
+}
@@ -0,0 +1,178 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// the size of a serialized eStargz checkpoint: compressed offset (8 bytes), uncompressed offset (8 bytes)
+const estargzCheckpointBlobSize = 16
+
+// estargzCheckpoint is the location of a gzip member holding a file chunk of an eStargz layer.
+type estargzCheckpoint struct {
+	in  FileSize // offset of the gzip member in the compressed layer
+	out FileSize // offset of the chunk contents in the uncompressed file contents
+}
+
+// estargzZinfo is the Zinfo of eStargz layers.
+//
+// eStargz stores every chunk of a regular file in its own gzip member, so each member is
+// a span that can be uncompressed on its own. The tar headers between the chunks are never
+// needed, since the file metadata comes from the eStargz TOC. As a consequence,
+// the uncompressed offsets of the spans don't refer to the uncompressed tar stream, but to
+// the concatenation of the contents of all regular files of the layer.
+type estargzZinfo struct {
+	// tocOffset is the offset of the TOC in the compressed layer, which ends the last span.
+	tocOffset   FileSize
+	checkpoints []estargzCheckpoint
+}
+
+// newEstargzZinfo deserializes estargzZinfo. The blob starts with the number of checkpoints (4 bytes)
+// and the offset of the TOC (8 bytes), followed by the compressed (8 bytes) and uncompressed (8 bytes)
+// offsets of each checkpoint.
+func newEstargzZinfo(zinfoBytes []byte) (*estargzZinfo, error) {
+	if len(zinfoBytes) < 12 {
+		return nil, fmt.Errorf("eStargz checkpoints are too short: %d bytes", len(zinfoBytes))
+	}
+	have := binary.LittleEndian.Uint32(zinfoBytes[0:4])
+	tocOffset := binary.LittleEndian.Uint64(zinfoBytes[4:12])
+	if have == 0 || uint64(len(zinfoBytes)-12) < uint64(have)*estargzCheckpointBlobSize {
+		return nil, fmt.Errorf("invalid number of eStargz checkpoints: %d", have)
+	}
+
+	checkpoints := make([]estargzCheckpoint, have)
+	cur := zinfoBytes[12:]
+	for i := range checkpoints {
+		checkpoints[i] = estargzCheckpoint{
+			in:  FileSize(binary.LittleEndian.Uint64(cur[0:8])),
+			out: FileSize(binary.LittleEndian.Uint64(cur[8:16])),
+		}
+		cur = cur[estargzCheckpointBlobSize:]
+	}
+	return &estargzZinfo{
+		tocOffset:   FileSize(tocOffset),
+		checkpoints: checkpoints,
+	}, nil
+}
+
+func (i *estargzZinfo) MaxSpanId() SpanId {
+	return SpanId(len(i.checkpoints)) - 1
+}
+
+func (i *estargzZinfo) StartCompressedOffset(spanId SpanId) FileSize {
+	return i.checkpoints[spanId].in
+}
+
+// EndCompressedOffset returns the offset where the span ends. The last span ends at the TOC,
+// so neither the TOC nor the footer are fetched with it.
+func (i *estargzZinfo) EndCompressedOffset(spanId SpanId, fileSize FileSize) FileSize {
+	if spanId == i.MaxSpanId() {
+		return i.tocOffset
+	}
+	return i.checkpoints[spanId+1].in
+}
+
+func (i *estargzZinfo) StartUncompressedOffset(spanId SpanId) FileSize {
+	return i.checkpoints[spanId].out
+}
+
+func (i *estargzZinfo) EndUncompressedOffset(spanId SpanId, fileSize FileSize) FileSize {
+	if spanId == i.MaxSpanId() {
+		return fileSize
+	}
+	return i.checkpoints[spanId+1].out
+}
+
+// HasBits always returns false since gzip members are byte aligned.
+func (i *estargzZinfo) HasBits(spanId SpanId) bool {
+	return false
+}
+
+func (i *estargzZinfo) UncompressedOffsetToSpanId(offset FileSize) SpanId {
+	// find the last checkpoint whose uncompressed offset is <= offset
+	idx := sort.Search(len(i.checkpoints), func(j int) bool {
+		return i.checkpoints[j].out > offset
+	})
+	if idx == 0 {
+		return 0
+	}
+	return SpanId(idx - 1)
+}
+
+// ExtractDataFromBuffer uncompresses the requested range from compressedBuf, which holds the gzip
+// members starting from the span `spanId`. Only the chunk at the beginning of each member is used,
+// the tar headers following it are skipped.
+func (i *estargzZinfo) ExtractDataFromBuffer(compressedBuf []byte, uncompressedSize, uncompressedOffset FileSize, spanId SpanId) ([]byte, error) {
+	data := make([]byte, uncompressedSize)
+	base := i.checkpoints[spanId].in
+	var n FileSize
+	for id := spanId; n < uncompressedSize; id++ {
+		if id > i.MaxSpanId() {
+			return data, fmt.Errorf("error extracting data: requested range exceeds the last span")
+		}
+		start := i.checkpoints[id].in - base
+		end := i.EndCompressedOffset(id, 0) - base
+		if end > FileSize(len(compressedBuf)) {
+			end = FileSize(len(compressedBuf))
+		}
+		if start >= end {
+			return data, fmt.Errorf("error extracting data: span %d is out of the buffer of size %d", id, len(compressedBuf))
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(compressedBuf[start:end]))
+		if err != nil {
+			return data, fmt.Errorf("error extracting data: %w", err)
+		}
+		zr.Multistream(false)
+
+		skip := uncompressedOffset + n - i.checkpoints[id].out
+		toRead := uncompressedSize - n
+		if id < i.MaxSpanId() {
+			if avail := i.checkpoints[id+1].out - i.checkpoints[id].out - skip; avail < toRead {
+				toRead = avail
+			}
+		}
+		if _, err := io.CopyN(io.Discard, zr, int64(skip)); err != nil {
+			return data, fmt.Errorf("error extracting data: %w", err)
+		}
+		if _, err := io.ReadFull(zr, data[n:n+toRead]); err != nil {
+			return data, fmt.Errorf("error extracting data: %w", err)
+		}
+		n += toRead
+	}
+	return data, nil
+}
+
+func (i *estargzZinfo) Bytes() ([]byte, error) {
+	buf := make([]byte, 12+len(i.checkpoints)*estargzCheckpointBlobSize)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(i.checkpoints)))
+	binary.LittleEndian.PutUint64(buf[4:12], uint64(i.tocOffset))
+	cur := buf[12:]
+	for _, c := range i.checkpoints {
+		binary.LittleEndian.PutUint64(cur[0:8], uint64(c.in))
+		binary.LittleEndian.PutUint64(cur[8:16], uint64(c.out))
+		cur = cur[estargzCheckpointBlobSize:]
+	}
+	return buf, nil
+}
+
+func (i *estargzZinfo) Close() {}
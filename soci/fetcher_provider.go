@@ -0,0 +1,111 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/remotes"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// NewFetcherProvider returns a content.Provider which streams the contents from `fetcher`, e.g. from a registry,
+// without storing them. It's meant to be read sequentially, as BuildSociIndex does: reading
+// backwards fetches the contents again from the start. The contents aren't verified against their digest,
+// which BuildSociIndex does as it reads the layers.
+func NewFetcherProvider(fetcher remotes.Fetcher) content.Provider {
+	return &fetcherProvider{fetcher: fetcher}
+}
+
+type fetcherProvider struct {
+	fetcher remotes.Fetcher
+}
+
+func (p *fetcherProvider) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	ra := &fetcherReaderAt{ctx: ctx, fetcher: p.fetcher, desc: desc}
+	if err := ra.open(); err != nil {
+		return nil, err
+	}
+	return ra, nil
+}
+
+// fetcherReaderAt reads a blob from a stream. Reads continuing where the previous one stopped
+// read from the stream; others seek in the stream if possible, and open a new one otherwise.
+type fetcherReaderAt struct {
+	ctx     context.Context
+	fetcher remotes.Fetcher
+	desc    ocispec.Descriptor
+	rc      io.ReadCloser
+	pos     int64
+}
+
+func (ra *fetcherReaderAt) open() error {
+	rc, err := ra.fetcher.Fetch(ra.ctx, ra.desc)
+	if err != nil {
+		return fmt.Errorf("cannot fetch %s: %w", ra.desc.Digest, err)
+	}
+	ra.rc = rc
+	ra.pos = 0
+	return nil
+}
+
+func (ra *fetcherReaderAt) seek(offset int64) error {
+	if offset == ra.pos {
+		return nil
+	}
+	if s, ok := ra.rc.(io.Seeker); ok {
+		if _, err := s.Seek(offset, io.SeekStart); err == nil {
+			ra.pos = offset
+			return nil
+		}
+	}
+	if offset < ra.pos {
+		ra.rc.Close()
+		if err := ra.open(); err != nil {
+			return err
+		}
+	}
+	n, err := io.CopyN(io.Discard, ra.rc, offset-ra.pos)
+	ra.pos += n
+	return err
+}
+
+func (ra *fetcherReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+	if offset >= ra.desc.Size {
+		return 0, io.EOF
+	}
+	if err := ra.seek(offset); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(ra.rc, p)
+	ra.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (ra *fetcherReaderAt) Size() int64 {
+	return ra.desc.Size
+}
+
+func (ra *fetcherReaderAt) Close() error {
+	return ra.rc.Close()
+}
@@ -0,0 +1,107 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+// testFetcher is a remotes.Fetcher of a single blob, which counts how many times the blob is fetched.
+type testFetcher struct {
+	blob    []byte
+	fetches int
+}
+
+func (f *testFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	f.fetches++
+	return io.NopCloser(bytes.NewReader(f.blob)), nil
+}
+
+func TestFetcherProvider(t *testing.T) {
+	blob := make([]byte, 1000)
+	for i := range blob {
+		blob[i] = byte(i)
+	}
+	f := &testFetcher{blob: blob}
+	desc := ocispec.Descriptor{Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+	ra, err := NewFetcherProvider(f).ReaderAt(context.Background(), desc)
+	if err != nil {
+		t.Fatalf("cannot open the blob: %v", err)
+	}
+	defer ra.Close()
+
+	testCases := []struct {
+		name    string
+		offset  int64
+		size    int
+		fetches int
+	}{
+		{name: "start", offset: 0, size: 100, fetches: 1},
+		{name: "sequential", offset: 100, size: 100, fetches: 1},
+		{name: "forward", offset: 500, size: 100, fetches: 1},
+		{name: "backward", offset: 50, size: 100, fetches: 2},
+		{name: "end", offset: 950, size: 100, fetches: 2},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := make([]byte, tc.size)
+			n, err := ra.ReadAt(p, tc.offset)
+			expected := blob[tc.offset:]
+			if len(expected) > tc.size {
+				expected = expected[:tc.size]
+			}
+			if len(expected) < tc.size && err != io.EOF {
+				t.Fatalf("expected EOF reading past the end, got %v", err)
+			}
+			if len(expected) == tc.size && err != nil {
+				t.Fatalf("cannot read: %v", err)
+			}
+			if !bytes.Equal(p[:n], expected) {
+				t.Fatalf("unexpected contents at offset %d", tc.offset)
+			}
+			if f.fetches != tc.fetches {
+				t.Fatalf("blob fetched %d times; expected %d", f.fetches, tc.fetches)
+			}
+		})
+	}
+}
+
+func TestFetcherProviderDigestMismatch(t *testing.T) {
+	blob, err := io.ReadAll(testutil.BuildTarGz([]testutil.TarEntry{testutil.File("file", "contents")}, gzip.DefaultCompression))
+	if err != nil {
+		t.Fatalf("cannot build layer: %v", err)
+	}
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString("another layer"),
+		Size:      int64(len(blob)),
+	}
+	_, err = buildSociLayer(context.Background(), NewFetcherProvider(&testFetcher{blob: blob}), desc, 1<<16, memory.New(), &buildConfig{})
+	if err == nil || !strings.Contains(err.Error(), "don't match its digest") {
+		t.Fatalf("unexpected error building the ztoc of a layer which doesn't match its digest: %v", err)
+	}
+}
@@ -0,0 +1,416 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+// #include "indexer.h"
+// #include <stdlib.h>
+import "C"
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"unsafe"
+)
+
+const (
+	// the size of the buffer for the compressed data passed to the indexer
+	gzipBuilderBufferSize = 1 << 16
+	// the size of the window of a gzip checkpoint, WINSIZE in the C indexer
+	gzipWindowSize = C.WINSIZE
+
+	// gzipCompactFormat is the format of gzip checkpoints with compressed windows. Gzip checkpoints
+	// serialized by the C indexer start with the number of checkpoints, which is never 0, so
+	// compact checkpoints start with 4 zero bytes followed by the format.
+	gzipCompactFormat = 1
+	// the size of the header of compact checkpoints: zeros (4 bytes), format (1 byte),
+	// number of checkpoints (4 bytes), span size (8 bytes), number of windows (4 bytes)
+	gzipCompactHeaderSize = 21
+	// the size of a compact checkpoint: compressed offset (8 bytes), uncompressed offset (8 bytes),
+	// bits (1 byte), index of the window (4 bytes)
+	gzipCompactCheckpointSize = 21
+	// the index of the window of checkpoints which don't need one
+	gzipNoWindow = ^uint32(0)
+)
+
+// gzipZinfo is the Zinfo of gzip-compressed layers. It wraps the zlib index built by the C indexer.
+type gzipZinfo struct {
+	index *C.struct_gzip_index
+
+	// When the checkpoints are deserialized from the compact format, the windows are kept
+	// compressed and only uncompressed into the index when a span is extracted the first time.
+	mu         sync.Mutex
+	windows    [][]byte // the distinct compressed windows
+	windowRefs []uint32 // the index in windows of the window of each checkpoint
+	loaded     []bool   // whether the window of each checkpoint has been uncompressed into the index
+}
+
+func newGzipZinfo(zinfoBytes []byte) (*gzipZinfo, error) {
+	if len(zinfoBytes) == 0 {
+		return nil, fmt.Errorf("empty checkpoints")
+	}
+	if len(zinfoBytes) >= 5 && binary.LittleEndian.Uint32(zinfoBytes[0:4]) == 0 {
+		return newGzipZinfoCompact(zinfoBytes)
+	}
+	index := C.blob_to_index(unsafe.Pointer(&zinfoBytes[0]))
+	if index == nil {
+		return nil, fmt.Errorf("cannot convert blob to gzip_index")
+	}
+	return &gzipZinfo{index: index}, nil
+}
+
+// newGzipZinfoCompact deserializes gzip checkpoints in the compact format. After the header, it has
+// the checkpoints and then the windows, each made of its size (4 bytes) and its deflate-compressed data.
+func newGzipZinfoCompact(zinfoBytes []byte) (*gzipZinfo, error) {
+	if zinfoBytes[4] != gzipCompactFormat {
+		return nil, fmt.Errorf("unsupported format of gzip checkpoints: %d", zinfoBytes[4])
+	}
+	if len(zinfoBytes) < gzipCompactHeaderSize {
+		return nil, fmt.Errorf("gzip checkpoints are too short: %d bytes", len(zinfoBytes))
+	}
+	have := binary.LittleEndian.Uint32(zinfoBytes[5:9])
+	spanSize := binary.LittleEndian.Uint64(zinfoBytes[9:17])
+	numWindows := binary.LittleEndian.Uint32(zinfoBytes[17:21])
+	cur := zinfoBytes[gzipCompactHeaderSize:]
+	if have == 0 || uint64(len(cur)) < uint64(have)*gzipCompactCheckpointSize {
+		return nil, fmt.Errorf("invalid number of gzip checkpoints: %d", have)
+	}
+
+	index := C.new_index(C.int(have), C.off_t(spanSize))
+	if index == nil {
+		return nil, fmt.Errorf("cannot allocate gzip_index")
+	}
+	i := &gzipZinfo{
+		index:      index,
+		windowRefs: make([]uint32, have),
+		loaded:     make([]bool, have),
+	}
+	for id := range i.windowRefs {
+		C.set_point(index, C.int(id),
+			C.off_t(binary.LittleEndian.Uint64(cur[0:8])),
+			C.off_t(binary.LittleEndian.Uint64(cur[8:16])),
+			C.int(cur[16]))
+		i.windowRefs[id] = binary.LittleEndian.Uint32(cur[17:21])
+		if i.windowRefs[id] != gzipNoWindow && i.windowRefs[id] >= numWindows {
+			i.Close()
+			return nil, fmt.Errorf("invalid window of gzip checkpoint %d: %d", id, i.windowRefs[id])
+		}
+		cur = cur[gzipCompactCheckpointSize:]
+	}
+	for w := uint32(0); w < numWindows; w++ {
+		if len(cur) < 4 || uint64(len(cur)-4) < uint64(binary.LittleEndian.Uint32(cur[0:4])) {
+			i.Close()
+			return nil, fmt.Errorf("gzip checkpoint window %d is truncated", w)
+		}
+		size := binary.LittleEndian.Uint32(cur[0:4])
+		i.windows = append(i.windows, cur[4:4+size])
+		cur = cur[4+size:]
+	}
+	return i, nil
+}
+
+// loadWindow uncompresses the window of the checkpoint `spanId` into the index if it hasn't been done yet.
+func (i *gzipZinfo) loadWindow(spanId SpanId) error {
+	if i.loaded == nil {
+		return nil
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.loaded[spanId] {
+		return nil
+	}
+	if ref := i.windowRefs[spanId]; ref != gzipNoWindow {
+		window, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(i.windows[ref])), gzipWindowSize+1))
+		if err != nil {
+			return fmt.Errorf("cannot uncompress window of span %d: %w", spanId, err)
+		}
+		if len(window) != gzipWindowSize {
+			return fmt.Errorf("invalid size of the window of span %d: %d", spanId, len(window))
+		}
+		if ret := C.set_window(i.index, C.int(spanId), unsafe.Pointer(&window[0])); ret != C.GZIP_INDEXER_OK {
+			return fmt.Errorf("cannot set window of span %d; return code: %v", spanId, ret)
+		}
+	}
+	i.loaded[spanId] = true
+	return nil
+}
+
+// compressedWindow returns the window of the checkpoint `spanId` compressed, or nil if it doesn't need one.
+func (i *gzipZinfo) compressedWindow(spanId SpanId) ([]byte, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.loaded != nil && !i.loaded[spanId] {
+		if ref := i.windowRefs[spanId]; ref != gzipNoWindow {
+			return i.windows[ref], nil
+		}
+		return nil, nil
+	}
+	window := C.get_window(i.index, C.int(spanId))
+	if window == nil {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(C.GoBytes(unsafe.Pointer(window), gzipWindowSize)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compactBytes serializes the checkpoints in the compact format, in which windows are compressed
+// and stored once even if several checkpoints have the same window. Checkpoints whose span can be
+// uncompressed without a window don't have one.
+func (i *gzipZinfo) compactBytes() ([]byte, error) {
+	have := int(i.index.have)
+	var (
+		windows    [][]byte
+		windowRefs = make(map[string]uint32)
+	)
+	buf := make([]byte, gzipCompactHeaderSize, gzipCompactHeaderSize+have*gzipCompactCheckpointSize)
+	buf[4] = gzipCompactFormat
+	binary.LittleEndian.PutUint32(buf[5:9], uint32(have))
+	binary.LittleEndian.PutUint64(buf[9:17], uint64(i.index.span_size))
+	for id := 0; id < have; id++ {
+		window, err := i.compressedWindow(SpanId(id))
+		if err != nil {
+			return nil, err
+		}
+		ref := gzipNoWindow
+		if window != nil {
+			var ok bool
+			if ref, ok = windowRefs[string(window)]; !ok {
+				ref = uint32(len(windows))
+				windowRefs[string(window)] = ref
+				windows = append(windows, window)
+			}
+		}
+		var cp [gzipCompactCheckpointSize]byte
+		binary.LittleEndian.PutUint64(cp[0:8], uint64(C.get_comp_off(i.index, C.int(id))))
+		binary.LittleEndian.PutUint64(cp[8:16], uint64(C.get_ucomp_off(i.index, C.int(id))))
+		cp[16] = byte(C.get_bits(i.index, C.int(id)))
+		binary.LittleEndian.PutUint32(cp[17:21], ref)
+		buf = append(buf, cp[:]...)
+	}
+	binary.LittleEndian.PutUint32(buf[17:21], uint32(len(windows)))
+	for _, window := range windows {
+		var size [4]byte
+		binary.LittleEndian.PutUint32(size[:], uint32(len(window)))
+		buf = append(buf, size[:]...)
+		buf = append(buf, window...)
+	}
+	return buf, nil
+}
+
+// legacySize returns the size of the checkpoints serialized by the C indexer, which stores all windows uncompressed.
+func (i *gzipZinfo) legacySize() int64 {
+	return int64(C.get_blob_size(i.index))
+}
+
+func (i *gzipZinfo) MaxSpanId() SpanId {
+	return SpanId(i.index.have) - 1
+}
+
+func (i *gzipZinfo) StartCompressedOffset(spanId SpanId) FileSize {
+	start := FileSize(C.get_comp_off(i.index, C.int(spanId)))
+	if i.HasBits(spanId) {
+		start--
+	}
+	return start
+}
+
+func (i *gzipZinfo) EndCompressedOffset(spanId SpanId, fileSize FileSize) FileSize {
+	if spanId == i.MaxSpanId() {
+		return fileSize
+	}
+	return FileSize(C.get_comp_off(i.index, C.int(spanId+1)))
+}
+
+func (i *gzipZinfo) StartUncompressedOffset(spanId SpanId) FileSize {
+	return FileSize(C.get_ucomp_off(i.index, C.int(spanId)))
+}
+
+func (i *gzipZinfo) EndUncompressedOffset(spanId SpanId, fileSize FileSize) FileSize {
+	if spanId == i.MaxSpanId() {
+		return fileSize
+	}
+	return FileSize(C.get_ucomp_off(i.index, C.int(spanId+1)))
+}
+
+func (i *gzipZinfo) HasBits(spanId SpanId) bool {
+	return C.has_bits(i.index, C.int(spanId)) != 0
+}
+
+// bits returns the number of bits of the span `spanId` in the byte before its compressed data.
+func (i *gzipZinfo) bits(spanId SpanId) int {
+	return int(C.get_bits(i.index, C.int(spanId)))
+}
+
+func (i *gzipZinfo) UncompressedOffsetToSpanId(offset FileSize) SpanId {
+	return SpanId(C.pt_index_from_ucmp_offset(i.index, C.off_t(offset)))
+}
+
+func (i *gzipZinfo) ExtractDataFromBuffer(compressedBuf []byte, uncompressedSize, uncompressedOffset FileSize, spanId SpanId) ([]byte, error) {
+	bytes := make([]byte, uncompressedSize)
+	if uncompressedSize == 0 {
+		return bytes, nil
+	}
+	if err := i.loadWindow(spanId); err != nil {
+		return bytes, err
+	}
+	ret := C.extract_data_from_buffer(unsafe.Pointer(&compressedBuf[0]), C.off_t(len(compressedBuf)), i.index, C.off_t(uncompressedOffset), unsafe.Pointer(&bytes[0]), C.off_t(uncompressedSize), C.int(spanId))
+	if ret <= 0 {
+		return bytes, fmt.Errorf("error extracting data; return code: %v", ret)
+	}
+	return bytes, nil
+}
+
+func (i *gzipZinfo) Bytes() ([]byte, error) {
+	for id := SpanId(0); id <= i.MaxSpanId(); id++ {
+		if err := i.loadWindow(id); err != nil {
+			return nil, err
+		}
+	}
+	blobSize := C.get_blob_size(i.index)
+	bytes := make([]byte, uint64(blobSize))
+	ret := C.index_to_blob(i.index, unsafe.Pointer(&bytes[0]))
+	if int(ret) <= 0 {
+		return nil, fmt.Errorf("could not serialize index to byte array; return code: %v", ret)
+	}
+	return bytes, nil
+}
+
+func (i *gzipZinfo) Close() {
+	if i.index != nil {
+		C.free_index(i.index)
+		i.index = nil
+	}
+}
+
+// gzipZinfoBuilder builds gzipZinfo with the streaming C indexer.
+type gzipZinfoBuilder struct {
+	r            io.Reader
+	builder      *C.struct_gzip_index_builder
+	onCheckpoint checkpointFunc
+	buf          []byte // compressed data read from r
+	bufStart     int    // start of the compressed data not passed to the indexer yet
+	bufEnd       int
+	eof          bool // r is exhausted
+	done         bool // the end of the gzip stream has been reached
+	checkpoints  int  // number of checkpoints reported to onCheckpoint
+}
+
+func newGzipZinfoBuilder(r io.Reader, spanSize int64, onCheckpoint checkpointFunc) (*gzipZinfoBuilder, error) {
+	builder := C.index_builder_new(C.off_t(spanSize))
+	if builder == nil {
+		return nil, fmt.Errorf("cannot create gzip index builder")
+	}
+	return &gzipZinfoBuilder{
+		r:            r,
+		builder:      builder,
+		onCheckpoint: onCheckpoint,
+		buf:          make([]byte, gzipBuilderBufferSize),
+	}, nil
+}
+
+func (b *gzipZinfoBuilder) Read(p []byte) (int, error) {
+	if b.done {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		if b.bufStart == b.bufEnd && !b.eof {
+			n, err := b.r.Read(b.buf)
+			b.bufStart, b.bufEnd = 0, n
+			if err == io.EOF {
+				b.eof = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
+
+		var in unsafe.Pointer
+		if b.bufStart < b.bufEnd {
+			in = unsafe.Pointer(&b.buf[b.bufStart])
+		}
+		var inUsed, outUsed C.uint
+		ret := C.index_builder_inflate(b.builder, in, C.uint(b.bufEnd-b.bufStart), unsafe.Pointer(&p[0]), C.uint(len(p)), &inUsed, &outUsed)
+		b.bufStart += int(inUsed)
+		b.reportCheckpoints()
+		if ret < 0 {
+			return int(outUsed), fmt.Errorf("error uncompressing gzip stream; return code: %v", ret)
+		}
+		if ret == 1 {
+			b.done = true
+		}
+		if outUsed > 0 {
+			return int(outUsed), nil
+		}
+		if b.done {
+			return 0, io.EOF
+		}
+		if inUsed == 0 && b.eof && b.bufStart == b.bufEnd {
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+}
+
+// reportCheckpoints calls onCheckpoint for the checkpoints created since it was called last time.
+func (b *gzipZinfoBuilder) reportCheckpoints() {
+	index := C.index_builder_index(b.builder)
+	if index == nil {
+		return
+	}
+	for ; b.checkpoints < int(index.have); b.checkpoints++ {
+		i := C.int(b.checkpoints)
+		end := FileSize(C.get_comp_off(index, i))
+		start := end
+		if C.has_bits(index, i) != 0 {
+			start--
+		}
+		b.onCheckpoint(start, end)
+	}
+}
+
+func (b *gzipZinfoBuilder) Zinfo() (Zinfo, error) {
+	if !b.done {
+		return nil, fmt.Errorf("the end of the gzip stream hasn't been reached")
+	}
+	index := C.index_builder_finish(b.builder)
+	b.builder = nil
+	if index == nil {
+		return nil, fmt.Errorf("no checkpoints in the gzip stream")
+	}
+	return &gzipZinfo{index: index}, nil
+}
+
+func (b *gzipZinfoBuilder) Close() {
+	if b.builder != nil {
+		C.index_builder_free(b.builder)
+		b.builder = nil
+	}
+}
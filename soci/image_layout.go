@@ -0,0 +1,454 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+)
+
+const (
+	// maxLayoutIndexSize is the maximum size of the index.json file of an OCI image layout.
+	maxLayoutIndexSize = 4 << 20
+	// name of the index file of an OCI image layout
+	layoutIndexFile = "index.json"
+	// annotation of the image name in the image layouts exported by containerd
+	containerdImageNameAnnotation = "io.containerd.image.name"
+	// name of the manifest file of the tarballs created by `docker save`
+	dockerArchiveManifestFile = "manifest.json"
+)
+
+// OpenOCILayout returns the image `ref` of the OCI image layout at `dir`, and a content.Provider to
+// read its contents from. `ref` is matched against the image names of index.json. It can be empty if
+// the layout has a single image.
+func OpenOCILayout(dir, ref string) (content.Provider, images.Image, error) {
+	p := &layoutProvider{files: dirLayout(dir)}
+	img, err := p.image(ref)
+	if err != nil {
+		return nil, images.Image{}, fmt.Errorf("cannot read OCI image layout %s: %w", dir, err)
+	}
+	return p, img, nil
+}
+
+// OpenDockerArchive returns the image `ref` of the tarball at `archivePath`, and a content.Provider to
+// read its contents from. The tarball contains an OCI image layout, such as the tarballs created by
+// `docker save` since Docker 25, or by `ctr image export`. `ref` is matched like with OpenOCILayout.
+//
+// The tarballs created by `docker save` before Docker 25 only have a manifest.json. Their images are
+// read as OCI images with the uncompressed layers of the tarball, named after their first tag, so
+// their SOCI indices only apply to these images as they are, e.g. once pushed by `ctr image push`.
+//
+// The returned function closes the tarball.
+func OpenDockerArchive(archivePath, ref string) (content.Provider, images.Image, func() error, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, images.Image{}, nil, err
+	}
+	files, err := newTarLayout(f)
+	if err != nil {
+		f.Close()
+		return nil, images.Image{}, nil, fmt.Errorf("cannot read archive %s: %w", archivePath, err)
+	}
+	if _, ok := files.entries[layoutIndexFile]; !ok {
+		if err := files.addDockerArchiveLayout(); err != nil {
+			f.Close()
+			return nil, images.Image{}, nil, fmt.Errorf("cannot read archive %s: %w", archivePath, err)
+		}
+	}
+	p := &layoutProvider{files: files}
+	img, err := p.image(ref)
+	if err != nil {
+		f.Close()
+		return nil, images.Image{}, nil, fmt.Errorf("cannot read archive %s: %w", archivePath, err)
+	}
+	return p, img, f.Close, nil
+}
+
+// WriteSociIndexToLayout copies the SOCI index and its blobs from `store` into the OCI image layout at `dir`,
+// and adds the index to the index.json of the layout, so that the layout can be copied to a registry with its SOCI index.
+func WriteSociIndexToLayout(ctx context.Context, index *SociIndex, store orascontent.Storage, dir string) error {
+	manifest, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	indexDesc := ocispec.Descriptor{
+		MediaType: sociIndexMediaType,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+	}
+	for _, desc := range index.Blobs {
+		if desc == nil {
+			continue
+		}
+		rc, err := store.Fetch(ctx, *desc)
+		if err != nil {
+			return fmt.Errorf("cannot fetch blob %s: %w", desc.Digest, err)
+		}
+		err = writeLayoutBlob(dir, *desc, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := writeLayoutBlob(dir, indexDesc, bytes.NewReader(manifest)); err != nil {
+		return err
+	}
+
+	return addLayoutManifest(dir, indexDesc)
+}
+
+// addLayoutManifest adds `desc` to the manifests of the index.json of the OCI image layout at `dir`.
+// The other fields of index.json are kept as they are, including the ones unknown to ocispec.
+func addLayoutManifest(dir string, desc ocispec.Descriptor) error {
+	indexPath := filepath.Join(dir, layoutIndexFile)
+	b, err := os.ReadFile(indexPath)
+	if err != nil {
+		return err
+	}
+	var index map[string]json.RawMessage
+	if err := json.Unmarshal(b, &index); err != nil {
+		return fmt.Errorf("cannot decode %s: %w", indexPath, err)
+	}
+	var manifests []json.RawMessage
+	if m, ok := index["manifests"]; ok {
+		if err := json.Unmarshal(m, &manifests); err != nil {
+			return fmt.Errorf("cannot decode the manifests of %s: %w", indexPath, err)
+		}
+	}
+	for _, m := range manifests {
+		var existing ocispec.Descriptor
+		if err := json.Unmarshal(m, &existing); err != nil {
+			return fmt.Errorf("cannot decode the manifests of %s: %w", indexPath, err)
+		}
+		if existing.Digest == desc.Digest {
+			return nil
+		}
+	}
+	d, err := json.Marshal(desc)
+	if err != nil {
+		return err
+	}
+	if index["manifests"], err = json.Marshal(append(manifests, d)); err != nil {
+		return err
+	}
+	if b, err = json.Marshal(index); err != nil {
+		return err
+	}
+	return writeFileAtomic(indexPath, b)
+}
+
+// writeLayoutBlob writes the blob `desc` to the OCI image layout at `dir`, unless it's already there.
+func writeLayoutBlob(dir string, desc ocispec.Descriptor, r io.Reader) error {
+	p := blobPath(dir, desc.Digest)
+	if _, err := os.Stat(p); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	verifier := desc.Digest.Verifier()
+	var buf bytes.Buffer
+	if _, err := io.Copy(io.MultiWriter(&buf, verifier), io.LimitReader(r, desc.Size)); err != nil {
+		return fmt.Errorf("cannot read blob %s: %w", desc.Digest, err)
+	}
+	if int64(buf.Len()) != desc.Size || !verifier.Verified() {
+		return fmt.Errorf("blob %s doesn't match its descriptor", desc.Digest)
+	}
+	return writeFileAtomic(p, buf.Bytes())
+}
+
+func writeFileAtomic(name string, b []byte) error {
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// layoutFiles gives access to the files of an OCI image layout, by their slash-separated path in the layout.
+type layoutFiles interface {
+	open(name string) (content.ReaderAt, error)
+}
+
+// dirLayout is an OCI image layout in a directory.
+type dirLayout string
+
+func (d dirLayout) open(name string) (content.ReaderAt, error) {
+	f, err := os.Open(filepath.Join(string(d), filepath.FromSlash(name)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s: %w", name, errdefs.ErrNotFound)
+		}
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &sizedReaderAt{ReaderAt: f, size: fi.Size(), close: f.Close}, nil
+}
+
+// tarLayout is an OCI image layout in a tarball. The files are read in place, at their offset in the tarball.
+type tarLayout struct {
+	entries map[string]*io.SectionReader
+}
+
+func newTarLayout(f *os.File) (*tarLayout, error) {
+	entries := make(map[string]*io.SectionReader)
+	links := make(map[string]string)
+	pt := &positionTrackerReader{r: f}
+	tr := tar.NewReader(pt)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error while reading tar header: %w", err)
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			entries[name] = io.NewSectionReader(f, int64(pt.CurrentPos()), hdr.Size)
+		case tar.TypeSymlink:
+			links[name] = path.Join(path.Dir(name), hdr.Linkname)
+		case tar.TypeLink:
+			links[name] = path.Clean(strings.TrimPrefix(hdr.Linkname, "./"))
+		}
+	}
+	for name, target := range links {
+		// links in layouts only point to regular files, so a single level of indirection is enough
+		if sr, ok := entries[target]; ok {
+			entries[name] = sr
+		}
+	}
+	return &tarLayout{entries: entries}, nil
+}
+
+// dockerArchiveManifest is an image of the manifest.json of the tarballs created by `docker save`.
+type dockerArchiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// addDockerArchiveLayout adds the files of an OCI image layout to a tarball created by `docker save`
+// before Docker 25, from its manifest.json. The blobs are the config and the layers of the tarball,
+// named after their digest, and the manifests, which are made up. The layers are uncompressed, so
+// their digests are the diff IDs of the config.
+func (t *tarLayout) addDockerArchiveLayout() error {
+	sr, ok := t.entries[dockerArchiveManifestFile]
+	if !ok {
+		return fmt.Errorf("neither %s nor %s found", layoutIndexFile, dockerArchiveManifestFile)
+	}
+	var archiveManifests []dockerArchiveManifest
+	if err := json.NewDecoder(io.LimitReader(sr, maxLayoutIndexSize)).Decode(&archiveManifests); err != nil {
+		return fmt.Errorf("cannot decode %s: %w", dockerArchiveManifestFile, err)
+	}
+	var index ocispec.Index
+	index.SchemaVersion = 2
+	for _, m := range archiveManifests {
+		configReader, ok := t.entries[path.Clean(m.Config)]
+		if !ok {
+			return fmt.Errorf("config %s: %w", m.Config, errdefs.ErrNotFound)
+		}
+		config, err := io.ReadAll(io.NewSectionReader(configReader, 0, configReader.Size()))
+		if err != nil {
+			return fmt.Errorf("cannot read config %s: %w", m.Config, err)
+		}
+		var img ocispec.Image
+		if err := json.Unmarshal(config, &img); err != nil {
+			return fmt.Errorf("cannot decode config %s: %w", m.Config, err)
+		}
+		if len(img.RootFS.DiffIDs) != len(m.Layers) {
+			return fmt.Errorf("config %s has %d diff IDs for %d layers", m.Config, len(img.RootFS.DiffIDs), len(m.Layers))
+		}
+
+		manifest := ocispec.Manifest{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config: ocispec.Descriptor{
+				MediaType: images.MediaTypeDockerSchema2Config,
+				Digest:    digest.FromBytes(config),
+				Size:      int64(len(config)),
+			},
+		}
+		manifest.SchemaVersion = 2
+		t.entries[layoutBlobName(manifest.Config.Digest)] = configReader
+		for i, l := range m.Layers {
+			layerReader, ok := t.entries[path.Clean(l)]
+			if !ok {
+				return fmt.Errorf("layer %s: %w", l, errdefs.ErrNotFound)
+			}
+			diffID := img.RootFS.DiffIDs[i]
+			if err := diffID.Validate(); err != nil {
+				return fmt.Errorf("invalid diff ID of layer %s: %w", l, err)
+			}
+			manifest.Layers = append(manifest.Layers, ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageLayer,
+				Digest:    diffID,
+				Size:      layerReader.Size(),
+			})
+			t.entries[layoutBlobName(diffID)] = layerReader
+		}
+
+		b, err := json.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+		desc := ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    digest.FromBytes(b),
+			Size:      int64(len(b)),
+		}
+		if len(m.RepoTags) > 0 {
+			desc.Annotations = map[string]string{containerdImageNameAnnotation: m.RepoTags[0]}
+		}
+		t.entries[layoutBlobName(desc.Digest)] = io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+		index.Manifests = append(index.Manifests, desc)
+	}
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	t.entries[layoutIndexFile] = io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+	return nil
+}
+
+func (t *tarLayout) open(name string) (content.ReaderAt, error) {
+	sr, ok := t.entries[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, errdefs.ErrNotFound)
+	}
+	return &sizedReaderAt{ReaderAt: sr, size: sr.Size(), close: func() error { return nil }}, nil
+}
+
+type sizedReaderAt struct {
+	io.ReaderAt
+	size  int64
+	close func() error
+}
+
+func (r *sizedReaderAt) Size() int64  { return r.size }
+func (r *sizedReaderAt) Close() error { return r.close() }
+
+// layoutProvider is a content.Provider of the blobs of an OCI image layout.
+// Blobs are read by path, so they're verified against their descriptor: layers are verified by
+// BuildSociIndex as it reads them, and the other blobs, e.g. manifests, when they're opened.
+type layoutProvider struct {
+	files layoutFiles
+}
+
+func (p *layoutProvider) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	ra, err := p.files.open(layoutBlobName(desc.Digest))
+	if err != nil {
+		return nil, err
+	}
+	if ra.Size() != desc.Size {
+		ra.Close()
+		return nil, fmt.Errorf("unexpected size of blob %s; expected %d, got %d", desc.Digest, desc.Size, ra.Size())
+	}
+	if images.IsLayerType(desc.MediaType) {
+		return ra, nil
+	}
+	verifier := desc.Digest.Verifier()
+	if _, err := io.Copy(verifier, io.NewSectionReader(ra, 0, ra.Size())); err != nil {
+		ra.Close()
+		return nil, fmt.Errorf("cannot read blob %s: %w", desc.Digest, err)
+	}
+	if !verifier.Verified() {
+		ra.Close()
+		return nil, fmt.Errorf("blob %s doesn't match its digest", desc.Digest)
+	}
+	return ra, nil
+}
+
+// layoutBlobName returns the slash-separated path of the blob `dgst` in an OCI image layout.
+func layoutBlobName(dgst digest.Digest) string {
+	return path.Join("blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// image returns the image `ref` of the layout. If `ref` is empty, the layout must have a single image.
+func (p *layoutProvider) image(ref string) (images.Image, error) {
+	index, err := readLayoutIndex(p.files)
+	if err != nil {
+		return images.Image{}, err
+	}
+	var found []images.Image
+	for _, desc := range index.Manifests {
+		// the layout may have SOCI indices written by WriteSociIndexToLayout
+		if desc.MediaType == sociIndexMediaType {
+			continue
+		}
+		name := desc.Annotations[containerdImageNameAnnotation]
+		if name == "" {
+			name = desc.Annotations[ocispec.AnnotationRefName]
+		}
+		if ref == "" || ref == name || ref == desc.Annotations[ocispec.AnnotationRefName] {
+			found = append(found, images.Image{Name: name, Target: desc})
+		}
+	}
+	switch {
+	case len(found) == 1:
+		return found[0], nil
+	case len(found) == 0 && ref != "":
+		return images.Image{}, fmt.Errorf("image %s: %w", ref, errdefs.ErrNotFound)
+	case len(found) == 0:
+		return images.Image{}, fmt.Errorf("no image: %w", errdefs.ErrNotFound)
+	default:
+		var names []string
+		for _, img := range found {
+			names = append(names, img.Name)
+		}
+		return images.Image{}, fmt.Errorf("%d images match %q, one must be chosen by name: %s", len(found), ref, strings.Join(names, ", "))
+	}
+}
+
+func readLayoutIndex(files layoutFiles) (*ocispec.Index, error) {
+	ra, err := files.open(layoutIndexFile)
+	if err != nil {
+		if errors.Is(err, errdefs.ErrNotFound) {
+			return nil, fmt.Errorf("not an OCI image layout: %w", err)
+		}
+		return nil, err
+	}
+	defer ra.Close()
+	var index ocispec.Index
+	if err := json.NewDecoder(io.LimitReader(io.NewSectionReader(ra, 0, ra.Size()), maxLayoutIndexSize)).Decode(&index); err != nil {
+		return nil, fmt.Errorf("cannot decode %s: %w", layoutIndexFile, err)
+	}
+	return &index, nil
+}
@@ -0,0 +1,361 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+// writeTestLayout writes an OCI image layout with two images, named "example.com/image1" and "image2".
+// It returns the descriptors of the images.
+func writeTestLayout(t *testing.T, dir string) []ocispec.Descriptor {
+	var manifests []ocispec.Descriptor
+	for i, name := range []string{"example.com/image1", "image2"} {
+		layer := writeTestBlob(t, dir, []byte(name+" layer"))
+		manifest, err := json.Marshal(ocispec.Manifest{
+			Layers: []ocispec.Descriptor{{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: layer, Size: int64(len(name + " layer"))}},
+		})
+		if err != nil {
+			t.Fatalf("cannot marshal manifest: %v", err)
+		}
+		desc := ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    writeTestBlob(t, dir, manifest),
+			Size:      int64(len(manifest)),
+		}
+		if i == 0 {
+			desc.Annotations = map[string]string{containerdImageNameAnnotation: name, ocispec.AnnotationRefName: "latest"}
+		} else {
+			desc.Annotations = map[string]string{ocispec.AnnotationRefName: name}
+		}
+		manifests = append(manifests, desc)
+	}
+	index, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests":     manifests,
+		"unknownField":  "kept",
+	})
+	if err != nil {
+		t.Fatalf("cannot marshal index: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, layoutIndexFile), index, 0644); err != nil {
+		t.Fatalf("cannot write index: %v", err)
+	}
+	return manifests
+}
+
+// tarTestLayout writes the OCI image layout at `dir` into a tarball, the way `docker save` does,
+// with a symlink to the first layer.
+func tarTestLayout(t *testing.T, dir string, firstLayer digest.Digest) string {
+	archivePath := filepath.Join(t.TempDir(), "image.tar")
+	f, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatalf("cannot create archive: %v", err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: "./" + filepath.ToSlash(name), Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(b))}); err != nil {
+			return err
+		}
+		_, err = tw.Write(b)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("cannot write archive: %v", err)
+	}
+	err = tw.WriteHeader(&tar.Header{Name: "layer1/layer.tar", Typeflag: tar.TypeSymlink, Linkname: "../blobs/sha256/" + firstLayer.Encoded()})
+	if err != nil {
+		t.Fatalf("cannot write archive: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("cannot write archive: %v", err)
+	}
+	return archivePath
+}
+
+func TestOpenOCILayout(t *testing.T) {
+	dir := t.TempDir()
+	manifests := writeTestLayout(t, dir)
+
+	testCases := []struct {
+		name     string
+		ref      string
+		expected *ocispec.Descriptor
+	}{
+		{name: "containerd image name", ref: "example.com/image1", expected: &manifests[0]},
+		{name: "ref name", ref: "latest", expected: &manifests[0]},
+		{name: "ref name without containerd image name", ref: "image2", expected: &manifests[1]},
+		{name: "unknown image", ref: "example.com/image3"},
+		{name: "no ref with several images", ref: ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, img, err := OpenOCILayout(dir, tc.ref)
+			if tc.expected == nil {
+				if err == nil {
+					t.Fatalf("expected an error, got image %v", img)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("cannot open layout: %v", err)
+			}
+			if img.Target.Digest != tc.expected.Digest {
+				t.Fatalf("unexpected image; expected %s, got %s", tc.expected.Digest, img.Target.Digest)
+			}
+			checkLayoutImage(t, p, img)
+		})
+	}
+}
+
+func TestOpenDockerArchive(t *testing.T) {
+	dir := t.TempDir()
+	manifests := writeTestLayout(t, dir)
+	b, err := os.ReadFile(blobPath(dir, manifests[0].Digest))
+	if err != nil {
+		t.Fatalf("cannot read manifest: %v", err)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		t.Fatalf("cannot decode manifest: %v", err)
+	}
+	archivePath := tarTestLayout(t, dir, manifest.Layers[0].Digest)
+
+	p, img, closeArchive, err := OpenDockerArchive(archivePath, "example.com/image1")
+	if err != nil {
+		t.Fatalf("cannot open archive: %v", err)
+	}
+	defer closeArchive()
+	if img.Target.Digest != manifests[0].Digest {
+		t.Fatalf("unexpected image; expected %s, got %s", manifests[0].Digest, img.Target.Digest)
+	}
+	checkLayoutImage(t, p, img)
+
+	files := p.(*layoutProvider).files
+	ra, err := files.open("layer1/layer.tar")
+	if err != nil {
+		t.Fatalf("cannot open the symlink to the layer: %v", err)
+	}
+	defer ra.Close()
+	if ra.Size() != manifest.Layers[0].Size {
+		t.Fatalf("unexpected size of the symlink to the layer: %d", ra.Size())
+	}
+}
+
+func TestOpenDockerArchiveLegacy(t *testing.T) {
+	var layers [][]byte
+	var diffIDs []digest.Digest
+	for _, name := range []string{"file1", "file2"} {
+		layer, err := io.ReadAll(testutil.BuildTar([]testutil.TarEntry{testutil.File(name, name+" contents")}))
+		if err != nil {
+			t.Fatalf("cannot build layer: %v", err)
+		}
+		layers = append(layers, layer)
+		diffIDs = append(diffIDs, digest.FromBytes(layer))
+	}
+	config, err := json.Marshal(ocispec.Image{
+		Architecture: runtime.GOARCH,
+		OS:           runtime.GOOS,
+		RootFS:       ocispec.RootFS{Type: "layers", DiffIDs: diffIDs},
+	})
+	if err != nil {
+		t.Fatalf("cannot marshal config: %v", err)
+	}
+	configName := digest.FromBytes(config).Encoded() + ".json"
+	manifest := []byte(`[{"Config":"` + configName + `","RepoTags":["image:latest","image:1"],"Layers":["layer1/layer.tar","layer2/layer.tar"]}]`)
+
+	archivePath := filepath.Join(t.TempDir(), "image.tar")
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range []struct {
+		name     string
+		contents []byte
+	}{
+		{"layer1/layer.tar", layers[0]},
+		{"layer2/layer.tar", layers[1]},
+		{configName, config},
+		{"manifest.json", manifest},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.contents))}); err != nil {
+			t.Fatalf("cannot write archive: %v", err)
+		}
+		if _, err := tw.Write(f.contents); err != nil {
+			t.Fatalf("cannot write archive: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("cannot write archive: %v", err)
+	}
+	if err := os.WriteFile(archivePath, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("cannot write archive: %v", err)
+	}
+
+	p, img, closeArchive, err := OpenDockerArchive(archivePath, "image:latest")
+	if err != nil {
+		t.Fatalf("cannot open legacy archive: %v", err)
+	}
+	defer closeArchive()
+	checkLayoutImage(t, p, img)
+	m, err := images.Manifest(context.Background(), p, img.Target, platforms.Default())
+	if err != nil {
+		t.Fatalf("cannot read the manifest for the platform of the host: %v", err)
+	}
+	if len(m.Layers) != 2 {
+		t.Fatalf("unexpected layers %v", m.Layers)
+	}
+	for i, l := range m.Layers {
+		if l.MediaType != ocispec.MediaTypeImageLayer || l.Digest != diffIDs[i] {
+			t.Fatalf("unexpected layer %v; expected uncompressed layer %s", l, diffIDs[i])
+		}
+	}
+}
+
+func TestOpenOCILayoutCorruptedBlobs(t *testing.T) {
+	dir := t.TempDir()
+	manifests := writeTestLayout(t, dir)
+	p, img, err := OpenOCILayout(dir, "example.com/image1")
+	if err != nil {
+		t.Fatalf("cannot open layout: %v", err)
+	}
+	manifest, err := images.Manifest(context.Background(), p, img.Target, nil)
+	if err != nil {
+		t.Fatalf("cannot read the manifest: %v", err)
+	}
+
+	// layers are verified as they're read, only their size is checked when they're opened
+	layer := manifest.Layers[0]
+	layer.Size++
+	if _, err := p.ReaderAt(context.Background(), layer); err == nil {
+		t.Fatalf("opened a layer of an unexpected size")
+	}
+
+	b, err := os.ReadFile(blobPath(dir, manifests[0].Digest))
+	if err != nil {
+		t.Fatalf("cannot read manifest: %v", err)
+	}
+	b[0] = ' '
+	if err := os.WriteFile(blobPath(dir, manifests[0].Digest), b, 0644); err != nil {
+		t.Fatalf("cannot corrupt manifest: %v", err)
+	}
+	if _, err := images.Manifest(context.Background(), p, img.Target, nil); err == nil {
+		t.Fatalf("read a manifest which doesn't match its digest")
+	}
+}
+
+// checkLayoutImage checks that the manifest and the layers of `img` can be read from `p`.
+func checkLayoutImage(t *testing.T, p content.Provider, img images.Image) {
+	manifest, err := images.Manifest(context.Background(), p, img.Target, nil)
+	if err != nil {
+		t.Fatalf("cannot read the manifest: %v", err)
+	}
+	for _, l := range manifest.Layers {
+		b, err := content.ReadBlob(context.Background(), p, l)
+		if err != nil {
+			t.Fatalf("cannot read layer %s: %v", l.Digest, err)
+		}
+		if digest.FromBytes(b) != l.Digest {
+			t.Fatalf("unexpected contents of layer %s", l.Digest)
+		}
+	}
+}
+
+func TestWriteSociIndexToLayout(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	manifests := writeTestLayout(t, dir)
+
+	store := memory.New()
+	ztoc := []byte("ztoc")
+	ztocDesc := ocispec.Descriptor{MediaType: SociLayerMediaType, Digest: digest.FromBytes(ztoc), Size: int64(len(ztoc))}
+	if err := store.Push(ctx, ztocDesc, bytes.NewReader(ztoc)); err != nil {
+		t.Fatalf("cannot push ztoc: %v", err)
+	}
+	index := &SociIndex{
+		MediaType:    sociIndexMediaType,
+		ArtifactType: SociIndexArtifactType,
+		Blobs:        []*ocispec.Descriptor{&ztocDesc, nil},
+		Subject:      manifests[0],
+	}
+
+	// writing the index twice only adds it once
+	for i := 0; i < 2; i++ {
+		if err := WriteSociIndexToLayout(ctx, index, store, dir); err != nil {
+			t.Fatalf("cannot write index to layout: %v", err)
+		}
+	}
+
+	if b, err := os.ReadFile(blobPath(dir, ztocDesc.Digest)); err != nil || !bytes.Equal(b, ztoc) {
+		t.Fatalf("ztoc not written to the layout: %v", err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, layoutIndexFile))
+	if err != nil {
+		t.Fatalf("cannot read index: %v", err)
+	}
+	var layoutIndex struct {
+		Manifests    []ocispec.Descriptor `json:"manifests"`
+		UnknownField string               `json:"unknownField"`
+	}
+	if err := json.Unmarshal(b, &layoutIndex); err != nil {
+		t.Fatalf("cannot decode index: %v", err)
+	}
+	if layoutIndex.UnknownField != "kept" {
+		t.Fatalf("unknown field of index.json lost")
+	}
+	if len(layoutIndex.Manifests) != 3 || layoutIndex.Manifests[2].MediaType != sociIndexMediaType {
+		t.Fatalf("unexpected manifests of index.json: %v", layoutIndex.Manifests)
+	}
+	sociIndex, err := readIndexBlob(dir, layoutIndex.Manifests[2].Digest.String())
+	if err != nil {
+		t.Fatalf("cannot read SOCI index from the layout: %v", err)
+	}
+	if sociIndex.Subject.Digest != manifests[0].Digest {
+		t.Fatalf("unexpected subject of SOCI index: %s", sociIndex.Subject.Digest)
+	}
+
+	// the layout still opens, without considering the SOCI index as an image
+	if _, img, err := OpenOCILayout(dir, "image2"); err != nil || img.Target.Digest != manifests[1].Digest {
+		t.Fatalf("cannot open layout with a SOCI index: %v", err)
+	}
+}
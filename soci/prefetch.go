@@ -0,0 +1,248 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+)
+
+const (
+	// SociPrefetchListMediaType is the mediaType of the prefetch lists attached to SOCI indices.
+	SociPrefetchListMediaType = "application/vnd.amazon.soci.prefetch-list.v1+json"
+	// maxPrefetchListSize is the maximum size of a prefetch list read from a store.
+	maxPrefetchListSize = 16 << 20
+)
+
+// FileAccess is an access to the uncompressed contents of a layer, recorded while profiling the startup
+// of a container. Opening a file is recorded as an empty range at the start of the file's contents.
+type FileAccess struct {
+	Start FileSize `json:"start"`
+	End   FileSize `json:"end"`
+}
+
+// PrefetchList lists the files and spans of the layers of an image which are read when a container starts,
+// so that the snapshotter fetches them before the other spans.
+type PrefetchList struct {
+	Layers []PrefetchLayer `json:"layers"`
+}
+
+// PrefetchLayer lists the files and spans of a layer read when a container starts, in the order they were first accessed.
+type PrefetchLayer struct {
+	// Digest is the digest of the image layer.
+	Digest digest.Digest `json:"digest"`
+	// Files are the names of the files opened or read. They're informative; the spans are what is prefetched.
+	Files []string `json:"files,omitempty"`
+	// Spans are the spans of the ztoc of the layer which were read.
+	Spans []SpanId `json:"spans"`
+}
+
+// Spans returns the spans to prefetch first for the layer `layerDigest`. It returns nil if the list has none.
+func (l *PrefetchList) Spans(layerDigest digest.Digest) []SpanId {
+	if l == nil {
+		return nil
+	}
+	for _, layer := range l.Layers {
+		if layer.Digest == layerDigest {
+			return layer.Spans
+		}
+	}
+	return nil
+}
+
+// NewPrefetchLayer maps the accesses to the layer `layerDigest` to the files and spans of its ztoc.
+func NewPrefetchLayer(layerDigest digest.Digest, ztoc *Ztoc, accesses []FileAccess) (PrefetchLayer, error) {
+	zinfo, err := ztoc.Zinfo()
+	if err != nil {
+		return PrefetchLayer{}, err
+	}
+	defer zinfo.Close()
+
+	// regular files sorted by the offset of their contents
+	var files []*FileMetadata
+	for i := range ztoc.Metadata {
+		if ztoc.Metadata[i].Type == "reg" {
+			files = append(files, &ztoc.Metadata[i])
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].UncompressedOffset < files[j].UncompressedOffset })
+
+	layer := PrefetchLayer{Digest: layerDigest, Spans: []SpanId{}}
+	seenFiles := make(map[string]struct{})
+	seenSpans := make(map[SpanId]struct{})
+	for _, a := range accesses {
+		if a.Start < 0 || a.End < a.Start {
+			return PrefetchLayer{}, fmt.Errorf("invalid access [%d, %d)", a.Start, a.End)
+		}
+		// the file with the last contents starting at or before the access
+		i := sort.Search(len(files), func(i int) bool { return files[i].UncompressedOffset > a.Start }) - 1
+		if i >= 0 && (a.Start == files[i].UncompressedOffset || a.Start < files[i].UncompressedOffset+files[i].UncompressedSize) {
+			if _, ok := seenFiles[files[i].Name]; !ok {
+				seenFiles[files[i].Name] = struct{}{}
+				layer.Files = append(layer.Files, files[i].Name)
+			}
+		}
+		if a.Start == a.End {
+			continue
+		}
+		first := zinfo.UncompressedOffsetToSpanId(a.Start)
+		last := zinfo.UncompressedOffsetToSpanId(a.End - 1)
+		if last > ztoc.MaxSpanId {
+			last = ztoc.MaxSpanId
+		}
+		for id := first; id <= last; id++ {
+			if _, ok := seenSpans[id]; !ok {
+				seenSpans[id] = struct{}{}
+				layer.Spans = append(layer.Spans, id)
+			}
+		}
+	}
+	return layer, nil
+}
+
+// ReadFileAccesses reads the accesses of a profile, written as one JSON object per line.
+func ReadFileAccesses(r io.Reader) ([]FileAccess, error) {
+	var accesses []FileAccess
+	dec := json.NewDecoder(r)
+	for {
+		var a FileAccess
+		err := dec.Decode(&a)
+		if err == io.EOF {
+			return accesses, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode file access: %w", err)
+		}
+		accesses = append(accesses, a)
+	}
+}
+
+// PrefetchListDescriptor returns the descriptor of the prefetch list of the index, or nil if it has none.
+func (index *SociIndex) PrefetchListDescriptor() *ocispec.Descriptor {
+	for _, blob := range index.Blobs {
+		if blob != nil && blob.MediaType == SociPrefetchListMediaType {
+			return blob
+		}
+	}
+	return nil
+}
+
+// ReadPrefetchList reads the prefetch list of the index from `store`. It returns nil if the index has none.
+func ReadPrefetchList(ctx context.Context, index *SociIndex, store orascontent.Fetcher) (*PrefetchList, error) {
+	desc := index.PrefetchListDescriptor()
+	if desc == nil {
+		return nil, nil
+	}
+	if desc.Size > maxPrefetchListSize {
+		return nil, fmt.Errorf("prefetch list %s is too large: %d bytes", desc.Digest, desc.Size)
+	}
+	b, err := orascontent.FetchAll(ctx, store, *desc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch prefetch list %s: %w", desc.Digest, err)
+	}
+	var list PrefetchList
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("cannot decode prefetch list %s: %w", desc.Digest, err)
+	}
+	return &list, nil
+}
+
+// AddPrefetchList attaches `list` to the SOCI index `indexDigest` of the local store. Since the index is
+// immutable, a new index is written, with the blobs of the original one and the prefetch list instead of
+// its previous one, if any. Signatures of the original index don't apply to the new one.
+// It returns the digest of the new index.
+func AddPrefetchList(ctx context.Context, indexDigest digest.Digest, list *PrefetchList, store orascontent.Storage) (digest.Digest, error) {
+	indexBytes, entry, err := readLocalIndex(ctx, indexDigest, store)
+	if err != nil {
+		return "", err
+	}
+	var index SociIndex
+	if err := json.Unmarshal(indexBytes, &index); err != nil {
+		return "", fmt.Errorf("cannot decode SOCI index %s: %w", indexDigest, err)
+	}
+
+	b, err := json.Marshal(list)
+	if err != nil {
+		return "", err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: SociPrefetchListMediaType,
+		Digest:    digest.FromBytes(b),
+		Size:      int64(len(b)),
+	}
+	err = store.Push(ctx, desc, bytes.NewReader(b))
+	if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return "", fmt.Errorf("cannot write prefetch list to local store: %w", err)
+	}
+	err = writeArtifactEntry(&ArtifactEntry{
+		Size:           desc.Size,
+		Digest:         desc.Digest.String(),
+		OriginalDigest: index.Subject.Digest.String(),
+		ImageDigest:    entry.ImageDigest,
+		Platform:       entry.Platform,
+		Location:       entry.Location,
+		Type:           ArtifactEntryTypePrefetchList,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var platform ocispec.Platform
+	if entry.Platform != "" {
+		if platform, err = platforms.Parse(entry.Platform); err != nil {
+			return "", fmt.Errorf("invalid platform of SOCI index %s: %w", indexDigest, err)
+		}
+	}
+	newIndex := withPrefetchList(&index, desc)
+	err = WriteSociIndex(ctx, IndexWithMetadata{
+		Index:       newIndex,
+		ImageDigest: digest.Digest(entry.ImageDigest),
+		Platform:    platform,
+	}, store)
+	if err != nil {
+		return "", err
+	}
+	manifest, err := json.Marshal(newIndex)
+	if err != nil {
+		return "", err
+	}
+	return digest.FromBytes(manifest), nil
+}
+
+// withPrefetchList returns a copy of `index` whose prefetch list is `desc`.
+func withPrefetchList(index *SociIndex, desc ocispec.Descriptor) *SociIndex {
+	newIndex := *index
+	newIndex.Blobs = nil
+	for _, blob := range index.Blobs {
+		if blob == nil || blob.MediaType != SociPrefetchListMediaType {
+			newIndex.Blobs = append(newIndex.Blobs, blob)
+		}
+	}
+	newIndex.Blobs = append(newIndex.Blobs, &desc)
+	return &newIndex
+}
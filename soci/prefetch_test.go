@@ -0,0 +1,116 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestNewPrefetchLayer(t *testing.T) {
+	const spanSize = 1 << 14
+	tarEntries := []testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("dir/file1", string(genRandomByteData(100000))),
+		testutil.File("empty", ""),
+		testutil.File("dir/file2", string(genRandomByteData(50000))),
+	}
+	// spans of uncompressed layers are the ranges of `spanSize` bytes of the tar archive
+	ztoc, _, err := BuildTarZtocReader(tarEntries, spanSize)
+	if err != nil {
+		t.Fatalf("cannot build ztoc: %v", err)
+	}
+	file1 := findFileMetadata(ztoc, "dir/file1")
+	file2 := findFileMetadata(ztoc, "dir/file2")
+	empty := findFileMetadata(ztoc, "empty")
+	layerDigest := digest.FromString("layer")
+
+	accesses := []FileAccess{
+		// open and read the end of file2
+		{Start: file2.UncompressedOffset, End: file2.UncompressedOffset},
+		{Start: file2.UncompressedOffset + 40000, End: file2.UncompressedOffset + 50000},
+		// open the empty file
+		{Start: empty.UncompressedOffset, End: empty.UncompressedOffset},
+		// read file1 twice
+		{Start: file1.UncompressedOffset, End: file1.UncompressedOffset + 20000},
+		{Start: file1.UncompressedOffset, End: file1.UncompressedOffset + 20000},
+	}
+	layer, err := NewPrefetchLayer(layerDigest, ztoc, accesses)
+	if err != nil {
+		t.Fatalf("cannot build prefetch layer: %v", err)
+	}
+
+	var expectedSpans []SpanId
+	for id := SpanId((file2.UncompressedOffset + 40000) / spanSize); id <= SpanId((file2.UncompressedOffset+49999)/spanSize); id++ {
+		expectedSpans = append(expectedSpans, id)
+	}
+	for id := SpanId(file1.UncompressedOffset / spanSize); id <= SpanId((file1.UncompressedOffset+19999)/spanSize); id++ {
+		expectedSpans = append(expectedSpans, id)
+	}
+	if !reflect.DeepEqual(layer.Spans, expectedSpans) {
+		t.Fatalf("unexpected spans; expected %v, got %v", expectedSpans, layer.Spans)
+	}
+	expectedFiles := []string{"dir/file2", "empty", "dir/file1"}
+	if !reflect.DeepEqual(layer.Files, expectedFiles) {
+		t.Fatalf("unexpected files; expected %v, got %v", expectedFiles, layer.Files)
+	}
+
+	list := &PrefetchList{Layers: []PrefetchLayer{layer}}
+	if !reflect.DeepEqual(list.Spans(layerDigest), expectedSpans) {
+		t.Fatalf("unexpected spans of the layer in the prefetch list: %v", list.Spans(layerDigest))
+	}
+	if spans := list.Spans(digest.FromString("other layer")); spans != nil {
+		t.Fatalf("unexpected spans of a layer missing from the prefetch list: %v", spans)
+	}
+}
+
+func TestReadFileAccesses(t *testing.T) {
+	accesses, err := ReadFileAccesses(strings.NewReader("{\"start\":1,\"end\":1}\n{\"start\":2,\"end\":10}\n"))
+	if err != nil {
+		t.Fatalf("cannot read accesses: %v", err)
+	}
+	expected := []FileAccess{{Start: 1, End: 1}, {Start: 2, End: 10}}
+	if !reflect.DeepEqual(accesses, expected) {
+		t.Fatalf("unexpected accesses; expected %v, got %v", expected, accesses)
+	}
+	if _, err := ReadFileAccesses(strings.NewReader("{\"start\":1,")); err == nil {
+		t.Fatalf("expected an error reading a truncated access")
+	}
+}
+
+func TestWithPrefetchList(t *testing.T) {
+	ztocDesc := ocispec.Descriptor{MediaType: SociLayerMediaType, Digest: digest.FromString("ztoc")}
+	oldList := ocispec.Descriptor{MediaType: SociPrefetchListMediaType, Digest: digest.FromString("old list")}
+	newList := ocispec.Descriptor{MediaType: SociPrefetchListMediaType, Digest: digest.FromString("new list")}
+	index := &SociIndex{Blobs: []*ocispec.Descriptor{&ztocDesc, nil, &oldList}}
+
+	newIndex := withPrefetchList(index, newList)
+	if len(newIndex.Blobs) != 3 || newIndex.Blobs[0].Digest != ztocDesc.Digest || newIndex.Blobs[1] != nil {
+		t.Fatalf("unexpected blobs of the new index: %v", newIndex.Blobs)
+	}
+	if desc := newIndex.PrefetchListDescriptor(); desc == nil || desc.Digest != newList.Digest {
+		t.Fatalf("unexpected prefetch list of the new index: %v", desc)
+	}
+	if desc := index.PrefetchListDescriptor(); desc == nil || desc.Digest != oldList.Digest {
+		t.Fatalf("the original index was modified: %v", desc)
+	}
+}
@@ -0,0 +1,181 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+)
+
+// maxIndexSize is the maximum size of a SOCI index read from the local store.
+const maxIndexSize = 16 << 20
+
+// RemoveIndex removes the SOCI index `indexDigest` and its signatures from the ArtifactsDB
+// and from the OCI image layout at `storePath`. It returns the removed entries.
+// The ztocs of the index are kept, since other indices may use them. They are removed
+// by PruneArtifacts once no index uses them anymore.
+func RemoveIndex(db *ArtifactsDb, storePath, indexDigest string) ([]ArtifactEntry, error) {
+	entry, err := db.GetArtifactEntry(indexDigest)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Type != ArtifactEntryTypeIndex {
+		return nil, fmt.Errorf("%s is not a SOCI index, but a %s", indexDigest, entry.Type)
+	}
+
+	removed := []ArtifactEntry{*entry}
+	err = db.Walk(func(ae *ArtifactEntry) error {
+		if ae.Type == ArtifactEntryTypeSignature && ae.OriginalDigest == indexDigest {
+			removed = append(removed, *ae)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := removeArtifacts(db, storePath, removed); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+// PruneArtifacts removes the SOCI artifacts which aren't needed anymore from the ArtifactsDB and
+// from the OCI image layout at `storePath`:
+//   - indices of images which don't exist anymore, according to `imageExists`, or whose contents are missing,
+//   - signatures of removed indices,
+//   - ztocs and prefetch lists which aren't used by any remaining index.
+//
+// Indices without image digest, such as indices fetched from a registry, are kept.
+// Only the artifacts recorded in the ArtifactsDB are considered: blobs which the snapshotter fetched
+// into the store aren't recorded, and may be in use by mounted layers, so they are never removed.
+// If `dryRun` is true, nothing is removed. It returns the entries which are (or would be) removed.
+func PruneArtifacts(db *ArtifactsDb, storePath string, imageExists func(imageDigest string) (bool, error), dryRun bool) ([]ArtifactEntry, error) {
+	var indices, blobs, signatures []ArtifactEntry
+	err := db.Walk(func(ae *ArtifactEntry) error {
+		switch ae.Type {
+		case ArtifactEntryTypeIndex:
+			indices = append(indices, *ae)
+		case ArtifactEntryTypeLayer, ArtifactEntryTypePrefetchList:
+			blobs = append(blobs, *ae)
+		case ArtifactEntryTypeSignature:
+			signatures = append(signatures, *ae)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []ArtifactEntry
+	liveIndices := make(map[string]struct{})
+	usedBlobs := make(map[string]struct{})
+	for _, ae := range indices {
+		if ae.ImageDigest != "" {
+			exists, err := imageExists(ae.ImageDigest)
+			if err != nil {
+				return nil, fmt.Errorf("cannot check the image of index %s: %w", ae.Digest, err)
+			}
+			if !exists {
+				removed = append(removed, ae)
+				continue
+			}
+		}
+		index, err := readIndexBlob(storePath, ae.Digest)
+		if errors.Is(err, errdefs.ErrNotFound) {
+			removed = append(removed, ae)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		liveIndices[ae.Digest] = struct{}{}
+		for _, blob := range index.Blobs {
+			if blob != nil {
+				usedBlobs[blob.Digest.String()] = struct{}{}
+			}
+		}
+	}
+	for _, ae := range blobs {
+		if _, ok := usedBlobs[ae.Digest]; !ok {
+			removed = append(removed, ae)
+		}
+	}
+	for _, ae := range signatures {
+		if _, ok := liveIndices[ae.OriginalDigest]; !ok {
+			removed = append(removed, ae)
+		}
+	}
+
+	if dryRun {
+		return removed, nil
+	}
+	if err := removeArtifacts(db, storePath, removed); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+// removeArtifacts removes the blobs of `entries` from the OCI image layout at `storePath`, then the entries from the ArtifactsDB.
+// Blobs which are already missing are ignored, so a removal interrupted half way can be retried.
+func removeArtifacts(db *ArtifactsDb, storePath string, entries []ArtifactEntry) error {
+	for _, ae := range entries {
+		dgst, err := digest.Parse(ae.Digest)
+		if err != nil {
+			return fmt.Errorf("invalid digest of artifact %s: %w", ae.Digest, err)
+		}
+		if err := os.Remove(blobPath(storePath, dgst)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot remove artifact %s from the local store: %w", ae.Digest, err)
+		}
+		if err := db.RemoveArtifactEntry(ae.Digest); err != nil && !errors.Is(err, errdefs.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// blobPath returns the path of the blob `dgst` in the OCI image layout at `storePath`.
+func blobPath(storePath string, dgst digest.Digest) string {
+	return filepath.Join(storePath, "blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// readIndexBlob reads the SOCI index `indexDigest` from the OCI image layout at `storePath`.
+func readIndexBlob(storePath, indexDigest string) (*SociIndex, error) {
+	dgst, err := digest.Parse(indexDigest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid digest of index %s: %w", indexDigest, err)
+	}
+	f, err := os.Open(blobPath(storePath, dgst))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("index %s: %w", indexDigest, errdefs.ErrNotFound)
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var index SociIndex
+	if err := json.NewDecoder(io.LimitReader(f, maxIndexSize)).Decode(&index); err != nil {
+		return nil, fmt.Errorf("cannot decode index %s: %w", indexDigest, err)
+	}
+	return &index, nil
+}
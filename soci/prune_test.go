@@ -0,0 +1,216 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// writeTestBlob writes `content` to the OCI image layout at `storePath` and returns its digest.
+func writeTestBlob(t *testing.T, storePath string, content []byte) digest.Digest {
+	dgst := digest.FromBytes(content)
+	path := blobPath(storePath, dgst)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("cannot create blob directory: %v", err)
+	}
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("cannot write blob: %v", err)
+	}
+	return dgst
+}
+
+func TestPruneArtifacts(t *testing.T) {
+	db, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	storePath := t.TempDir()
+
+	writeZtoc := func(name string) digest.Digest {
+		dgst := writeTestBlob(t, storePath, []byte(name))
+		if err := db.WriteArtifactEntry(&ArtifactEntry{Digest: dgst.String(), Size: int64(len(name)), Type: ArtifactEntryTypeLayer}); err != nil {
+			t.Fatalf("cannot write artifact entry: %v", err)
+		}
+		return dgst
+	}
+	writeIndex := func(imageDigest string, ztocs ...digest.Digest) digest.Digest {
+		index := SociIndex{MediaType: sociIndexMediaType, ArtifactType: SociIndexArtifactType}
+		for _, z := range ztocs {
+			index.Blobs = append(index.Blobs, &ocispec.Descriptor{MediaType: SociLayerMediaType, Digest: z})
+		}
+		b, err := json.Marshal(index)
+		if err != nil {
+			t.Fatalf("cannot marshal index: %v", err)
+		}
+		dgst := writeTestBlob(t, storePath, b)
+		if err := db.WriteArtifactEntry(&ArtifactEntry{Digest: dgst.String(), Size: int64(len(b)), ImageDigest: imageDigest, Type: ArtifactEntryTypeIndex}); err != nil {
+			t.Fatalf("cannot write artifact entry: %v", err)
+		}
+		return dgst
+	}
+	writeSignature := func(name string, indexDigest digest.Digest) digest.Digest {
+		dgst := writeTestBlob(t, storePath, []byte(name))
+		if err := db.WriteArtifactEntry(&ArtifactEntry{Digest: dgst.String(), OriginalDigest: indexDigest.String(), Type: ArtifactEntryTypeSignature}); err != nil {
+			t.Fatalf("cannot write artifact entry: %v", err)
+		}
+		return dgst
+	}
+
+	const (
+		liveImage    = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+		removedImage = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	)
+	sharedZtoc := writeZtoc("shared ztoc")
+	liveZtoc := writeZtoc("live ztoc")
+	removedZtoc := writeZtoc("removed ztoc")
+	orphanZtoc := writeZtoc("orphan ztoc")
+	liveIndex := writeIndex(liveImage, sharedZtoc, liveZtoc)
+	removedIndex := writeIndex(removedImage, sharedZtoc, removedZtoc)
+	remoteIndex := writeIndex("")
+	liveSignature := writeSignature("live signature", liveIndex)
+	removedSignature := writeSignature("removed signature", removedIndex)
+
+	// the contents of this index are missing
+	missingIndex := digest.FromString("missing index")
+	if err := db.WriteArtifactEntry(&ArtifactEntry{Digest: missingIndex.String(), ImageDigest: liveImage, Type: ArtifactEntryTypeIndex}); err != nil {
+		t.Fatalf("cannot write artifact entry: %v", err)
+	}
+
+	imageExists := func(imageDigest string) (bool, error) {
+		return imageDigest == liveImage, nil
+	}
+	expectedRemoved := []string{
+		removedIndex.String(),
+		missingIndex.String(),
+		removedZtoc.String(),
+		orphanZtoc.String(),
+		removedSignature.String(),
+	}
+	sort.Strings(expectedRemoved)
+	kept := []digest.Digest{liveIndex, remoteIndex, sharedZtoc, liveZtoc, liveSignature}
+
+	checkRemoved := func(removed []ArtifactEntry) {
+		var digests []string
+		for _, ae := range removed {
+			digests = append(digests, ae.Digest)
+		}
+		sort.Strings(digests)
+		if len(digests) != len(expectedRemoved) {
+			t.Fatalf("unexpected removed artifacts; expected %v, got %v", expectedRemoved, digests)
+		}
+		for i := range digests {
+			if digests[i] != expectedRemoved[i] {
+				t.Fatalf("unexpected removed artifacts; expected %v, got %v", expectedRemoved, digests)
+			}
+		}
+	}
+
+	removed, err := PruneArtifacts(db, storePath, imageExists, true)
+	if err != nil {
+		t.Fatalf("cannot prune artifacts: %v", err)
+	}
+	checkRemoved(removed)
+	for _, dgst := range expectedRemoved {
+		if _, err := db.GetArtifactEntry(dgst); err != nil {
+			t.Fatalf("artifact %s removed by a dry run: %v", dgst, err)
+		}
+	}
+
+	removed, err = PruneArtifacts(db, storePath, imageExists, false)
+	if err != nil {
+		t.Fatalf("cannot prune artifacts: %v", err)
+	}
+	checkRemoved(removed)
+	for _, dgst := range expectedRemoved {
+		if _, err := db.GetArtifactEntry(dgst); err == nil {
+			t.Fatalf("artifact %s not removed from the db", dgst)
+		}
+		if _, err := os.Stat(blobPath(storePath, digest.Digest(dgst))); !os.IsNotExist(err) {
+			t.Fatalf("artifact %s not removed from the store: %v", dgst, err)
+		}
+	}
+	for _, dgst := range kept {
+		if _, err := db.GetArtifactEntry(dgst.String()); err != nil {
+			t.Fatalf("artifact %s removed from the db: %v", dgst, err)
+		}
+		if _, err := os.Stat(blobPath(storePath, dgst)); err != nil {
+			t.Fatalf("artifact %s removed from the store: %v", dgst, err)
+		}
+	}
+
+	removed, err = PruneArtifacts(db, storePath, imageExists, false)
+	if err != nil {
+		t.Fatalf("cannot prune artifacts again: %v", err)
+	}
+	if len(removed) != 0 {
+		t.Fatalf("unexpected artifacts removed by a second prune: %v", removed)
+	}
+}
+
+func TestRemoveIndex(t *testing.T) {
+	db, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	storePath := t.TempDir()
+	indexDigest := writeTestBlob(t, storePath, []byte("index"))
+	signatureDigest := writeTestBlob(t, storePath, []byte("signature"))
+	ztocDigest := writeTestBlob(t, storePath, []byte("ztoc"))
+	entries := []ArtifactEntry{
+		{Digest: indexDigest.String(), Type: ArtifactEntryTypeIndex},
+		{Digest: signatureDigest.String(), OriginalDigest: indexDigest.String(), Type: ArtifactEntryTypeSignature},
+		{Digest: ztocDigest.String(), Type: ArtifactEntryTypeLayer},
+	}
+	for _, entry := range entries {
+		entry := entry
+		if err := db.WriteArtifactEntry(&entry); err != nil {
+			t.Fatalf("cannot write artifact entry: %v", err)
+		}
+	}
+
+	if _, err := RemoveIndex(db, storePath, ztocDigest.String()); err == nil {
+		t.Fatalf("removing a ztoc as an index should fail")
+	}
+	removed, err := RemoveIndex(db, storePath, indexDigest.String())
+	if err != nil {
+		t.Fatalf("cannot remove index: %v", err)
+	}
+	if len(removed) != 2 {
+		t.Fatalf("expected the index and its signature to be removed, got %v", removed)
+	}
+	for _, dgst := range []digest.Digest{indexDigest, signatureDigest} {
+		if _, err := db.GetArtifactEntry(dgst.String()); err == nil {
+			t.Fatalf("artifact %s not removed from the db", dgst)
+		}
+		if _, err := os.Stat(blobPath(storePath, dgst)); !os.IsNotExist(err) {
+			t.Fatalf("artifact %s not removed from the store: %v", dgst, err)
+		}
+	}
+	if _, err := db.GetArtifactEntry(ztocDigest.String()); err != nil {
+		t.Fatalf("ztoc removed along with the index: %v", err)
+	}
+	if _, err := RemoveIndex(db, storePath, indexDigest.String()); err == nil {
+		t.Fatalf("removing an index twice should fail")
+	}
+}
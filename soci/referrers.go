@@ -0,0 +1,223 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// maxReferrersIndexSize is the maximum size of a page of the referrers API or of a referrers index.
+const maxReferrersIndexSize = 4 << 20
+
+// errReferrersAPIUnsupported is returned when the registry doesn't support the referrers API.
+var errReferrersAPIUnsupported = errors.New("referrers API is not supported")
+
+// Referrer is a descriptor of a manifest referring to another manifest through its subject,
+// as listed by the referrers API. It carries the artifact type of the referrer, which
+// isn't part of ocispec.Descriptor.
+type Referrer struct {
+	ocispec.Descriptor
+	ArtifactType string `json:"artifactType,omitempty"`
+}
+
+// referrersIndex is the image index listing referrers, returned by the referrers API and
+// tagged with the referrers tag schema.
+type referrersIndex struct {
+	SchemaVersion int        `json:"schemaVersion"`
+	MediaType     string     `json:"mediaType,omitempty"`
+	Manifests     []Referrer `json:"manifests"`
+}
+
+// GetReferrers lists the referrers of the manifest `subject` in the remote repository whose artifact type is `artifactType`.
+// It uses the referrers API of the registry, and falls back to the referrers tag schema if the registry doesn't support it.
+// See https://github.com/opencontainers/distribution-spec/blob/main/spec.md#listing-referrers.
+func GetReferrers(ctx context.Context, repo *remote.Repository, subject digest.Digest, artifactType string) ([]Referrer, error) {
+	referrers, err := getReferrersFromAPI(ctx, repo, subject, artifactType)
+	if errors.Is(err, errReferrersAPIUnsupported) {
+		var index *referrersIndex
+		index, _, err = getReferrersIndex(ctx, repo, subject)
+		if index != nil {
+			referrers = index.Manifests
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var filtered []Referrer
+	for _, r := range referrers {
+		// registries may ignore the artifact type filter of the referrers API
+		if r.ArtifactType == artifactType {
+			filtered = append(filtered, r)
+		}
+	}
+	return filtered, nil
+}
+
+func getReferrersFromAPI(ctx context.Context, repo *remote.Repository, subject digest.Digest, artifactType string) ([]Referrer, error) {
+	scheme := "https"
+	if repo.PlainHTTP {
+		scheme = "http"
+	}
+	u := fmt.Sprintf("%s://%s/v2/%s/referrers/%s?artifactType=%s", scheme, repo.Reference.Registry, repo.Reference.Repository, subject, url.QueryEscape(artifactType))
+
+	var referrers []Referrer
+	for u != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", ocispec.MediaTypeImageIndex)
+		resp, err := repoClient(repo).Do(req)
+		if err != nil {
+			return nil, err
+		}
+		index, err := decodeReferrersPage(resp)
+		if err != nil {
+			return nil, err
+		}
+		referrers = append(referrers, index.Manifests...)
+		u, err = nextLink(resp)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return referrers, nil
+}
+
+func decodeReferrersPage(resp *http.Response) (*referrersIndex, error) {
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, errReferrersAPIUnsupported
+	default:
+		return nil, fmt.Errorf("%s %q: unexpected status code %d", resp.Request.Method, resp.Request.URL, resp.StatusCode)
+	}
+	var index referrersIndex
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxReferrersIndexSize)).Decode(&index); err != nil {
+		return nil, fmt.Errorf("%s %q: cannot decode the referrers: %w", resp.Request.Method, resp.Request.URL, err)
+	}
+	return &index, nil
+}
+
+// nextLink returns the URL of the next page of a paginated response, or an empty string if it's the last page.
+func nextLink(resp *http.Response) (string, error) {
+	link := resp.Header.Get("Link")
+	if link == "" {
+		return "", nil
+	}
+	if link[0] != '<' {
+		return "", fmt.Errorf("invalid Link header %q", link)
+	}
+	end := strings.IndexByte(link, '>')
+	if end == -1 {
+		return "", fmt.Errorf("invalid Link header %q", link)
+	}
+	next, err := resp.Request.URL.Parse(link[1:end])
+	if err != nil {
+		return "", fmt.Errorf("invalid Link header %q: %w", link, err)
+	}
+	return next.String(), nil
+}
+
+func repoClient(repo *remote.Repository) remote.Client {
+	if repo.Client == nil {
+		return auth.DefaultClient
+	}
+	return repo.Client
+}
+
+// referrersTag returns the tag of the referrers index of `subject` in the referrers tag schema,
+// which is the digest with the colon replaced by a dash.
+func referrersTag(subject digest.Digest) string {
+	return strings.Replace(subject.String(), ":", "-", 1)
+}
+
+// getReferrersIndex fetches the referrers index of `subject` tagged with the referrers tag schema.
+// It returns a nil index if the tag doesn't exist.
+func getReferrersIndex(ctx context.Context, repo *remote.Repository, subject digest.Digest) (*referrersIndex, ocispec.Descriptor, error) {
+	desc, rc, err := repo.FetchReference(ctx, referrersTag(subject))
+	if err != nil {
+		if errors.Is(err, errdef.ErrNotFound) {
+			return nil, ocispec.Descriptor{}, nil
+		}
+		return nil, ocispec.Descriptor{}, fmt.Errorf("cannot fetch the referrers index of %s: %w", subject, err)
+	}
+	defer rc.Close()
+	var index referrersIndex
+	if err := json.NewDecoder(io.LimitReader(rc, maxReferrersIndexSize)).Decode(&index); err != nil {
+		return nil, ocispec.Descriptor{}, fmt.Errorf("cannot decode the referrers index of %s: %w", subject, err)
+	}
+	return &index, desc, nil
+}
+
+// AddReferrerToTagSchema adds `referrer` to the referrers index of `subject` tagged with the referrers tag schema,
+// if the registry doesn't support the referrers API. Registries supporting it list the referrers by themselves.
+func AddReferrerToTagSchema(ctx context.Context, repo *remote.Repository, subject digest.Digest, referrer Referrer) error {
+	_, err := getReferrersFromAPI(ctx, repo, subject, referrer.ArtifactType)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, errReferrersAPIUnsupported) {
+		return err
+	}
+
+	index, _, err := getReferrersIndex(ctx, repo, subject)
+	if err != nil {
+		return err
+	}
+	if index == nil {
+		index = &referrersIndex{}
+	}
+	for _, r := range index.Manifests {
+		if r.Digest == referrer.Digest {
+			return nil
+		}
+	}
+	index.SchemaVersion = 2
+	index.MediaType = ocispec.MediaTypeImageIndex
+	index.Manifests = append(index.Manifests, referrer)
+
+	indexBytes, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Digest:    digest.FromBytes(indexBytes),
+		Size:      int64(len(indexBytes)),
+	}
+	if err := repo.PushReference(ctx, desc, bytes.NewReader(indexBytes), referrersTag(subject)); err != nil {
+		return fmt.Errorf("cannot push the referrers index of %s: %w", subject, err)
+	}
+	return nil
+}
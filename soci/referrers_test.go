@@ -0,0 +1,171 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/registry"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+func newTestRepository(t *testing.T, handler http.Handler) *remote.Repository {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("cannot parse the server URL: %v", err)
+	}
+	return &remote.Repository{
+		Reference: registry.Reference{Registry: u.Host, Repository: "repo"},
+		PlainHTTP: true,
+		Client:    http.DefaultClient,
+	}
+}
+
+func TestGetReferrersFromAPI(t *testing.T) {
+	subject := digest.FromString("image manifest")
+	sociIndex := Referrer{
+		Descriptor:   ocispec.Descriptor{MediaType: sociIndexMediaType, Digest: digest.FromString("soci index"), Size: 10},
+		ArtifactType: SociIndexArtifactType,
+	}
+	otherArtifact := Referrer{
+		Descriptor:   ocispec.Descriptor{MediaType: sociIndexMediaType, Digest: digest.FromString("other"), Size: 5},
+		ArtifactType: "application/vnd.example.other",
+	}
+	pages := [][]Referrer{{otherArtifact}, {sociIndex}}
+
+	repo := newTestRepository(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/repo/referrers/"+subject.String() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if got := r.URL.Query().Get("artifactType"); got != SociIndexArtifactType {
+			t.Errorf("unexpected artifactType filter %q", got)
+		}
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page+1 < len(pages) {
+			w.Header().Set("Link", "</v2/repo/referrers/"+subject.String()+"?artifactType="+url.QueryEscape(SociIndexArtifactType)+"&page="+strconv.Itoa(page+1)+`>; rel="next"`)
+		}
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageIndex)
+		json.NewEncoder(w).Encode(referrersIndex{SchemaVersion: 2, MediaType: ocispec.MediaTypeImageIndex, Manifests: pages[page]})
+	}))
+
+	referrers, err := GetReferrers(context.Background(), repo, subject, SociIndexArtifactType)
+	if err != nil {
+		t.Fatalf("cannot get referrers: %v", err)
+	}
+	if len(referrers) != 1 || referrers[0].Digest != sociIndex.Digest {
+		t.Fatalf("unexpected referrers: %v", referrers)
+	}
+}
+
+// tagSchemaRegistry is a registry without the referrers API, which only serves manifests by tag.
+type tagSchemaRegistry struct {
+	mu        sync.Mutex
+	manifests map[string][]byte
+	mediaType map[string]string
+}
+
+func (reg *tagSchemaRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	tag := strings.TrimPrefix(r.URL.Path, "/v2/repo/manifests/")
+	if tag == r.URL.Path {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		b, ok := reg.manifests[tag]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", reg.mediaType[tag])
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(b).String())
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		w.Write(b)
+	case http.MethodPut:
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reg.manifests[tag] = b
+		reg.mediaType[tag] = r.Header.Get("Content-Type")
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(b).String())
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestReferrersTagSchema(t *testing.T) {
+	reg := &tagSchemaRegistry{manifests: map[string][]byte{}, mediaType: map[string]string{}}
+	repo := newTestRepository(t, reg)
+	ctx := context.Background()
+	subject := digest.FromString("image manifest")
+	sociIndex := Referrer{
+		Descriptor:   ocispec.Descriptor{MediaType: sociIndexMediaType, Digest: digest.FromString("soci index"), Size: 10},
+		ArtifactType: SociIndexArtifactType,
+	}
+	signature := Referrer{
+		Descriptor:   ocispec.Descriptor{MediaType: sociIndexMediaType, Digest: digest.FromString("signature"), Size: 5},
+		ArtifactType: SociSignatureArtifactType,
+	}
+
+	referrers, err := GetReferrers(ctx, repo, subject, SociIndexArtifactType)
+	if err != nil {
+		t.Fatalf("cannot get referrers without referrers index: %v", err)
+	}
+	if len(referrers) != 0 {
+		t.Fatalf("unexpected referrers without referrers index: %v", referrers)
+	}
+
+	for _, r := range []Referrer{sociIndex, signature, sociIndex} {
+		if err := AddReferrerToTagSchema(ctx, repo, subject, r); err != nil {
+			t.Fatalf("cannot add referrer %s: %v", r.Digest, err)
+		}
+	}
+	var index referrersIndex
+	if err := json.Unmarshal(reg.manifests[referrersTag(subject)], &index); err != nil {
+		t.Fatalf("cannot decode the referrers index: %v", err)
+	}
+	if len(index.Manifests) != 2 {
+		t.Fatalf("expected 2 referrers in the referrers index, got %d", len(index.Manifests))
+	}
+
+	referrers, err = GetReferrers(ctx, repo, subject, SociIndexArtifactType)
+	if err != nil {
+		t.Fatalf("cannot get referrers: %v", err)
+	}
+	if len(referrers) != 1 || referrers[0].Digest != sociIndex.Digest {
+		t.Fatalf("unexpected referrers: %v", referrers)
+	}
+}
@@ -0,0 +1,389 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+)
+
+const (
+	// SociSignatureArtifactType is the artifact type of the signatures of SOCI indices.
+	SociSignatureArtifactType = "application/vnd.amazon.soci.signature.v1"
+	// SociSignatureMediaType is the media type of the blob holding the raw signature of a SOCI index.
+	SociSignatureMediaType = "application/vnd.amazon.soci.signature.v1.sig"
+	// SignatureAnnotationKeyID is the annotation of signatures holding the ID of the key which signed the index,
+	// which is the digest of the PKIX encoding of the public key.
+	SignatureAnnotationKeyID = "com.amazon.soci.signature.key-id"
+
+	// maxSignatureSize is the maximum size of the signature manifest and of the signature blob,
+	// which are both fetched in memory.
+	maxSignatureSize = 1 << 20
+)
+
+// ErrIndexNotSigned is returned when a SOCI index isn't signed by any of the trusted keys.
+var ErrIndexNotSigned = errors.New("soci index is not signed by a trusted key")
+
+// SociSignature is the artifact manifest of the signature of a SOCI index.
+// The index is the subject of the manifest, so the signature is a referrer of the index.
+//
+// ECDSA keys sign the SHA-256 digest of the serialized index, and the signature is ASN.1 encoded.
+// ed25519 keys sign the serialized index itself.
+type SociSignature struct {
+	MediaType    string `json:"mediaType"`
+	ArtifactType string `json:"artifactType"`
+	// descriptor of the signature blob
+	Blobs []ocispec.Descriptor `json:"blobs,omitempty"`
+	// descriptor of the SOCI index
+	Subject ocispec.Descriptor `json:"subject,omitempty"`
+
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// LoadPrivateKey loads a PEM-encoded ECDSA or ed25519 private key, either in PKCS #8 or in SEC 1 form.
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	var key interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q in %s", block.Type, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the private key in %s: %w", path, err)
+	}
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T in %s: only ECDSA and ed25519 keys are supported", key, path)
+	}
+}
+
+// LoadPublicKey loads a PEM-encoded ECDSA or ed25519 public key in PKIX form.
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("unsupported PEM block %q in %s", block.Type, path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the public key in %s: %w", path, err)
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T in %s: only ECDSA and ed25519 keys are supported", key, path)
+	}
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	return block, nil
+}
+
+// KeyID returns the ID of a public key, which is the digest of its PKIX encoding.
+func KeyID(pub crypto.PublicKey) (digest.Digest, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	return digest.FromBytes(der), nil
+}
+
+func signPayload(signer crypto.Signer, payload []byte) ([]byte, error) {
+	switch signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		h := sha256.Sum256(payload)
+		return signer.Sign(rand.Reader, h[:], crypto.SHA256)
+	case ed25519.PublicKey:
+		return signer.Sign(rand.Reader, payload, crypto.Hash(0))
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", signer.Public())
+	}
+}
+
+func verifyPayload(pub crypto.PublicKey, payload, sig []byte) bool {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		h := sha256.Sum256(payload)
+		return ecdsa.VerifyASN1(pub, h[:], sig)
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, payload, sig)
+	default:
+		return false
+	}
+}
+
+// SignIndex signs the SOCI index in the local store with `signer`. The signature is written to the
+// local store as a referrer of the index, so that it's pushed along with the index.
+// It returns the descriptor of the signature manifest.
+func SignIndex(ctx context.Context, indexDigest digest.Digest, signer crypto.Signer, store orascontent.Storage) (*ocispec.Descriptor, error) {
+	indexBytes, entry, err := readLocalIndex(ctx, indexDigest, store)
+	if err != nil {
+		return nil, err
+	}
+
+	manifestDesc, err := pushSignature(ctx, indexBytes, signer, store)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeArtifactEntry(&ArtifactEntry{
+		Size:           manifestDesc.Size,
+		Digest:         manifestDesc.Digest.String(),
+		OriginalDigest: indexDigest.String(),
+		ImageDigest:    entry.ImageDigest,
+		Platform:       entry.Platform,
+		Location:       entry.Location,
+		Type:           ArtifactEntryTypeSignature,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &manifestDesc, nil
+}
+
+// pushSignature signs the serialized SOCI index with `signer` and pushes the signature blob and manifest to `store`.
+// It returns the descriptor of the signature manifest.
+func pushSignature(ctx context.Context, indexBytes []byte, signer crypto.Signer, store orascontent.Pusher) (ocispec.Descriptor, error) {
+	indexDigest := digest.FromBytes(indexBytes)
+	sig, err := signPayload(signer, indexBytes)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("cannot sign SOCI index %s: %w", indexDigest, err)
+	}
+	keyID, err := KeyID(signer.Public())
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	sigDesc := ocispec.Descriptor{
+		MediaType: SociSignatureMediaType,
+		Digest:    digest.FromBytes(sig),
+		Size:      int64(len(sig)),
+	}
+	if err := store.Push(ctx, sigDesc, bytes.NewReader(sig)); err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return ocispec.Descriptor{}, fmt.Errorf("cannot write the signature to local store: %w", err)
+	}
+
+	manifest, err := json.Marshal(SociSignature{
+		MediaType:    sociIndexMediaType,
+		ArtifactType: SociSignatureArtifactType,
+		Blobs:        []ocispec.Descriptor{sigDesc},
+		Subject: ocispec.Descriptor{
+			MediaType: sociIndexMediaType,
+			Digest:    indexDigest,
+			Size:      int64(len(indexBytes)),
+		},
+		Annotations: map[string]string{
+			SignatureAnnotationKeyID: keyID.String(),
+		},
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	manifestDesc := ocispec.Descriptor{
+		MediaType: sociIndexMediaType,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+	}
+	if err := store.Push(ctx, manifestDesc, bytes.NewReader(manifest)); err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return ocispec.Descriptor{}, fmt.Errorf("cannot write the signature manifest to local store: %w", err)
+	}
+	return manifestDesc, nil
+}
+
+// readLocalIndex reads the serialized SOCI index from the local store.
+func readLocalIndex(ctx context.Context, indexDigest digest.Digest, store orascontent.Fetcher) ([]byte, *ArtifactEntry, error) {
+	entry, err := getArtifactEntry(indexDigest.String())
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot find SOCI index %s: %w", indexDigest, err)
+	}
+	if entry.Type != ArtifactEntryTypeIndex {
+		return nil, nil, fmt.Errorf("%s is not a SOCI index", indexDigest)
+	}
+	indexBytes, err := orascontent.FetchAll(ctx, store, ocispec.Descriptor{
+		MediaType: sociIndexMediaType,
+		Digest:    indexDigest,
+		Size:      entry.Size,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read SOCI index %s: %w", indexDigest, err)
+	}
+	return indexBytes, entry, nil
+}
+
+// GetSignatureDescriptors returns the descriptors of the signatures of the SOCI index in the local store.
+func GetSignatureDescriptors(indexDigest digest.Digest) ([]ocispec.Descriptor, error) {
+	artifacts, err := NewDB()
+	if err != nil {
+		return nil, err
+	}
+	var descriptors []ocispec.Descriptor
+	err = artifacts.Walk(func(ae *ArtifactEntry) error {
+		if ae.Type != ArtifactEntryTypeSignature || ae.OriginalDigest != indexDigest.String() {
+			return nil
+		}
+		dgst, err := digest.Parse(ae.Digest)
+		if err != nil {
+			return nil
+		}
+		descriptors = append(descriptors, ocispec.Descriptor{
+			MediaType: sociIndexMediaType,
+			Digest:    dgst,
+			Size:      ae.Size,
+		})
+		return nil
+	})
+	return descriptors, err
+}
+
+// IndexVerifier verifies the signatures of SOCI indices against a set of trusted public keys.
+type IndexVerifier struct {
+	keys map[digest.Digest]crypto.PublicKey
+}
+
+// NewIndexVerifier creates an IndexVerifier trusting the given public keys.
+func NewIndexVerifier(keys ...crypto.PublicKey) (*IndexVerifier, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public keys to verify SOCI indices with")
+	}
+	v := &IndexVerifier{keys: make(map[digest.Digest]crypto.PublicKey)}
+	for _, key := range keys {
+		keyID, err := KeyID(key)
+		if err != nil {
+			return nil, err
+		}
+		v.keys[keyID] = key
+	}
+	return v, nil
+}
+
+// Verify verifies the serialized SOCI index `indexBytes` against the signature manifests described by `signatures`,
+// which are fetched from `fetcher`. It returns the ID of the trusted key which signed the index, or an error
+// wrapping ErrIndexNotSigned if none of the signatures is valid and made by a trusted key.
+func (v *IndexVerifier) Verify(ctx context.Context, indexBytes []byte, signatures []ocispec.Descriptor, fetcher orascontent.Fetcher) (digest.Digest, error) {
+	indexDigest := digest.FromBytes(indexBytes)
+	var errs []error
+	for _, desc := range signatures {
+		keyID, err := v.verifySignature(ctx, indexDigest, indexBytes, desc, fetcher)
+		if err == nil {
+			return keyID, nil
+		}
+		errs = append(errs, fmt.Errorf("signature %s: %w", desc.Digest, err))
+	}
+	if len(errs) == 0 {
+		return "", fmt.Errorf("%w: index %s has no signatures", ErrIndexNotSigned, indexDigest)
+	}
+	return "", fmt.Errorf("%w: index %s: %v", ErrIndexNotSigned, indexDigest, errs)
+}
+
+// VerifyLocalIndex verifies the SOCI index in the local store against its signatures in the local store.
+// It returns the ID of the trusted key which signed the index.
+func (v *IndexVerifier) VerifyLocalIndex(ctx context.Context, indexDigest digest.Digest, store orascontent.Fetcher) (digest.Digest, error) {
+	indexBytes, _, err := readLocalIndex(ctx, indexDigest, store)
+	if err != nil {
+		return "", err
+	}
+	signatures, err := GetSignatureDescriptors(indexDigest)
+	if err != nil {
+		return "", err
+	}
+	return v.Verify(ctx, indexBytes, signatures, store)
+}
+
+func (v *IndexVerifier) verifySignature(ctx context.Context, indexDigest digest.Digest, indexBytes []byte, desc ocispec.Descriptor, fetcher orascontent.Fetcher) (digest.Digest, error) {
+	if desc.Size > maxSignatureSize {
+		return "", fmt.Errorf("signature manifest is too large: %d bytes", desc.Size)
+	}
+	manifestBytes, err := orascontent.FetchAll(ctx, fetcher, desc)
+	if err != nil {
+		return "", fmt.Errorf("cannot fetch the signature manifest: %w", err)
+	}
+	var manifest SociSignature
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return "", fmt.Errorf("cannot parse the signature manifest: %w", err)
+	}
+	if manifest.ArtifactType != SociSignatureArtifactType {
+		return "", fmt.Errorf("unexpected artifact type %q", manifest.ArtifactType)
+	}
+	if manifest.Subject.Digest != indexDigest {
+		return "", fmt.Errorf("signature is for %s", manifest.Subject.Digest)
+	}
+
+	keys := v.keys
+	if keyID := digest.Digest(manifest.Annotations[SignatureAnnotationKeyID]); keyID != "" {
+		key, ok := v.keys[keyID]
+		if !ok {
+			return "", fmt.Errorf("signed by untrusted key %s", keyID)
+		}
+		keys = map[digest.Digest]crypto.PublicKey{keyID: key}
+	}
+	for _, blob := range manifest.Blobs {
+		if blob.MediaType != SociSignatureMediaType {
+			continue
+		}
+		if blob.Size > maxSignatureSize {
+			return "", fmt.Errorf("signature is too large: %d bytes", blob.Size)
+		}
+		sig, err := orascontent.FetchAll(ctx, fetcher, blob)
+		if err != nil {
+			return "", fmt.Errorf("cannot fetch the signature: %w", err)
+		}
+		for keyID, key := range keys {
+			if verifyPayload(key, indexBytes, sig) {
+				return keyID, nil
+			}
+		}
+		return "", fmt.Errorf("invalid signature")
+	}
+	return "", fmt.Errorf("no signature blob found")
+}
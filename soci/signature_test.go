@@ -0,0 +1,216 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+func TestIndexSignature(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate ECDSA key: %v", err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate ed25519 key: %v", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate ECDSA key: %v", err)
+	}
+
+	indexBytes := []byte(`{"mediaType":"application/vnd.cncf.oras.artifact.manifest.v1+json","artifactType":"application/vnd.amazon.soci.index.v1+json"}`)
+	testCases := []struct {
+		name        string
+		signer      crypto.Signer
+		trusted     []crypto.PublicKey
+		indexBytes  []byte
+		expectError bool
+	}{
+		{
+			name:       "ECDSA signature",
+			signer:     ecdsaKey,
+			trusted:    []crypto.PublicKey{ecdsaKey.Public()},
+			indexBytes: indexBytes,
+		},
+		{
+			name:       "ed25519 signature",
+			signer:     ed25519Key,
+			trusted:    []crypto.PublicKey{otherKey.Public(), ed25519Key.Public()},
+			indexBytes: indexBytes,
+		},
+		{
+			name:        "untrusted key",
+			signer:      ecdsaKey,
+			trusted:     []crypto.PublicKey{otherKey.Public()},
+			indexBytes:  indexBytes,
+			expectError: true,
+		},
+		{
+			name:        "modified index",
+			signer:      ed25519Key,
+			trusted:     []crypto.PublicKey{ed25519Key.Public()},
+			indexBytes:  append(append([]byte{}, indexBytes...), ' '),
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := memory.New()
+			desc, err := pushSignature(ctx, indexBytes, tc.signer, store)
+			if err != nil {
+				t.Fatalf("cannot sign index: %v", err)
+			}
+			verifier, err := NewIndexVerifier(tc.trusted...)
+			if err != nil {
+				t.Fatalf("cannot create verifier: %v", err)
+			}
+			keyID, err := verifier.Verify(ctx, tc.indexBytes, []ocispec.Descriptor{desc}, store)
+			if tc.expectError {
+				if !errors.Is(err, ErrIndexNotSigned) {
+					t.Fatalf("unexpected error; expected %v, got %v", ErrIndexNotSigned, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("cannot verify index: %v", err)
+			}
+			expectedKeyID, err := KeyID(tc.signer.Public())
+			if err != nil {
+				t.Fatalf("cannot get key ID: %v", err)
+			}
+			if keyID != expectedKeyID {
+				t.Fatalf("unexpected key ID; expected %v, got %v", expectedKeyID, keyID)
+			}
+		})
+	}
+}
+
+func TestIndexSignatureNoSignatures(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate ECDSA key: %v", err)
+	}
+	verifier, err := NewIndexVerifier(key.Public())
+	if err != nil {
+		t.Fatalf("cannot create verifier: %v", err)
+	}
+	_, err = verifier.Verify(context.Background(), []byte("{}"), nil, memory.New())
+	if !errors.Is(err, ErrIndexNotSigned) {
+		t.Fatalf("unexpected error; expected %v, got %v", ErrIndexNotSigned, err)
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate ECDSA key: %v", err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate ed25519 key: %v", err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecdsaKey)
+	if err != nil {
+		t.Fatalf("cannot marshal ECDSA key: %v", err)
+	}
+
+	dir := t.TempDir()
+	writePEM := func(name, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+			t.Fatalf("cannot write %s: %v", name, err)
+		}
+		return path
+	}
+	marshalPKCS8 := func(key interface{}) []byte {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatalf("cannot marshal private key: %v", err)
+		}
+		return der
+	}
+	marshalPKIX := func(key interface{}) []byte {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			t.Fatalf("cannot marshal public key: %v", err)
+		}
+		return der
+	}
+
+	for _, tc := range []struct {
+		name    string
+		private string
+		public  string
+	}{
+		{
+			name:    "ECDSA PKCS #8",
+			private: writePEM("ecdsa-pkcs8.pem", "PRIVATE KEY", marshalPKCS8(ecdsaKey)),
+			public:  writePEM("ecdsa.pub", "PUBLIC KEY", marshalPKIX(ecdsaKey.Public())),
+		},
+		{
+			name:    "ECDSA SEC 1",
+			private: writePEM("ecdsa-sec1.pem", "EC PRIVATE KEY", ecDER),
+			public:  writePEM("ecdsa.pub", "PUBLIC KEY", marshalPKIX(ecdsaKey.Public())),
+		},
+		{
+			name:    "ed25519",
+			private: writePEM("ed25519.pem", "PRIVATE KEY", marshalPKCS8(ed25519Key)),
+			public:  writePEM("ed25519.pub", "PUBLIC KEY", marshalPKIX(ed25519Key.Public())),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			signer, err := LoadPrivateKey(tc.private)
+			if err != nil {
+				t.Fatalf("cannot load private key: %v", err)
+			}
+			pub, err := LoadPublicKey(tc.public)
+			if err != nil {
+				t.Fatalf("cannot load public key: %v", err)
+			}
+			payload := []byte("payload")
+			sig, err := signPayload(signer, payload)
+			if err != nil {
+				t.Fatalf("cannot sign: %v", err)
+			}
+			if !verifyPayload(pub, payload, sig) {
+				t.Fatalf("signature doesn't verify with the public key")
+			}
+		})
+	}
+
+	if _, err := LoadPublicKey(writePEM("private-as-public.pem", "PRIVATE KEY", marshalPKCS8(ecdsaKey))); err == nil {
+		t.Fatalf("loaded a private key as a public key")
+	}
+}
@@ -22,8 +22,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"os"
 	"path"
+	"sync/atomic"
 
 	"github.com/awslabs/soci-snapshotter/fs/config"
 	"github.com/containerd/containerd/content"
@@ -53,10 +53,13 @@ const (
 	IndexAnnotationBuildToolIdentifier = "com.amazon.soci.build-tool-identifier"
 	// index annotation for build tool version
 	IndexAnnotationBuildToolVersion = "com.amazon.soci.build-tool-version"
+	// index annotation for the comma-separated spans and files of a layer to fetch first in background
+	IndexAnnotationPrefetchPriority = "com.amazon.soci.prefetch-priority"
 )
 
 var (
-	errNotLayerType = errors.New("not a layer mediaType")
+	errNotLayerType           = errors.New("not a layer mediaType")
+	errUnsupportedLayerFormat = errors.New("unsupported layer format")
 )
 
 // nolint:revive
@@ -77,30 +80,41 @@ type IndexWithMetadata struct {
 	Platform    ocispec.Platform
 }
 
-func GetIndexDescriptorCollection(ctx context.Context, cs content.Store, img images.Image) ([]ocispec.Descriptor, error) {
+// GetIndexDescriptorCollection returns the descriptors of the SOCI indices built for the image.
+// If no platforms are given, the indices for the default platform of the host are returned.
+func GetIndexDescriptorCollection(ctx context.Context, cs content.Provider, img images.Image, ps []ocispec.Platform) ([]ocispec.Descriptor, error) {
 	descriptors := []ocispec.Descriptor{}
-	platform := platforms.Default()
-	indexDesc, err := GetImageManifestDescriptor(ctx, cs, img, platform)
-	if err != nil {
-		return descriptors, err
+	matchers := []platforms.MatchComparer{platforms.Default()}
+	if len(ps) > 0 {
+		matchers = nil
+		for _, p := range ps {
+			matchers = append(matchers, platforms.OnlyStrict(p))
+		}
 	}
 
-	entries, err := getIndexArtifactEntries(indexDesc.Digest.String())
-	if err != nil {
-		return descriptors, err
-	}
+	for _, platform := range matchers {
+		manifestDesc, err := GetImageManifestDescriptor(ctx, cs, img, platform)
+		if err != nil {
+			return descriptors, err
+		}
 
-	for _, entry := range entries {
-		dgst, err := digest.Parse(entry.Digest)
+		entries, err := getIndexArtifactEntries(manifestDesc.Digest.String())
 		if err != nil {
-			continue
+			return descriptors, err
 		}
-		desc := ocispec.Descriptor{
-			MediaType: sociIndexMediaType,
-			Digest:    dgst,
-			Size:      entry.Size,
+
+		for _, entry := range entries {
+			dgst, err := digest.Parse(entry.Digest)
+			if err != nil {
+				continue
+			}
+			desc := ocispec.Descriptor{
+				MediaType: sociIndexMediaType,
+				Digest:    dgst,
+				Size:      entry.Size,
+			}
+			descriptors = append(descriptors, desc)
 		}
-		descriptors = append(descriptors, desc)
 	}
 
 	return descriptors, nil
@@ -110,6 +124,9 @@ type buildConfig struct {
 	minLayerSize        int64
 	buildToolIdentifier string
 	buildToolVersion    string
+	platform            ocispec.Platform
+	ztocVersion         string
+	forceRebuild        bool
 }
 
 type BuildOption func(c *buildConfig) error
@@ -128,6 +145,17 @@ func WithBuildToolIdentifier(tool string) BuildOption {
 	}
 }
 
+// WithZtocVersion sets the version of the ztocs to build. By default, DefaultZtocVersion is used.
+func WithZtocVersion(version string) BuildOption {
+	return func(c *buildConfig) error {
+		if err := checkZtocVersion(version); err != nil {
+			return err
+		}
+		c.ztocVersion = version
+		return nil
+	}
+}
+
 func WithBuildToolVersion(version string) BuildOption {
 	return func(c *buildConfig) error {
 		c.buildToolVersion = version
@@ -135,15 +163,37 @@ func WithBuildToolVersion(version string) BuildOption {
 	}
 }
 
-func BuildSociIndex(ctx context.Context, cs content.Store, img images.Image, spanSize int64, store orascontent.Storage, opts ...BuildOption) (*SociIndex, error) {
-	var config buildConfig
+// WithForceRebuild sets whether to build the ztocs of all layers. By default, the ztocs built
+// previously for the same layers with the same span size, ztoc version and build tool are reused.
+func WithForceRebuild(forceRebuild bool) BuildOption {
+	return func(c *buildConfig) error {
+		c.forceRebuild = forceRebuild
+		return nil
+	}
+}
+
+// WithPlatform sets the platform of the image manifest for which the SOCI index is built.
+// If it's not set, the default platform of the host is used.
+func WithPlatform(platform ocispec.Platform) BuildOption {
+	return func(c *buildConfig) error {
+		c.platform = platform
+		return nil
+	}
+}
+
+// BuildSociIndex builds the SOCI index for the image manifest matching the platform in the build options.
+// The platform is matched strictly, so that the manifest the index refers to is the one of the requested platform.
+func BuildSociIndex(ctx context.Context, cs content.Provider, img images.Image, spanSize int64, store orascontent.Storage, opts ...BuildOption) (*SociIndex, error) {
+	config := buildConfig{
+		platform: platforms.DefaultSpec(),
+	}
 	for _, o := range opts {
 		if err := o(&config); err != nil {
 			return nil, err
 		}
 	}
 
-	platform := platforms.Default()
+	platform := platforms.OnlyStrict(config.platform)
 	// we get manifest descriptor before calling images.Manifest, since after calling
 	// images.Manifest, images.Children will error out when reading the manifest blob (this happens on containerd side)
 	imgManifestDesc, err := GetImageManifestDescriptor(ctx, cs, img, platform)
@@ -156,14 +206,23 @@ func BuildSociIndex(ctx context.Context, cs content.Store, img images.Image, spa
 	}
 
 	sociLayersDesc := make([]*ocispec.Descriptor, len(manifest.Layers))
+	var reused int32
 	eg, ctx := errgroup.WithContext(ctx)
 	for i, l := range manifest.Layers {
 		i, l := i, l
 		eg.Go(func() error {
-			desc, err := buildSociLayer(ctx, cs, l, spanSize, store, &config)
+			desc, ok, err := reuseSociLayer(ctx, l, spanSize, store, &config)
 			if err != nil {
 				return err
 			}
+			if ok {
+				atomic.AddInt32(&reused, 1)
+			} else {
+				desc, err = buildSociLayer(ctx, cs, l, spanSize, store, &config)
+				if err != nil {
+					return err
+				}
+			}
 			sociLayersDesc[i] = desc
 			return nil
 		})
@@ -171,6 +230,7 @@ func BuildSociIndex(ctx context.Context, cs content.Store, img images.Image, spa
 	if err := eg.Wait(); err != nil {
 		return nil, err
 	}
+	fmt.Printf("%d ztocs reused\n", reused)
 
 	annotations := map[string]string{
 		IndexAnnotationBuildToolIdentifier: config.buildToolIdentifier,
@@ -204,7 +264,7 @@ func skipBuildingZtoc(desc ocispec.Descriptor, cfg *buildConfig) bool {
 }
 
 // buildSociLayer builds the ztoc for an image layer and returns a Descriptor for the new ztoc.
-func buildSociLayer(ctx context.Context, cs content.Store, desc ocispec.Descriptor, spanSize int64, store orascontent.Storage, cfg *buildConfig) (*ocispec.Descriptor, error) {
+func buildSociLayer(ctx context.Context, cs content.Provider, desc ocispec.Descriptor, spanSize int64, store orascontent.Storage, cfg *buildConfig) (*ocispec.Descriptor, error) {
 	if !images.IsLayerType(desc.MediaType) {
 		return nil, errNotLayerType
 	}
@@ -213,29 +273,32 @@ func buildSociLayer(ctx context.Context, cs content.Store, desc ocispec.Descript
 		fmt.Printf("layer %s -> ztoc skipped\n", desc.Digest)
 		return nil, nil
 	}
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid layer digest %q: %w", desc.Digest, err)
+	}
 	ra, err := cs.ReaderAt(ctx, desc)
 	if err != nil {
 		return nil, err
 	}
 	defer ra.Close()
 	sr := io.NewSectionReader(ra, 0, desc.Size)
-
-	tmpFile, err := os.CreateTemp("", "tmp.*")
+	compressionAlgo, err := compressionAlgorithmFromMediaType(ctx, desc.MediaType, sr)
 	if err != nil {
 		return nil, err
 	}
-	defer os.Remove(tmpFile.Name())
-	n, err := io.Copy(tmpFile, sr)
+
+	// The layer may be streamed from a registry or read from an image layout, so its contents are
+	// verified while the ztoc is built, before anything is recorded for the layer digest.
+	verifier := desc.Digest.Verifier()
+	ztoc, err := buildZtocFromReader(io.TeeReader(io.NewSectionReader(ra, 0, desc.Size), verifier), spanSize, compressionAlgo, cfg)
 	if err != nil {
 		return nil, err
 	}
-	if n != desc.Size {
-		return nil, errors.New("the size of the temp file doesn't match that of the layer")
+	if int64(ztoc.CompressedFileSize) != desc.Size {
+		return nil, fmt.Errorf("the size of the layer read from the content store doesn't match that of the descriptor; expected %d, got %d", desc.Size, ztoc.CompressedFileSize)
 	}
-
-	ztoc, err := BuildZtoc(tmpFile.Name(), spanSize, cfg)
-	if err != nil {
-		return nil, err
+	if !verifier.Verified() {
+		return nil, fmt.Errorf("the contents of layer %s don't match its digest", desc.Digest)
 	}
 
 	ztocReader, ztocDesc, err := NewZtocReader(ztoc)
@@ -251,11 +314,16 @@ func buildSociLayer(ctx context.Context, cs content.Store, desc ocispec.Descript
 	// write the artifact entry for soci layer
 	// this part is needed for local store only
 	entry := &ArtifactEntry{
-		Size:           ztocDesc.Size,
-		Digest:         ztocDesc.Digest.String(),
-		OriginalDigest: desc.Digest.String(),
-		Type:           ArtifactEntryTypeLayer,
-		Location:       path.Join(config.SociIndexDirectory, desc.Digest.String()),
+		Size:                ztocDesc.Size,
+		Digest:              ztocDesc.Digest.String(),
+		OriginalDigest:      desc.Digest.String(),
+		Type:                ArtifactEntryTypeLayer,
+		Location:            path.Join(config.SociIndexDirectory, desc.Digest.String()),
+		SpanSize:            spanSize,
+		ZtocVersion:         ztoc.Version,
+		BuildToolIdentifier: cfg.buildToolIdentifier,
+		BuildToolVersion:    cfg.buildToolVersion,
+		ZtocBuilderRevision: ZtocBuilderRevision,
 	}
 	err = writeArtifactEntry(entry)
 	if err != nil {
@@ -264,16 +332,77 @@ func buildSociLayer(ctx context.Context, cs content.Store, desc ocispec.Descript
 
 	fmt.Printf("layer %s -> ztoc %s\n", desc.Digest, ztocDesc.Digest)
 
+	return sociLayerDescriptor(desc, ztocDesc), nil
+}
+
+// sociLayerDescriptor returns the descriptor of the ztoc `ztocDesc` of the layer `desc` in a SOCI index.
+func sociLayerDescriptor(desc, ztocDesc ocispec.Descriptor) *ocispec.Descriptor {
 	ztocDesc.MediaType = SociLayerMediaType
 	ztocDesc.Annotations = map[string]string{
-		IndexAnnotationImageLayerMediaType: ocispec.MediaTypeImageLayerGzip,
+		IndexAnnotationImageLayerMediaType: desc.MediaType,
 		IndexAnnotationImageLayerDigest:    desc.Digest.String(),
 	}
-	return &ztocDesc, err
+	return &ztocDesc
+}
+
+// reuseSociLayer looks up a ztoc built previously for the image layer `desc` with the same span size,
+// ztoc version and build tool, and returns a Descriptor for it. It returns false if there is none,
+// if the ztoc isn't in `store` anymore, or if the build is forced.
+func reuseSociLayer(ctx context.Context, desc ocispec.Descriptor, spanSize int64, store orascontent.Storage, cfg *buildConfig) (*ocispec.Descriptor, bool, error) {
+	if cfg.forceRebuild || !images.IsLayerType(desc.MediaType) || skipBuildingZtoc(desc, cfg) {
+		return nil, false, nil
+	}
+	db, err := NewDB()
+	if err != nil {
+		return nil, false, err
+	}
+	entry, err := findCompatibleZtoc(db, desc.Digest, spanSize, cfg)
+	if err != nil || entry == nil {
+		return nil, false, err
+	}
+	ztocDigest, err := digest.Parse(entry.Digest)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid digest of ztoc %s: %w", entry.Digest, err)
+	}
+	ztocDesc := ocispec.Descriptor{Digest: ztocDigest, Size: entry.Size}
+	exists, err := store.Exists(ctx, ztocDesc)
+	if err != nil || !exists {
+		return nil, false, err
+	}
+
+	fmt.Printf("layer %s -> ztoc %s (reused)\n", desc.Digest, ztocDesc.Digest)
+
+	return sociLayerDescriptor(desc, ztocDesc), true, nil
+}
+
+// findCompatibleZtoc returns the entry of a ztoc of the layer `layerDigest` built by ZtocBuilderRevision with
+// the span size `spanSize`, and the ztoc version and build tool of `cfg`, or nil if there is none.
+func findCompatibleZtoc(db *ArtifactsDb, layerDigest digest.Digest, spanSize int64, cfg *buildConfig) (*ArtifactEntry, error) {
+	ztocVersion := cfg.ztocVersion
+	if ztocVersion == "" {
+		ztocVersion = DefaultZtocVersion
+	}
+	var found *ArtifactEntry
+	err := db.Walk(func(ae *ArtifactEntry) error {
+		if found == nil && ae.Type == ArtifactEntryTypeLayer &&
+			ae.OriginalDigest == layerDigest.String() &&
+			ae.SpanSize == spanSize &&
+			ae.ZtocVersion == ztocVersion &&
+			ae.ZtocBuilderRevision == ZtocBuilderRevision &&
+			ae.BuildToolIdentifier == cfg.buildToolIdentifier &&
+			ae.BuildToolVersion == cfg.buildToolVersion {
+			found = ae
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
 }
 
 // getImageManifestDescriptor gets the descriptor of image manifest
-func GetImageManifestDescriptor(ctx context.Context, cs content.Store, img images.Image, platform platforms.MatchComparer) (*ocispec.Descriptor, error) {
+func GetImageManifestDescriptor(ctx context.Context, cs content.Provider, img images.Image, platform platforms.MatchComparer) (*ocispec.Descriptor, error) {
 	target := img.Target
 	if images.IsIndexType(target.MediaType) {
 		manifests, err := images.Children(ctx, cs, target)
@@ -20,6 +20,7 @@ import (
 	"context"
 	"testing"
 
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"oras.land/oras-go/v2/content/memory"
 )
@@ -210,3 +211,74 @@ func TestBuildSociIndexWithLimits(t *testing.T) {
 		})
 	}
 }
+
+func TestFindCompatibleZtoc(t *testing.T) {
+	db, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("cannot create database: %v", err)
+	}
+	layer := digest.FromString("layer")
+	ztoc := ArtifactEntry{
+		Size:                100,
+		Digest:              digest.FromString("ztoc").String(),
+		OriginalDigest:      layer.String(),
+		Type:                ArtifactEntryTypeLayer,
+		SpanSize:            1 << 20,
+		ZtocVersion:         DefaultZtocVersion,
+		BuildToolIdentifier: "tool",
+		BuildToolVersion:    "0.1",
+		ZtocBuilderRevision: ZtocBuilderRevision,
+	}
+	// ztocs built by another revision of the ztoc builder are never reused
+	staleLayer := digest.FromString("stale layer")
+	stale := ztoc
+	stale.Digest = digest.FromString("stale ztoc").String()
+	stale.OriginalDigest = staleLayer.String()
+	stale.ZtocBuilderRevision = "0"
+	// ztocs built before the span size was recorded are never reused
+	legacy := ArtifactEntry{
+		Size:           100,
+		Digest:         digest.FromString("legacy ztoc").String(),
+		OriginalDigest: layer.String(),
+		Type:           ArtifactEntryTypeLayer,
+	}
+	for _, e := range []ArtifactEntry{ztoc, stale, legacy} {
+		e := e
+		if err := db.WriteArtifactEntry(&e); err != nil {
+			t.Fatalf("cannot write artifact entry: %v", err)
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		layer    digest.Digest
+		spanSize int64
+		cfg      buildConfig
+		found    bool
+	}{
+		{name: "same options", layer: layer, spanSize: 1 << 20, cfg: buildConfig{buildToolIdentifier: "tool", buildToolVersion: "0.1"}, found: true},
+		{name: "explicit ztoc version", layer: layer, spanSize: 1 << 20, cfg: buildConfig{buildToolIdentifier: "tool", buildToolVersion: "0.1", ztocVersion: DefaultZtocVersion}, found: true},
+		{name: "other layer", layer: digest.FromString("other layer"), spanSize: 1 << 20, cfg: buildConfig{buildToolIdentifier: "tool", buildToolVersion: "0.1"}},
+		{name: "other span size", layer: layer, spanSize: 1 << 21, cfg: buildConfig{buildToolIdentifier: "tool", buildToolVersion: "0.1"}},
+		{name: "other ztoc version", layer: layer, spanSize: 1 << 20, cfg: buildConfig{buildToolIdentifier: "tool", buildToolVersion: "0.1", ztocVersion: ZtocVersionGob}},
+		{name: "other build tool version", layer: layer, spanSize: 1 << 20, cfg: buildConfig{buildToolIdentifier: "tool", buildToolVersion: "0.2"}},
+		{name: "other ztoc builder revision", layer: staleLayer, spanSize: 1 << 20, cfg: buildConfig{buildToolIdentifier: "tool", buildToolVersion: "0.1"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			entry, err := findCompatibleZtoc(db, tc.layer, tc.spanSize, &tc.cfg)
+			if err != nil {
+				t.Fatalf("cannot look up ztoc: %v", err)
+			}
+			if !tc.found {
+				if entry != nil {
+					t.Fatalf("unexpected compatible ztoc %s", entry.Digest)
+				}
+				return
+			}
+			if entry == nil || entry.Digest != ztoc.Digest {
+				t.Fatalf("expected compatible ztoc %s, got %v", ztoc.Digest, entry)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// the size of a serialized tarZinfo: span size (8 bytes), size of the layer (8 bytes)
+const tarZinfoBlobSize = 16
+
+// tarZinfo is the Zinfo of uncompressed tar layers.
+//
+// Uncompressed layers don't have any compression info. Spans are plain byte ranges
+// of `spanSize` bytes, so compressed and uncompressed offsets are the same.
+type tarZinfo struct {
+	spanSize FileSize
+	size     FileSize
+}
+
+func newTarZinfo(zinfoBytes []byte) (*tarZinfo, error) {
+	if len(zinfoBytes) != tarZinfoBlobSize {
+		return nil, fmt.Errorf("invalid size of tar checkpoints: %d bytes", len(zinfoBytes))
+	}
+	spanSize := FileSize(binary.LittleEndian.Uint64(zinfoBytes[0:8]))
+	if spanSize <= 0 {
+		return nil, fmt.Errorf("invalid span size: %d", spanSize)
+	}
+	return &tarZinfo{
+		spanSize: spanSize,
+		size:     FileSize(binary.LittleEndian.Uint64(zinfoBytes[8:16])),
+	}, nil
+}
+
+// tarZinfoBuilder passes an uncompressed layer through and creates a checkpoint every `spanSize` bytes.
+type tarZinfoBuilder struct {
+	r            io.Reader
+	onCheckpoint checkpointFunc
+	spanSize     FileSize
+	size         FileSize
+	nextSpan     FileSize // offset of the next checkpoint
+}
+
+func newTarZinfoBuilder(r io.Reader, spanSize int64, onCheckpoint checkpointFunc) *tarZinfoBuilder {
+	onCheckpoint(0, 0)
+	return &tarZinfoBuilder{
+		r:            r,
+		onCheckpoint: onCheckpoint,
+		spanSize:     FileSize(spanSize),
+		nextSpan:     FileSize(spanSize),
+	}
+}
+
+func (b *tarZinfoBuilder) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.size += FileSize(n)
+	// a span is only created once there is data in it
+	for b.size > b.nextSpan {
+		b.onCheckpoint(b.nextSpan, b.nextSpan)
+		b.nextSpan += b.spanSize
+	}
+	return n, err
+}
+
+func (b *tarZinfoBuilder) Zinfo() (Zinfo, error) {
+	return &tarZinfo{
+		spanSize: b.spanSize,
+		size:     b.size,
+	}, nil
+}
+
+func (b *tarZinfoBuilder) Close() {}
+
+func (i *tarZinfo) MaxSpanId() SpanId {
+	if i.size == 0 {
+		return 0
+	}
+	return SpanId((i.size - 1) / i.spanSize)
+}
+
+func (i *tarZinfo) StartCompressedOffset(spanId SpanId) FileSize {
+	return i.StartUncompressedOffset(spanId)
+}
+
+func (i *tarZinfo) EndCompressedOffset(spanId SpanId, fileSize FileSize) FileSize {
+	return i.EndUncompressedOffset(spanId, fileSize)
+}
+
+func (i *tarZinfo) StartUncompressedOffset(spanId SpanId) FileSize {
+	return FileSize(spanId) * i.spanSize
+}
+
+func (i *tarZinfo) EndUncompressedOffset(spanId SpanId, fileSize FileSize) FileSize {
+	if spanId == i.MaxSpanId() {
+		return fileSize
+	}
+	return FileSize(spanId+1) * i.spanSize
+}
+
+// HasBits always returns false since spans of uncompressed layers are byte aligned.
+func (i *tarZinfo) HasBits(spanId SpanId) bool {
+	return false
+}
+
+func (i *tarZinfo) UncompressedOffsetToSpanId(offset FileSize) SpanId {
+	spanId := SpanId(offset / i.spanSize)
+	if max := i.MaxSpanId(); spanId > max {
+		return max
+	}
+	return spanId
+}
+
+// ExtractDataFromBuffer returns the requested range of compressedBuf, which already holds uncompressed data.
+func (i *tarZinfo) ExtractDataFromBuffer(compressedBuf []byte, uncompressedSize, uncompressedOffset FileSize, spanId SpanId) ([]byte, error) {
+	start := uncompressedOffset - i.StartUncompressedOffset(spanId)
+	if start < 0 || start+uncompressedSize > FileSize(len(compressedBuf)) {
+		return nil, fmt.Errorf("requested range [%d, %d) is out of the buffer of size %d", start, start+uncompressedSize, len(compressedBuf))
+	}
+	return compressedBuf[start : start+uncompressedSize], nil
+}
+
+func (i *tarZinfo) Bytes() ([]byte, error) {
+	buf := make([]byte, tarZinfoBlobSize)
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(i.spanSize))
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(i.size))
+	return buf, nil
+}
+
+func (i *tarZinfo) Close() {}
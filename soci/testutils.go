@@ -26,11 +26,14 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"math/rand"
 	"os"
 	"sort"
+	"strings"
+	"time"
 	"unsafe"
 
 	"github.com/awslabs/soci-snapshotter/util/testutil"
@@ -77,7 +80,10 @@ func unmarshalGzipIndex(blob byte) (*gzipIndex, error) {
 	lst := unsafe.Slice(index.list, int(index.have))
 	for i := 0; i < int(index.have); i++ {
 		indexPoint := lst[i]
-		window := C.GoBytes(unsafe.Pointer(&indexPoint.window[0]), windowSize)
+		window := make([]byte, windowSize)
+		if indexPoint.window != nil {
+			window = C.GoBytes(unsafe.Pointer(indexPoint.window), windowSize)
+		}
 		listEntry := gzipIndexPoint{
 			out:    int64(indexPoint.out),
 			in:     int64(indexPoint.in),
@@ -213,23 +219,190 @@ func tempTarGz(inputDir string, targzName string) (*string, error) {
 func BuildZtocReader(ents []testutil.TarEntry, compressionLevel int, spanSize int64, opts ...testutil.BuildTarOption) (*Ztoc, *io.SectionReader, error) {
 	// build tar gz file
 	tarReader := testutil.BuildTarGz(ents, compressionLevel, opts...)
+	return buildZtocReader(tarReader, CompressionGzip, spanSize)
+}
+
+// BuildZstdZtocReader creates the zstd-compressed tar file for tar entries, with a zstd frame every frameSize bytes.
+// It returns ztoc and io.SectionReader of the file.
+func BuildZstdZtocReader(ents []testutil.TarEntry, frameSize int, spanSize int64, opts ...testutil.BuildTarOption) (*Ztoc, *io.SectionReader, error) {
+	tarReader := testutil.BuildTarZstd(ents, frameSize, opts...)
+	return buildZtocReader(tarReader, CompressionZstd, spanSize)
+}
+
+// BuildTarZtocReader creates the uncompressed tar file for tar entries.
+// It returns ztoc and io.SectionReader of the file.
+func BuildTarZtocReader(ents []testutil.TarEntry, spanSize int64, opts ...testutil.BuildTarOption) (*Ztoc, *io.SectionReader, error) {
+	tarReader := testutil.BuildTar(ents, opts...)
+	return buildZtocReader(tarReader, CompressionUncompressed, spanSize)
+}
 
-	// build ztoc
-	tarFile, err := os.CreateTemp("", "tmp.*")
+// BuildEstargzZtocReader creates the eStargz layer for tar entries, with regular files split into chunks
+// of chunkSize bytes, and converts its TOC to a ztoc.
+// It returns ztoc and io.SectionReader of the layer.
+func BuildEstargzZtocReader(ents []testutil.TarEntry, chunkSize int64, opts ...testutil.BuildTarOption) (*Ztoc, *io.SectionReader, error) {
+	sr, tocDigest, err := BuildEstargz(ents, chunkSize, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	ztoc, err := NewZtocFromEstargz(sr, tocDigest)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create temp file: %v", err)
+		return nil, nil, fmt.Errorf("failed to convert eStargz TOC: %v", err)
 	}
-	defer os.Remove(tarFile.Name())
-	tarBuf := new(bytes.Buffer)
-	w := io.MultiWriter(tarFile, tarBuf)
-	_, err = io.Copy(w, tarReader)
+	return ztoc, sr, nil
+}
+
+// BuildEstargz creates the eStargz layer for tar entries, in the same way as the eStargz writer
+// of stargz-snapshotter: every chunk of a regular file starts a new gzip member and the TOC is
+// stored in the last member before the footer.
+// It returns io.SectionReader of the layer and the digest of the TOC.
+func BuildEstargz(ents []testutil.TarEntry, chunkSize int64, opts ...testutil.BuildTarOption) (*io.SectionReader, digest.Digest, error) {
+	var (
+		buf bytes.Buffer
+		gw  *gzip.Writer
+		toc estargzTOC
+	)
+	closeGz := func() error {
+		if gw == nil {
+			return nil
+		}
+		err := gw.Close()
+		gw = nil
+		return err
+	}
+	// the tar stream is written to the current gzip member, which is opened lazily
+	tw := tar.NewWriter(writerFunc(func(p []byte) (int, error) {
+		if gw == nil {
+			gw = gzip.NewWriter(&buf)
+		}
+		return gw.Write(p)
+	}))
+
+	tr := tar.NewReader(testutil.BuildTar(ents, opts...))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, "", err
+		}
+		fileType, err := getType(h)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return nil, "", err
+		}
+		ent := estargzTOCEntry{
+			Name:        h.Name,
+			Type:        fileType,
+			ModTime3339: h.ModTime.UTC().Format(time.RFC3339),
+			LinkName:    h.Linkname,
+			Mode:        h.Mode,
+			UID:         h.Uid,
+			GID:         h.Gid,
+			Uname:       h.Uname,
+			Gname:       h.Gname,
+			DevMajor:    int(h.Devmajor),
+			DevMinor:    int(h.Devminor),
+		}
+		for k, v := range h.PAXRecords {
+			if strings.HasPrefix(k, "SCHILY.xattr.") {
+				if ent.Xattrs == nil {
+					ent.Xattrs = make(map[string][]byte)
+				}
+				ent.Xattrs[strings.TrimPrefix(k, "SCHILY.xattr.")] = []byte(v)
+			}
+		}
+		if h.Typeflag != tar.TypeReg || h.Size == 0 {
+			toc.Entries = append(toc.Entries, ent)
+			continue
+		}
+		ent.Size = h.Size
+		regIdx := len(toc.Entries)
+		fileDigester := digest.Canonical.Digester()
+		for written := int64(0); written < h.Size; {
+			if err := closeGz(); err != nil {
+				return nil, "", err
+			}
+			size := chunkSize
+			if h.Size-written < size {
+				size = h.Size - written
+			}
+			chunk := make([]byte, size)
+			if _, err := io.ReadFull(tr, chunk); err != nil {
+				return nil, "", err
+			}
+			ent.Offset = int64(buf.Len())
+			ent.ChunkOffset = written
+			ent.ChunkSize = size
+			ent.ChunkDigest = digest.FromBytes(chunk).String()
+			fileDigester.Hash().Write(chunk)
+			if _, err := tw.Write(chunk); err != nil {
+				return nil, "", err
+			}
+			toc.Entries = append(toc.Entries, ent)
+			written += size
+			ent = estargzTOCEntry{Name: h.Name, Type: estargzChunkType}
+		}
+		toc.Entries[regIdx].Digest = fileDigester.Digest().String()
+	}
+	if err := tw.Flush(); err != nil {
+		return nil, "", err
+	}
+	if err := closeGz(); err != nil {
+		return nil, "", err
+	}
+
+	// TOC
+	tocOffset := buf.Len()
+	tocJSON, err := json.Marshal(toc)
+	if err != nil {
+		return nil, "", err
+	}
+	gw = gzip.NewWriter(&buf)
+	tocWriter := tar.NewWriter(gw)
+	if err := tocWriter.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     estargzTOCName,
+		Size:     int64(len(tocJSON)),
+		Mode:     0444,
+	}); err != nil {
+		return nil, "", err
+	}
+	if _, err := tocWriter.Write(tocJSON); err != nil {
+		return nil, "", err
+	}
+	if err := tocWriter.Close(); err != nil {
+		return nil, "", err
+	}
+	if err := closeGz(); err != nil {
+		return nil, "", err
+	}
+
+	// footer: an empty gzip member with the offset of the TOC in the extra field.
+	// It's written by hand since compress/gzip doesn't write the empty stored block of the 51 bytes footer.
+	buf.Write([]byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff, 26, 0, 'S', 'G', 22, 0})
+	buf.WriteString(fmt.Sprintf("%016xSTARGZ", tocOffset))
+	buf.Write([]byte{1, 0, 0, 0xff, 0xff})
+	buf.Write(make([]byte, 8))
+
+	data := buf.Bytes()
+	return io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), digest.FromBytes(tocJSON), nil
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func buildZtocReader(tarReader io.Reader, compressionAlgo string, spanSize int64) (*Ztoc, *io.SectionReader, error) {
+	tarData, err := io.ReadAll(tarReader)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to write tar file: %v", err)
+		return nil, nil, fmt.Errorf("failed to read tar file: %v", err)
 	}
-	tarData := tarBuf.Bytes()
 	sr := io.NewSectionReader(bytes.NewReader(tarData), 0, int64(len(tarData)))
-	cfg := &buildConfig{}
-	ztoc, err := BuildZtoc(tarFile.Name(), spanSize, cfg)
+	ztoc, err := BuildZtocFromReader(bytes.NewReader(tarData), compressionAlgo, spanSize)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to build sample ztoc: %v", err)
 	}
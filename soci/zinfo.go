@@ -0,0 +1,207 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// CompressionGzip is the compression algorithm of gzip-compressed layers
+	CompressionGzip = "gzip"
+	// CompressionZstd is the compression algorithm of zstd-compressed layers
+	CompressionZstd = "zstd"
+	// CompressionUncompressed is used for uncompressed tar layers
+	CompressionUncompressed = "uncompressed"
+	// CompressionEstargz is used for ztocs converted from the TOC of eStargz layers.
+	// eStargz layers are gzip-compressed, but their ztocs are never built by SOCI.
+	CompressionEstargz = "estargz"
+)
+
+// Zinfo is the compression specific part of the ztoc. It holds the checkpoints
+// of the layer, which split it into spans, and knows how to uncompress the data
+// of the layer starting from any of the checkpoints.
+type Zinfo interface {
+	// MaxSpanId returns the id of the last span of the layer.
+	MaxSpanId() SpanId
+	// StartCompressedOffset returns the offset in the compressed layer where the span starts.
+	StartCompressedOffset(spanId SpanId) FileSize
+	// EndCompressedOffset returns the offset in the compressed layer where the span ends.
+	// fileSize is the size of the compressed layer and is returned for the last span.
+	EndCompressedOffset(spanId SpanId, fileSize FileSize) FileSize
+	// StartUncompressedOffset returns the offset in the uncompressed layer where the span starts.
+	StartUncompressedOffset(spanId SpanId) FileSize
+	// EndUncompressedOffset returns the offset in the uncompressed layer where the span ends.
+	// fileSize is the size of the uncompressed layer and is returned for the last span.
+	EndUncompressedOffset(spanId SpanId, fileSize FileSize) FileSize
+	// HasBits returns true if the span starts in the middle of a byte,
+	// in which case the compressed data of the span starts one byte earlier.
+	HasBits(spanId SpanId) bool
+	// UncompressedOffsetToSpanId returns the id of the span containing the uncompressed offset.
+	UncompressedOffsetToSpanId(offset FileSize) SpanId
+	// ExtractDataFromBuffer uncompresses `uncompressedSize` bytes starting at `uncompressedOffset`
+	// from compressedBuf, which holds the compressed data starting from the span `spanId`.
+	ExtractDataFromBuffer(compressedBuf []byte, uncompressedSize, uncompressedOffset FileSize, spanId SpanId) ([]byte, error)
+	// Bytes returns the serialized Zinfo, which is stored in the ztoc.
+	Bytes() ([]byte, error)
+	// Close releases the resources held by the Zinfo.
+	Close()
+}
+
+// NewZinfo deserializes the Zinfo of a layer compressed with `compressionAlgo`.
+// An empty compression algorithm means gzip, which was the only supported algorithm
+// before the compression algorithm has been recorded in the ztoc.
+func NewZinfo(compressionAlgo string, zinfoBytes []byte) (Zinfo, error) {
+	switch compressionAlgo {
+	case CompressionGzip, "":
+		return newGzipZinfo(zinfoBytes)
+	case CompressionZstd:
+		return newZstdZinfo(zinfoBytes)
+	case CompressionUncompressed:
+		return newTarZinfo(zinfoBytes)
+	case CompressionEstargz:
+		return newEstargzZinfo(zinfoBytes)
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm: %s", compressionAlgo)
+	}
+}
+
+// zinfoBuilder uncompresses a layer read as a stream and builds its Zinfo on the way.
+type zinfoBuilder interface {
+	// Read reads the uncompressed layer.
+	io.Reader
+	// Zinfo returns the Zinfo of the layer. It must be called after the whole uncompressed layer has been read.
+	Zinfo() (Zinfo, error)
+	// Close releases the resources held by the builder.
+	Close()
+}
+
+// checkpointFunc is called by zinfoBuilder when a new span is found, in the order of the spans.
+// `start` is the compressed offset where the new span starts and `prevEnd` is the compressed
+// offset where the previous span ends, as returned by StartCompressedOffset and EndCompressedOffset.
+// When it's called, all the compressed data up to `prevEnd` has been read by the builder.
+type checkpointFunc func(start, prevEnd FileSize)
+
+// newZinfoBuilder returns the zinfoBuilder of a layer compressed with `compressionAlgo` and read from `r`.
+// A checkpoint is created roughly every `spanSize` uncompressed bytes.
+func newZinfoBuilder(compressionAlgo string, r io.Reader, spanSize int64, onCheckpoint checkpointFunc) (zinfoBuilder, error) {
+	if spanSize <= 0 {
+		return nil, fmt.Errorf("invalid span size: %d", spanSize)
+	}
+	switch compressionAlgo {
+	case CompressionGzip, "":
+		return newGzipZinfoBuilder(r, spanSize, onCheckpoint)
+	case CompressionZstd:
+		return newZstdZinfoBuilder(r, spanSize, onCheckpoint)
+	case CompressionUncompressed:
+		return newTarZinfoBuilder(r, spanSize, onCheckpoint), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm: %s", compressionAlgo)
+	}
+}
+
+// Zinfo returns the Zinfo of the ztoc. Close must be called when it's not needed anymore.
+func (ztoc *Ztoc) Zinfo() (Zinfo, error) {
+	return NewZinfo(ztoc.CompressionAlgorithm, ztoc.IndexByteData)
+}
+
+// zinfoBytes serializes zinfo for a ztoc of the given version. Only gzip checkpoints are serialized
+// differently, since they can be compact in ztocs of version ZtocVersionCompactCheckpoints and later.
+func zinfoBytes(zinfo Zinfo, version string) ([]byte, error) {
+	if gzipZinfo, ok := zinfo.(*gzipZinfo); ok && version != ZtocVersionGob && version != ZtocVersionProto {
+		return gzipZinfo.compactBytes()
+	}
+	return zinfo.Bytes()
+}
+
+// UncompressedSpanKey returns a digest identifying the uncompressed contents of the span `spanId`, whose
+// compressed contents have the digest `spanDigest`. Spans with the same key have the same uncompressed
+// contents even if they belong to different layers. Besides its compressed contents, uncompressing a gzip
+// span depends on the bits and the window of its checkpoint, which are part of the key.
+func UncompressedSpanKey(zinfo Zinfo, spanId SpanId, spanDigest digest.Digest, uncompressedSize FileSize) (digest.Digest, error) {
+	digester := digest.Canonical.Digester()
+	fmt.Fprintf(digester.Hash(), "%s %d", spanDigest, uncompressedSize)
+	if gzipZinfo, ok := zinfo.(*gzipZinfo); ok {
+		window, err := gzipZinfo.compressedWindow(spanId)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(digester.Hash(), " %d ", gzipZinfo.bits(spanId))
+		digester.Hash().Write(window)
+	}
+	return digester.Digest(), nil
+}
+
+// CheckpointsSize returns the size of the checkpoints of the ztoc, as well as the size they would
+// have if the windows of gzip checkpoints were all stored uncompressed, as in ztocs before
+// ZtocVersionCompactCheckpoints.
+func (ztoc *Ztoc) CheckpointsSize() (size, uncompressedSize int64, err error) {
+	zinfo, err := ztoc.Zinfo()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer zinfo.Close()
+	size = int64(len(ztoc.IndexByteData))
+	if gzipZinfo, ok := zinfo.(*gzipZinfo); ok {
+		return size, gzipZinfo.legacySize(), nil
+	}
+	return size, size, nil
+}
+
+// compressionAlgorithmFromMediaType returns the compression algorithm of the layer with the media type.
+// For media types which don't tell whether the layer is compressed, the compression is detected
+// from the first bytes of the layer, which are read from `r`.
+func compressionAlgorithmFromMediaType(ctx context.Context, mediaType string, r io.ReaderAt) (string, error) {
+	compression, err := images.DiffCompression(ctx, mediaType)
+	if err != nil {
+		return "", err
+	}
+	switch compression {
+	case CompressionGzip, CompressionZstd:
+		return compression, nil
+	case "":
+		return CompressionUncompressed, nil
+	case "unknown":
+		return detectCompression(r)
+	default:
+		return "", fmt.Errorf("%w: %s", errUnsupportedLayerFormat, mediaType)
+	}
+}
+
+// detectCompression detects the compression algorithm from the magic number of the layer.
+func detectCompression(r io.ReaderAt) (string, error) {
+	magic := make([]byte, 4)
+	n, err := r.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	magic = magic[:n]
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return CompressionGzip, nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return CompressionZstd, nil
+	default:
+		return CompressionUncompressed, nil
+	}
+}
@@ -0,0 +1,364 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	zstdFrameMagic          = 0xFD2FB528
+	zstdSkippableFrameMagic = 0x184D2A50
+	zstdSkippableFrameMask  = 0xFFFFFFF0
+
+	// the size of a serialized zstd checkpoint: compressed offset (8 bytes), uncompressed offset (8 bytes)
+	zstdCheckpointBlobSize = 16
+)
+
+var errInvalidZstdFrame = errors.New("invalid zstd frame")
+
+// zstdCheckpoint is the location of a zstd frame boundary in the compressed and uncompressed layer.
+type zstdCheckpoint struct {
+	in  FileSize // offset of the frame in the compressed layer
+	out FileSize // offset of the frame contents in the uncompressed layer
+}
+
+// zstdZinfo is the Zinfo of zstd-compressed layers.
+//
+// zstd frames are independent of each other, so every frame boundary can be used as a checkpoint
+// and, unlike gzip, no window needs to be stored. As a consequence, a layer compressed as a single frame
+// consists of a single span.
+type zstdZinfo struct {
+	spanSize    FileSize
+	checkpoints []zstdCheckpoint
+}
+
+// newZstdZinfo deserializes zstdZinfo. The blob starts with the number of checkpoints (4 bytes)
+// and the span size (8 bytes), followed by the compressed (8 bytes) and uncompressed (8 bytes)
+// offsets of each checkpoint except checkpoint 0, which is always at the beginning of the layer.
+func newZstdZinfo(zinfoBytes []byte) (*zstdZinfo, error) {
+	if len(zinfoBytes) < 12 {
+		return nil, fmt.Errorf("zstd checkpoints are too short: %d bytes", len(zinfoBytes))
+	}
+	have := binary.LittleEndian.Uint32(zinfoBytes[0:4])
+	spanSize := binary.LittleEndian.Uint64(zinfoBytes[4:12])
+	if have == 0 || uint64(len(zinfoBytes)-12) < uint64(have-1)*zstdCheckpointBlobSize {
+		return nil, fmt.Errorf("invalid number of zstd checkpoints: %d", have)
+	}
+
+	checkpoints := make([]zstdCheckpoint, have)
+	cur := zinfoBytes[12:]
+	for i := 1; i < int(have); i++ {
+		checkpoints[i] = zstdCheckpoint{
+			in:  FileSize(binary.LittleEndian.Uint64(cur[0:8])),
+			out: FileSize(binary.LittleEndian.Uint64(cur[8:16])),
+		}
+		cur = cur[zstdCheckpointBlobSize:]
+	}
+	return &zstdZinfo{
+		spanSize:    FileSize(spanSize),
+		checkpoints: checkpoints,
+	}, nil
+}
+
+// zstdZinfoBuilder uncompresses a zstd stream frame by frame and creates
+// a checkpoint at the first frame boundary after every `spanSize` uncompressed bytes.
+type zstdZinfoBuilder struct {
+	r            *bufio.Reader
+	dec          *zstd.Decoder
+	frame        *zstdFrameReader // the frame being uncompressed, nil between frames
+	onCheckpoint checkpointFunc
+	spanSize     FileSize
+	checkpoints  []zstdCheckpoint
+	in, out      FileSize // offsets of the end of the data uncompressed so far
+	done         bool
+}
+
+func newZstdZinfoBuilder(r io.Reader, spanSize int64, onCheckpoint checkpointFunc) (*zstdZinfoBuilder, error) {
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create zstd reader: %v", err)
+	}
+	// the first span always starts at the beginning of the layer
+	onCheckpoint(0, 0)
+	return &zstdZinfoBuilder{
+		r:            bufio.NewReader(r),
+		dec:          dec,
+		onCheckpoint: onCheckpoint,
+		spanSize:     FileSize(spanSize),
+		checkpoints:  []zstdCheckpoint{{in: 0, out: 0}},
+	}, nil
+}
+
+func (b *zstdZinfoBuilder) Read(p []byte) (int, error) {
+	for {
+		if b.done {
+			return 0, io.EOF
+		}
+		if b.frame == nil {
+			if _, err := b.r.Peek(1); err == io.EOF {
+				b.done = true
+				continue
+			} else if err != nil {
+				return 0, err
+			}
+			// a new span starts at this frame if the current one is large enough
+			last := b.checkpoints[len(b.checkpoints)-1]
+			if b.in != last.in && b.out-last.out >= b.spanSize {
+				b.checkpoints = append(b.checkpoints, zstdCheckpoint{in: b.in, out: b.out})
+				b.onCheckpoint(b.in, b.in)
+			}
+			b.frame = &zstdFrameReader{r: b.r}
+			if err := b.dec.Reset(b.frame); err != nil {
+				return 0, fmt.Errorf("cannot uncompress zstd frame at offset %d: %w", b.in, err)
+			}
+		}
+
+		n, err := b.dec.Read(p)
+		b.out += FileSize(n)
+		if err == io.EOF {
+			b.in += b.frame.size
+			b.frame = nil
+			err = nil
+		} else if err != nil {
+			return n, fmt.Errorf("cannot uncompress zstd frame at offset %d: %w", b.in, err)
+		}
+		if n > 0 || len(p) == 0 {
+			return n, err
+		}
+	}
+}
+
+func (b *zstdZinfoBuilder) Zinfo() (Zinfo, error) {
+	if !b.done {
+		return nil, fmt.Errorf("the end of the zstd stream hasn't been reached")
+	}
+	return &zstdZinfo{
+		spanSize:    b.spanSize,
+		checkpoints: b.checkpoints,
+	}, nil
+}
+
+func (b *zstdZinfoBuilder) Close() {
+	b.dec.Close()
+}
+
+// zstdFrameReader reads a single zstd frame, including skippable frames, from the beginning of r
+// and returns io.EOF at the end of the frame. The frame is parsed while it's read so nothing after it is consumed.
+// See https://github.com/facebook/zstd/blob/dev/doc/zstd_compression_format.md#frames for the format.
+type zstdFrameReader struct {
+	r     *bufio.Reader
+	size  FileSize // bytes of the frame read so far
+	left  int64    // bytes left in the current part of the frame
+	state int
+	// hasChecksum is true if the frame ends with a checksum
+	hasChecksum bool
+}
+
+const (
+	zstdFrameStart = iota
+	zstdFrameBlocks
+	zstdFrameChecksum
+	zstdFrameEnd
+)
+
+func (f *zstdFrameReader) Read(p []byte) (int, error) {
+	for f.left == 0 {
+		if err := f.nextPart(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > f.left {
+		p = p[:f.left]
+	}
+	n, err := f.r.Read(p)
+	f.left -= int64(n)
+	f.size += FileSize(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nextPart finds the size of the next part of the frame: the frame header, a block or the checksum.
+func (f *zstdFrameReader) nextPart() error {
+	switch f.state {
+	case zstdFrameStart:
+		buf, err := f.peek(5)
+		if err != nil {
+			return err
+		}
+		magic := binary.LittleEndian.Uint32(buf[:4])
+		if magic&zstdSkippableFrameMask == zstdSkippableFrameMagic {
+			if buf, err = f.peek(8); err != nil {
+				return err
+			}
+			f.left = 8 + int64(binary.LittleEndian.Uint32(buf[4:8]))
+			f.state = zstdFrameEnd
+			return nil
+		}
+		if magic != zstdFrameMagic {
+			return errInvalidZstdFrame
+		}
+
+		descriptor := buf[4]
+		fcsFlag := descriptor >> 6
+		singleSegment := descriptor&(1<<5) != 0
+		dictIDFlag := descriptor & 3
+		f.hasChecksum = descriptor&(1<<2) != 0
+
+		headerSize := int64(1)
+		if !singleSegment {
+			headerSize++ // window descriptor
+		}
+		headerSize += [4]int64{0, 1, 2, 4}[dictIDFlag]
+		switch fcsFlag {
+		case 0:
+			if singleSegment {
+				headerSize++
+			}
+		case 1:
+			headerSize += 2
+		case 2:
+			headerSize += 4
+		case 3:
+			headerSize += 8
+		}
+		f.left = 4 + headerSize
+		f.state = zstdFrameBlocks
+	case zstdFrameBlocks:
+		buf, err := f.peek(3)
+		if err != nil {
+			return err
+		}
+		header := uint32(buf[0]) | uint32(buf[1])<<8 | uint32(buf[2])<<16
+		blockSize := int64(header >> 3)
+		switch (header >> 1) & 3 {
+		case 0, 2: // raw and compressed blocks
+			f.left = 3 + blockSize
+		case 1: // RLE blocks store a single byte
+			f.left = 3 + 1
+		default:
+			return errInvalidZstdFrame
+		}
+		if header&1 != 0 { // last block
+			f.state = zstdFrameChecksum
+		}
+	case zstdFrameChecksum:
+		f.state = zstdFrameEnd
+		if f.hasChecksum {
+			f.left = 4
+		}
+	case zstdFrameEnd:
+		return io.EOF
+	}
+	return nil
+}
+
+func (f *zstdFrameReader) peek(n int) ([]byte, error) {
+	buf, err := f.r.Peek(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf, err
+}
+
+func (i *zstdZinfo) MaxSpanId() SpanId {
+	return SpanId(len(i.checkpoints)) - 1
+}
+
+func (i *zstdZinfo) StartCompressedOffset(spanId SpanId) FileSize {
+	return i.checkpoints[spanId].in
+}
+
+func (i *zstdZinfo) EndCompressedOffset(spanId SpanId, fileSize FileSize) FileSize {
+	if spanId == i.MaxSpanId() {
+		return fileSize
+	}
+	return i.checkpoints[spanId+1].in
+}
+
+func (i *zstdZinfo) StartUncompressedOffset(spanId SpanId) FileSize {
+	return i.checkpoints[spanId].out
+}
+
+func (i *zstdZinfo) EndUncompressedOffset(spanId SpanId, fileSize FileSize) FileSize {
+	if spanId == i.MaxSpanId() {
+		return fileSize
+	}
+	return i.checkpoints[spanId+1].out
+}
+
+// HasBits always returns false since zstd frames are byte aligned.
+func (i *zstdZinfo) HasBits(spanId SpanId) bool {
+	return false
+}
+
+func (i *zstdZinfo) UncompressedOffsetToSpanId(offset FileSize) SpanId {
+	// find the last checkpoint whose uncompressed offset is <= offset
+	idx := sort.Search(len(i.checkpoints), func(j int) bool {
+		return i.checkpoints[j].out > offset
+	})
+	if idx == 0 {
+		return 0
+	}
+	return SpanId(idx - 1)
+}
+
+func (i *zstdZinfo) ExtractDataFromBuffer(compressedBuf []byte, uncompressedSize, uncompressedOffset FileSize, spanId SpanId) ([]byte, error) {
+	data := make([]byte, uncompressedSize)
+	if uncompressedSize == 0 {
+		return data, nil
+	}
+	dec, err := zstd.NewReader(bytes.NewReader(compressedBuf), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return data, fmt.Errorf("cannot create zstd reader: %v", err)
+	}
+	defer dec.Close()
+
+	skip := int64(uncompressedOffset - i.checkpoints[spanId].out)
+	if _, err := io.CopyN(io.Discard, dec, skip); err != nil {
+		return data, fmt.Errorf("error extracting data: %w", err)
+	}
+	if _, err := io.ReadFull(dec, data); err != nil {
+		return data, fmt.Errorf("error extracting data: %w", err)
+	}
+	return data, nil
+}
+
+func (i *zstdZinfo) Bytes() ([]byte, error) {
+	buf := make([]byte, 12+(len(i.checkpoints)-1)*zstdCheckpointBlobSize)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(i.checkpoints)))
+	binary.LittleEndian.PutUint64(buf[4:12], uint64(i.spanSize))
+	cur := buf[12:]
+	for _, c := range i.checkpoints[1:] {
+		binary.LittleEndian.PutUint64(cur[0:8], uint64(c.in))
+		binary.LittleEndian.PutUint64(cur[8:16], uint64(c.out))
+		cur = cur[zstdCheckpointBlobSize:]
+	}
+	return buf, nil
+}
+
+func (i *zstdZinfo) Close() {}
@@ -23,6 +23,7 @@ import "C"
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"time"
@@ -58,6 +59,44 @@ type FileMetadata struct {
 	Devminor int64     // Minor device number (valid for TypeChar or TypeBlock)
 
 	Xattrs map[string]string
+
+	// Digest is the digest of the contents of regular files. It's empty if the ztoc doesn't record it.
+	Digest digest.Digest
+}
+
+const (
+	// ZtocVersionGob is the version of ztocs which are gob-encoded Go structs.
+	ZtocVersionGob = "0.1"
+	// ZtocVersionProto is the version of ztocs encoded with the protobuf schema in ztoc.proto.
+	ZtocVersionProto = "0.2"
+	// ZtocVersionCompactCheckpoints is the version of protobuf ztocs whose gzip checkpoints have
+	// compressed windows, and no windows for the spans which don't need them.
+	ZtocVersionCompactCheckpoints = "0.3"
+	// DefaultZtocVersion is the version of the ztocs built unless another version is requested.
+	DefaultZtocVersion = ZtocVersionCompactCheckpoints
+)
+
+// ErrUnsupportedZtocVersion is returned when a ztoc of an unknown version is serialized or deserialized.
+var ErrUnsupportedZtocVersion = errors.New("unsupported ztoc version")
+
+// checkZtocVersion returns an error if ztocs of the version can't be serialized and deserialized.
+func checkZtocVersion(version string) error {
+	switch version {
+	case ZtocVersionGob, ZtocVersionProto, ZtocVersionCompactCheckpoints:
+		return nil
+	default:
+		return fmt.Errorf("%w: %q", ErrUnsupportedZtocVersion, version)
+	}
+}
+
+// checkZtocVersionForCompression returns an error if ztocs of the version can't describe layers
+// compressed with compressionAlgo. Gob ztocs don't record the compression algorithm, so the
+// snapshotters which only support them read every ztoc as the ztoc of a gzip layer.
+func checkZtocVersionForCompression(version, compressionAlgo string) error {
+	if version == ZtocVersionGob && compressionAlgo != "" && compressionAlgo != CompressionGzip {
+		return fmt.Errorf("%w: %s layers need ztoc version %s or later", ErrUnsupportedZtocVersion, compressionAlgo, ZtocVersionProto)
+	}
+	return nil
 }
 
 type Ztoc struct {
@@ -71,6 +110,7 @@ type Ztoc struct {
 	MaxSpanId            SpanId //The total number of spans in Ztoc - 1
 	ZtocInfo             ztocInfo
 	IndexByteData        []byte
+	CompressionAlgorithm string // Compression algorithm of the layer. Empty for ztocs built before it was recorded, which are gzip.
 }
 
 type ztocInfo struct {
@@ -86,6 +126,8 @@ type FileExtractConfig struct {
 	IndexByteData      []byte
 	CompressedFileSize FileSize
 	MaxSpanId          SpanId
+	// CompressionAlgorithm is the compression algorithm of the layer. Empty means gzip.
+	CompressionAlgorithm string
 }
 
 type MetadataEntry struct {
@@ -104,45 +146,36 @@ func ExtractFile(r *io.SectionReader, config *FileExtractConfig) ([]byte, error)
 
 	numSpans := config.SpanEnd - config.SpanStart + 1
 
-	index := C.blob_to_index(unsafe.Pointer(&config.IndexByteData[0]))
-
-	if index == nil {
-		return bytes, fmt.Errorf("cannot convert blob to gzip_index")
+	zinfo, err := NewZinfo(config.CompressionAlgorithm, config.IndexByteData)
+	if err != nil {
+		return bytes, err
 	}
-	defer C.free_index(index)
+	defer zinfo.Close()
 	var bufSize FileSize
 	starts := make([]FileSize, numSpans)
 	ends := make([]FileSize, numSpans)
 
 	var i SpanId
 	for i = 0; i < numSpans; i++ {
-		starts[i] = FileSize(C.get_comp_off(index, C.int(i+config.SpanStart)))
-		if i+config.SpanStart == config.MaxSpanId {
-			ends[i] = config.CompressedFileSize - 1
-		} else {
-			ends[i] = FileSize(C.get_comp_off(index, C.int(i+1+config.SpanStart)))
+		starts[i] = zinfo.StartCompressedOffset(i + config.SpanStart)
+		ends[i] = zinfo.EndCompressedOffset(i+config.SpanStart, config.CompressedFileSize) - 1
+		if i > 0 && zinfo.HasBits(i+config.SpanStart) {
+			// the byte holding the partial bits is already fetched as a part of the previous span
+			starts[i]++
 		}
 		bufSize += (ends[i] - starts[i] + 1)
 	}
 
 	start := starts[0]
-	// Fetch all span data in parallel
-	if config.FirstSpanHasBits == "true" {
-		bufSize += 1
-		start -= 1
-	}
-
 	buf := make([]byte, bufSize)
 	eg, _ := errgroup.WithContext(context.Background())
 
+	// Fetch all span data in parallel
 	for i = 0; i < numSpans; i++ {
 		j := i
 		eg.Go(func() error {
 			rangeStart := starts[j]
 			rangeEnd := ends[j]
-			if j == 0 && config.FirstSpanHasBits == "true" {
-				rangeStart -= 1
-			}
 			n, err := r.ReadAt(buf[rangeStart-start:rangeEnd-start+1], int64(rangeStart)) // need to convert rangeStart to int64 to use in ReadAt
 			if err != nil {
 				return err
@@ -159,12 +192,59 @@ func ExtractFile(r *io.SectionReader, config *FileExtractConfig) ([]byte, error)
 		return bytes, err
 	}
 
-	ret := C.extract_data_from_buffer(unsafe.Pointer(&buf[0]), C.off_t(len(buf)), index, C.off_t(config.UncompressedOffset), unsafe.Pointer(&bytes[0]), C.off_t(config.UncompressedSize), C.int(config.SpanStart))
-	if ret <= 0 {
-		return bytes, fmt.Errorf("error extracting data; return code: %v", ret)
+	return zinfo.ExtractDataFromBuffer(buf, config.UncompressedSize, config.UncompressedOffset, config.SpanStart)
+}
+
+// ExtractFileByName extracts the contents of the file `name` from the layer `r` using its ztoc.
+// Links are followed. If the ztoc records the digest of the file, the contents are checked against it.
+func ExtractFileByName(r *io.SectionReader, ztoc *Ztoc, name string) ([]byte, error) {
+	md, err := getFileMetadataByName(ztoc, name)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := ExtractFile(r, &FileExtractConfig{
+		UncompressedSize:     md.UncompressedSize,
+		UncompressedOffset:   md.UncompressedOffset,
+		SpanStart:            md.SpanStart,
+		SpanEnd:              md.SpanEnd,
+		IndexByteData:        ztoc.IndexByteData,
+		CompressedFileSize:   ztoc.CompressedFileSize,
+		MaxSpanId:            ztoc.MaxSpanId,
+		CompressionAlgorithm: ztoc.CompressionAlgorithm,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot extract %s: %w", name, err)
+	}
+	if md.Digest != "" && md.Digest != digest.FromBytes(contents) {
+		return nil, fmt.Errorf("contents of %s don't match digest %s", name, md.Digest)
+	}
+	return contents, nil
+}
+
+// maxLinkDepth is the maximum number of links followed to find a file.
+const maxLinkDepth = 40
+
+func getFileMetadataByName(ztoc *Ztoc, name string) (*FileMetadata, error) {
+	for depth := 0; depth < maxLinkDepth; depth++ {
+		md := findFileMetadata(ztoc, name)
+		if md == nil {
+			return nil, fmt.Errorf("file %s does not exist in metadata", name)
+		}
+		if md.Linkname == "" {
+			return md, nil
+		}
+		name = md.Linkname
 	}
+	return nil, fmt.Errorf("too many levels of links to %s", name)
+}
 
-	return bytes, nil
+func findFileMetadata(ztoc *Ztoc, name string) *FileMetadata {
+	for i := range ztoc.Metadata {
+		if ztoc.Metadata[i].Name == name {
+			return &ztoc.Metadata[i]
+		}
+	}
+	return nil
 }
 
 func GetMetadataEntry(ztoc *Ztoc, text string) (*MetadataEntry, error) {
@@ -199,16 +279,17 @@ func ExtractFromTarGz(gz string, ztoc *Ztoc, text string) (string, error) {
 	cstr := C.CString(gz)
 	defer C.free(unsafe.Pointer(cstr))
 
-	index := C.blob_to_index(unsafe.Pointer(&ztoc.IndexByteData[0]))
-
-	if index == nil {
-		return "", fmt.Errorf("cannot convert blob to gzip_index")
+	zinfo, err := newGzipZinfo(ztoc.IndexByteData)
+	if err != nil {
+		return "", err
+	}
+	defer zinfo.Close()
+	if err := zinfo.loadWindow(entry.SpanStart); err != nil {
+		return "", err
 	}
-
-	defer C.free_index(index)
 
 	bytes := make([]byte, entry.UncompressedSize)
-	ret := C.extract_data(cstr, index, C.off_t(entry.UncompressedOffset), unsafe.Pointer(&bytes[0]), C.int(entry.UncompressedSize))
+	ret := C.extract_data(cstr, zinfo.index, C.off_t(entry.UncompressedOffset), unsafe.Pointer(&bytes[0]), C.int(entry.UncompressedSize))
 
 	if ret <= 0 {
 		return "", fmt.Errorf("unable to extract data; return code = %v", ret)
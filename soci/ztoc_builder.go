@@ -18,48 +18,109 @@ package soci
 
 // #cgo CFLAGS: -I${SRCDIR}/../c/
 // #cgo LDFLAGS: -L${SRCDIR}/../out -lindexer -lz
-// #include "indexer.h"
-// #include <stdlib.h>
-// #include <stdint.h>
 import "C"
 
 import (
 	"archive/tar"
 	"bytes"
-	"compress/gzip"
 	"encoding/gob"
 	"fmt"
 	"io"
 	"os"
-	"unsafe"
 
 	"github.com/klauspost/compress/zstd"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+// ZtocBuilderRevision identifies the ztocs built by this package. Ztocs are only reused for layers
+// indexed again if they were built by the same revision, so it must be bumped whenever a change makes
+// the builder produce different ztocs for the same layer and options.
+const ZtocBuilderRevision = "1"
+
+// BuildZtoc builds the ztoc of a gzip-compressed layer stored in gzipFile.
 func BuildZtoc(gzipFile string, span int64, cfg *buildConfig) (*Ztoc, error) {
-	if gzipFile == "" {
-		return nil, fmt.Errorf("need to provide gzip file")
+	return buildZtoc(gzipFile, span, CompressionGzip, cfg)
+}
+
+// BuildZtocFromReader builds the ztoc of a layer compressed with compressionAlgo, which is read from r.
+// The layer is read only once: the checkpoints, the metadata of the files and the digests of the spans
+// are all computed while it's streamed, so it doesn't need to be stored anywhere else first.
+func BuildZtocFromReader(r io.Reader, compressionAlgo string, span int64, opts ...BuildOption) (*Ztoc, error) {
+	var cfg buildConfig
+	for _, o := range opts {
+		if err := o(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	return buildZtocFromReader(r, span, compressionAlgo, &cfg)
+}
+
+// buildZtoc builds the ztoc of a layer compressed with compressionAlgo and stored in file.
+func buildZtoc(file string, span int64, compressionAlgo string, cfg *buildConfig) (*Ztoc, error) {
+	if file == "" {
+		return nil, fmt.Errorf("need to provide a compressed file")
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file for reading: %v", err)
+	}
+	defer f.Close()
+	return buildZtocFromReader(f, span, compressionAlgo, cfg)
+}
+
+func buildZtocFromReader(r io.Reader, span int64, compressionAlgo string, cfg *buildConfig) (*Ztoc, error) {
+	version := cfg.ztocVersion
+	if version == "" {
+		version = DefaultZtocVersion
+	}
+	if err := checkZtocVersionForCompression(version, compressionAlgo); err != nil {
+		return nil, err
 	}
 
-	index, indexData, err := getGzipIndexByteData(gzipFile, span)
+	digester := &spanDigester{r: r}
+	zb, err := newZinfoBuilder(compressionAlgo, digester, span, digester.checkpoint)
 	if err != nil {
 		return nil, err
 	}
-	defer C.free(unsafe.Pointer(index))
+	defer zb.Close()
 
-	fm, uncompressedFileSize, err := getGzipFileMetadata(gzipFile, index)
+	pt := &positionTrackerReader{r: zb}
+	fm, err := getFileMetadata(pt)
 	if err != nil {
 		return nil, err
 	}
+	// read what follows the end of the tar archive, so that the whole layer goes through the builder
+	if _, err := io.Copy(io.Discard, pt); err != nil {
+		return nil, fmt.Errorf("error uncompressing layer: %v", err)
+	}
+	uncompressedFileSize := pt.CurrentPos()
 
-	fs, err := getFileSize(gzipFile)
+	zinfo, err := zb.Zinfo()
 	if err != nil {
 		return nil, err
 	}
+	defer zinfo.Close()
 
-	digests, err := getPerSpanDigests(gzipFile, int64(fs), index)
+	// some compressed data, e.g. padding, may follow the end of the compressed stream
+	if _, err := io.Copy(io.Discard, digester); err != nil {
+		return nil, fmt.Errorf("error reading layer: %v", err)
+	}
+	digests, err := digester.finish()
+	if err != nil {
+		return nil, err
+	}
+	if len(digests) != int(zinfo.MaxSpanId())+1 {
+		return nil, fmt.Errorf("unexpected number of span digests; expected %d, got %d", zinfo.MaxSpanId()+1, len(digests))
+	}
+
+	for i := range fm {
+		fm[i].SpanStart = zinfo.UncompressedOffsetToSpanId(fm[i].UncompressedOffset)
+		fm[i].SpanEnd = zinfo.UncompressedOffsetToSpanId(fm[i].UncompressedOffset + fm[i].UncompressedSize)
+		fm[i].FirstSpanHasBits = zinfo.HasBits(fm[i].SpanStart)
+	}
+
+	indexData, err := zinfoBytes(zinfo, version)
 	if err != nil {
 		return nil, err
 	}
@@ -69,23 +130,36 @@ func BuildZtoc(gzipFile string, span int64, cfg *buildConfig) (*Ztoc, error) {
 	}
 
 	return &Ztoc{
-		Version:              "0.1",
+		Version:              version,
 		IndexByteData:        indexData,
 		Metadata:             fm,
-		CompressedFileSize:   fs,
+		CompressedFileSize:   digester.total,
 		UncompressedFileSize: uncompressedFileSize,
-		MaxSpanId:            SpanId(index.have) - 1,
+		MaxSpanId:            zinfo.MaxSpanId(),
 		BuildToolIdentifier:  cfg.buildToolIdentifier,
 		ZtocInfo:             ztocInfo,
+		CompressionAlgorithm: compressionAlgo,
 	}, nil
 }
 
+// NewZtocReader serializes the ztoc in the format of its version.
+// It returns the reader for the serialized ztoc and its descriptor.
 func NewZtocReader(ztoc *Ztoc) (io.Reader, ocispec.Descriptor, error) {
+	if err := checkZtocVersion(ztoc.Version); err != nil {
+		return nil, ocispec.Descriptor{}, err
+	}
+	if err := checkZtocVersionForCompression(ztoc.Version, ztoc.CompressionAlgorithm); err != nil {
+		return nil, ocispec.Descriptor{}, err
+	}
 	serializedBuf := new(bytes.Buffer)
-	enc := gob.NewEncoder(serializedBuf)
-	err := enc.Encode(*ztoc)
-	if err != nil {
-		return nil, ocispec.Descriptor{}, fmt.Errorf("cannot serialize ztoc: %v", err)
+	if ztoc.Version == ZtocVersionGob {
+		enc := gob.NewEncoder(serializedBuf)
+		err := enc.Encode(*ztoc)
+		if err != nil {
+			return nil, ocispec.Descriptor{}, fmt.Errorf("cannot serialize ztoc: %v", err)
+		}
+	} else {
+		serializedBuf.Write(marshalZtocProto(ztoc))
 	}
 
 	compressedBuf := new(bytes.Buffer)
@@ -111,89 +185,80 @@ func NewZtocReader(ztoc *Ztoc) (io.Reader, ocispec.Descriptor, error) {
 	}, nil
 }
 
-func getPerSpanDigests(gzipFile string, fileSize int64, index *C.struct_gzip_index) ([]digest.Digest, error) {
-	file, err := os.Open(gzipFile)
-	if err != nil {
-		return nil, fmt.Errorf("could not open file for reading: %v", err)
-	}
-	defer file.Close()
-
-	gzipPoints := unsafe.Slice(index.list, index.have)
-	var digests []digest.Digest
-
-	for i := 0; i < len(gzipPoints); i++ {
-		var (
-			startOffset = int64(gzipPoints[i].in)
-			endOffset   int64
-		)
-
-		if gzipPoints[i].bits != 0 {
-			startOffset -= 1
-		}
-
-		if i == len(gzipPoints)-1 {
-			endOffset = fileSize
-		} else {
-			endOffset = int64(gzipPoints[i+1].in)
-		}
+// spanDigesterLookahead is the amount of compressed data spanDigester keeps without digesting it, because
+// the next checkpoint may start in it. zinfoBuilders report checkpoints at most their input buffer behind
+// the data they have read, e.g. twice gzipBuilderBufferSize for gzip, so this is a generous bound.
+const spanDigesterLookahead = 1 << 20
+
+// spanDigester computes the digests of the compressed spans of a layer while the layer is read through it.
+// The compressed data of the current span is digested as it's read, except for the last spanDigesterLookahead
+// bytes: the span may end in them, which is only known once the zinfoBuilder reading from spanDigester
+// finds the next checkpoint.
+type spanDigester struct {
+	r        io.Reader
+	buf      []byte          // compressed data starting at bufStart, which hasn't been digested yet
+	bufStart FileSize        // offset of buf[0] in the layer
+	total    FileSize        // number of bytes read from r
+	digester digest.Digester // digester of the current span, nil until the first span starts
+	digests  []digest.Digest
+	err      error // error of a checkpoint in data which has been digested already
+}
 
-		section := io.NewSectionReader(file, startOffset, endOffset-startOffset)
-		dgst, err := digest.FromReader(section)
-		if err != nil {
-			return nil, fmt.Errorf("unable to compute digest for section; start=%d, end=%d, file=%s, size=%d", startOffset, endOffset, gzipFile, fileSize)
+func (d *spanDigester) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.buf = append(d.buf, p[:n]...)
+	d.total += FileSize(n)
+	if len(d.buf) > 2*spanDigesterLookahead {
+		// digest all but the lookahead, without copying the buffer on every read
+		consumed := len(d.buf) - spanDigesterLookahead
+		if d.digester != nil {
+			d.digester.Hash().Write(d.buf[:consumed])
 		}
-		digests = append(digests, dgst)
+		d.buf = append(d.buf[:0], d.buf[consumed:]...)
+		d.bufStart += FileSize(consumed)
+	}
+	if err == nil && d.err != nil {
+		err = d.err
 	}
-	return digests, nil
+	return n, err
 }
 
-func getGzipIndexByteData(gzipFile string, span int64) (*C.struct_gzip_index, []byte, error) {
-	cstr := C.CString(gzipFile)
-	defer C.free(unsafe.Pointer(cstr))
-
-	var index *C.struct_gzip_index
-
-	ret := C.generate_index(cstr, C.off_t(span), &index)
-
-	if int(ret) < 0 {
-		return nil, nil, fmt.Errorf("could not get index: %v", ret)
+// checkpoint is the checkpointFunc of the zinfoBuilder reading from d.
+func (d *spanDigester) checkpoint(start, prevEnd FileSize) {
+	if d.err != nil {
+		return
 	}
-
-	blobSize := C.get_blob_size(index)
-	bytes := make([]byte, uint64(blobSize))
-
-	if bytes == nil {
-		return nil, nil, fmt.Errorf("could not allocate byte array of size %d", blobSize)
+	if start < d.bufStart {
+		d.err = fmt.Errorf("span at compressed offset %d starts in data digested already, up to %d", start, d.bufStart)
+		return
 	}
-	ret = C.index_to_blob(index, unsafe.Pointer(&bytes[0]))
-
-	if int(ret) <= 0 {
-		return nil, nil, fmt.Errorf("could not serialize index to byte array; return code: %v", ret)
+	if d.digester != nil {
+		d.digester.Hash().Write(d.buf[:prevEnd-d.bufStart])
+		d.digests = append(d.digests, d.digester.Digest())
 	}
-
-	return index, bytes, nil
+	d.buf = append(d.buf[:0], d.buf[start-d.bufStart:]...)
+	d.bufStart = start
+	d.digester = digest.Canonical.Digester()
 }
 
-func getGzipFileMetadata(gzipFile string, index *C.struct_gzip_index) ([]FileMetadata, FileSize, error) {
-	file, err := os.Open(gzipFile)
-	if err != nil {
-		return nil, 0, fmt.Errorf("could not open file for reading: %v", err)
-	}
-	defer file.Close()
-
-	gzipRdr, err := gzip.NewReader(file)
-	if err != nil {
-		return nil, 0, fmt.Errorf("could not create gzip reader: %v", err)
+// finish digests the last span, which ends at the end of the layer, and returns the digests of all spans.
+func (d *spanDigester) finish() ([]digest.Digest, error) {
+	if d.err != nil {
+		return nil, d.err
 	}
-
-	f, sr, uncompressedFileSize, err := getTarReader(gzipRdr)
-
-	if err != nil {
-		return nil, 0, err
+	if d.digester != nil {
+		d.digester.Hash().Write(d.buf)
+		d.digests = append(d.digests, d.digester.Digest())
+		d.buf = nil
+		d.digester = nil
 	}
-	defer os.Remove(f.Name())
+	return d.digests, nil
+}
 
-	pt := &positionTrackerReader{r: sr}
+// getFileMetadata reads the tar archive from pt and returns the metadata of its files, including
+// the digests of the contents of regular files.
+// The spans of the files are not set, since they are only known once the whole layer is read.
+func getFileMetadata(pt *positionTrackerReader) ([]FileMetadata, error) {
 	tarRdr := tar.NewReader(pt)
 	var md []FileMetadata
 
@@ -203,33 +268,13 @@ func getGzipFileMetadata(gzipFile string, index *C.struct_gzip_index) ([]FileMet
 			if err == io.EOF {
 				break
 			} else {
-				return nil, 0, fmt.Errorf("error while reading tar header: %v", err)
+				return nil, fmt.Errorf("error while reading tar header: %v", err)
 			}
 		}
 
-		start := pt.CurrentPos()
-		end := pt.CurrentPos() + FileSize(hdr.Size)
-
-		var indexStart SpanId
-		var indexEnd SpanId
-
-		ret := C.span_indices_for_file(index, C.off_t(start), C.off_t(end), unsafe.Pointer(&indexStart), unsafe.Pointer(&indexEnd))
-
-		if int(ret) <= 0 {
-			return nil, 0, fmt.Errorf("cannot get the span indices for file with start and end offset: %d, %d; return code: %v", start, end, ret)
-		}
-
-		var hasBits bool
-		ret = C.has_bits(index, C.int(indexStart))
-		if ret == 0 {
-			hasBits = false
-		} else {
-			hasBits = true
-		}
-
 		fileType, err := getType(hdr)
 		if err != nil {
-			return nil, 0, err
+			return nil, err
 		}
 
 		metadataEntry := FileMetadata{
@@ -237,9 +282,6 @@ func getGzipFileMetadata(gzipFile string, index *C.struct_gzip_index) ([]FileMet
 			Type:               fileType,
 			UncompressedOffset: pt.CurrentPos(),
 			UncompressedSize:   FileSize(hdr.Size),
-			SpanStart:          indexStart,
-			SpanEnd:            indexEnd,
-			FirstSpanHasBits:   hasBits,
 			Linkname:           hdr.Linkname,
 			Mode:               hdr.Mode,
 			UID:                hdr.Uid,
@@ -251,41 +293,16 @@ func getGzipFileMetadata(gzipFile string, index *C.struct_gzip_index) ([]FileMet
 			Devminor:           hdr.Devminor,
 			Xattrs:             hdr.PAXRecords,
 		}
+		if hdr.Typeflag == tar.TypeReg {
+			digester := digest.Canonical.Digester()
+			if _, err := io.Copy(digester.Hash(), tarRdr); err != nil {
+				return nil, fmt.Errorf("error while reading the contents of %s: %v", hdr.Name, err)
+			}
+			metadataEntry.Digest = digester.Digest()
+		}
 		md = append(md, metadataEntry)
 	}
-	return md, uncompressedFileSize, nil
-}
-
-func getFileSize(file string) (FileSize, error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return 0, err
-	}
-	defer f.Close()
-	st, err := f.Stat()
-	if err != nil {
-		return 0, err
-	}
-	return FileSize(st.Size()), nil
-}
-
-func getTarReader(gzipReader io.Reader) (*os.File, *io.SectionReader, FileSize, error) {
-	file, err := os.CreateTemp("/tmp", "tempfile-ztoc-builder")
-	if err != nil {
-		return nil, nil, 0, err
-	}
-	_, err = io.Copy(file, gzipReader)
-	if err != nil {
-		os.Remove(file.Name())
-		return nil, nil, 0, err
-	}
-
-	tarRdr, uncompressedFileSize, err := tarSectionReaderFromFile(file)
-	if err != nil {
-		return nil, nil, 0, err
-	}
-
-	return file, tarRdr, uncompressedFileSize, nil
+	return md, nil
 }
 
 func getType(header *tar.Header) (fileType string, e error) {
@@ -310,25 +327,14 @@ func getType(header *tar.Header) (fileType string, e error) {
 	return
 }
 
-func tarSectionReaderFromFile(f *os.File) (*io.SectionReader, FileSize, error) {
-	st, err := f.Stat()
-	if err != nil {
-		return nil, 0, err
-	}
-
-	return io.NewSectionReader(f, 0, st.Size()), FileSize(st.Size()), nil
-}
-
 type positionTrackerReader struct {
-	r   io.ReaderAt
+	r   io.Reader
 	pos FileSize
 }
 
 func (p *positionTrackerReader) Read(b []byte) (int, error) {
-	n, err := p.r.ReadAt(b, int64(p.pos))
-	if err == nil {
-		p.pos += FileSize(n)
-	}
+	n, err := p.r.Read(b)
+	p.pos += FileSize(n)
 	return n, err
 }
 
@@ -18,6 +18,8 @@ package soci
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
 	"encoding/gob"
 	"fmt"
 	"io"
@@ -35,7 +37,9 @@ func GetZtocFromFile(filename string) (*Ztoc, error) {
 	return GetZtoc(reader)
 }
 
-// GetZtoc reads and returns the Ztoc
+// GetZtoc reads and returns the Ztoc.
+// Both protobuf ztocs and gob ztocs (version 0.1) are accepted. An error is returned
+// if the version of the ztoc isn't supported.
 func GetZtoc(reader io.Reader) (*Ztoc, error) {
 	zs, err := zstd.NewReader(reader)
 	if err != nil {
@@ -43,12 +47,37 @@ func GetZtoc(reader io.Reader) (*Ztoc, error) {
 	}
 	defer zs.Close()
 
-	decoder := gob.NewDecoder(zs)
-	ztoc := new(Ztoc)
-
-	if err := decoder.Decode(ztoc); err != nil {
+	br := bufio.NewReader(zs)
+	magic, err := br.Peek(len(ztocProtoMagic))
+	if err != nil && err != io.EOF {
 		return nil, fmt.Errorf("cannot decode ztoc: %w", err)
 	}
+
+	var ztoc *Ztoc
+	if bytes.Equal(magic, ztocProtoMagic) {
+		b, err := io.ReadAll(br)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode ztoc: %w", err)
+		}
+		ztoc, err = unmarshalZtocProto(b)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode ztoc: %w", err)
+		}
+		if ztoc.Version == ZtocVersionGob {
+			return nil, fmt.Errorf("%w: %q is not a protobuf ztoc version", ErrUnsupportedZtocVersion, ztoc.Version)
+		}
+	} else {
+		ztoc = new(Ztoc)
+		if err := gob.NewDecoder(br).Decode(ztoc); err != nil {
+			return nil, fmt.Errorf("cannot decode ztoc: %w", err)
+		}
+		if ztoc.Version != ZtocVersionGob {
+			return nil, fmt.Errorf("%w: %q is not a gob ztoc version", ErrUnsupportedZtocVersion, ztoc.Version)
+		}
+	}
+	if err := checkZtocVersion(ztoc.Version); err != nil {
+		return nil, err
+	}
 	return ztoc, nil
 }
 
@@ -0,0 +1,340 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// This file implements the protobuf encoding of ztocs described in ztoc.proto.
+// The messages are encoded by hand so no generated code is needed. Fields with
+// zero values are omitted and map entries are sorted by key, so the encoding is deterministic.
+
+// ztocProtoMagic starts protobuf-encoded ztocs. Its first byte can't start a gob stream,
+// which is how protobuf and gob ztocs are told apart.
+var ztocProtoMagic = []byte("\x89ZTOC")
+
+var errInvalidZtocProto = errors.New("invalid protobuf ztoc")
+
+// field numbers of the Ztoc message
+const (
+	ztocFieldVersion              protowire.Number = 1
+	ztocFieldBuildToolIdentifier  protowire.Number = 2
+	ztocFieldMetadata             protowire.Number = 3
+	ztocFieldCompressedFileSize   protowire.Number = 4
+	ztocFieldUncompressedFileSize protowire.Number = 5
+	ztocFieldMaxSpanId            protowire.Number = 6
+	ztocFieldSpanDigests          protowire.Number = 7
+	ztocFieldCheckpoints          protowire.Number = 8
+	ztocFieldCompressionAlgorithm protowire.Number = 9
+)
+
+// field numbers of the FileMetadata message
+const (
+	fileFieldName               protowire.Number = 1
+	fileFieldType               protowire.Number = 2
+	fileFieldUncompressedOffset protowire.Number = 3
+	fileFieldUncompressedSize   protowire.Number = 4
+	fileFieldSpanStart          protowire.Number = 5
+	fileFieldSpanEnd            protowire.Number = 6
+	fileFieldFirstSpanHasBits   protowire.Number = 7
+	fileFieldLinkname           protowire.Number = 8
+	fileFieldMode               protowire.Number = 9
+	fileFieldUID                protowire.Number = 10
+	fileFieldGID                protowire.Number = 11
+	fileFieldUname              protowire.Number = 12
+	fileFieldGname              protowire.Number = 13
+	fileFieldModTime            protowire.Number = 14
+	fileFieldDevmajor           protowire.Number = 15
+	fileFieldDevminor           protowire.Number = 16
+	fileFieldXattrs             protowire.Number = 17
+	fileFieldDigest             protowire.Number = 18
+)
+
+func marshalZtocProto(ztoc *Ztoc) []byte {
+	b := append([]byte{}, ztocProtoMagic...)
+	b = appendString(b, ztocFieldVersion, ztoc.Version)
+	b = appendString(b, ztocFieldBuildToolIdentifier, ztoc.BuildToolIdentifier)
+	for i := range ztoc.Metadata {
+		b = protowire.AppendTag(b, ztocFieldMetadata, protowire.BytesType)
+		b = protowire.AppendBytes(b, marshalFileMetadataProto(&ztoc.Metadata[i]))
+	}
+	b = appendInt(b, ztocFieldCompressedFileSize, int64(ztoc.CompressedFileSize))
+	b = appendInt(b, ztocFieldUncompressedFileSize, int64(ztoc.UncompressedFileSize))
+	b = appendInt(b, ztocFieldMaxSpanId, int64(ztoc.MaxSpanId))
+	for _, d := range ztoc.ZtocInfo.SpanDigests {
+		// repeated fields keep their empty elements
+		b = protowire.AppendTag(b, ztocFieldSpanDigests, protowire.BytesType)
+		b = protowire.AppendString(b, d.String())
+	}
+	if len(ztoc.IndexByteData) > 0 {
+		b = protowire.AppendTag(b, ztocFieldCheckpoints, protowire.BytesType)
+		b = protowire.AppendBytes(b, ztoc.IndexByteData)
+	}
+	b = appendString(b, ztocFieldCompressionAlgorithm, ztoc.CompressionAlgorithm)
+	return b
+}
+
+func marshalFileMetadataProto(m *FileMetadata) []byte {
+	var b []byte
+	b = appendString(b, fileFieldName, m.Name)
+	b = appendString(b, fileFieldType, m.Type)
+	b = appendInt(b, fileFieldUncompressedOffset, int64(m.UncompressedOffset))
+	b = appendInt(b, fileFieldUncompressedSize, int64(m.UncompressedSize))
+	b = appendInt(b, fileFieldSpanStart, int64(m.SpanStart))
+	b = appendInt(b, fileFieldSpanEnd, int64(m.SpanEnd))
+	if m.FirstSpanHasBits {
+		b = protowire.AppendTag(b, fileFieldFirstSpanHasBits, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	}
+	b = appendString(b, fileFieldLinkname, m.Linkname)
+	b = appendInt(b, fileFieldMode, m.Mode)
+	b = appendInt(b, fileFieldUID, int64(m.UID))
+	b = appendInt(b, fileFieldGID, int64(m.GID))
+	b = appendString(b, fileFieldUname, m.Uname)
+	b = appendString(b, fileFieldGname, m.Gname)
+	if !m.ModTime.IsZero() {
+		// google.protobuf.Timestamp
+		var ts []byte
+		ts = appendInt(ts, 1, m.ModTime.Unix())
+		ts = appendInt(ts, 2, int64(m.ModTime.Nanosecond()))
+		b = protowire.AppendTag(b, fileFieldModTime, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+	b = appendInt(b, fileFieldDevmajor, m.Devmajor)
+	b = appendInt(b, fileFieldDevminor, m.Devminor)
+	keys := make([]string, 0, len(m.Xattrs))
+	for k := range m.Xattrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		// map entries are messages with the key as field 1 and the value as field 2
+		entry := protowire.AppendTag(nil, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, m.Xattrs[k])
+		b = protowire.AppendTag(b, fileFieldXattrs, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	b = appendString(b, fileFieldDigest, m.Digest.String())
+	return b
+}
+
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+// appendInt appends an int32 or int64 field. Negative int32 values are sign extended
+// to 64 bits as in protobuf, so both types are encoded the same way.
+func appendInt(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+// unmarshalZtocProto decodes the protobuf ztoc `b`, which starts with ztocProtoMagic.
+// The version of the ztoc isn't checked.
+func unmarshalZtocProto(b []byte) (*Ztoc, error) {
+	ztoc := new(Ztoc)
+	err := consumeMessage(b[len(ztocProtoMagic):], func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == ztocFieldVersion && typ == protowire.BytesType:
+			return consumeString(b, &ztoc.Version)
+		case num == ztocFieldBuildToolIdentifier && typ == protowire.BytesType:
+			return consumeString(b, &ztoc.BuildToolIdentifier)
+		case num == ztocFieldMetadata && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			m, err := unmarshalFileMetadataProto(v)
+			if err != nil {
+				return 0, err
+			}
+			ztoc.Metadata = append(ztoc.Metadata, *m)
+			return n, nil
+		case num == ztocFieldCompressedFileSize && typ == protowire.VarintType:
+			return consumeInt(b, (*int64)(&ztoc.CompressedFileSize))
+		case num == ztocFieldUncompressedFileSize && typ == protowire.VarintType:
+			return consumeInt(b, (*int64)(&ztoc.UncompressedFileSize))
+		case num == ztocFieldMaxSpanId && typ == protowire.VarintType:
+			var v int64
+			n, err := consumeInt(b, &v)
+			ztoc.MaxSpanId = SpanId(v)
+			return n, err
+		case num == ztocFieldSpanDigests && typ == protowire.BytesType:
+			var d string
+			n, err := consumeString(b, &d)
+			ztoc.ZtocInfo.SpanDigests = append(ztoc.ZtocInfo.SpanDigests, digest.Digest(d))
+			return n, err
+		case num == ztocFieldCheckpoints && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			ztoc.IndexByteData = append([]byte{}, v...)
+			return n, nil
+		case num == ztocFieldCompressionAlgorithm && typ == protowire.BytesType:
+			return consumeString(b, &ztoc.CompressionAlgorithm)
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ztoc, nil
+}
+
+func unmarshalFileMetadataProto(b []byte) (*FileMetadata, error) {
+	m := new(FileMetadata)
+	err := consumeMessage(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		var v int64
+		switch {
+		case num == fileFieldName && typ == protowire.BytesType:
+			return consumeString(b, &m.Name)
+		case num == fileFieldType && typ == protowire.BytesType:
+			return consumeString(b, &m.Type)
+		case num == fileFieldUncompressedOffset && typ == protowire.VarintType:
+			return consumeInt(b, (*int64)(&m.UncompressedOffset))
+		case num == fileFieldUncompressedSize && typ == protowire.VarintType:
+			return consumeInt(b, (*int64)(&m.UncompressedSize))
+		case num == fileFieldSpanStart && typ == protowire.VarintType:
+			n, err := consumeInt(b, &v)
+			m.SpanStart = SpanId(v)
+			return n, err
+		case num == fileFieldSpanEnd && typ == protowire.VarintType:
+			n, err := consumeInt(b, &v)
+			m.SpanEnd = SpanId(v)
+			return n, err
+		case num == fileFieldFirstSpanHasBits && typ == protowire.VarintType:
+			n, err := consumeInt(b, &v)
+			m.FirstSpanHasBits = v != 0
+			return n, err
+		case num == fileFieldLinkname && typ == protowire.BytesType:
+			return consumeString(b, &m.Linkname)
+		case num == fileFieldMode && typ == protowire.VarintType:
+			return consumeInt(b, &m.Mode)
+		case num == fileFieldUID && typ == protowire.VarintType:
+			n, err := consumeInt(b, &v)
+			m.UID = int(v)
+			return n, err
+		case num == fileFieldGID && typ == protowire.VarintType:
+			n, err := consumeInt(b, &v)
+			m.GID = int(v)
+			return n, err
+		case num == fileFieldUname && typ == protowire.BytesType:
+			return consumeString(b, &m.Uname)
+		case num == fileFieldGname && typ == protowire.BytesType:
+			return consumeString(b, &m.Gname)
+		case num == fileFieldModTime && typ == protowire.BytesType:
+			ts, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			var sec, nsec int64
+			err := consumeMessage(ts, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+				switch {
+				case num == 1 && typ == protowire.VarintType:
+					return consumeInt(b, &sec)
+				case num == 2 && typ == protowire.VarintType:
+					return consumeInt(b, &nsec)
+				}
+				return protowire.ConsumeFieldValue(num, typ, b), nil
+			})
+			m.ModTime = time.Unix(sec, nsec).UTC()
+			return n, err
+		case num == fileFieldDevmajor && typ == protowire.VarintType:
+			return consumeInt(b, &m.Devmajor)
+		case num == fileFieldDevminor && typ == protowire.VarintType:
+			return consumeInt(b, &m.Devminor)
+		case num == fileFieldXattrs && typ == protowire.BytesType:
+			entry, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			var key, value string
+			err := consumeMessage(entry, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+				switch {
+				case num == 1 && typ == protowire.BytesType:
+					return consumeString(b, &key)
+				case num == 2 && typ == protowire.BytesType:
+					return consumeString(b, &value)
+				}
+				return protowire.ConsumeFieldValue(num, typ, b), nil
+			})
+			if m.Xattrs == nil {
+				m.Xattrs = make(map[string]string)
+			}
+			m.Xattrs[key] = value
+			return n, err
+		case num == fileFieldDigest && typ == protowire.BytesType:
+			var d string
+			n, err := consumeString(b, &d)
+			m.Digest = digest.Digest(d)
+			return n, err
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// consumeMessage calls consumeField for each field of the message `b`. consumeField is called with
+// the rest of the message after the tag of the field and returns the size of the field value.
+// Fields which aren't known must be skipped with protowire.ConsumeFieldValue.
+func consumeMessage(b []byte, consumeField func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("%w: %v", errInvalidZtocProto, protowire.ParseError(n))
+		}
+		b = b[n:]
+		n, err := consumeField(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("%w: field %d: %v", errInvalidZtocProto, num, protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func consumeString(b []byte, v *string) (int, error) {
+	s, n := protowire.ConsumeString(b)
+	*v = s
+	return n, nil
+}
+
+func consumeInt(b []byte, v *int64) (int, error) {
+	x, n := protowire.ConsumeVarint(b)
+	*v = int64(x)
+	return n, nil
+}
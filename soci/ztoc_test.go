@@ -17,7 +17,10 @@
 package soci
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"errors"
 	"io"
 	"math/rand"
 	"os"
@@ -26,7 +29,10 @@ import (
 	"sort"
 	"strconv"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	"github.com/awslabs/soci-snapshotter/util/testutil"
 	"github.com/opencontainers/go-digest"
 )
 
@@ -406,6 +412,445 @@ func TestZtocGeneration(t *testing.T) {
 
 }
 
+func TestZstdZtoc(t *testing.T) {
+	testcases := []struct {
+		name      string
+		frameSize int
+		spanSize  int64
+		minSpans  SpanId
+	}{
+		{
+			name:      "single frame",
+			frameSize: 1 << 30,
+			spanSize:  65535,
+			minSpans:  1,
+		},
+		{
+			name:      "frame size 64KiB, span size 64KiB",
+			frameSize: 1 << 16,
+			spanSize:  1 << 16,
+			minSpans:  10,
+		},
+		{
+			name:      "frame size 10kB, span size 100kB",
+			frameSize: 10000,
+			spanSize:  100000,
+			minSpans:  5,
+		},
+	}
+
+	fileContents := []fileContent{
+		{fileName: "file1", content: genRandomByteData(10)},
+		{fileName: "file2", content: genRandomByteData(500000)},
+		{fileName: "file3", content: genRandomByteData(88888)},
+		{fileName: "file4", content: genRandomByteData(250000)},
+	}
+	var tarEntries []testutil.TarEntry
+	for _, fc := range fileContents {
+		tarEntries = append(tarEntries, testutil.File(fc.fileName, string(fc.content)))
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ztoc, sr, err := BuildZstdZtocReader(tarEntries, tc.frameSize, tc.spanSize)
+			if err != nil {
+				t.Fatalf("can't build ztoc: %v", err)
+			}
+			if ztoc.CompressionAlgorithm != CompressionZstd {
+				t.Fatalf("unexpected compression algorithm; expected %s, got %s", CompressionZstd, ztoc.CompressionAlgorithm)
+			}
+			if ztoc.MaxSpanId+1 < tc.minSpans {
+				t.Fatalf("unexpected number of spans; expected at least %d, got %d", tc.minSpans, ztoc.MaxSpanId+1)
+			}
+			if len(ztoc.ZtocInfo.SpanDigests) != int(ztoc.MaxSpanId)+1 {
+				t.Fatalf("unexpected number of span digests; expected %d, got %d", ztoc.MaxSpanId+1, len(ztoc.ZtocInfo.SpanDigests))
+			}
+
+			for _, fc := range fileContents {
+				entry, err := GetMetadataEntry(ztoc, fc.fileName)
+				if err != nil {
+					t.Fatalf("could not find the metadata entry for the file %s: %v", fc.fileName, err)
+				}
+				extracted, err := ExtractFile(sr, &FileExtractConfig{
+					UncompressedSize:     entry.UncompressedSize,
+					UncompressedOffset:   entry.UncompressedOffset,
+					SpanStart:            entry.SpanStart,
+					SpanEnd:              entry.SpanEnd,
+					IndexByteData:        ztoc.IndexByteData,
+					CompressedFileSize:   ztoc.CompressedFileSize,
+					MaxSpanId:            ztoc.MaxSpanId,
+					CompressionAlgorithm: ztoc.CompressionAlgorithm,
+				})
+				if err != nil {
+					t.Fatalf("could not extract file %s: %v", fc.fileName, err)
+				}
+				if !bytes.Equal(extracted, fc.content) {
+					t.Fatalf("file %s: extracted bytes != original bytes", fc.fileName)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildZtocFromReader(t *testing.T) {
+	fileContents := []fileContent{
+		{fileName: "file1", content: genRandomByteData(10)},
+		{fileName: "file2", content: genRandomByteData(500000)},
+		{fileName: "file3", content: genRandomByteData(88888)},
+		{fileName: "empty", content: []byte{}},
+		{fileName: "file4", content: genRandomByteData(250000)},
+	}
+	var tarEntries []testutil.TarEntry
+	for _, fc := range fileContents {
+		tarEntries = append(tarEntries, testutil.File(fc.fileName, string(fc.content)))
+	}
+
+	testcases := []struct {
+		name            string
+		compressionAlgo string
+		layer           io.Reader
+	}{
+		{
+			name:            "gzip",
+			compressionAlgo: CompressionGzip,
+			layer:           testutil.BuildTarGz(tarEntries, gzip.DefaultCompression),
+		},
+		{
+			name:            "zstd",
+			compressionAlgo: CompressionZstd,
+			layer:           testutil.BuildTarZstd(tarEntries, 1<<16),
+		},
+		{
+			name:            "uncompressed",
+			compressionAlgo: CompressionUncompressed,
+			layer:           testutil.BuildTar(tarEntries),
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			layer, err := io.ReadAll(tc.layer)
+			if err != nil {
+				t.Fatalf("can't build layer: %v", err)
+			}
+			// short reads make the checkpoints fall in the middle of the data read from the layer
+			ztoc, err := BuildZtocFromReader(iotest.HalfReader(bytes.NewReader(layer)), tc.compressionAlgo, 1<<16)
+			if err != nil {
+				t.Fatalf("can't build ztoc: %v", err)
+			}
+			if ztoc.CompressedFileSize != FileSize(len(layer)) {
+				t.Fatalf("unexpected compressed file size; expected %d, got %d", len(layer), ztoc.CompressedFileSize)
+			}
+			if ztoc.MaxSpanId < 5 {
+				t.Fatalf("unexpected number of spans; expected at least 6, got %d", ztoc.MaxSpanId+1)
+			}
+
+			zinfo, err := ztoc.Zinfo()
+			if err != nil {
+				t.Fatalf("can't read checkpoints: %v", err)
+			}
+			defer zinfo.Close()
+			if len(ztoc.ZtocInfo.SpanDigests) != int(ztoc.MaxSpanId)+1 {
+				t.Fatalf("unexpected number of span digests; expected %d, got %d", ztoc.MaxSpanId+1, len(ztoc.ZtocInfo.SpanDigests))
+			}
+			for i, dgst := range ztoc.ZtocInfo.SpanDigests {
+				start := zinfo.StartCompressedOffset(SpanId(i))
+				end := zinfo.EndCompressedOffset(SpanId(i), ztoc.CompressedFileSize)
+				if expected := digest.FromBytes(layer[start:end]); dgst != expected {
+					t.Fatalf("unexpected digest of span %d; expected %v, got %v", i, expected, dgst)
+				}
+			}
+
+			sr := io.NewSectionReader(bytes.NewReader(layer), 0, int64(len(layer)))
+			for _, fc := range fileContents {
+				entry, err := GetMetadataEntry(ztoc, fc.fileName)
+				if err != nil {
+					t.Fatalf("could not find the metadata entry for the file %s: %v", fc.fileName, err)
+				}
+				extracted, err := ExtractFile(sr, &FileExtractConfig{
+					UncompressedSize:     entry.UncompressedSize,
+					UncompressedOffset:   entry.UncompressedOffset,
+					SpanStart:            entry.SpanStart,
+					SpanEnd:              entry.SpanEnd,
+					IndexByteData:        ztoc.IndexByteData,
+					CompressedFileSize:   ztoc.CompressedFileSize,
+					MaxSpanId:            ztoc.MaxSpanId,
+					CompressionAlgorithm: ztoc.CompressionAlgorithm,
+				})
+				if err != nil {
+					t.Fatalf("could not extract file %s: %v", fc.fileName, err)
+				}
+				if !bytes.Equal(extracted, fc.content) {
+					t.Fatalf("file %s: extracted bytes != original bytes", fc.fileName)
+				}
+			}
+
+			contents := make(map[string][]byte)
+			for _, fc := range fileContents {
+				contents[fc.fileName] = fc.content
+			}
+			for _, md := range ztoc.Metadata {
+				if md.Type != "reg" {
+					continue
+				}
+				if expected := digest.FromBytes(contents[md.Name]); md.Digest != expected {
+					t.Fatalf("unexpected digest of file %s; expected %v, got %v", md.Name, expected, md.Digest)
+				}
+			}
+		})
+	}
+}
+
+func TestSpanDigester(t *testing.T) {
+	// e.g. a zstd layer with a single frame, whose only span is the whole layer
+	data := genRandomByteData(8 << 20)
+	d := &spanDigester{r: bytes.NewReader(data)}
+	d.checkpoint(0, 0)
+	buf := make([]byte, 32<<10)
+	maxBuf := 0
+	for {
+		_, err := d.Read(buf)
+		if len(d.buf) > maxBuf {
+			maxBuf = len(d.buf)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		if d.total == FileSize(len(data)/2) {
+			// a checkpoint behind the data read, with gzip's overlapping byte
+			d.checkpoint(d.total-1000, d.total-999)
+		}
+	}
+	if maxBuf > 2*spanDigesterLookahead+len(buf) {
+		t.Fatalf("unexpected size of the undigested data; expected at most %d, got %d", 2*spanDigesterLookahead+len(buf), maxBuf)
+	}
+	digests, err := d.finish()
+	if err != nil {
+		t.Fatalf("failed to digest spans: %v", err)
+	}
+	half := len(data) / 2
+	expected := []digest.Digest{digest.FromBytes(data[:half-999]), digest.FromBytes(data[half-1000:])}
+	if !reflect.DeepEqual(digests, expected) {
+		t.Fatalf("unexpected span digests; expected %v, got %v", expected, digests)
+	}
+
+	// a checkpoint in data digested already
+	d = &spanDigester{r: bytes.NewReader(data)}
+	d.checkpoint(0, 0)
+	if _, err := io.Copy(io.Discard, d); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	d.checkpoint(1000, 1000)
+	if _, err := d.finish(); err == nil {
+		t.Fatalf("expected an error for a checkpoint in data digested already")
+	}
+}
+
+func TestBuildZtocFromReaderTruncated(t *testing.T) {
+	tarEntries := []testutil.TarEntry{
+		testutil.File("file1", string(genRandomByteData(100000))),
+	}
+	for _, tc := range []struct {
+		compressionAlgo string
+		layer           io.Reader
+	}{
+		{CompressionGzip, testutil.BuildTarGz(tarEntries, gzip.DefaultCompression)},
+		{CompressionZstd, testutil.BuildTarZstd(tarEntries, 1<<16)},
+	} {
+		layer, err := io.ReadAll(tc.layer)
+		if err != nil {
+			t.Fatalf("can't build layer: %v", err)
+		}
+		truncated := bytes.NewReader(layer[:len(layer)/2])
+		if _, err := BuildZtocFromReader(truncated, tc.compressionAlgo, 1<<16); err == nil {
+			t.Fatalf("%s: built ztoc of a truncated layer", tc.compressionAlgo)
+		}
+	}
+}
+
+func TestBuildGobZtocOfNonGzipLayer(t *testing.T) {
+	tarEntries := []testutil.TarEntry{
+		testutil.File("file1", string(genRandomByteData(100000))),
+	}
+	for _, tc := range []struct {
+		compressionAlgo string
+		layer           io.Reader
+	}{
+		{CompressionZstd, testutil.BuildTarZstd(tarEntries, 1<<16)},
+		{CompressionUncompressed, testutil.BuildTar(tarEntries)},
+	} {
+		_, err := BuildZtocFromReader(tc.layer, tc.compressionAlgo, 1<<16, WithZtocVersion(ZtocVersionGob))
+		if !errors.Is(err, ErrUnsupportedZtocVersion) {
+			t.Fatalf("%s: unexpected error; expected %v, got %v", tc.compressionAlgo, ErrUnsupportedZtocVersion, err)
+		}
+	}
+
+	ztoc, _, err := BuildZtocReader(tarEntries, gzip.DefaultCompression, 1<<16)
+	if err != nil {
+		t.Fatalf("can't build ztoc: %v", err)
+	}
+	ztoc.Version = ZtocVersionGob
+	ztoc.CompressionAlgorithm = CompressionZstd
+	if _, _, err := NewZtocReader(ztoc); !errors.Is(err, ErrUnsupportedZtocVersion) {
+		t.Fatalf("unexpected error serializing a gob ztoc of a zstd layer; expected %v, got %v", ErrUnsupportedZtocVersion, err)
+	}
+}
+
+func TestZtocCompactCheckpoints(t *testing.T) {
+	words := []string{"lorem", "ipsum", "dolor", "sit", "amet", "consectetur", "adipiscing", "elit"}
+	var text bytes.Buffer
+	for text.Len() < 1000000 {
+		text.WriteString(words[rand.Intn(len(words))])
+		text.WriteByte(' ')
+	}
+
+	testcases := []struct {
+		name       string
+		content    []byte
+		maxWindows int // the maximum number of distinct windows, or -1 if some windows are needed
+	}{
+		{
+			name:       "compressible data needs windows",
+			content:    text.Bytes(),
+			maxWindows: -1,
+		},
+		{
+			name:       "stored blocks don't need windows",
+			content:    genRandomByteData(1000000),
+			maxWindows: 0,
+		},
+		{
+			name:       "identical windows are stored once",
+			content:    make([]byte, 1000000),
+			maxWindows: 1,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			layer, err := buildFlushedTarGz("file1", tc.content, 1<<16)
+			if err != nil {
+				t.Fatalf("can't build layer: %v", err)
+			}
+			legacy, err := BuildZtocFromReader(bytes.NewReader(layer), CompressionGzip, 1<<16, WithZtocVersion(ZtocVersionProto))
+			if err != nil {
+				t.Fatalf("can't build ztoc: %v", err)
+			}
+			compact, err := BuildZtocFromReader(bytes.NewReader(layer), CompressionGzip, 1<<16, WithZtocVersion(ZtocVersionCompactCheckpoints))
+			if err != nil {
+				t.Fatalf("can't build ztoc: %v", err)
+			}
+			if compact.MaxSpanId != legacy.MaxSpanId || compact.MaxSpanId < 2 {
+				t.Fatalf("unexpected number of spans; expected %d, got %d", legacy.MaxSpanId+1, compact.MaxSpanId+1)
+			}
+
+			size, uncompressedSize, err := compact.CheckpointsSize()
+			if err != nil {
+				t.Fatalf("can't get the size of the checkpoints: %v", err)
+			}
+			if size != int64(len(compact.IndexByteData)) || uncompressedSize != int64(len(legacy.IndexByteData)) {
+				t.Fatalf("unexpected checkpoints size; expected %d and %d, got %d and %d", len(compact.IndexByteData), len(legacy.IndexByteData), size, uncompressedSize)
+			}
+			if size >= uncompressedSize {
+				t.Fatalf("compact checkpoints aren't smaller; %d bytes instead of %d", size, uncompressedSize)
+			}
+
+			zinfo, err := newGzipZinfo(compact.IndexByteData)
+			if err != nil {
+				t.Fatalf("can't read compact checkpoints: %v", err)
+			}
+			defer zinfo.Close()
+			if tc.maxWindows >= 0 && len(zinfo.windows) > tc.maxWindows {
+				t.Fatalf("unexpected number of windows; expected at most %d, got %d", tc.maxWindows, len(zinfo.windows))
+			}
+			if tc.maxWindows < 0 && len(zinfo.windows) == 0 {
+				t.Fatalf("no windows kept for compressible data")
+			}
+
+			// windows are only uncompressed for the spans which are extracted
+			spanId := compact.MaxSpanId / 2
+			start := zinfo.StartCompressedOffset(spanId)
+			end := zinfo.EndCompressedOffset(spanId, compact.CompressedFileSize)
+			offset := zinfo.StartUncompressedOffset(spanId)
+			extracted, err := zinfo.ExtractDataFromBuffer(layer[start:end], 1000, offset, spanId)
+			if err != nil {
+				t.Fatalf("can't extract span %d: %v", spanId, err)
+			}
+			for id, loaded := range zinfo.loaded {
+				if loaded != (SpanId(id) == spanId) {
+					t.Fatalf("unexpected state of the window of span %d; loaded: %v", id, loaded)
+				}
+			}
+			fileOffset := offset - compact.Metadata[0].UncompressedOffset
+			if !bytes.Equal(extracted, tc.content[fileOffset:fileOffset+1000]) {
+				t.Fatalf("extracted bytes of span %d != original bytes", spanId)
+			}
+
+			// all windows are uncompressed when the checkpoints are serialized as before
+			legacyBytes, err := zinfo.Bytes()
+			if err != nil {
+				t.Fatalf("can't serialize checkpoints: %v", err)
+			}
+			if int64(len(legacyBytes)) != uncompressedSize {
+				t.Fatalf("unexpected size of serialized checkpoints; expected %d, got %d", uncompressedSize, len(legacyBytes))
+			}
+
+			sr := io.NewSectionReader(bytes.NewReader(layer), 0, int64(len(layer)))
+			entry := compact.Metadata[0]
+			extracted, err = ExtractFile(sr, &FileExtractConfig{
+				UncompressedSize:     entry.UncompressedSize,
+				UncompressedOffset:   entry.UncompressedOffset,
+				SpanStart:            entry.SpanStart,
+				SpanEnd:              entry.SpanEnd,
+				IndexByteData:        compact.IndexByteData,
+				CompressedFileSize:   compact.CompressedFileSize,
+				MaxSpanId:            compact.MaxSpanId,
+				CompressionAlgorithm: compact.CompressionAlgorithm,
+			})
+			if err != nil {
+				t.Fatalf("could not extract file: %v", err)
+			}
+			if !bytes.Equal(extracted, tc.content) {
+				t.Fatalf("extracted bytes != original bytes")
+			}
+		})
+	}
+}
+
+// buildFlushedTarGz builds a gzip-compressed tar with a single file, whose compressed data is flushed
+// every `flushSize` bytes of content, so that a deflate block ends at least every `flushSize` bytes.
+func buildFlushedTarGz(name string, content []byte, flushSize int) ([]byte, error) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}); err != nil {
+		return nil, err
+	}
+	for len(content) > 0 {
+		n := flushSize
+		if n > len(content) {
+			n = len(content)
+		}
+		if _, err := tw.Write(content[:n]); err != nil {
+			return nil, err
+		}
+		if err := gw.Flush(); err != nil {
+			return nil, err
+		}
+		content = content[n:]
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func TestWriteZtoc(t *testing.T) {
 	testCases := []struct {
 		name                 string
@@ -428,8 +873,20 @@ func TestWriteZtoc(t *testing.T) {
 			uncompressedFileSize: 2500000,
 			maxSpanID:            3,
 			buildTool:            "AWS SOCI CLI",
-			expDigest:            "sha256:4a2322b19c52ff5756b07bbc301e19ca9e95df6c017ababc7690bec03c3c8f25",
-			expSize:              455,
+			expDigest:            "sha256:b564a7732d758881dd32de0ab29019302af145a76e9a0e0b5fcc88961e1d7be1",
+			expSize:              475,
+		},
+		{
+			name:                 "success write protobuf ztoc succeeds - same digest and size",
+			version:              "0.2",
+			indexByteData:        make([]byte, 1<<16),
+			metadata:             make([]FileMetadata, 2),
+			compressedFileSize:   2000000,
+			uncompressedFileSize: 2500000,
+			maxSpanID:            3,
+			buildTool:            "AWS SOCI CLI",
+			expDigest:            "sha256:05cacaff910802f32a96dd66cd58acb9871f269f65adbf4b40919d2c28cb6573",
+			expSize:              79,
 		},
 	}
 
@@ -461,6 +918,87 @@ func TestWriteZtoc(t *testing.T) {
 	}
 }
 
+func TestZtocSerialization(t *testing.T) {
+	tarEntries := []testutil.TarEntry{
+		testutil.Dir("dir/", testutil.WithDirXattrs(map[string]string{"testkey": "testval", "otherkey": ""})),
+		testutil.File("dir/file1", string(genRandomByteData(100000)), testutil.WithFileModTime(time.Unix(1664387000, 123))),
+		testutil.Symlink("link", "dir/file1"),
+	}
+	ztoc, _, err := BuildZtocReader(tarEntries, gzip.DefaultCompression, 1<<14)
+	if err != nil {
+		t.Fatalf("can't build ztoc: %v", err)
+	}
+
+	for _, version := range []string{ZtocVersionGob, ZtocVersionProto, ZtocVersionCompactCheckpoints} {
+		t.Run(version, func(t *testing.T) {
+			ztoc.Version = version
+			r, _, err := NewZtocReader(ztoc)
+			if err != nil {
+				t.Fatalf("can't serialize ztoc: %v", err)
+			}
+			decoded, err := GetZtoc(r)
+			if err != nil {
+				t.Fatalf("can't deserialize ztoc: %v", err)
+			}
+			if len(decoded.Metadata) != len(ztoc.Metadata) {
+				t.Fatalf("unexpected number of files; expected %d, got %d", len(ztoc.Metadata), len(decoded.Metadata))
+			}
+			// the time zone of the modification times isn't kept by all versions
+			for i := range decoded.Metadata {
+				if !decoded.Metadata[i].ModTime.Equal(ztoc.Metadata[i].ModTime) {
+					t.Fatalf("unexpected modification time of %s; expected %v, got %v", ztoc.Metadata[i].Name, ztoc.Metadata[i].ModTime, decoded.Metadata[i].ModTime)
+				}
+				decoded.Metadata[i].ModTime = ztoc.Metadata[i].ModTime
+			}
+			if !reflect.DeepEqual(decoded, ztoc) {
+				t.Fatalf("deserialized ztoc is different; expected %+v, got %+v", ztoc, decoded)
+			}
+		})
+	}
+
+	t.Run("unsupported version", func(t *testing.T) {
+		ztoc.Version = "9.9"
+		if _, _, err := NewZtocReader(ztoc); !errors.Is(err, ErrUnsupportedZtocVersion) {
+			t.Fatalf("unexpected error; expected %v, got %v", ErrUnsupportedZtocVersion, err)
+		}
+	})
+}
+
+func TestExtractFileByName(t *testing.T) {
+	contents := genRandomByteData(100000)
+	tarEntries := []testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("dir/file1", string(contents)),
+		testutil.Symlink("link", "dir/file1"),
+		testutil.Symlink("loop1", "loop2"),
+		testutil.Symlink("loop2", "loop1"),
+	}
+	ztoc, sr, err := BuildZtocReader(tarEntries, gzip.DefaultCompression, 1<<14)
+	if err != nil {
+		t.Fatalf("can't build ztoc: %v", err)
+	}
+
+	for _, name := range []string{"dir/file1", "link"} {
+		extracted, err := ExtractFileByName(sr, ztoc, name)
+		if err != nil {
+			t.Fatalf("can't extract %s: %v", name, err)
+		}
+		if !bytes.Equal(extracted, contents) {
+			t.Fatalf("unexpected contents of %s", name)
+		}
+	}
+	for _, name := range []string{"missing", "loop1"} {
+		if _, err := ExtractFileByName(sr, ztoc, name); err == nil {
+			t.Fatalf("extracting %s should fail", name)
+		}
+	}
+
+	ztoc.Metadata[1].Digest = digest.FromString("corrupted")
+	if _, err := ExtractFileByName(sr, ztoc, "dir/file1"); err == nil {
+		t.Fatalf("extracting a file with a wrong digest should fail")
+	}
+}
+
 func genRandomByteData(size int) []byte {
 	b := make([]byte, size)
 	rand.Read(b)
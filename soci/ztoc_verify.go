@@ -0,0 +1,308 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+// ZtocMismatch is a difference between a ztoc and its layer, found by VerifyZtoc.
+type ZtocMismatch struct {
+	// Subject is the part of the ztoc which doesn't match the layer, e.g. "span 3" or "file etc/hosts".
+	Subject string
+	// Reason describes the difference.
+	Reason string
+}
+
+func (m ZtocMismatch) String() string {
+	return fmt.Sprintf("%s: %s", m.Subject, m.Reason)
+}
+
+// VerifyZtoc checks that the ztoc matches the layer `r`. The digests of the spans are recomputed,
+// and every file of the ztoc is compared with the layer read as a stream, including the contents
+// of regular files extracted through the ztoc. Each span is uncompressed only once.
+// It returns the differences found, or an error if the layer can't be read.
+func VerifyZtoc(ztoc *Ztoc, r *io.SectionReader) ([]ZtocMismatch, error) {
+	if FileSize(r.Size()) != ztoc.CompressedFileSize {
+		// the offsets of the ztoc are meaningless in a layer of another size
+		return []ZtocMismatch{{
+			Subject: "layer",
+			Reason:  fmt.Sprintf("size is %d, but the ztoc expects %d", r.Size(), ztoc.CompressedFileSize),
+		}}, nil
+	}
+	zinfo, err := NewZinfo(ztoc.CompressionAlgorithm, ztoc.IndexByteData)
+	if err != nil {
+		return nil, err
+	}
+	defer zinfo.Close()
+
+	mismatches, err := verifySpanDigests(ztoc, zinfo, r)
+	if err != nil {
+		return nil, err
+	}
+	fileMismatches, err := verifyFiles(ztoc, zinfo, r)
+	if err != nil {
+		return nil, err
+	}
+	return append(mismatches, fileMismatches...), nil
+}
+
+func verifySpanDigests(ztoc *Ztoc, zinfo Zinfo, r *io.SectionReader) ([]ZtocMismatch, error) {
+	if len(ztoc.ZtocInfo.SpanDigests) != int(ztoc.MaxSpanId)+1 {
+		return []ZtocMismatch{{
+			Subject: "spans",
+			Reason:  fmt.Sprintf("%d span digests for %d spans", len(ztoc.ZtocInfo.SpanDigests), ztoc.MaxSpanId+1),
+		}}, nil
+	}
+
+	var mismatches []ZtocMismatch
+	var id SpanId
+	for id = 0; id <= ztoc.MaxSpanId; id++ {
+		start := zinfo.StartCompressedOffset(id)
+		end := zinfo.EndCompressedOffset(id, ztoc.CompressedFileSize)
+		buf := make([]byte, end-start)
+		if _, err := r.ReadAt(buf, int64(start)); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("cannot read span %d: %w", id, err)
+		}
+		// the span digests of eStargz layers are the digests of the uncompressed chunks
+		if ztoc.CompressionAlgorithm == CompressionEstargz {
+			uncompStart := zinfo.StartUncompressedOffset(id)
+			uncompEnd := zinfo.EndUncompressedOffset(id, ztoc.UncompressedFileSize)
+			var err error
+			buf, err = zinfo.ExtractDataFromBuffer(buf, uncompEnd-uncompStart, uncompStart, id)
+			if err != nil {
+				mismatches = append(mismatches, ZtocMismatch{
+					Subject: fmt.Sprintf("span %d", id),
+					Reason:  fmt.Sprintf("cannot uncompress: %v", err),
+				})
+				continue
+			}
+		}
+		if actual := digest.FromBytes(buf); actual != ztoc.ZtocInfo.SpanDigests[id] {
+			mismatches = append(mismatches, ZtocMismatch{
+				Subject: fmt.Sprintf("span %d", id),
+				Reason:  fmt.Sprintf("digest is %s, but the ztoc expects %s", actual, ztoc.ZtocInfo.SpanDigests[id]),
+			})
+		}
+	}
+	return mismatches, nil
+}
+
+// verifyFiles compares the files of the ztoc with the files of the layer read as a stream.
+func verifyFiles(ztoc *Ztoc, zinfo Zinfo, r *io.SectionReader) ([]ZtocMismatch, error) {
+	ur, err := newLayerDecompressor(ztoc.CompressionAlgorithm, io.NewSectionReader(r, 0, r.Size()))
+	if err != nil {
+		return nil, err
+	}
+	defer ur.Close()
+
+	// files of the ztoc by name, in order; a name may appear more than once in a tar archive
+	files := make(map[string][]*FileMetadata)
+	for i := range ztoc.Metadata {
+		md := &ztoc.Metadata[i]
+		files[md.Name] = append(files[md.Name], md)
+	}
+
+	spans := &spanExtractor{
+		zinfo:                zinfo,
+		r:                    r,
+		maxSpanId:            ztoc.MaxSpanId,
+		compressedFileSize:   ztoc.CompressedFileSize,
+		uncompressedFileSize: ztoc.UncompressedFileSize,
+	}
+
+	var mismatches []ZtocMismatch
+	pt := &positionTrackerReader{r: ur}
+	tr := tar.NewReader(pt)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error while reading tar header: %w", err)
+		}
+		offset := pt.CurrentPos()
+		candidates := files[hdr.Name]
+		if len(candidates) == 0 {
+			// the TOC of eStargz layers is a file of the layer, but not of the ztoc
+			if !(ztoc.CompressionAlgorithm == CompressionEstargz && hdr.Name == estargzTOCName) {
+				mismatches = append(mismatches, ZtocMismatch{Subject: "file " + hdr.Name, Reason: "missing from the ztoc"})
+			}
+			continue
+		}
+		md := candidates[0]
+		files[hdr.Name] = candidates[1:]
+
+		var reasons []string
+		fileType, err := getType(hdr)
+		if err != nil {
+			return nil, err
+		}
+		if md.Type != fileType {
+			reasons = append(reasons, fmt.Sprintf("type is %s, but the ztoc has %s", fileType, md.Type))
+		}
+		if md.UncompressedSize != FileSize(hdr.Size) {
+			reasons = append(reasons, fmt.Sprintf("size is %d, but the ztoc has %d", hdr.Size, md.UncompressedSize))
+		}
+		// the offsets of eStargz ztocs are offsets in the uncompressed chunks, not in the tar archive
+		if ztoc.CompressionAlgorithm != CompressionEstargz && md.UncompressedOffset != offset {
+			reasons = append(reasons, fmt.Sprintf("offset is %d, but the ztoc has %d", offset, md.UncompressedOffset))
+		}
+		if md.Linkname != hdr.Linkname {
+			reasons = append(reasons, fmt.Sprintf("link is %q, but the ztoc has %q", hdr.Linkname, md.Linkname))
+		}
+		if md.Mode != hdr.Mode || md.UID != hdr.Uid || md.GID != hdr.Gid {
+			reasons = append(reasons, fmt.Sprintf("mode and owner are %o %d:%d, but the ztoc has %o %d:%d", hdr.Mode, hdr.Uid, hdr.Gid, md.Mode, md.UID, md.GID))
+		}
+		if hdr.Typeflag == tar.TypeReg && len(reasons) == 0 {
+			reason, err := verifyFileContents(md, tr, spans)
+			if err != nil {
+				return nil, err
+			}
+			if reason != "" {
+				reasons = append(reasons, reason)
+			}
+		}
+		for _, reason := range reasons {
+			mismatches = append(mismatches, ZtocMismatch{Subject: "file " + hdr.Name, Reason: reason})
+		}
+	}
+	for i := range ztoc.Metadata {
+		md := &ztoc.Metadata[i]
+		for _, missing := range files[md.Name] {
+			if missing == md {
+				mismatches = append(mismatches, ZtocMismatch{Subject: "file " + md.Name, Reason: "missing from the layer"})
+			}
+		}
+	}
+	return mismatches, nil
+}
+
+// verifyFileContents compares the contents of a regular file read from the tar stream `tr` with
+// its contents extracted through the ztoc by `spans`, and with its digest in the ztoc.
+// It returns the difference found, if any.
+func verifyFileContents(md *FileMetadata, tr io.Reader, spans *spanExtractor) (string, error) {
+	digester := digest.Canonical.Digester()
+	if _, err := io.Copy(digester.Hash(), tr); err != nil {
+		return "", fmt.Errorf("error while reading the contents of %s: %w", md.Name, err)
+	}
+	actual := digester.Digest()
+	if md.Digest != "" && md.Digest != actual {
+		return fmt.Sprintf("digest is %s, but the ztoc has %s", actual, md.Digest), nil
+	}
+	extracted, err := spans.digestFile(md)
+	if err != nil {
+		return fmt.Sprintf("cannot extract through the ztoc: %v", err), nil
+	}
+	if extracted != actual {
+		return fmt.Sprintf("contents extracted through the ztoc have digest %s, but the layer has %s", extracted, actual), nil
+	}
+	return "", nil
+}
+
+// spanExtractor uncompresses the spans of a layer through its ztoc. Only the last span uncompressed
+// is kept, so when files are requested in the order of the layer, every span is uncompressed once,
+// however many files it holds.
+type spanExtractor struct {
+	zinfo                Zinfo
+	r                    *io.SectionReader
+	maxSpanId            SpanId
+	compressedFileSize   FileSize
+	uncompressedFileSize FileSize
+
+	// the last span uncompressed, and the uncompressed offset where it starts
+	id    SpanId
+	data  []byte
+	start FileSize
+}
+
+// span returns the uncompressed contents of the span `id` and the uncompressed offset where it starts.
+func (e *spanExtractor) span(id SpanId) ([]byte, FileSize, error) {
+	if e.data != nil && e.id == id {
+		return e.data, e.start, nil
+	}
+	if id < 0 || id > e.maxSpanId {
+		return nil, 0, fmt.Errorf("span %d doesn't exist", id)
+	}
+	start := e.zinfo.StartCompressedOffset(id)
+	end := e.zinfo.EndCompressedOffset(id, e.compressedFileSize)
+	buf := make([]byte, end-start)
+	if _, err := e.r.ReadAt(buf, int64(start)); err != nil && err != io.EOF {
+		return nil, 0, fmt.Errorf("cannot read span %d: %w", id, err)
+	}
+	uncompStart := e.zinfo.StartUncompressedOffset(id)
+	uncompEnd := e.zinfo.EndUncompressedOffset(id, e.uncompressedFileSize)
+	data, err := e.zinfo.ExtractDataFromBuffer(buf, uncompEnd-uncompStart, uncompStart, id)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot uncompress span %d: %w", id, err)
+	}
+	e.id, e.data, e.start = id, data, uncompStart
+	return data, uncompStart, nil
+}
+
+// digestFile returns the digest of the contents of a regular file, extracted from the spans
+// which the ztoc records for it.
+func (e *spanExtractor) digestFile(md *FileMetadata) (digest.Digest, error) {
+	digester := digest.Canonical.Digester()
+	offset := md.UncompressedOffset
+	end := md.UncompressedOffset + md.UncompressedSize
+	for id := md.SpanStart; offset < end; id++ {
+		if id > md.SpanEnd {
+			return "", fmt.Errorf("spans %d to %d end before offset %d", md.SpanStart, md.SpanEnd, offset)
+		}
+		data, start, err := e.span(id)
+		if err != nil {
+			return "", err
+		}
+		if offset < start || offset >= start+FileSize(len(data)) {
+			return "", fmt.Errorf("span %d doesn't hold offset %d", id, offset)
+		}
+		n := start + FileSize(len(data)) - offset
+		if n > end-offset {
+			n = end - offset
+		}
+		digester.Hash().Write(data[offset-start : offset-start+n])
+		offset += n
+	}
+	return digester.Digest(), nil
+}
+
+// newLayerDecompressor returns a reader of the uncompressed tar archive of a layer compressed with `compressionAlgo`.
+func newLayerDecompressor(compressionAlgo string, r io.Reader) (io.ReadCloser, error) {
+	switch compressionAlgo {
+	case CompressionGzip, CompressionEstargz, "":
+		// eStargz layers are concatenated gzip members, which gzip.Reader reads as one stream
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	case CompressionUncompressed:
+		return io.NopCloser(r), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm: %s", compressionAlgo)
+	}
+}
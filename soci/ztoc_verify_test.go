@@ -0,0 +1,201 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestVerifyZtoc(t *testing.T) {
+	tarEntries := []testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("dir/file1", string(genRandomByteData(100000))),
+		testutil.File("dir/file2", string(genRandomByteData(10))),
+		testutil.File("empty", ""),
+		testutil.Symlink("link", "dir/file1"),
+		testutil.File("dir/file3", string(genRandomByteData(50000))),
+	}
+	builders := []struct {
+		name  string
+		build func() (*Ztoc, *io.SectionReader, error)
+	}{
+		{"gzip", func() (*Ztoc, *io.SectionReader, error) {
+			return BuildZtocReader(tarEntries, gzip.DefaultCompression, 1<<14)
+		}},
+		{"zstd", func() (*Ztoc, *io.SectionReader, error) {
+			return BuildZstdZtocReader(tarEntries, 1<<14, 1<<14)
+		}},
+		{"uncompressed", func() (*Ztoc, *io.SectionReader, error) {
+			return BuildTarZtocReader(tarEntries, 1<<14)
+		}},
+		{"estargz", func() (*Ztoc, *io.SectionReader, error) {
+			return BuildEstargzZtocReader(tarEntries, 1<<14)
+		}},
+	}
+	testCases := []struct {
+		name     string
+		corrupt  func(*Ztoc)
+		expected string
+	}{
+		{
+			name:    "valid",
+			corrupt: func(*Ztoc) {},
+		},
+		{
+			name: "span digest",
+			corrupt: func(ztoc *Ztoc) {
+				ztoc.ZtocInfo.SpanDigests[1] = digest.FromString("corrupted")
+			},
+			expected: "span 1",
+		},
+		{
+			name: "file size",
+			corrupt: func(ztoc *Ztoc) {
+				findFileMetadata(ztoc, "dir/file2").UncompressedSize++
+			},
+			expected: "file dir/file2",
+		},
+		{
+			name: "file contents",
+			corrupt: func(ztoc *Ztoc) {
+				md := findFileMetadata(ztoc, "dir/file1")
+				md.Digest = ""
+				md.UncompressedOffset++
+			},
+			expected: "file dir/file1",
+		},
+		{
+			name: "file digest",
+			corrupt: func(ztoc *Ztoc) {
+				findFileMetadata(ztoc, "dir/file3").Digest = digest.FromString("corrupted")
+			},
+			expected: "file dir/file3",
+		},
+		{
+			name: "missing file",
+			corrupt: func(ztoc *Ztoc) {
+				for i := range ztoc.Metadata {
+					if ztoc.Metadata[i].Name == "empty" {
+						ztoc.Metadata = append(ztoc.Metadata[:i], ztoc.Metadata[i+1:]...)
+						return
+					}
+				}
+			},
+			expected: "file empty: missing from the ztoc",
+		},
+		{
+			name: "extra file",
+			corrupt: func(ztoc *Ztoc) {
+				ztoc.Metadata = append(ztoc.Metadata, FileMetadata{Name: "extra", Type: "reg"})
+			},
+			expected: "file extra: missing from the layer",
+		},
+		{
+			name: "layer size",
+			corrupt: func(ztoc *Ztoc) {
+				ztoc.CompressedFileSize++
+			},
+			expected: "layer",
+		},
+	}
+
+	for _, b := range builders {
+		for _, tc := range testCases {
+			t.Run(b.name+"/"+tc.name, func(t *testing.T) {
+				ztoc, sr, err := b.build()
+				if err != nil {
+					t.Fatalf("can't build ztoc: %v", err)
+				}
+				tc.corrupt(ztoc)
+				mismatches, err := VerifyZtoc(ztoc, sr)
+				if err != nil {
+					t.Fatalf("can't verify ztoc: %v", err)
+				}
+				if tc.expected == "" {
+					if len(mismatches) != 0 {
+						t.Fatalf("unexpected mismatches: %v", mismatches)
+					}
+					return
+				}
+				if len(mismatches) == 0 {
+					t.Fatalf("expected a mismatch of %s", tc.expected)
+				}
+				for _, m := range mismatches {
+					if !strings.HasPrefix(m.String(), tc.expected) {
+						t.Fatalf("unexpected mismatch %q; expected %q", m, tc.expected)
+					}
+				}
+			})
+		}
+	}
+}
+
+// countingReaderAt counts the reads of the underlying ReaderAt.
+type countingReaderAt struct {
+	r     io.ReaderAt
+	reads int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.reads++
+	return c.r.ReadAt(p, off)
+}
+
+func TestSpanExtractorReadsSpansOnce(t *testing.T) {
+	var tarEntries []testutil.TarEntry
+	for i := 0; i < 200; i++ {
+		tarEntries = append(tarEntries, testutil.File(fmt.Sprintf("file%d", i), string(genRandomByteData(1000))))
+	}
+	ztoc, sr, err := BuildZtocReader(tarEntries, gzip.DefaultCompression, 1<<14)
+	if err != nil {
+		t.Fatalf("can't build ztoc: %v", err)
+	}
+	zinfo, err := NewZinfo(ztoc.CompressionAlgorithm, ztoc.IndexByteData)
+	if err != nil {
+		t.Fatalf("can't load checkpoints: %v", err)
+	}
+	defer zinfo.Close()
+
+	cr := &countingReaderAt{r: sr}
+	spans := &spanExtractor{
+		zinfo:                zinfo,
+		r:                    io.NewSectionReader(cr, 0, sr.Size()),
+		maxSpanId:            ztoc.MaxSpanId,
+		compressedFileSize:   ztoc.CompressedFileSize,
+		uncompressedFileSize: ztoc.UncompressedFileSize,
+	}
+	for i := range ztoc.Metadata {
+		md := &ztoc.Metadata[i]
+		dgst, err := spans.digestFile(md)
+		if err != nil {
+			t.Fatalf("can't extract %s: %v", md.Name, err)
+		}
+		if dgst != md.Digest {
+			t.Fatalf("unexpected digest of %s; expected %s, got %s", md.Name, md.Digest, dgst)
+		}
+	}
+	if cr.reads > int(ztoc.MaxSpanId)+1 {
+		t.Fatalf("%d spans read %d times", ztoc.MaxSpanId+1, cr.reads)
+	}
+}
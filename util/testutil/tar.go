@@ -42,6 +42,8 @@ import (
 	"os"
 	"strings"
 	"time"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 // TarEntry is an entry of tar.
@@ -122,6 +124,40 @@ func BuildTarGz(ents []TarEntry, compressionLevel int, opts ...BuildTarOption) i
 	return pr
 }
 
+// BuildTarZstd builds a zstd-compressed tar blob. The uncompressed tar is split into chunks
+// of frameSize bytes, each of which is compressed as a separate zstd frame.
+func BuildTarZstd(ents []TarEntry, frameSize int, opts ...BuildTarOption) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		defer enc.Close()
+		tr := BuildTar(ents, opts...)
+		buf := make([]byte, frameSize)
+		for {
+			n, err := io.ReadFull(tr, buf)
+			if n > 0 {
+				if _, err := pw.Write(enc.EncodeAll(buf[:n], nil)); err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+	return pr
+}
+
 type tarEntryFunc func(*tar.Writer, BuildTarOptions) error
 
 func (f tarEntryFunc) AppendTar(tw *tar.Writer, opts BuildTarOptions) error { return f(tw, opts) }